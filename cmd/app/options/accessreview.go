@@ -0,0 +1,51 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package options
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/pflag"
+	cliflag "k8s.io/component-base/cli/flag"
+)
+
+type AccessReviewOptions struct {
+	Enabled  bool
+	AllowTTL time.Duration
+	DenyTTL  time.Duration
+}
+
+func NewAccessReviewOptions(nfs *cliflag.NamedFlagSets) *AccessReviewOptions {
+	return new(AccessReviewOptions).AddFlags(nfs.FlagSet("Access Review"))
+}
+
+func (a *AccessReviewOptions) AddFlags(fs *pflag.FlagSet) *AccessReviewOptions {
+	fs.BoolVar(&a.Enabled, "access-review", a.Enabled, ""+
+		"(Alpha) If enabled, each request is authorized as the impersonated user with "+
+		"a SubjectAccessReview against the API server before it is forwarded. Denied "+
+		"requests are rejected with the reason given by the review.")
+
+	fs.DurationVar(&a.AllowTTL, "access-review-allow-ttl", time.Minute*5, ""+
+		"(Alpha) Duration to cache allowed access review decisions. If 0, allowed "+
+		"decisions are not cached.")
+
+	fs.DurationVar(&a.DenyTTL, "access-review-deny-ttl", time.Second*30, ""+
+		"(Alpha) Duration to cache denied access review decisions. If 0, denied "+
+		"decisions are not cached.")
+
+	return a
+}
+
+func (a *AccessReviewOptions) Validate() []error {
+	var errs []error
+
+	if a.AllowTTL < 0 {
+		errs = append(errs, fmt.Errorf("--access-review-allow-ttl must not be negative, got %s", a.AllowTTL))
+	}
+
+	if a.DenyTTL < 0 {
+		errs = append(errs, fmt.Errorf("--access-review-deny-ttl must not be negative, got %s", a.DenyTTL))
+	}
+
+	return errs
+}
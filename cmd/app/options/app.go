@@ -2,22 +2,41 @@
 package options
 
 import (
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/spf13/pflag"
 	cliflag "k8s.io/component-base/cli/flag"
 
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/revocation"
 	"github.com/jetstack/kube-oidc-proxy/pkg/util/flags"
 )
 
 type KubeOIDCProxyOptions struct {
 	DisableImpersonation bool
+	AllowImpersonation   bool
 	ReadinessProbePort   int
 
-	FlushInterval time.Duration
+	MetricsServingAddress string
+	AdminServingAddress   string
+
+	FlushInterval  time.Duration
+	RequestTimeout time.Duration
+
+	MaxRequestsInFlight         int
+	MaxMutatingRequestsInFlight int
+
+	ResponseFilterFile  string
+	RequestMutationFile string
+	FairnessConfigFile  string
+	GroupGrantsFile     string
+	ProxyPolicies       bool
 
 	ExtraHeaderOptions ExtraHeaderOptions
 	TokenPassthrough   TokenPassthroughOptions
+	TokenRevocation    TokenRevocationOptions
 }
 
 type TokenPassthroughOptions struct {
@@ -25,6 +44,11 @@ type TokenPassthroughOptions struct {
 	Enabled   bool
 }
 
+type TokenRevocationOptions struct {
+	File      string
+	ConfigMap string
+}
+
 type ExtraHeaderOptions struct {
 	EnableClientIPExtraUserHeader bool
 
@@ -40,17 +64,76 @@ func (k *KubeOIDCProxyOptions) AddFlags(fs *pflag.FlagSet) *KubeOIDCProxyOptions
 		"(Alpha) Disable the impersonation of authenticated requests. All "+
 			"authenticated requests will be forwarded as is.")
 
+	fs.BoolVar(&k.AllowImpersonation, "allow-impersonation", k.AllowImpersonation,
+		"(Alpha) Allow requests with impersonation headers, such as from "+
+			"'kubectl --as', from users authorized to impersonate the requested user, "+
+			"groups and extras by a SubjectAccessReview. The API server receives the "+
+			"requested identity, with the authenticated user recorded in its extras.")
+
 	fs.IntVarP(&k.ReadinessProbePort, "readiness-probe-port", "P", 8080,
 		"Port to expose readiness probe.")
 
+	fs.StringVar(&k.MetricsServingAddress, "metrics-serving-address", "",
+		"Address to serve Prometheus metrics on the /metrics path, such as "+
+			"0.0.0.0:9090. Must not use the readiness probe or secure serving port. "+
+			"If empty, metrics are not served.")
+
+	fs.StringVar(&k.AdminServingAddress, "admin-serving-address", "",
+		"Address to serve the unauthenticated admin endpoints, such as forcing a "+
+			"refresh of the OIDC issuer signing keys, such as 127.0.0.1:8081. Must not "+
+			"use the readiness probe or secure serving port. If empty, the admin "+
+			"endpoints are not served.")
+
 	fs.DurationVar(&k.FlushInterval, "flush-interval", time.Millisecond*50,
 		"Specifies the interval to flush request bodies. If 0ms, "+
 			"no periodic flushing is done. A negative value means to flush "+
 			"immediately after each write. Streaming requests such as 'kubectl exec' "+
 			"will ignore this option and flush immediately.")
 
+	fs.DurationVar(&k.RequestTimeout, "proxy-request-timeout", 0,
+		"Timeout of proxied requests, other than long-running requests such as "+
+			"watch, exec and logs. Requests may shorten this timeout using the "+
+			"'timeout' query parameter. If 0, there is no timeout other than the "+
+			"'timeout' query parameter.")
+
+	fs.IntVar(&k.MaxRequestsInFlight, "max-requests-inflight", 0,
+		"Maximum number of read-only requests in flight, other than long-running "+
+			"requests such as watch and exec. Requests over the limit are rejected "+
+			"with 429 Too Many Requests. If 0, there is no limit.")
+
+	fs.IntVar(&k.MaxMutatingRequestsInFlight, "max-mutating-requests-inflight", 0,
+		"Maximum number of mutating requests in flight. Requests over the limit are "+
+			"rejected with 429 Too Many Requests. If 0, there is no limit.")
+
+	fs.StringVar(&k.ResponseFilterFile, "response-filter-file", k.ResponseFilterFile,
+		"(Alpha) Path to a file containing rules which filter the list and watch "+
+			"responses of resources to the objects matching a label selector or names "+
+			"derived from the claims of the user's OIDC token.")
+
+	fs.StringVar(&k.RequestMutationFile, "request-mutation-file", k.RequestMutationFile,
+		"(Alpha) Path to a file containing rules which mutate the bodies of create, "+
+			"update and patch requests for resources, such as stamping the username of "+
+			"the user onto objects.")
+
+	fs.StringVar(&k.FairnessConfigFile, "fairness-config-file", k.FairnessConfigFile,
+		"(Alpha) Path to a file containing priority levels and flow schemas, which "+
+			"queue requests fairly between users, so that one user's burst of "+
+			"requests can not starve others.")
+
+	fs.StringVar(&k.GroupGrantsFile, "group-grants-file", k.GroupGrantsFile,
+		"(Alpha) Path to a file containing time-bound grants of groups to users. "+
+			"Requests of a user with a valid grant are impersonated with the granted "+
+			"groups until the grant expires. The file is watched for changes.")
+
+	fs.BoolVar(&k.ProxyPolicies, "proxy-policies", k.ProxyPolicies,
+		"(Alpha) Watch the cluster scoped ProxyPolicy and ClaimMapping resources "+
+			"of the upstream cluster, applying their response filter, request "+
+			"mutation and claim mapping rules live, in addition to those of files "+
+			"and flags. Whether each object is valid is reported in its status.")
+
 	k.TokenPassthrough.AddFlags(fs)
 	k.ExtraHeaderOptions.AddFlags(fs)
+	k.TokenRevocation.AddFlags(fs)
 
 	return k
 }
@@ -69,6 +152,50 @@ func (t *TokenPassthroughOptions) AddFlags(fs *pflag.FlagSet) {
 		"is sent on as is, with no impersonation.")
 }
 
+func (t *TokenRevocationOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&t.File, "token-revocation-file", t.File, ""+
+		"(Alpha) Path to a file containing a list of revoked OIDC tokens, by token "+
+		"ID, subject, or issued before time per subject. The file is watched for "+
+		"changes. Requests with revoked tokens are rejected.")
+
+	fs.StringVar(&t.ConfigMap, "token-revocation-configmap", t.ConfigMap, ""+
+		"(Alpha) A ConfigMap, in the form <namespace>/<name>, whose '"+
+		revocation.ConfigMapKey+"' key contains a list of revoked OIDC tokens. "+
+		"The ConfigMap is watched for changes. May not be used with "+
+		"--token-revocation-file.")
+}
+
+// Enabled returns whether tokens are checked for revocation.
+func (t *TokenRevocationOptions) Enabled() bool {
+	return len(t.File) > 0 || len(t.ConfigMap) > 0
+}
+
+// Validate will validate the token revocation options.
+func (t *TokenRevocationOptions) Validate() error {
+	if len(t.File) > 0 && len(t.ConfigMap) > 0 {
+		return errors.New("cannot use both --token-revocation-file and --token-revocation-configmap")
+	}
+
+	if len(t.ConfigMap) > 0 {
+		if _, _, err := t.ConfigMapNamespaceName(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ConfigMapNamespaceName returns the namespace and name of the token
+// revocation ConfigMap.
+func (t *TokenRevocationOptions) ConfigMapNamespaceName() (string, string, error) {
+	parts := strings.Split(t.ConfigMap, "/")
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return "", "", fmt.Errorf("invalid --token-revocation-configmap %q, expecting <namespace>/<name>", t.ConfigMap)
+	}
+
+	return parts[0], parts[1], nil
+}
+
 func (e *ExtraHeaderOptions) AddFlags(fs *pflag.FlagSet) {
 	fs.BoolVar(&e.EnableClientIPExtraUserHeader, "extra-user-header-client-ip",
 		e.EnableClientIPExtraUserHeader, "(Alpha) If enabled, proxied requests will "+
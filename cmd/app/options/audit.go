@@ -2,6 +2,11 @@
 package options
 
 import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
 	"github.com/spf13/pflag"
 	apiserveroptions "k8s.io/apiserver/pkg/server/options"
 	cliflag "k8s.io/component-base/cli/flag"
@@ -9,6 +14,33 @@ import (
 
 type AuditOptions struct {
 	*apiserveroptions.AuditOptions
+
+	FileOptions   AuditFileOptions
+	SyslogOptions AuditSyslogOptions
+
+	// MaxObjectSize is the maximum size in bytes of request and response
+	// bodies buffered to be logged to audit events.
+	MaxObjectSize int64
+}
+
+// AuditFileOptions configures the rotating file audit backend which writes
+// newline delimited JSON audit events.
+type AuditFileOptions struct {
+	Path       string
+	MaxAge     int
+	MaxBackups int
+	MaxSize    int
+	Compress   bool
+}
+
+// AuditSyslogOptions configures the syslog audit backend which sends RFC 5424
+// formatted audit events over TCP.
+type AuditSyslogOptions struct {
+	Address      string
+	AppName      string
+	Facility     int
+	DialTimeout  time.Duration
+	WriteTimeout time.Duration
 }
 
 func NewAuditOptions(nfs *cliflag.NamedFlagSets) *AuditOptions {
@@ -21,5 +53,119 @@ func NewAuditOptions(nfs *cliflag.NamedFlagSets) *AuditOptions {
 
 func (a *AuditOptions) AddFlags(fs *pflag.FlagSet) *AuditOptions {
 	a.AuditOptions.AddFlags(fs)
+	a.FileOptions.AddFlags(fs)
+	a.SyslogOptions.AddFlags(fs)
+
+	fs.Int64Var(&a.MaxObjectSize, "audit-max-object-size", 3*1024*1024, ""+
+		"The maximum size in bytes of request and response bodies logged to audit "+
+		"events at the Request and RequestResponse levels. Larger bodies are omitted "+
+		"from the event, which is annotated instead.")
+
 	return a
 }
+
+func (a *AuditOptions) Validate() []error {
+	var errs []error
+
+	if a.AuditOptions != nil {
+		errs = append(errs, a.AuditOptions.Validate()...)
+	}
+
+	errs = append(errs, a.FileOptions.Validate()...)
+	errs = append(errs, a.SyslogOptions.Validate()...)
+
+	if a.MaxObjectSize <= 0 {
+		errs = append(errs, fmt.Errorf("--audit-max-object-size %v must be greater than 0", a.MaxObjectSize))
+	}
+
+	// Without a policy no events are recorded, so the backends would be unused.
+	if (len(a.FileOptions.Path) > 0 || len(a.SyslogOptions.Address) > 0) &&
+		(a.AuditOptions == nil || len(a.PolicyFile) == 0) {
+		errs = append(errs, errors.New("--audit-file-path and --audit-syslog-address require --audit-policy-file"))
+	}
+
+	return errs
+}
+
+func (a *AuditFileOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&a.Path, "audit-file-path", a.Path, ""+
+		"If set, all requests coming to the proxy will be written to this file as "+
+		"newline delimited JSON audit events. The file will be rotated according to "+
+		"the --audit-file-max-* flags.")
+
+	fs.IntVar(&a.MaxAge, "audit-file-max-age", a.MaxAge, ""+
+		"The maximum number of days to retain old audit files based on the "+
+		"timestamp encoded in their filename.")
+
+	fs.IntVar(&a.MaxBackups, "audit-file-max-backups", a.MaxBackups, ""+
+		"The maximum number of old audit files to retain.")
+
+	fs.IntVar(&a.MaxSize, "audit-file-max-size", 100, ""+
+		"The maximum size in megabytes of the audit file before it gets rotated.")
+
+	fs.BoolVar(&a.Compress, "audit-file-compress", a.Compress, ""+
+		"If enabled, rotated audit files will be compressed using gzip.")
+}
+
+func (a *AuditFileOptions) Validate() []error {
+	var errs []error
+
+	if len(a.Path) == 0 {
+		return nil
+	}
+
+	if a.MaxAge < 0 {
+		errs = append(errs, fmt.Errorf("--audit-file-max-age %v can't be a negative number", a.MaxAge))
+	}
+	if a.MaxBackups < 0 {
+		errs = append(errs, fmt.Errorf("--audit-file-max-backups %v can't be a negative number", a.MaxBackups))
+	}
+	if a.MaxSize < 0 {
+		errs = append(errs, fmt.Errorf("--audit-file-max-size %v can't be a negative number", a.MaxSize))
+	}
+
+	return errs
+}
+
+func (a *AuditSyslogOptions) AddFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&a.Address, "audit-syslog-address", a.Address, ""+
+		"If set, audit events will be sent to this TCP syslog server address "+
+		"(host:port) as RFC 5424 formatted messages containing the JSON encoded event.")
+
+	fs.StringVar(&a.AppName, "audit-syslog-app-name", AppName, ""+
+		"The APP-NAME field used in syslog audit messages.")
+
+	fs.IntVar(&a.Facility, "audit-syslog-facility", 13, ""+
+		"The syslog facility code used in syslog audit messages. Defaults to 13 (log audit).")
+
+	fs.DurationVar(&a.DialTimeout, "audit-syslog-dial-timeout", time.Second*10, ""+
+		"Timeout when connecting to the syslog server.")
+
+	fs.DurationVar(&a.WriteTimeout, "audit-syslog-write-timeout", time.Second*10, ""+
+		"Timeout when writing an audit message to the syslog server, after which "+
+		"the connection is closed and the message is sent again over a new connection.")
+}
+
+func (a *AuditSyslogOptions) Validate() []error {
+	var errs []error
+
+	if len(a.Address) == 0 {
+		return nil
+	}
+
+	if _, _, err := net.SplitHostPort(a.Address); err != nil {
+		errs = append(errs, fmt.Errorf("--audit-syslog-address %q is not a valid host:port: %s",
+			a.Address, err))
+	}
+	if a.Facility < 0 || a.Facility > 23 {
+		errs = append(errs, fmt.Errorf("--audit-syslog-facility %v must be between 0 and 23", a.Facility))
+	}
+	if a.WriteTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("--audit-syslog-write-timeout %v must be greater than 0", a.WriteTimeout))
+	}
+	if len(a.AppName) > 48 {
+		errs = append(errs, fmt.Errorf("--audit-syslog-app-name %q must be at most 48 characters", a.AppName))
+	}
+
+	return errs
+}
@@ -0,0 +1,75 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package options
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spf13/pflag"
+	cliflag "k8s.io/component-base/cli/flag"
+)
+
+type BreakGlassOptions struct {
+	KeysFile       string
+	Issuer         string
+	Group          string
+	UsernamePrefix string
+	MaxLifetime    time.Duration
+}
+
+func NewBreakGlassOptions(nfs *cliflag.NamedFlagSets) *BreakGlassOptions {
+	return new(BreakGlassOptions).AddFlags(nfs.FlagSet("Break Glass"))
+}
+
+func (b *BreakGlassOptions) Enabled() bool {
+	return b != nil && len(b.KeysFile) > 0
+}
+
+func (b *BreakGlassOptions) AddFlags(fs *pflag.FlagSet) *BreakGlassOptions {
+	fs.StringVar(&b.KeysFile, "break-glass-keys-file", b.KeysFile, ""+
+		"(Alpha) Path to a file containing the public keys which sign break-glass "+
+		"tokens, either as a JWKS document or PEM encoded public keys and "+
+		"certificates. If provided, break-glass tokens are authenticated without "+
+		"the OIDC issuer, for emergency access.")
+
+	fs.StringVar(&b.Issuer, "break-glass-issuer", "kube-oidc-proxy-break-glass", ""+
+		"(Alpha) The 'iss' claim of break-glass tokens. Must differ from the OIDC "+
+		"issuer URL.")
+
+	fs.StringVar(&b.Group, "break-glass-group", b.Group, ""+
+		"(Alpha) The group of users authenticated with a break-glass token. Required "+
+		"with --break-glass-keys-file.")
+
+	fs.StringVar(&b.UsernamePrefix, "break-glass-username-prefix", "break-glass:", ""+
+		"(Alpha) Prefix prepended to the 'sub' claim of break-glass tokens to give "+
+		"the username.")
+
+	fs.DurationVar(&b.MaxLifetime, "break-glass-max-lifetime", time.Hour, ""+
+		"(Alpha) Maximum lifetime of break-glass tokens, from their 'iat' to 'exp' "+
+		"claims. Tokens with a longer lifetime are rejected.")
+
+	return b
+}
+
+func (b *BreakGlassOptions) Validate() []error {
+	if !b.Enabled() {
+		return nil
+	}
+
+	var errs []error
+
+	if len(b.Issuer) == 0 {
+		errs = append(errs, errors.New("--break-glass-issuer must be specified with --break-glass-keys-file"))
+	}
+
+	if len(b.Group) == 0 {
+		errs = append(errs, errors.New("--break-glass-group must be specified with --break-glass-keys-file"))
+	}
+
+	if b.MaxLifetime <= 0 {
+		errs = append(errs, fmt.Errorf("--break-glass-max-lifetime must be positive, got %s", b.MaxLifetime))
+	}
+
+	return errs
+}
@@ -0,0 +1,81 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package options
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/spf13/pflag"
+	cliflag "k8s.io/component-base/cli/flag"
+)
+
+type UpstreamFailoverOptions struct {
+	Endpoints           []string
+	Balancer            string
+	HealthCheckInterval time.Duration
+	HealthCheckTimeout  time.Duration
+	EjectionDuration    time.Duration
+}
+
+func NewUpstreamFailoverOptions(nfs *cliflag.NamedFlagSets) *UpstreamFailoverOptions {
+	return new(UpstreamFailoverOptions).AddFlags(nfs.FlagSet("Upstream Failover"))
+}
+
+func (u *UpstreamFailoverOptions) AddFlags(fs *pflag.FlagSet) *UpstreamFailoverOptions {
+	fs.StringSliceVar(&u.Endpoints, "upstream-endpoints", nil, ""+
+		"(Alpha) List of API server URLs to balance requests over, such as "+
+		"https://10.0.0.1:6443. If unset, requests are sent to the API server of the "+
+		"client configuration.")
+
+	fs.StringVar(&u.Balancer, "upstream-balancer", "round-robin", ""+
+		"(Alpha) Algorithm used to balance requests over the upstream endpoints, "+
+		"either 'round-robin' or 'least-connections'.")
+
+	fs.DurationVar(&u.HealthCheckInterval, "upstream-health-check-interval", time.Second*10, ""+
+		"(Alpha) Interval of health checks against the /readyz endpoint of each "+
+		"upstream endpoint. If 0, health checks are disabled.")
+
+	fs.DurationVar(&u.HealthCheckTimeout, "upstream-health-check-timeout", time.Second*5, ""+
+		"(Alpha) Timeout of each health check against an upstream endpoint.")
+
+	fs.DurationVar(&u.EjectionDuration, "upstream-ejection-duration", time.Second*30, ""+
+		"(Alpha) How long an upstream endpoint receives no requests after a "+
+		"connection to it is refused or reset.")
+
+	return u
+}
+
+func (u *UpstreamFailoverOptions) Enabled() bool {
+	return len(u.Endpoints) > 0
+}
+
+func (u *UpstreamFailoverOptions) Validate() []error {
+	var errs []error
+
+	for _, e := range u.Endpoints {
+		endpoint, err := url.Parse(e)
+		if err != nil || (endpoint.Scheme != "https" && endpoint.Scheme != "http") || len(endpoint.Host) == 0 {
+			errs = append(errs, fmt.Errorf("--upstream-endpoints must contain URLs such as https://10.0.0.1:6443, got %q", e))
+		}
+	}
+
+	if u.Balancer != "round-robin" && u.Balancer != "least-connections" {
+		errs = append(errs, fmt.Errorf("--upstream-balancer must be 'round-robin' or 'least-connections', got %q", u.Balancer))
+	}
+
+	for _, f := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"upstream-health-check-interval", u.HealthCheckInterval},
+		{"upstream-health-check-timeout", u.HealthCheckTimeout},
+		{"upstream-ejection-duration", u.EjectionDuration},
+	} {
+		if f.value < 0 {
+			errs = append(errs, fmt.Errorf("--%s must not be negative, got %s", f.name, f.value))
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,104 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package options
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/pflag"
+	cliflag "k8s.io/component-base/cli/flag"
+)
+
+type TokenIntrospectionOptions struct {
+	URL              string
+	ClientID         string
+	ClientSecret     string
+	ClientSecretFile string
+	Audiences        []string
+	CAFile           string
+	UsernameClaim    string
+	UsernamePrefix   string
+	GroupsClaim      string
+	GroupsPrefix     string
+	QPS              float32
+	Burst            int
+}
+
+func NewTokenIntrospectionOptions(nfs *cliflag.NamedFlagSets) *TokenIntrospectionOptions {
+	return new(TokenIntrospectionOptions).AddFlags(nfs.FlagSet("Token Introspection"))
+}
+
+func (t *TokenIntrospectionOptions) Enabled() bool {
+	return t != nil && len(t.URL) > 0
+}
+
+func (t *TokenIntrospectionOptions) Validate() error {
+	if !t.Enabled() {
+		return nil
+	}
+
+	if len(t.ClientID) == 0 || (len(t.ClientSecret) == 0) == (len(t.ClientSecretFile) == 0) {
+		return errors.New("token-introspection-client-id and one of token-introspection-client-secret " +
+			"or token-introspection-client-secret-file must be specified with token-introspection-url")
+	}
+
+	if len(t.Audiences) == 0 {
+		return errors.New("token-introspection-audiences must be specified with token-introspection-url")
+	}
+
+	if t.QPS < 0 || t.Burst < 1 {
+		return fmt.Errorf("token-introspection-qps (%v) must not be negative and "+
+			"token-introspection-burst (%d) must be at least 1", t.QPS, t.Burst)
+	}
+
+	return nil
+}
+
+func (t *TokenIntrospectionOptions) AddFlags(fs *pflag.FlagSet) *TokenIntrospectionOptions {
+	fs.StringVar(&t.URL, "token-introspection-url", t.URL, ""+
+		"(Alpha) If provided, the URL of an OAuth 2.0 token introspection endpoint (RFC 7662), "+
+		"only HTTPS scheme will be accepted. Bearer tokens that fail OIDC validation are "+
+		"introspected before any token passthrough.")
+
+	fs.StringVar(&t.ClientID, "token-introspection-client-id", t.ClientID,
+		"(Alpha) The client ID used to authenticate to the token introspection endpoint.")
+
+	fs.StringVar(&t.ClientSecret, "token-introspection-client-secret", t.ClientSecret,
+		"(Alpha) The client secret used to authenticate to the token introspection endpoint.")
+
+	fs.StringVar(&t.ClientSecretFile, "token-introspection-client-secret-file", t.ClientSecretFile, ""+
+		"(Alpha) A file containing the client secret used to authenticate to the token "+
+		"introspection endpoint, rather than giving it with token-introspection-client-secret.")
+
+	fs.StringSliceVar(&t.Audiences, "token-introspection-audiences", t.Audiences, ""+
+		"(Alpha) The audiences of which introspected tokens must contain one, or client IDs "+
+		"of which introspected tokens must have been issued to one. Required with "+
+		"token-introspection-url, so that tokens issued to other clients are not accepted.")
+
+	fs.StringVar(&t.CAFile, "token-introspection-ca-file", t.CAFile, ""+
+		"(Alpha) The token introspection endpoint's certificate will be verified by one of "+
+		"the authorities in this file, otherwise the host's root CA set will be used.")
+
+	fs.StringVar(&t.UsernameClaim, "token-introspection-username-claim", "sub", ""+
+		"(Alpha) The introspection response field to use as the username, such as 'sub' "+
+		"or 'username'.")
+
+	fs.StringVar(&t.UsernamePrefix, "token-introspection-username-prefix", t.UsernamePrefix,
+		"(Alpha) If provided, all introspected usernames will be prefixed with this value.")
+
+	fs.StringVar(&t.GroupsClaim, "token-introspection-groups-claim", t.GroupsClaim, ""+
+		"(Alpha) If provided, the introspection response field to use as the user's groups. "+
+		"The field value is expected to be a string or array of strings.")
+
+	fs.StringVar(&t.GroupsPrefix, "token-introspection-groups-prefix", t.GroupsPrefix,
+		"(Alpha) If provided, all introspected groups will be prefixed with this value.")
+
+	fs.Float32Var(&t.QPS, "token-introspection-qps", 10, ""+
+		"(Alpha) The maximum rate of requests to the token introspection endpoint for tokens "+
+		"not cached, per second. If 0, requests are not limited.")
+
+	fs.IntVar(&t.Burst, "token-introspection-burst", 20, ""+
+		"(Alpha) The maximum burst of requests to the token introspection endpoint.")
+
+	return t
+}
@@ -2,7 +2,9 @@
 package options
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/spf13/pflag"
 
@@ -12,6 +14,7 @@ import (
 type OIDCAuthenticationOptions struct {
 	CAFile         string
 	ClientID       string
+	Audiences      []string
 	IssuerURL      string
 	UsernameClaim  string
 	UsernamePrefix string
@@ -19,6 +22,16 @@ type OIDCAuthenticationOptions struct {
 	GroupsPrefix   string
 	SigningAlgs    []string
 	RequiredClaims map[string]string
+	RequiredScopes []string
+	ScopeGroups    map[string]string
+
+	ClaimValidationRulesFile string
+	UsernameExpressions      []string
+	GroupsExpressions        []string
+
+	JWKSRefreshInterval    time.Duration
+	JWKSMinRefreshInterval time.Duration
+	KeysFile               string
 }
 
 func NewOIDCAuthenticationOptions(nfs *cliflag.NamedFlagSets) *OIDCAuthenticationOptions {
@@ -30,6 +43,14 @@ func (o *OIDCAuthenticationOptions) Validate() error {
 		return fmt.Errorf("oidc-issuer-url and oidc-client-id should be specified together")
 	}
 
+	if o != nil && o.JWKSRefreshInterval < 0 {
+		return errors.New("oidc-jwks-refresh-interval must not be negative")
+	}
+
+	if o != nil && o.JWKSMinRefreshInterval <= 0 {
+		return errors.New("oidc-jwks-min-refresh-interval must be greater than zero")
+	}
+
 	return nil
 }
 
@@ -40,6 +61,11 @@ func (o *OIDCAuthenticationOptions) AddFlags(fs *pflag.FlagSet) *OIDCAuthenticat
 	fs.StringVar(&o.ClientID, "oidc-client-id", o.ClientID,
 		"The client ID for the OpenID Connect client.")
 
+	fs.StringSliceVar(&o.Audiences, "oidc-audiences", o.Audiences, ""+
+		"Comma-separated list of further audiences, in addition to the client ID, that "+
+		"tokens may be issued for. Tokens must be issued for at least one of the "+
+		"client ID or these audiences.")
+
 	fs.StringVar(&o.CAFile, "oidc-ca-file", o.CAFile, ""+
 		"The OpenID server's certificate will be verified by one of the authorities "+
 		"in the oidc-ca-file, otherwise the host's root CA set will be used")
@@ -53,6 +79,13 @@ func (o *OIDCAuthenticationOptions) AddFlags(fs *pflag.FlagSet) *OIDCAuthenticat
 		"username claims other than 'email' are prefixed by the issuer URL to avoid "+
 		"clashes. To skip any prefixing, provide the value '-'.")
 
+	fs.StringArrayVar(&o.UsernameExpressions, "oidc-username-expression", o.UsernameExpressions, ""+
+		"If provided, an expression evaluated against the token claims to derive the "+
+		"username, in place of --oidc-username-claim and --oidc-username-prefix. Repeat "+
+		"this flag to give fallback expressions, used in order when the previous "+
+		"expression fails to evaluate, such as for a missing claim, or evaluates to an "+
+		"empty username.")
+
 	fs.StringVar(&o.GroupsClaim, "oidc-groups-claim", "", ""+
 		"If provided, the name of a custom OpenID Connect claim for specifying user groups. "+
 		"The claim value is expected to be a string or array of strings.")
@@ -61,6 +94,12 @@ func (o *OIDCAuthenticationOptions) AddFlags(fs *pflag.FlagSet) *OIDCAuthenticat
 		"If provided, all groups will be prefixed with this value to prevent conflicts with "+
 		"other authentication strategies.")
 
+	fs.StringArrayVar(&o.GroupsExpressions, "oidc-groups-expression", o.GroupsExpressions, ""+
+		"If provided, an expression evaluated against the token claims to derive further "+
+		"groups of the user, either a single group, or several groups when the output is "+
+		"only the list function. These groups are not prefixed by --oidc-groups-prefix. "+
+		"Repeat this flag to specify multiple expressions.")
+
 	fs.StringSliceVar(&o.SigningAlgs, "oidc-signing-algs", []string{"RS256"}, ""+
 		"Comma-separated list of allowed JOSE asymmetric signing algorithms. JWTs with a "+
 		"'alg' header value not in this list will be rejected. "+
@@ -71,5 +110,35 @@ func (o *OIDCAuthenticationOptions) AddFlags(fs *pflag.FlagSet) *OIDCAuthenticat
 		"If set, the claim is verified to be present in the ID Token with a matching value. "+
 		"Repeat this flag to specify multiple claims.")
 
+	fs.StringSliceVar(&o.RequiredScopes, "oidc-required-scopes", o.RequiredScopes, ""+
+		"Comma-separated list of scopes that must all be present in the 'scope' or 'scp' "+
+		"claim of the token.")
+
+	fs.Var(cliflag.NewMapStringString(&o.ScopeGroups), "oidc-scope-groups", ""+
+		"A list of scope=group pairs. Users with a token containing the scope are given "+
+		"the group, which is not prefixed by --oidc-groups-prefix. For example "+
+		"'k8s:read=oidc:readonly'.")
+
+	fs.StringVar(&o.ClaimValidationRulesFile, "oidc-claim-validation-rules-file", o.ClaimValidationRulesFile, ""+
+		"If provided, the path to a file containing a list of expressions which must all "+
+		"evaluate to true against the claims of the token, along with a message to reject "+
+		"the token with otherwise.")
+
+	fs.DurationVar(&o.JWKSRefreshInterval, "oidc-jwks-refresh-interval", time.Hour, ""+
+		"The interval at which the OpenID issuer signing keys are periodically refreshed. "+
+		"Keys are also refreshed when a token is signed by an unknown key. If 0, "+
+		"periodic refreshing is disabled.")
+
+	fs.DurationVar(&o.JWKSMinRefreshInterval, "oidc-jwks-min-refresh-interval", time.Second*10, ""+
+		"The minimum interval between refreshes of the OpenID issuer signing keys "+
+		"triggered by tokens signed with an unknown key. Failed refreshes back off "+
+		"exponentially from this interval.")
+
+	fs.StringVar(&o.KeysFile, "oidc-keys-file", o.KeysFile, ""+
+		"If provided, the path to a file containing the OpenID issuer signing keys, "+
+		"either as a JWKS document or PEM encoded public keys and certificates. "+
+		"Issuer discovery is skipped and the file is watched for changes. Tokens "+
+		"are still validated against the issuer URL and client ID.")
+
 	return o
 }
@@ -4,6 +4,8 @@ package options
 import (
 	"errors"
 	"fmt"
+	"net"
+	"strconv"
 
 	"github.com/spf13/cobra"
 	k8sErrors "k8s.io/apimachinery/pkg/util/errors"
@@ -18,7 +20,14 @@ const (
 type Options struct {
 	App                *KubeOIDCProxyOptions
 	OIDCAuthentication *OIDCAuthenticationOptions
+	TokenIntrospection *TokenIntrospectionOptions
+	Tenancy            *TenancyOptions
 	SecureServing      *SecureServingOptions
+	UpstreamTransport  *UpstreamTransportOptions
+	UpstreamFailover   *UpstreamFailoverOptions
+	UpstreamRetry      *UpstreamRetryOptions
+	AccessReview       *AccessReviewOptions
+	BreakGlass         *BreakGlassOptions
 	Audit              *AuditOptions
 	Client             *ClientOptions
 	Misc               *MiscOptions
@@ -33,7 +42,14 @@ func New() *Options {
 	return &Options{
 		App:                NewKubeOIDCProxyOptions(nfs),
 		OIDCAuthentication: NewOIDCAuthenticationOptions(nfs),
+		TokenIntrospection: NewTokenIntrospectionOptions(nfs),
+		Tenancy:            NewTenancyOptions(nfs),
 		SecureServing:      NewSecureServingOptions(nfs),
+		UpstreamTransport:  NewUpstreamTransportOptions(nfs),
+		UpstreamFailover:   NewUpstreamFailoverOptions(nfs),
+		UpstreamRetry:      NewUpstreamRetryOptions(nfs),
+		AccessReview:       NewAccessReviewOptions(nfs),
+		BreakGlass:         NewBreakGlassOptions(nfs),
 		Audit:              NewAuditOptions(nfs),
 		Client:             NewClientOptions(nfs),
 		Misc:               NewMiscOptions(nfs),
@@ -74,14 +90,72 @@ func (o *Options) Validate(cmd *cobra.Command) error {
 		errs = append(errs, err)
 	}
 
+	if err := o.TokenIntrospection.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := o.Tenancy.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
 	if err := o.SecureServing.Validate(); len(err) > 0 {
 		errs = append(errs, err...)
 	}
 
+	if err := o.UpstreamTransport.Validate(); len(err) > 0 {
+		errs = append(errs, err...)
+	}
+
+	if err := o.UpstreamFailover.Validate(); len(err) > 0 {
+		errs = append(errs, err...)
+	}
+
+	if err := o.UpstreamRetry.Validate(); len(err) > 0 {
+		errs = append(errs, err...)
+	}
+
+	if err := o.AccessReview.Validate(); len(err) > 0 {
+		errs = append(errs, err...)
+	}
+
+	if err := o.BreakGlass.Validate(); len(err) > 0 {
+		errs = append(errs, err...)
+	}
+
+	if o.BreakGlass.Enabled() && o.BreakGlass.Issuer == o.OIDCAuthentication.IssuerURL {
+		errs = append(errs, errors.New("--break-glass-issuer must differ from --oidc-issuer-url"))
+	}
+
+	// Introspected tokens are opaque, so have no claims to check for
+	// revocation, derive tenants from or filter responses by.
+	if o.TokenIntrospection.Enabled() {
+		if o.App.TokenRevocation.Enabled() {
+			errs = append(errs, errors.New("cannot revoke tokens when token introspection enabled"))
+		}
+
+		if o.Tenancy.Enabled() {
+			errs = append(errs, errors.New("cannot restrict users to tenants when token introspection enabled"))
+		}
+
+		if len(o.App.ResponseFilterFile) > 0 || o.App.ProxyPolicies {
+			errs = append(errs, errors.New("cannot filter responses or watch proxy policies when token introspection enabled"))
+		}
+	}
+
 	if o.SecureServing.BindPort == o.App.ReadinessProbePort {
 		errs = append(errs, errors.New("unable to securely serve on port 8080 (used by readiness probe)"))
 	}
 
+	if len(o.App.MetricsServingAddress) > 0 {
+		errs = append(errs, o.validateServingAddress("--metrics-serving-address",
+			o.App.MetricsServingAddress, "metrics", o.App.AdminServingAddress)...)
+	}
+
+	if len(o.App.AdminServingAddress) > 0 {
+		errs = append(errs, o.validateServingAddress("--admin-serving-address",
+			o.App.AdminServingAddress, "admin endpoints", "")...)
+	}
+
 	if err := o.Audit.Validate(); len(err) > 0 {
 		errs = append(errs, err...)
 	}
@@ -91,6 +165,34 @@ func (o *Options) Validate(cmd *cobra.Command) error {
 		errs = append(errs, errors.New("cannot add extra user headers when impersonation disabled"))
 	}
 
+	if o.App.DisableImpersonation && o.App.AllowImpersonation {
+		errs = append(errs, errors.New("cannot allow impersonation requests when impersonation disabled"))
+	}
+
+	if o.App.DisableImpersonation && o.AccessReview.Enabled {
+		errs = append(errs, errors.New("cannot review access of requests when impersonation disabled"))
+	}
+
+	if o.App.DisableImpersonation && len(o.App.GroupGrantsFile) > 0 {
+		errs = append(errs, errors.New("cannot grant groups to users when impersonation disabled"))
+	}
+
+	if o.App.RequestTimeout < 0 {
+		errs = append(errs, fmt.Errorf("--proxy-request-timeout must not be negative, got %s", o.App.RequestTimeout))
+	}
+
+	if o.App.MaxRequestsInFlight < 0 {
+		errs = append(errs, fmt.Errorf("--max-requests-inflight must not be negative, got %d", o.App.MaxRequestsInFlight))
+	}
+
+	if o.App.MaxMutatingRequestsInFlight < 0 {
+		errs = append(errs, fmt.Errorf("--max-mutating-requests-inflight must not be negative, got %d", o.App.MaxMutatingRequestsInFlight))
+	}
+
+	if err := o.App.TokenRevocation.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
 	if o.Audit.DynamicOptions.Enabled {
 		errs = append(errs, errors.New("The flag --audit-dynamic-configuration may not be set"))
 	}
@@ -101,3 +203,29 @@ func (o *Options) Validate(cmd *cobra.Command) error {
 
 	return nil
 }
+
+// validateServingAddress ensures the address of an additional server is
+// valid, and does not conflict with the ports of the readiness probe, secure
+// serving, or the admin endpoints if given.
+func (o *Options) validateServingAddress(flag, address, name, adminAddress string) []error {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return []error{fmt.Errorf("invalid %s %q: %s", flag, address, err)}
+	}
+
+	var errs []error
+
+	if port == strconv.Itoa(o.App.ReadinessProbePort) {
+		errs = append(errs, fmt.Errorf("unable to serve %s on port %s (used by readiness probe)", name, port))
+	}
+
+	if port == strconv.Itoa(o.SecureServing.BindPort) {
+		errs = append(errs, fmt.Errorf("unable to serve %s on port %s (used by secure serving)", name, port))
+	}
+
+	if _, adminPort, err := net.SplitHostPort(adminAddress); err == nil && port == adminPort {
+		errs = append(errs, fmt.Errorf("unable to serve %s on port %s (used by admin endpoints)", name, port))
+	}
+
+	return errs
+}
@@ -0,0 +1,55 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package options
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/pflag"
+	cliflag "k8s.io/component-base/cli/flag"
+)
+
+type UpstreamRetryOptions struct {
+	MaxRetries int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+func NewUpstreamRetryOptions(nfs *cliflag.NamedFlagSets) *UpstreamRetryOptions {
+	return new(UpstreamRetryOptions).AddFlags(nfs.FlagSet("Upstream Retries"))
+}
+
+func (u *UpstreamRetryOptions) AddFlags(fs *pflag.FlagSet) *UpstreamRetryOptions {
+	fs.IntVar(&u.MaxRetries, "upstream-max-retries", 3, ""+
+		"Maximum number of retries of GET and HEAD requests whose connection to the "+
+		"API server is refused or reset. Watches and other streaming requests are "+
+		"never retried. If 0, requests are not retried.")
+
+	fs.DurationVar(&u.Backoff, "upstream-retry-backoff", time.Millisecond*200, ""+
+		"Wait before the first retry of a request, doubling with each retry. Each "+
+		"wait is jittered by up to the same again.")
+
+	fs.DurationVar(&u.MaxBackoff, "upstream-retry-max-backoff", time.Second*2, ""+
+		"Maximum wait before a retry of a request, before jitter.")
+
+	return u
+}
+
+func (u *UpstreamRetryOptions) Validate() []error {
+	var errs []error
+
+	if u.MaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("--upstream-max-retries must not be negative, got %d", u.MaxRetries))
+	}
+
+	if u.Backoff < 0 {
+		errs = append(errs, fmt.Errorf("--upstream-retry-backoff must not be negative, got %s", u.Backoff))
+	}
+
+	if u.MaxBackoff < u.Backoff {
+		errs = append(errs, fmt.Errorf("--upstream-retry-max-backoff (%s) must not be less than --upstream-retry-backoff (%s)",
+			u.MaxBackoff, u.Backoff))
+	}
+
+	return errs
+}
@@ -0,0 +1,52 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package options
+
+import (
+	"errors"
+
+	"github.com/spf13/pflag"
+	cliflag "k8s.io/component-base/cli/flag"
+)
+
+type TenancyOptions struct {
+	Claim          string
+	NamespaceLabel string
+	ExemptGroups   []string
+}
+
+func NewTenancyOptions(nfs *cliflag.NamedFlagSets) *TenancyOptions {
+	return new(TenancyOptions).AddFlags(nfs.FlagSet("Tenancy"))
+}
+
+func (t *TenancyOptions) Enabled() bool {
+	return t != nil && len(t.NamespaceLabel) > 0
+}
+
+func (t *TenancyOptions) Validate() error {
+	if !t.Enabled() {
+		return nil
+	}
+
+	if len(t.Claim) == 0 {
+		return errors.New("tenancy-claim must be specified with tenancy-namespace-label")
+	}
+
+	return nil
+}
+
+func (t *TenancyOptions) AddFlags(fs *pflag.FlagSet) *TenancyOptions {
+	fs.StringVar(&t.NamespaceLabel, "tenancy-namespace-label", t.NamespaceLabel, ""+
+		"(Alpha) If provided, users authenticated with OIDC are restricted to namespaces "+
+		"whose value of this label is one of their tenants, given by --tenancy-claim. "+
+		"Namespace lists are filtered to the namespaces of their tenants.")
+
+	fs.StringVar(&t.Claim, "tenancy-claim", "team", ""+
+		"(Alpha) The OIDC claim holding the tenants of the user, as a string or array of "+
+		"strings.")
+
+	fs.StringSliceVar(&t.ExemptGroups, "tenancy-exempt-groups", t.ExemptGroups, ""+
+		"(Alpha) Groups whose members are not restricted to the namespaces of their "+
+		"tenants.")
+
+	return t
+}
@@ -0,0 +1,109 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package options
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/pflag"
+	cliflag "k8s.io/component-base/cli/flag"
+)
+
+type UpstreamTransportOptions struct {
+	EnableHTTP2           bool
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int
+	IdleConnTimeout       time.Duration
+	DialTimeout           time.Duration
+	KeepAlive             time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+}
+
+func NewUpstreamTransportOptions(nfs *cliflag.NamedFlagSets) *UpstreamTransportOptions {
+	return new(UpstreamTransportOptions).AddFlags(nfs.FlagSet("Upstream Transport"))
+}
+
+func (u *UpstreamTransportOptions) AddFlags(fs *pflag.FlagSet) *UpstreamTransportOptions {
+	fs.BoolVar(&u.EnableHTTP2, "upstream-http2", false, ""+
+		"Attempt HTTP/2 connections to the API server. Upgrade requests, such as exec "+
+		"and port-forward, always use HTTP/1.1.")
+
+	fs.IntVar(&u.MaxIdleConns, "upstream-max-idle-conns", 100, ""+
+		"Maximum number of idle connections to the API server kept open. If 0, there "+
+		"is no limit.")
+
+	fs.IntVar(&u.MaxIdleConnsPerHost, "upstream-max-idle-conns-per-host", 25, ""+
+		"Maximum number of idle connections kept open per API server host.")
+
+	fs.IntVar(&u.MaxConnsPerHost, "upstream-max-conns-per-host", 0, ""+
+		"Maximum number of connections per API server host, including those in use. "+
+		"Requests wait for a connection once the limit is reached. If 0, there is no "+
+		"limit.")
+
+	fs.DurationVar(&u.IdleConnTimeout, "upstream-idle-conn-timeout", time.Second*90, ""+
+		"How long an idle connection to the API server is kept open. If 0, idle "+
+		"connections are kept open indefinitely.")
+
+	fs.DurationVar(&u.DialTimeout, "upstream-dial-timeout", time.Second*30, ""+
+		"Timeout for establishing a connection to the API server. If 0, there is no "+
+		"timeout.")
+
+	fs.DurationVar(&u.KeepAlive, "upstream-keepalive", time.Second*30, ""+
+		"Interval of TCP keepalive probes on connections to the API server. If 0, "+
+		"keepalives are disabled.")
+
+	fs.DurationVar(&u.TLSHandshakeTimeout, "upstream-tls-handshake-timeout", time.Second*10, ""+
+		"Timeout for the TLS handshake with the API server. If 0, there is no timeout.")
+
+	fs.DurationVar(&u.ResponseHeaderTimeout, "upstream-response-header-timeout", 0, ""+
+		"Timeout for receiving the response headers from the API server, once the "+
+		"request has been sent. If 0, there is no timeout.")
+
+	return u
+}
+
+func (u *UpstreamTransportOptions) Validate() []error {
+	var errs []error
+
+	for _, f := range []struct {
+		name  string
+		value int
+	}{
+		{"upstream-max-idle-conns", u.MaxIdleConns},
+		{"upstream-max-idle-conns-per-host", u.MaxIdleConnsPerHost},
+		{"upstream-max-conns-per-host", u.MaxConnsPerHost},
+	} {
+		if f.value < 0 {
+			errs = append(errs, fmt.Errorf("--%s must not be negative, got %d", f.name, f.value))
+		}
+	}
+
+	for _, f := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"upstream-idle-conn-timeout", u.IdleConnTimeout},
+		{"upstream-dial-timeout", u.DialTimeout},
+		{"upstream-keepalive", u.KeepAlive},
+		{"upstream-tls-handshake-timeout", u.TLSHandshakeTimeout},
+		{"upstream-response-header-timeout", u.ResponseHeaderTimeout},
+	} {
+		if f.value < 0 {
+			errs = append(errs, fmt.Errorf("--%s must not be negative, got %s", f.name, f.value))
+		}
+	}
+
+	if u.MaxIdleConns > 0 && u.MaxIdleConnsPerHost > u.MaxIdleConns {
+		errs = append(errs, fmt.Errorf("--upstream-max-idle-conns-per-host (%d) must not be greater than --upstream-max-idle-conns (%d)",
+			u.MaxIdleConnsPerHost, u.MaxIdleConns))
+	}
+
+	if u.MaxConnsPerHost > 0 && u.MaxIdleConnsPerHost > u.MaxConnsPerHost {
+		errs = append(errs, fmt.Errorf("--upstream-max-idle-conns-per-host (%d) must not be greater than --upstream-max-conns-per-host (%d)",
+			u.MaxIdleConnsPerHost, u.MaxConnsPerHost))
+	}
+
+	return errs
+}
@@ -6,12 +6,28 @@ import (
 
 	"github.com/spf13/cobra"
 	"k8s.io/apiserver/pkg/server"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 
 	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
+	"github.com/jetstack/kube-oidc-proxy/pkg/admin"
+	"github.com/jetstack/kube-oidc-proxy/pkg/metrics"
 	"github.com/jetstack/kube-oidc-proxy/pkg/probe"
 	"github.com/jetstack/kube-oidc-proxy/pkg/proxy"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/accessreview"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/breakglass"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/fairness"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/filter"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/grants"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/impersonation"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/introspection"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/mutation"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/policy"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/revocation"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/tenancy"
 	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/tokenreview"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/upstream"
 	"github.com/jetstack/kube-oidc-proxy/pkg/util"
 )
 
@@ -66,21 +82,270 @@ func buildRunCommand(stopCh <-chan struct{}, opts *options.Options) *cobra.Comma
 				}
 			}
 
+			// Initialise token introspector if enabled
+			var tokenIntrospector *introspection.Authenticator
+			if opts.TokenIntrospection.Enabled() {
+				tokenIntrospector, err = introspection.New(introspection.Options{
+					URL:              opts.TokenIntrospection.URL,
+					ClientID:         opts.TokenIntrospection.ClientID,
+					ClientSecret:     opts.TokenIntrospection.ClientSecret,
+					ClientSecretFile: opts.TokenIntrospection.ClientSecretFile,
+					Audiences:        opts.TokenIntrospection.Audiences,
+					CAFile:           opts.TokenIntrospection.CAFile,
+					UsernameClaim:    opts.TokenIntrospection.UsernameClaim,
+					UsernamePrefix:   opts.TokenIntrospection.UsernamePrefix,
+					GroupsClaim:      opts.TokenIntrospection.GroupsClaim,
+					GroupsPrefix:     opts.TokenIntrospection.GroupsPrefix,
+					QPS:              opts.TokenIntrospection.QPS,
+					Burst:            opts.TokenIntrospection.Burst,
+				})
+				if err != nil {
+					return err
+				}
+			}
+
+			// Initialise break-glass authentication if enabled
+			var breakGlass *breakglass.Authenticator
+			if opts.BreakGlass.Enabled() {
+				breakGlass, err = breakglass.New(breakglass.Options{
+					KeysFile:       opts.BreakGlass.KeysFile,
+					Issuer:         opts.BreakGlass.Issuer,
+					Group:          opts.BreakGlass.Group,
+					UsernamePrefix: opts.BreakGlass.UsernamePrefix,
+					MaxLifetime:    opts.BreakGlass.MaxLifetime,
+				})
+				if err != nil {
+					return err
+				}
+			}
+
+			// Initialise token revoker if enabled
+			var tokenRevoker *revocation.Revoker
+			if len(opts.App.TokenRevocation.File) > 0 {
+				tokenRevoker, err = revocation.NewFromFile(opts.App.TokenRevocation.File)
+				if err != nil {
+					return err
+				}
+			}
+
+			if len(opts.App.TokenRevocation.ConfigMap) > 0 {
+				namespace, name, err := opts.App.TokenRevocation.ConfigMapNamespaceName()
+				if err != nil {
+					return err
+				}
+
+				kubeclient, err := kubernetes.NewForConfig(restConfig)
+				if err != nil {
+					return err
+				}
+
+				tokenRevoker = revocation.NewFromConfigMap(kubeclient, namespace, name)
+			}
+
+			if tokenRevoker != nil {
+				if err := tokenRevoker.Run(stopCh); err != nil {
+					return err
+				}
+			}
+
+			// Initialise time-bound group grants if enabled
+			var groupGrants *grants.Grants
+			if len(opts.App.GroupGrantsFile) > 0 {
+				groupGrants, err = grants.NewFromFile(opts.App.GroupGrantsFile)
+				if err != nil {
+					return err
+				}
+
+				groupGrants.Run(stopCh)
+			}
+
+			// Initialise namespace tenancy if enabled
+			var proxyTenancy *tenancy.Tenancy
+			if opts.Tenancy.Enabled() {
+				kubeclient, err := kubernetes.NewForConfig(restConfig)
+				if err != nil {
+					return err
+				}
+
+				proxyTenancy = tenancy.New(kubeclient, tenancy.Options{
+					Claim:          opts.Tenancy.Claim,
+					NamespaceLabel: opts.Tenancy.NamespaceLabel,
+					ExemptGroups:   opts.Tenancy.ExemptGroups,
+				})
+
+				if err := proxyTenancy.Run(stopCh); err != nil {
+					return err
+				}
+			}
+
+			// Initialise response filter if enabled
+			var (
+				responseFilter *filter.Filter
+				filterConfig   *filter.Config
+			)
+			if len(opts.App.ResponseFilterFile) > 0 {
+				filterConfig, err = filter.LoadConfig(opts.App.ResponseFilterFile)
+				if err != nil {
+					return err
+				}
+
+				responseFilter, err = filter.New(filterConfig)
+				if err != nil {
+					return err
+				}
+			}
+
+			// Initialise request mutation if enabled
+			var (
+				requestMutation *mutation.Mutation
+				mutationConfig  *mutation.Config
+			)
+			if len(opts.App.RequestMutationFile) > 0 {
+				mutationConfig, err = mutation.LoadConfig(opts.App.RequestMutationFile)
+				if err != nil {
+					return err
+				}
+
+				requestMutation, err = mutation.New(mutationConfig)
+				if err != nil {
+					return err
+				}
+			}
+
+			// Initialise proxy policies if enabled, whose rules are applied after
+			// those of the response filter and request mutation files
+			var proxyPolicy *policy.Policy
+			if opts.App.ProxyPolicies {
+				dynamicclient, err := dynamic.NewForConfig(restConfig)
+				if err != nil {
+					return err
+				}
+
+				proxyPolicy = policy.New(dynamicclient, policy.Options{
+					ResponseFilter:  filterConfig,
+					RequestMutation: mutationConfig,
+				})
+
+				if err := proxyPolicy.Run(stopCh); err != nil {
+					return err
+				}
+			}
+
+			// Initialise fair queuing if enabled
+			var proxyFairness *fairness.Fairness
+			if len(opts.App.FairnessConfigFile) > 0 {
+				fairnessConfig, err := fairness.LoadConfig(opts.App.FairnessConfigFile)
+				if err != nil {
+					return err
+				}
+
+				proxyFairness, err = fairness.New(fairnessConfig)
+				if err != nil {
+					return err
+				}
+			}
+
+			// Initialise impersonation authorization if enabled
+			var impersonationAuthorizer *impersonation.Authorizer
+			if opts.App.AllowImpersonation {
+				kubeclient, err := kubernetes.NewForConfig(restConfig)
+				if err != nil {
+					return err
+				}
+
+				impersonationAuthorizer = impersonation.New(kubeclient)
+			}
+
+			// Initialise access review if enabled
+			var accessReview *accessreview.AccessReview
+			if opts.AccessReview.Enabled {
+				kubeclient, err := kubernetes.NewForConfig(restConfig)
+				if err != nil {
+					return err
+				}
+
+				accessReview = accessreview.New(kubeclient, accessreview.Options{
+					AllowTTL: opts.AccessReview.AllowTTL,
+					DenyTTL:  opts.AccessReview.DenyTTL,
+				})
+			}
+
+			// Initialise upstream failover if enabled
+			var upstreamPool *upstream.Pool
+			if opts.UpstreamFailover.Enabled() {
+				upstreamPool, err = upstream.New(upstream.Options{
+					Endpoints:           opts.UpstreamFailover.Endpoints,
+					Balancer:            opts.UpstreamFailover.Balancer,
+					HealthCheckInterval: opts.UpstreamFailover.HealthCheckInterval,
+					HealthCheckTimeout:  opts.UpstreamFailover.HealthCheckTimeout,
+					EjectionDuration:    opts.UpstreamFailover.EjectionDuration,
+				})
+				if err != nil {
+					return err
+				}
+			}
+
 			// Initialise Secure Serving Config
 			secureServingInfo := new(server.SecureServingInfo)
 			if err := opts.SecureServing.ApplyTo(&secureServingInfo); err != nil {
 				return err
 			}
 
+			// A keepalive of 0 disables keepalives, rather than using the dialer
+			// default
+			keepAlive := opts.UpstreamTransport.KeepAlive
+			if keepAlive == 0 {
+				keepAlive = -1
+			}
+
 			proxyConfig := &proxy.Config{
 				TokenReview:          opts.App.TokenPassthrough.Enabled,
 				DisableImpersonation: opts.App.DisableImpersonation,
 
 				FlushInterval:   opts.App.FlushInterval,
+				RequestTimeout:  opts.App.RequestTimeout,
 				ExternalAddress: opts.SecureServing.BindAddress.String(),
 
+				MaxRequestsInFlight:         opts.App.MaxRequestsInFlight,
+				MaxMutatingRequestsInFlight: opts.App.MaxMutatingRequestsInFlight,
+
+				Transport: proxy.TransportConfig{
+					EnableHTTP2:           opts.UpstreamTransport.EnableHTTP2,
+					MaxIdleConns:          opts.UpstreamTransport.MaxIdleConns,
+					MaxIdleConnsPerHost:   opts.UpstreamTransport.MaxIdleConnsPerHost,
+					MaxConnsPerHost:       opts.UpstreamTransport.MaxConnsPerHost,
+					IdleConnTimeout:       opts.UpstreamTransport.IdleConnTimeout,
+					DialTimeout:           opts.UpstreamTransport.DialTimeout,
+					KeepAlive:             keepAlive,
+					TLSHandshakeTimeout:   opts.UpstreamTransport.TLSHandshakeTimeout,
+					ResponseHeaderTimeout: opts.UpstreamTransport.ResponseHeaderTimeout,
+				},
+				Upstream: upstreamPool,
+				Retry: proxy.RetryConfig{
+					MaxRetries: opts.UpstreamRetry.MaxRetries,
+					Backoff:    opts.UpstreamRetry.Backoff,
+					MaxBackoff: opts.UpstreamRetry.MaxBackoff,
+				},
+
 				ExtraUserHeaders:                opts.App.ExtraHeaderOptions.ExtraUserHeaders,
 				ExtraUserHeadersClientIPEnabled: opts.App.ExtraHeaderOptions.EnableClientIPExtraUserHeader,
+
+				TokenRevoker: tokenRevoker,
+				BreakGlass:   breakGlass,
+				Grants:       groupGrants,
+				Tenancy:      proxyTenancy,
+
+				ResponseFilter:  responseFilter,
+				RequestMutation: requestMutation,
+				Fairness:        proxyFairness,
+				Policy:          proxyPolicy,
+
+				ImpersonationAuthorizer: impersonationAuthorizer,
+				AccessReview:            accessReview,
+			}
+
+			if tokenIntrospector != nil {
+				proxyConfig.TokenIntrospector = tokenIntrospector
 			}
 
 			// Initialise proxy with OIDC token authenticator
@@ -102,6 +367,17 @@ func buildRunCommand(stopCh <-chan struct{}, opts *options.Options) *cobra.Comma
 				return err
 			}
 
+			// Start metrics and admin servers
+			if err := metrics.Run(opts.App.MetricsServingAddress, stopCh); err != nil {
+				return err
+			}
+
+			adminServer := admin.New(opts.App.AdminServingAddress)
+			adminServer.Handle("/oidc/jwks/refresh", p.OIDCKeySetRefreshHandler())
+			if err := adminServer.Run(stopCh); err != nil {
+				return err
+			}
+
 			// Run proxy
 			waitCh, err := p.Run(stopCh)
 			if err != nil {
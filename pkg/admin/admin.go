@@ -0,0 +1,42 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package admin
+
+import (
+	"net/http"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/util"
+)
+
+// Server serves administrative endpoints of the proxy, such as forcing a
+// refresh of the OIDC issuer keys. These endpoints are unauthenticated so
+// the server should only be bound to a local address.
+type Server struct {
+	address string
+	mux     *http.ServeMux
+}
+
+func New(address string) *Server {
+	return &Server{
+		address: address,
+		mux:     http.NewServeMux(),
+	}
+}
+
+// Handle registers the handler for the given path on the admin server.
+func (s *Server) Handle(path string, handler http.Handler) {
+	s.mux.Handle(path, handler)
+}
+
+// Run will serve the admin endpoints until the stop channel is closed. If the
+// address is empty, the admin server is disabled. Returns an error if the
+// address could not be listened on.
+func (s *Server) Run(stopCh <-chan struct{}) error {
+	if len(s.address) == 0 {
+		return nil
+	}
+
+	return util.ListenAndServeUntil("admin endpoints", &http.Server{
+		Addr:    s.address,
+		Handler: s.mux,
+	}, stopCh)
+}
@@ -0,0 +1,57 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/util"
+)
+
+const (
+	// Namespace is the namespace of all metrics exposed by the proxy.
+	Namespace = "kube_oidc_proxy"
+)
+
+var (
+	// registry holds all metrics exposed by the proxy. Packages should
+	// register their collectors using MustRegister.
+	registry = prometheus.NewRegistry()
+)
+
+func init() {
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+}
+
+// MustRegister registers the given collectors with the proxy metrics
+// registry, panicking if any fail to register.
+func MustRegister(collectors ...prometheus.Collector) {
+	registry.MustRegister(collectors...)
+}
+
+// Handler returns an http.Handler that serves the proxy metrics.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// Run will serve the proxy metrics at the /metrics path of the given address
+// until the stop channel is closed. If the address is empty, metrics are not
+// served. Returns an error if the address could not be listened on.
+func Run(address string, stopCh <-chan struct{}) error {
+	if len(address) == 0 {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+
+	return util.ListenAndServeUntil("metrics", &http.Server{
+		Addr:    address,
+		Handler: mux,
+	}, stopCh)
+}
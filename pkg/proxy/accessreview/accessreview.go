@@ -0,0 +1,214 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package accessreview
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/cache"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/kubernetes"
+	authorizationv1client "k8s.io/client-go/kubernetes/typed/authorization/v1"
+	"k8s.io/client-go/transport"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/metrics"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+)
+
+const (
+	// defaultCacheSize is the number of decisions cached, matching the webhook
+	// authorizer of the API server.
+	defaultCacheSize = 1024
+)
+
+var (
+	reviewsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "access_review",
+		Name:      "decisions_total",
+		Help:      "Number of access review decisions, by decision and whether the decision was cached.",
+	}, []string{"decision", "cached"})
+)
+
+func init() {
+	metrics.MustRegister(reviewsTotal)
+}
+
+type Options struct {
+	// AllowTTL is the duration to cache allowed decisions. If 0, allowed
+	// decisions are not cached.
+	AllowTTL time.Duration
+
+	// DenyTTL is the duration to cache denied decisions. If 0, denied
+	// decisions are not cached.
+	DenyTTL time.Duration
+}
+
+// ForbiddenError is returned when a request is denied by an access review.
+type ForbiddenError struct {
+	Message string
+}
+
+func (e *ForbiddenError) Error() string {
+	return e.Message
+}
+
+// decision is a cached access review decision.
+type decision struct {
+	allowed bool
+	reason  string
+}
+
+// AccessReview authorizes requests as the impersonated identity with
+// SubjectAccessReviews against the upstream cluster, before they are
+// forwarded. Decisions are cached by identity and request attributes.
+type AccessReview struct {
+	client   authorizationv1client.SubjectAccessReviewInterface
+	cache    *cache.LRUExpireCache
+	allowTTL time.Duration
+	denyTTL  time.Duration
+}
+
+func New(client kubernetes.Interface, opts Options) *AccessReview {
+	return &AccessReview{
+		client:   client.AuthorizationV1().SubjectAccessReviews(),
+		cache:    cache.NewLRUExpireCache(defaultCacheSize),
+		allowTTL: opts.AllowTTL,
+		denyTTL:  opts.DenyTTL,
+	}
+}
+
+// Review returns a ForbiddenError if the request is not allowed for the
+// impersonated identity, with the reason given by the upstream cluster.
+func (a *AccessReview) Review(req *http.Request, conf *transport.ImpersonationConfig) error {
+	info, err := context.RequestInfo(req)
+	if err != nil {
+		return err
+	}
+
+	spec := authorizationv1.SubjectAccessReviewSpec{
+		User:   conf.UserName,
+		Groups: conf.Groups,
+	}
+
+	if len(conf.Extra) > 0 {
+		spec.Extra = make(map[string]authorizationv1.ExtraValue)
+		for k, v := range conf.Extra {
+			spec.Extra[k] = v
+		}
+	}
+
+	if info.IsResourceRequest {
+		spec.ResourceAttributes = &authorizationv1.ResourceAttributes{
+			Namespace:   info.Namespace,
+			Verb:        info.Verb,
+			Group:       info.APIGroup,
+			Version:     info.APIVersion,
+			Resource:    info.Resource,
+			Subresource: info.Subresource,
+			Name:        info.Name,
+		}
+	} else {
+		spec.NonResourceAttributes = &authorizationv1.NonResourceAttributes{
+			Path: info.Path,
+			Verb: info.Verb,
+		}
+	}
+
+	d, err := a.decide(req, spec)
+	if err != nil {
+		return err
+	}
+
+	if d.allowed {
+		return nil
+	}
+
+	return &ForbiddenError{
+		Message: forbiddenMessage(info, conf.UserName, d.reason),
+	}
+}
+
+// decide returns the decision of the review, from the cache if present.
+func (a *AccessReview) decide(req *http.Request, spec authorizationv1.SubjectAccessReviewSpec) (decision, error) {
+	// The spec is encoded as the cache key. Maps are encoded with sorted keys.
+	b, err := json.Marshal(spec)
+	if err != nil {
+		return decision{}, err
+	}
+	key := string(b)
+
+	if cached, ok := a.cache.Get(key); ok {
+		d := cached.(decision)
+		reviewsTotal.WithLabelValues(decisionLabel(d), "true").Inc()
+		return d, nil
+	}
+
+	review, err := a.client.Create(req.Context(), &authorizationv1.SubjectAccessReview{
+		Spec: spec,
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return decision{}, fmt.Errorf("failed to review access: %s", err)
+	}
+
+	d := decision{
+		allowed: review.Status.Allowed && !review.Status.Denied,
+		reason:  review.Status.Reason,
+	}
+
+	ttl := a.denyTTL
+	if d.allowed {
+		ttl = a.allowTTL
+	}
+
+	if ttl > 0 {
+		a.cache.Add(key, d, ttl)
+	}
+
+	reviewsTotal.WithLabelValues(decisionLabel(d), "false").Inc()
+
+	return d, nil
+}
+
+func decisionLabel(d decision) string {
+	if d.allowed {
+		return "allowed"
+	}
+	return "denied"
+}
+
+// forbiddenMessage returns the message of the API server when forbidding a
+// request.
+func forbiddenMessage(info *genericapirequest.RequestInfo, username, reason string) string {
+	resource := info.Resource
+	if len(info.Subresource) > 0 {
+		resource = resource + "/" + info.Subresource
+	}
+
+	var msg string
+	switch {
+	case !info.IsResourceRequest:
+		msg = fmt.Sprintf("User %q cannot %s path %q", username, info.Verb, info.Path)
+	case len(info.Namespace) > 0:
+		msg = fmt.Sprintf("User %q cannot %s resource %q in API group %q in the namespace %q",
+			username, info.Verb, resource, info.APIGroup, info.Namespace)
+	default:
+		msg = fmt.Sprintf("User %q cannot %s resource %q in API group %q at the cluster scope",
+			username, info.Verb, resource, info.APIGroup)
+	}
+
+	if len(reason) > 0 {
+		msg = msg + ": " + reason
+	}
+
+	gr := schema.GroupResource{Group: info.APIGroup, Resource: info.Resource}
+	return apierrors.NewForbidden(gr, info.Name, errors.New(msg)).ErrStatus.Message
+}
@@ -0,0 +1,224 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package accessreview
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/transport"
+)
+
+// newTestAccessReview returns an access review whose upstream cluster allows
+// members of the "admins" group to do anything, and anyone to get pods. The
+// returned function returns the reviews made.
+func newTestAccessReview(opts Options) (*AccessReview, func() []*authorizationv1.SubjectAccessReview) {
+	var reviews []*authorizationv1.SubjectAccessReview
+
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "subjectaccessreviews", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		sar := action.(clienttesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		reviews = append(reviews, sar)
+
+		for _, group := range sar.Spec.Groups {
+			if group == "admins" {
+				sar.Status.Allowed = true
+			}
+		}
+
+		if attr := sar.Spec.ResourceAttributes; attr != nil && attr.Resource == "pods" && attr.Verb == "get" {
+			sar.Status.Allowed = true
+		}
+
+		if !sar.Status.Allowed {
+			sar.Status.Reason = "no RBAC policy matched"
+		}
+
+		return true, sar, nil
+	})
+
+	return New(client, opts), func() []*authorizationv1.SubjectAccessReview {
+		return reviews
+	}
+}
+
+func newRequest(method, path string) *http.Request {
+	return &http.Request{
+		Method: method,
+		URL:    &url.URL{Path: path},
+	}
+}
+
+func TestReview(t *testing.T) {
+	tests := map[string]struct {
+		req  *http.Request
+		conf *transport.ImpersonationConfig
+
+		expErr  string
+		expSpec *authorizationv1.SubjectAccessReviewSpec
+	}{
+		"an allowed resource request should be allowed": {
+			req: newRequest(http.MethodGet, "/api/v1/namespaces/foo/pods/bar"),
+			conf: &transport.ImpersonationConfig{
+				UserName: "a-user",
+				Groups:   []string{"system:authenticated"},
+				Extra:    map[string][]string{"foo": []string{"bar"}},
+			},
+			expSpec: &authorizationv1.SubjectAccessReviewSpec{
+				User:   "a-user",
+				Groups: []string{"system:authenticated"},
+				Extra:  map[string]authorizationv1.ExtraValue{"foo": []string{"bar"}},
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace: "foo",
+					Verb:      "get",
+					Version:   "v1",
+					Resource:  "pods",
+					Name:      "bar",
+				},
+			},
+		},
+		"a denied namespaced request should be forbidden with the reason": {
+			req: newRequest(http.MethodDelete, "/apis/apps/v1/namespaces/foo/deployments/bar"),
+			conf: &transport.ImpersonationConfig{
+				UserName: "a-user",
+			},
+			expErr: `deployments.apps "bar" is forbidden: User "a-user" cannot delete resource "deployments" in API group "apps" in the namespace "foo": no RBAC policy matched`,
+			expSpec: &authorizationv1.SubjectAccessReviewSpec{
+				User: "a-user",
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace: "foo",
+					Verb:      "delete",
+					Group:     "apps",
+					Version:   "v1",
+					Resource:  "deployments",
+					Name:      "bar",
+				},
+			},
+		},
+		"a denied cluster scoped subresource request should be forbidden with the reason": {
+			req: newRequest(http.MethodGet, "/api/v1/nodes/foo/proxy"),
+			conf: &transport.ImpersonationConfig{
+				UserName: "a-user",
+			},
+			expErr: `nodes "foo" is forbidden: User "a-user" cannot get resource "nodes/proxy" in API group "" at the cluster scope: no RBAC policy matched`,
+			expSpec: &authorizationv1.SubjectAccessReviewSpec{
+				User: "a-user",
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Verb:        "get",
+					Version:     "v1",
+					Resource:    "nodes",
+					Subresource: "proxy",
+					Name:        "foo",
+				},
+			},
+		},
+		"a denied non-resource request should be forbidden with the reason": {
+			req: newRequest(http.MethodGet, "/metrics"),
+			conf: &transport.ImpersonationConfig{
+				UserName: "a-user",
+			},
+			expErr: `forbidden: User "a-user" cannot get path "/metrics": no RBAC policy matched`,
+			expSpec: &authorizationv1.SubjectAccessReviewSpec{
+				User: "a-user",
+				NonResourceAttributes: &authorizationv1.NonResourceAttributes{
+					Path: "/metrics",
+					Verb: "get",
+				},
+			},
+		},
+		"a request of an allowed group should be allowed": {
+			req: newRequest(http.MethodGet, "/metrics"),
+			conf: &transport.ImpersonationConfig{
+				UserName: "a-user",
+				Groups:   []string{"admins"},
+			},
+			expSpec: &authorizationv1.SubjectAccessReviewSpec{
+				User:   "a-user",
+				Groups: []string{"admins"},
+				NonResourceAttributes: &authorizationv1.NonResourceAttributes{
+					Path: "/metrics",
+					Verb: "get",
+				},
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			a, reviews := newTestAccessReview(Options{})
+
+			err := a.Review(test.req, test.conf)
+			if len(test.expErr) > 0 {
+				forbiddenErr, ok := err.(*ForbiddenError)
+				if !ok || forbiddenErr.Message != test.expErr {
+					t.Errorf("unexpected error, exp=%q got=%v", test.expErr, err)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+
+			if len(reviews()) != 1 {
+				t.Fatalf("unexpected number of reviews, exp=1 got=%d", len(reviews()))
+			}
+
+			if spec := reviews()[0].Spec; !reflect.DeepEqual(&spec, test.expSpec) {
+				t.Errorf("unexpected review, exp=%+v got=%+v", test.expSpec, &spec)
+			}
+		})
+	}
+}
+
+func TestReviewCache(t *testing.T) {
+	a, reviews := newTestAccessReview(Options{
+		AllowTTL: time.Minute,
+		DenyTTL:  time.Minute,
+	})
+
+	user := &transport.ImpersonationConfig{UserName: "a-user"}
+	admin := &transport.ImpersonationConfig{UserName: "a-user", Groups: []string{"admins"}}
+
+	for _, test := range []struct {
+		req        *http.Request
+		conf       *transport.ImpersonationConfig
+		expAllowed bool
+		expReviews int
+	}{
+		{newRequest(http.MethodGet, "/api/v1/namespaces/foo/pods/bar"), user, true, 1},
+		{newRequest(http.MethodGet, "/api/v1/namespaces/foo/pods/bar"), user, true, 1},
+		{newRequest(http.MethodDelete, "/api/v1/namespaces/foo/pods/bar"), user, false, 2},
+		{newRequest(http.MethodDelete, "/api/v1/namespaces/foo/pods/bar"), user, false, 2},
+		// A different identity is a different decision
+		{newRequest(http.MethodDelete, "/api/v1/namespaces/foo/pods/bar"), admin, true, 3},
+		// A different resource is a different decision
+		{newRequest(http.MethodGet, "/api/v1/namespaces/foo/pods/baz"), user, true, 4},
+	} {
+		err := a.Review(test.req, test.conf)
+		if allowed := err == nil; allowed != test.expAllowed {
+			t.Errorf("unexpected decision of %s %s, exp=%t got=%v",
+				test.req.Method, test.req.URL.Path, test.expAllowed, err)
+		}
+
+		if n := len(reviews()); n != test.expReviews {
+			t.Errorf("unexpected number of reviews after %s %s, exp=%d got=%d",
+				test.req.Method, test.req.URL.Path, test.expReviews, n)
+		}
+	}
+
+	// Decisions are not cached with a TTL of 0
+	a, reviews = newTestAccessReview(Options{})
+	for i := 0; i < 2; i++ {
+		if err := a.Review(newRequest(http.MethodGet, "/api/v1/namespaces/foo/pods/bar"), user); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}
+
+	if n := len(reviews()); n != 2 {
+		t.Errorf("unexpected number of reviews without caching, exp=2 got=%d", n)
+	}
+}
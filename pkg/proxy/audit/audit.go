@@ -2,20 +2,26 @@
 package audit
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"k8s.io/apimachinery/pkg/util/sets"
+	k8saudit "k8s.io/apiserver/pkg/audit"
 	genericapifilters "k8s.io/apiserver/pkg/endpoints/filters"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
 	"k8s.io/apiserver/pkg/server"
 	genericfilters "k8s.io/apiserver/pkg/server/filters"
+	"k8s.io/klog"
 
 	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
 )
 
 type Audit struct {
-	opts         *options.AuditOptions
-	serverConfig *server.CompletedConfig
+	opts          *options.AuditOptions
+	serverConfig  *server.CompletedConfig
+	maxObjectSize int64
 }
 
 // New creates a new Audit struct to handle auditing for proxy requests. This
@@ -26,11 +32,16 @@ func New(opts *options.AuditOptions, externalAddress string, secureServingInfo *
 		ExternalAddress: externalAddress,
 		SecureServing:   secureServingInfo,
 
-		// Default to treating watch as a long-running operation.
-		// Generic API servers have no inherent long-running subresources.
-		// This is so watch requests are handled correctly in the audit log.
+		// Resolve core API group requests to their resources, so that their
+		// events contain an object reference for redaction.
+		LegacyAPIGroupPrefixes: sets.NewString(server.DefaultLegacyAPIPrefix),
+
+		// Treat the same requests as long-running as the Kubernetes API
+		// server, so watch and streaming requests are handled correctly in the
+		// audit log, and are not subject to request timeouts.
 		LongRunningFunc: genericfilters.BasicLongRunningRequestCheck(
-			sets.NewString("watch"), sets.NewString()),
+			sets.NewString("watch", "proxy"),
+			sets.NewString("attach", "exec", "proxy", "log", "portforward")),
 	}
 
 	// We do not support dynamic auditing, so leave nil
@@ -38,11 +49,44 @@ func New(opts *options.AuditOptions, externalAddress string, secureServingInfo *
 		return nil, err
 	}
 
+	// Join any configured registered backends with the API server backends.
+	backends, err := newBackends(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(backends) > 0 {
+		if serverConfig.AuditPolicyChecker == nil {
+			return nil, errors.New("audit backends require an audit policy file")
+		}
+
+		if serverConfig.AuditBackend != nil {
+			backends = append([]k8saudit.Backend{serverConfig.AuditBackend}, backends...)
+		}
+
+		serverConfig.AuditBackend = k8saudit.Union(backends...)
+	}
+
+	// Redact request and response bodies using the rules in the audit policy
+	// file, before events reach any backend.
+	if serverConfig.AuditBackend != nil && opts.AuditOptions != nil && len(opts.PolicyFile) > 0 {
+		rules, err := loadRedactionRules(opts.PolicyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(rules) > 0 {
+			klog.V(2).Infof("redacting audit events using %d redaction rules", len(rules))
+			serverConfig.AuditBackend = newRedactingBackend(serverConfig.AuditBackend, rules)
+		}
+	}
+
 	completed := serverConfig.Complete(nil)
 
 	return &Audit{
-		opts:         opts,
-		serverConfig: &completed,
+		opts:          opts,
+		serverConfig:  &completed,
+		maxObjectSize: opts.MaxObjectSize,
 	}, nil
 }
 
@@ -66,11 +110,20 @@ func (a *Audit) Shutdown() error {
 	return nil
 }
 
+// LongRunningFunc returns the check of whether a request is long-running, such
+// as a watch or exec.
+func (a *Audit) LongRunningFunc() genericapirequest.LongRunningRequestCheck {
+	return a.serverConfig.LongRunningFunc
+}
+
 // WithRequest will wrap the given handler to inject the request information
-// into the context which is then used by the wrapped audit handler.
+// into the context which is then used by the wrapped audit handler. Request and
+// response bodies are logged to the audit event, depending on its level.
 func (a *Audit) WithRequest(handler http.Handler) http.Handler {
+	handler = withBreakGlass(handler)
+	handler = withObjects(handler, a.serverConfig.LongRunningFunc, a.maxObjectSize)
 	handler = genericapifilters.WithAudit(handler, a.serverConfig.AuditBackend, a.serverConfig.AuditPolicyChecker, a.serverConfig.LongRunningFunc)
-	return genericapifilters.WithRequestInfo(handler, a.serverConfig.RequestInfoResolver)
+	return a.withRequestInfo(handler)
 }
 
 // WithUnauthorized will wrap the given handler to inject the request
@@ -78,5 +131,28 @@ func (a *Audit) WithRequest(handler http.Handler) http.Handler {
 // handler.
 func (a *Audit) WithUnauthorized(handler http.Handler) http.Handler {
 	handler = genericapifilters.WithFailedAuthenticationAudit(handler, a.serverConfig.AuditBackend, a.serverConfig.AuditPolicyChecker)
-	return genericapifilters.WithRequestInfo(handler, a.serverConfig.RequestInfoResolver)
+	return a.withRequestInfo(handler)
+}
+
+// withRequestInfo will add the RequestInfo of the request to the context, if
+// not already resolved. Requests whose RequestInfo cannot be resolved are
+// audited as non-resource requests, rather than failing.
+func (a *Audit) withRequestInfo(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if _, ok := genericapirequest.RequestInfoFrom(req.Context()); ok {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		info, err := a.serverConfig.RequestInfoResolver.NewRequestInfo(req)
+		if err != nil {
+			klog.V(4).Infof("failed to resolve request info of %q for audit: %s", req.URL.Path, err)
+			info = &genericapirequest.RequestInfo{
+				Path: req.URL.Path,
+				Verb: strings.ToLower(req.Method),
+			}
+		}
+
+		handler.ServeHTTP(rw, req.WithContext(genericapirequest.WithRequestInfo(req.Context(), info)))
+	})
 }
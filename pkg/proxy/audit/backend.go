@@ -0,0 +1,71 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package audit
+
+import (
+	"sort"
+	"sync"
+
+	k8saudit "k8s.io/apiserver/pkg/audit"
+	"k8s.io/klog"
+
+	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
+)
+
+// BackendFactory builds an audit backend from the proxy audit options. If the
+// backend has not been configured, the factory should return a nil backend
+// and no error.
+type BackendFactory func(opts *options.AuditOptions) (k8saudit.Backend, error)
+
+var (
+	backendFactoriesLock sync.Mutex
+	backendFactories     = make(map[string]BackendFactory)
+)
+
+func init() {
+	RegisterBackend(FileBackendName, newFileBackend)
+	RegisterBackend(SyslogBackendName, newSyslogBackend)
+}
+
+// RegisterBackend registers an audit backend factory under the given name.
+// All registered backends are built when creating a new Audit and are run
+// alongside the log and webhook backends of the API server.
+func RegisterBackend(name string, factory BackendFactory) {
+	backendFactoriesLock.Lock()
+	defer backendFactoriesLock.Unlock()
+
+	if _, ok := backendFactories[name]; ok {
+		klog.Fatalf("audit backend %q was registered twice", name)
+	}
+
+	backendFactories[name] = factory
+}
+
+// newBackends will build all registered backends that have been configured,
+// in name order.
+func newBackends(opts *options.AuditOptions) ([]k8saudit.Backend, error) {
+	backendFactoriesLock.Lock()
+	defer backendFactoriesLock.Unlock()
+
+	var names []string
+	for name := range backendFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var backends []k8saudit.Backend
+	for _, name := range names {
+		backend, err := backendFactories[name](opts)
+		if err != nil {
+			return nil, err
+		}
+
+		if backend == nil {
+			continue
+		}
+
+		klog.V(2).Infof("using registered audit backend: %s", name)
+		backends = append(backends, backend)
+	}
+
+	return backends, nil
+}
@@ -0,0 +1,106 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package audit
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+	"k8s.io/apimachinery/pkg/runtime"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	k8saudit "k8s.io/apiserver/pkg/audit"
+	pluginbuffered "k8s.io/apiserver/plugin/pkg/audit/buffered"
+
+	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
+)
+
+const (
+	FileBackendName = "file"
+)
+
+// fileBackend writes audit events as newline delimited JSON to a writer,
+// usually a rotating file.
+type fileBackend struct {
+	out     io.WriteCloser
+	encoder runtime.Encoder
+	lock    sync.Mutex
+}
+
+var _ k8saudit.Backend = &fileBackend{}
+
+func newFileBackend(opts *options.AuditOptions) (k8saudit.Backend, error) {
+	o := opts.FileOptions
+	if len(o.Path) == 0 {
+		return nil, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(o.Path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create audit file directory: %s", err)
+	}
+
+	out := &lumberjack.Logger{
+		Filename:   o.Path,
+		MaxAge:     o.MaxAge,
+		MaxBackups: o.MaxBackups,
+		MaxSize:    o.MaxSize,
+		Compress:   o.Compress,
+	}
+
+	// Batching does not benefit a file backend, however buffering prevents
+	// slow disks from blocking requests.
+	return pluginbuffered.NewBackend(newFileBackendForWriter(out), pluginbuffered.BatchConfig{
+		BufferSize:   10000,
+		MaxBatchSize: 1,
+	}), nil
+}
+
+func newFileBackendForWriter(out io.WriteCloser) *fileBackend {
+	return &fileBackend{
+		out:     out,
+		encoder: k8saudit.Codecs.LegacyCodec(auditv1.SchemeGroupVersion),
+	}
+}
+
+func (f *fileBackend) ProcessEvents(events ...*auditinternal.Event) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	success := true
+	for _, ev := range events {
+		// The JSON encoder terminates each event with a new line.
+		b, err := runtime.Encode(f.encoder, ev)
+		if err != nil {
+			k8saudit.HandlePluginError(FileBackendName, err, ev)
+			success = false
+			continue
+		}
+
+		if _, err := f.out.Write(b); err != nil {
+			k8saudit.HandlePluginError(FileBackendName, err, ev)
+			success = false
+		}
+	}
+
+	return success
+}
+
+func (f *fileBackend) Run(stopCh <-chan struct{}) error {
+	return nil
+}
+
+func (f *fileBackend) Shutdown() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err := f.out.Close(); err != nil {
+		k8saudit.HandlePluginError(FileBackendName, err)
+	}
+}
+
+func (f *fileBackend) String() string {
+	return FileBackendName
+}
@@ -0,0 +1,49 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+type fakeWriteCloser struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (f *fakeWriteCloser) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestFileBackendProcessEvents(t *testing.T) {
+	out := new(fakeWriteCloser)
+	f := newFileBackendForWriter(out)
+
+	if !f.ProcessEvents(newTestEvent(), newTestEvent()) {
+		t.Fatal("expected events to be processed successfully")
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 newline delimited events, got=%q", out.Bytes())
+	}
+
+	for _, line := range lines {
+		var ev map[string]interface{}
+		if err := json.Unmarshal(line, &ev); err != nil {
+			t.Errorf("failed to decode event line %q: %s", line, err)
+			continue
+		}
+
+		if ev["kind"] != "Event" || ev["apiVersion"] != "audit.k8s.io/v1" {
+			t.Errorf("unexpected event encoding: %v", ev)
+		}
+	}
+
+	f.Shutdown()
+	if !out.closed {
+		t.Error("expected writer to be closed on shutdown")
+	}
+}
@@ -2,7 +2,51 @@
 package audit
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+	k8saudit "k8s.io/apiserver/pkg/audit"
+	genericapifilters "k8s.io/apiserver/pkg/endpoints/filters"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/client-go/transport"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+)
+
+const (
+	// AnnotationRejectionReason is the audit annotation key holding the
+	// reason a request was rejected by the proxy.
+	AnnotationRejectionReason = "kube-oidc-proxy.jetstack.io/rejection-reason"
+
+	// AnnotationImpersonationHeaders is the audit annotation key holding the
+	// impersonation headers given in a request rejected by the proxy.
+	AnnotationImpersonationHeaders = "kube-oidc-proxy.jetstack.io/impersonation-headers"
+
+	// AnnotationBreakGlass is the audit annotation key holding the ID of the
+	// break-glass token used by the request. It is also the user extra key
+	// holding the ID for users authenticated with a break-glass token.
+	AnnotationBreakGlass = "kube-oidc-proxy.jetstack.io/break-glass"
+
+	// AnnotationGrantedGroups is the audit annotation key holding the groups
+	// granted to the user by time-bound grants, used by the request.
+	AnnotationGrantedGroups = "kube-oidc-proxy.jetstack.io/granted-groups"
+
+	// AnnotationRequestObjectOmitted and AnnotationResponseObjectOmitted are
+	// the audit annotation keys set when the request or response body is
+	// omitted from the event for being too large.
+	AnnotationRequestObjectOmitted  = "kube-oidc-proxy.jetstack.io/request-object-omitted"
+	AnnotationResponseObjectOmitted = "kube-oidc-proxy.jetstack.io/response-object-omitted"
 )
 
 // This struct is used to implement an http.Handler interface. This will not
@@ -29,3 +73,285 @@ func NewUnauthenticatedHandler(a *Audit, serveFunc func(http.ResponseWriter, *ht
 func (u *unauthenticatedHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	u.serveFunc(rw, r)
 }
+
+// NewRejectedHandler returns an http.Handler that will serve the given
+// function and audit the request as having been rejected by the proxy for the
+// given reason. A single event will be sent at the ResponseComplete stage,
+// containing the authenticated user if one is present in the request context,
+// along with any impersonation headers the request attempted to use.
+func NewRejectedHandler(a *Audit, reason string, serveFunc func(http.ResponseWriter, *http.Request)) http.Handler {
+	handler := http.Handler(http.HandlerFunc(serveFunc))
+
+	// if auditor is nil then return without wrapping
+	if a == nil {
+		return handler
+	}
+
+	return a.WithRejection(handler, reason)
+}
+
+// WithRejection will wrap the given handler to audit the request as being
+// rejected by the proxy for the given reason.
+func (a *Audit) WithRejection(handler http.Handler, reason string) http.Handler {
+	sink, checker := a.serverConfig.AuditBackend, a.serverConfig.AuditPolicyChecker
+	if sink == nil || checker == nil {
+		return handler
+	}
+
+	rejectedHandler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		attribs, err := genericapifilters.GetAuthorizerAttributes(req.Context())
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("failed to get authorizer attributes for rejected request: %s", err))
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		level, omitStages := checker.LevelAndStages(attribs)
+		if level == auditinternal.LevelNone || stageOmitted(auditinternal.StageResponseComplete, omitStages) {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		ev, err := k8saudit.NewEventFromRequest(req, level, attribs)
+		if err != nil {
+			utilruntime.HandleError(fmt.Errorf("failed to create audit event for rejected request: %s", err))
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		k8saudit.LogAnnotation(ev, AnnotationRejectionReason, reason)
+		if headers := impersonationHeaders(req.Header); len(headers) > 0 {
+			k8saudit.LogAnnotation(ev, AnnotationImpersonationHeaders, headers)
+		}
+		if id, ok := breakGlassTokenID(req); ok {
+			k8saudit.LogAnnotation(ev, AnnotationBreakGlass, id)
+		}
+		if groups := context.GrantedGroups(req); len(groups) > 0 {
+			k8saudit.LogAnnotation(ev, AnnotationGrantedGroups, strings.Join(groups, ","))
+		}
+
+		srw := &statusResponseWriter{ResponseWriter: rw}
+		handler.ServeHTTP(srw, req)
+
+		ev.Stage = auditinternal.StageResponseComplete
+		ev.StageTimestamp = metav1.NewMicroTime(time.Now())
+		ev.ResponseStatus = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    int32(srw.code()),
+			Message: reason,
+		}
+
+		if !sink.ProcessEvents(ev) {
+			utilruntime.HandleError(fmt.Errorf("failed to process audit event for rejected request"))
+		}
+	})
+
+	return a.withRequestInfo(rejectedHandler)
+}
+
+// statusResponseWriter records the status code written to the response.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (s *statusResponseWriter) WriteHeader(code int) {
+	if s.statusCode == 0 {
+		s.statusCode = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusResponseWriter) Write(b []byte) (int, error) {
+	if s.statusCode == 0 {
+		s.statusCode = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *statusResponseWriter) code() int {
+	if s.statusCode == 0 {
+		return http.StatusOK
+	}
+	return s.statusCode
+}
+
+// impersonationHeaders returns the impersonation headers in the given header
+// formatted as a sorted list of key=value pairs.
+func impersonationHeaders(header http.Header) string {
+	var pairs []string
+	for k, vs := range header {
+		lk := strings.ToLower(k)
+		if lk != strings.ToLower(transport.ImpersonateUserHeader) &&
+			lk != strings.ToLower(transport.ImpersonateGroupHeader) &&
+			!strings.HasPrefix(lk, strings.ToLower(transport.ImpersonateUserExtraHeaderPrefix)) {
+			continue
+		}
+
+		for _, v := range vs {
+			pairs = append(pairs, k+"="+v)
+		}
+	}
+
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// withBreakGlass will annotate the audit event of requests authenticated with
+// a break-glass token.
+func withBreakGlass(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if id, ok := breakGlassTokenID(req); ok {
+			if ev := genericapirequest.AuditEventFrom(req.Context()); ev != nil {
+				k8saudit.LogAnnotation(ev, AnnotationBreakGlass, id)
+			}
+		}
+
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// withObjects will log the JSON request and response bodies of requests which
+// are not long-running to the audit event, at the Request and RequestResponse
+// levels respectively, so that they may be redacted before reaching the
+// backends. Compressed and non-JSON bodies are not logged, as they can not be
+// inspected. Bodies larger than the maximum size are not buffered, and are
+// omitted from the event with an annotation.
+func withObjects(handler http.Handler, longRunningCheck genericapirequest.LongRunningRequestCheck, maxSize int64) http.Handler {
+	omitted := fmt.Sprintf("larger than %d bytes", maxSize)
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ev := genericapirequest.AuditEventFrom(req.Context())
+		if ev == nil || ev.Level.Less(auditinternal.LevelRequest) {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		if info, ok := genericapirequest.RequestInfoFrom(req.Context()); ok &&
+			longRunningCheck != nil && longRunningCheck(req, info) {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		if req.Body != nil && isJSONBody(req.Header) {
+			body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxSize+1))
+			switch {
+			case err != nil:
+				utilruntime.HandleError(fmt.Errorf("failed to read request body for audit: %s", err))
+			case int64(len(body)) > maxSize:
+				k8saudit.LogAnnotation(ev, AnnotationRequestObjectOmitted, omitted)
+			case len(body) > 0:
+				ev.RequestObject = &runtime.Unknown{
+					Raw:         body,
+					ContentType: runtime.ContentTypeJSON,
+				}
+			}
+
+			// Pass on the body read so far, followed by the rest of the body.
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		}
+
+		if ev.Level.Less(auditinternal.LevelRequestResponse) {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		orw := &objectResponseWriter{ResponseWriter: rw, maxSize: maxSize}
+		handler.ServeHTTP(orw, req)
+
+		if orw.omitted {
+			k8saudit.LogAnnotation(ev, AnnotationResponseObjectOmitted, omitted)
+		}
+
+		if orw.capture && orw.body.Len() > 0 {
+			ev.ResponseObject = &runtime.Unknown{
+				Raw:         orw.body.Bytes(),
+				ContentType: runtime.ContentTypeJSON,
+			}
+		}
+	})
+}
+
+// isJSONBody returns whether the header describes an uncompressed JSON body,
+// including JSON patches.
+func isJSONBody(header http.Header) bool {
+	if len(header.Get("Content-Encoding")) > 0 {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	return mediaType == runtime.ContentTypeJSON || strings.HasSuffix(mediaType, "+json")
+}
+
+// objectResponseWriter records a copy of the JSON body written to the
+// response, until the body exceeds the maximum size.
+type objectResponseWriter struct {
+	http.ResponseWriter
+	maxSize     int64
+	wroteHeader bool
+	capture     bool
+	omitted     bool
+	body        bytes.Buffer
+}
+
+func (o *objectResponseWriter) WriteHeader(code int) {
+	if !o.wroteHeader {
+		o.wroteHeader = true
+		o.capture = isJSONBody(o.Header())
+	}
+	o.ResponseWriter.WriteHeader(code)
+}
+
+func (o *objectResponseWriter) Write(b []byte) (int, error) {
+	if !o.wroteHeader {
+		o.WriteHeader(http.StatusOK)
+	}
+	if o.capture {
+		if int64(o.body.Len()+len(b)) > o.maxSize {
+			o.capture, o.omitted = false, true
+			o.body = bytes.Buffer{}
+		} else {
+			o.body.Write(b)
+		}
+	}
+	return o.ResponseWriter.Write(b)
+}
+
+func (o *objectResponseWriter) Flush() {
+	if flusher, ok := o.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// breakGlassTokenID returns the ID of the break-glass token the user of the
+// request was authenticated with, if any.
+func breakGlassTokenID(req *http.Request) (string, bool) {
+	u, ok := genericapirequest.UserFrom(req.Context())
+	if !ok {
+		return "", false
+	}
+
+	ids, ok := u.GetExtra()[AnnotationBreakGlass]
+	if !ok || len(ids) == 0 {
+		return "", false
+	}
+
+	return ids[0], true
+}
+
+func stageOmitted(stage auditinternal.Stage, omitStages []auditinternal.Stage) bool {
+	for _, s := range omitStages {
+		if s == stage {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,324 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package audit
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+	"k8s.io/apiserver/pkg/audit/policy"
+	"k8s.io/apiserver/pkg/authentication/user"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/server"
+	genericfilters "k8s.io/apiserver/pkg/server/filters"
+	fakeaudit "k8s.io/apiserver/plugin/pkg/audit/fake"
+)
+
+func newTestAudit(backend *fakeaudit.Backend, level auditinternal.Level) *Audit {
+	completed := (&server.Config{
+		ExternalAddress:        "0.0.0.0:1234",
+		LegacyAPIGroupPrefixes: sets.NewString(server.DefaultLegacyAPIPrefix),
+		AuditBackend:           backend,
+		AuditPolicyChecker:     policy.FakeChecker(level, nil),
+	}).Complete(nil)
+
+	return &Audit{
+		serverConfig:  &completed,
+		maxObjectSize: 1024,
+	}
+}
+
+func TestRejectedHandler(t *testing.T) {
+	var events []*auditinternal.Event
+	backend := &fakeaudit.Backend{
+		OnRequest: func(evs []*auditinternal.Event) {
+			events = append(events, evs...)
+		},
+	}
+
+	handler := NewRejectedHandler(newTestAudit(backend, auditinternal.LevelMetadata), "a reason",
+		func(rw http.ResponseWriter, req *http.Request) {
+			http.Error(rw, "forbidden", http.StatusForbidden)
+		})
+
+	req := httptest.NewRequest("GET", "/api/v1/namespaces/foo/pods", nil)
+	req.Header.Set("Impersonate-User", "bob")
+	req.Header.Add("Impersonate-Group", "system:masters")
+	req = req.WithContext(genericapirequest.WithUser(req.Context(),
+		&user.DefaultInfo{Name: "alice", Groups: []string{"group-a"}}))
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusForbidden {
+		t.Errorf("unexpected response code, exp=%d got=%d", http.StatusForbidden, rw.Code)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("expected a single audit event, got=%d", len(events))
+	}
+	ev := events[0]
+
+	if ev.Stage != auditinternal.StageResponseComplete {
+		t.Errorf("unexpected audit stage, exp=%s got=%s", auditinternal.StageResponseComplete, ev.Stage)
+	}
+
+	if ev.User.Username != "alice" {
+		t.Errorf("unexpected audit user, exp=alice got=%s", ev.User.Username)
+	}
+
+	if ev.ResponseStatus == nil || ev.ResponseStatus.Code != http.StatusForbidden {
+		t.Errorf("unexpected audit response status: %v", ev.ResponseStatus)
+	}
+
+	if reason := ev.Annotations[AnnotationRejectionReason]; reason != "a reason" {
+		t.Errorf("unexpected rejection reason annotation, exp=%q got=%q", "a reason", reason)
+	}
+
+	expHeaders := "Impersonate-Group=system:masters, Impersonate-User=bob"
+	if headers := ev.Annotations[AnnotationImpersonationHeaders]; headers != expHeaders {
+		t.Errorf("unexpected impersonation headers annotation, exp=%q got=%q", expHeaders, headers)
+	}
+}
+
+func TestRejectedHandlerLevelNone(t *testing.T) {
+	var events []*auditinternal.Event
+	backend := &fakeaudit.Backend{
+		OnRequest: func(evs []*auditinternal.Event) {
+			events = append(events, evs...)
+		},
+	}
+
+	served := false
+	handler := NewRejectedHandler(newTestAudit(backend, auditinternal.LevelNone), "a reason",
+		func(rw http.ResponseWriter, req *http.Request) {
+			served = true
+		})
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api", nil))
+
+	if !served {
+		t.Error("expected rejected handler to be served")
+	}
+
+	if len(events) != 0 {
+		t.Errorf("expected no audit events, got=%d", len(events))
+	}
+}
+
+func TestBreakGlassAnnotation(t *testing.T) {
+	var events []*auditinternal.Event
+	backend := &fakeaudit.Backend{
+		OnRequest: func(evs []*auditinternal.Event) {
+			events = append(events, evs...)
+		},
+	}
+
+	a := newTestAudit(backend, auditinternal.LevelMetadata)
+
+	tests := map[string]struct {
+		handler http.Handler
+		extra   map[string][]string
+		expID   string
+	}{
+		"a request without a break-glass token should not be annotated": {
+			handler: a.WithRequest(http.NotFoundHandler()),
+		},
+		"a request with a break-glass token should be annotated": {
+			handler: a.WithRequest(http.NotFoundHandler()),
+			extra:   map[string][]string{AnnotationBreakGlass: []string{"token-1"}},
+			expID:   "token-1",
+		},
+		"a rejected request with a break-glass token should be annotated": {
+			handler: NewRejectedHandler(a, "a reason", func(rw http.ResponseWriter, req *http.Request) {
+				http.Error(rw, "forbidden", http.StatusForbidden)
+			}),
+			extra: map[string][]string{AnnotationBreakGlass: []string{"token-1"}},
+			expID: "token-1",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			events = nil
+
+			req := httptest.NewRequest("GET", "/api/v1/namespaces/foo/pods", nil)
+			req = req.WithContext(genericapirequest.WithUser(req.Context(),
+				&user.DefaultInfo{Name: "break-glass:alice", Extra: test.extra}))
+
+			test.handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if len(events) == 0 {
+				t.Fatal("expected audit events")
+			}
+
+			for _, ev := range events {
+				if id := ev.Annotations[AnnotationBreakGlass]; id != test.expID {
+					t.Errorf("unexpected break-glass annotation at stage %s, exp=%q got=%q",
+						ev.Stage, test.expID, id)
+				}
+			}
+		})
+	}
+}
+
+func TestObjectsTooLarge(t *testing.T) {
+	var events []*auditinternal.Event
+	backend := &fakeaudit.Backend{
+		OnRequest: func(evs []*auditinternal.Event) {
+			events = append(events, evs...)
+		},
+	}
+
+	a := newTestAudit(backend, auditinternal.LevelRequestResponse)
+	a.maxObjectSize = 8
+
+	reqBody, respBody := `{"a":"bcdefgh"}`, `{"c":"d"}`
+
+	handler := a.WithRequest(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The whole request body should still be passed on.
+		if string(body) != reqBody {
+			t.Errorf("unexpected request body passed to handler, exp=%s got=%s", reqBody, body)
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write([]byte(respBody[:4]))
+		rw.Write([]byte(respBody[4:]))
+	}))
+
+	req := httptest.NewRequest("POST", "/api/v1/namespaces/foo/pods", strings.NewReader(reqBody))
+	req.Header.Set("Content-Type", "application/json")
+	req = req.WithContext(genericapirequest.WithUser(req.Context(), &user.DefaultInfo{Name: "alice"}))
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	if rw.Body.String() != respBody {
+		t.Errorf("unexpected response body, exp=%s got=%s", respBody, rw.Body.String())
+	}
+
+	if len(events) == 0 {
+		t.Fatal("expected audit events")
+	}
+	ev := events[len(events)-1]
+
+	if ev.RequestObject != nil || ev.ResponseObject != nil {
+		t.Errorf("expected request and response objects to be omitted, got=%v %v", ev.RequestObject, ev.ResponseObject)
+	}
+
+	for _, key := range []string{AnnotationRequestObjectOmitted, AnnotationResponseObjectOmitted} {
+		if exp := "larger than 8 bytes"; ev.Annotations[key] != exp {
+			t.Errorf("unexpected %s annotation, exp=%q got=%q", key, exp, ev.Annotations[key])
+		}
+	}
+}
+
+func TestObjects(t *testing.T) {
+	tests := map[string]struct {
+		level           auditinternal.Level
+		path            string
+		contentType     string
+		contentEncoding string
+		expRequest      bool
+		expResponse     bool
+	}{
+		"metadata level should not log bodies": {
+			level:       auditinternal.LevelMetadata,
+			path:        "/api/v1/namespaces/foo/pods/a",
+			contentType: "application/json",
+		},
+		"request level should log the request body": {
+			level:       auditinternal.LevelRequest,
+			path:        "/api/v1/namespaces/foo/pods/a",
+			contentType: "application/json",
+			expRequest:  true,
+		},
+		"request response level should log both bodies": {
+			level:       auditinternal.LevelRequestResponse,
+			path:        "/api/v1/namespaces/foo/pods/a",
+			contentType: "application/merge-patch+json",
+			expRequest:  true,
+			expResponse: true,
+		},
+		"protobuf bodies should not be logged": {
+			level:       auditinternal.LevelRequestResponse,
+			path:        "/api/v1/namespaces/foo/pods/a",
+			contentType: "application/vnd.kubernetes.protobuf",
+		},
+		"compressed bodies should not be logged": {
+			level:           auditinternal.LevelRequestResponse,
+			path:            "/api/v1/namespaces/foo/pods/a",
+			contentType:     "application/json",
+			contentEncoding: "gzip",
+		},
+		"long-running requests should not log bodies": {
+			level:       auditinternal.LevelRequestResponse,
+			path:        "/api/v1/namespaces/foo/pods/a/exec",
+			contentType: "application/json",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var events []*auditinternal.Event
+			backend := &fakeaudit.Backend{
+				OnRequest: func(evs []*auditinternal.Event) {
+					events = append(events, evs...)
+				},
+			}
+
+			a := newTestAudit(backend, test.level)
+			a.serverConfig.LongRunningFunc = genericfilters.BasicLongRunningRequestCheck(
+				sets.NewString("watch"), sets.NewString("exec"))
+
+			handler := a.WithRequest(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				body, err := ioutil.ReadAll(req.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if string(body) != `{"a":"b"}` {
+					t.Errorf("unexpected request body passed to handler, got=%s", body)
+				}
+
+				rw.Header().Set("Content-Type", test.contentType)
+				rw.Header().Set("Content-Encoding", test.contentEncoding)
+				rw.Write([]byte(`{"c":"d"}`))
+			}))
+
+			req := httptest.NewRequest("POST", test.path, strings.NewReader(`{"a":"b"}`))
+			req.Header.Set("Content-Type", test.contentType)
+			req.Header.Set("Content-Encoding", test.contentEncoding)
+			req = req.WithContext(genericapirequest.WithUser(req.Context(), &user.DefaultInfo{Name: "alice"}))
+
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, req)
+
+			if rw.Body.String() != `{"c":"d"}` {
+				t.Errorf("unexpected response body, got=%s", rw.Body.String())
+			}
+
+			if len(events) == 0 {
+				t.Fatal("expected audit events")
+			}
+			ev := events[len(events)-1]
+
+			if (ev.RequestObject != nil) != test.expRequest {
+				t.Errorf("unexpected request object, exp=%t got=%v", test.expRequest, ev.RequestObject)
+			}
+
+			if (ev.ResponseObject != nil) != test.expResponse {
+				t.Errorf("unexpected response object, exp=%t got=%v", test.expResponse, ev.ResponseObject)
+			}
+		})
+	}
+}
@@ -0,0 +1,406 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+	k8saudit "k8s.io/apiserver/pkg/audit"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// AnnotationRedacted is the audit annotation key set when a request or
+	// response body of the event has been redacted.
+	AnnotationRedacted = "kube-oidc-proxy.jetstack.io/redacted"
+
+	// redactedValue replaces any redacted values in request or response
+	// bodies.
+	redactedValue = "REDACTED"
+)
+
+// RedactionRule describes request and response bodies that should be redacted
+// before audit events reach the audit backends. Redaction rules are given in
+// the audit policy file, under the top level `redactionRules` field.
+type RedactionRule struct {
+	// Group is the API group of the resources. The empty string represents
+	// the core API group.
+	Group string `json:"group"`
+
+	// Resources is a list of resources this rule applies to.
+	Resources []string `json:"resources"`
+
+	// ResourceNames, if given, restricts this rule to objects with these
+	// names.
+	ResourceNames []string `json:"resourceNames,omitempty"`
+
+	// LabelSelector, if given, restricts this rule to objects whose labels
+	// match the selector. As the labels of patched objects are not known,
+	// patch request bodies are redacted regardless of the selector.
+	LabelSelector string `json:"labelSelector,omitempty"`
+
+	// Paths is a list of dot separated JSON paths whose values are redacted.
+	// A `*` path element matches any key of an object or element of an
+	// array. If no paths are given, the whole body is redacted.
+	Paths []string `json:"paths,omitempty"`
+}
+
+// redactionPolicy is the audit policy file extension containing the
+// redaction rules.
+type redactionPolicy struct {
+	RedactionRules []RedactionRule `json:"redactionRules"`
+}
+
+type redactionRule struct {
+	group     string
+	resources map[string]bool
+	names     sets.String
+	selector  labels.Selector
+	paths     [][]string
+}
+
+// redactingBackend wraps an audit backend to redact the request and response
+// bodies of events matching the redaction rules.
+type redactingBackend struct {
+	k8saudit.Backend
+	rules []*redactionRule
+}
+
+var _ k8saudit.Backend = &redactingBackend{}
+
+// loadRedactionRules will load the redaction rules from the audit policy
+// file.
+func loadRedactionRules(filePath string) ([]*redactionRule, error) {
+	b, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit policy file %q: %s", filePath, err)
+	}
+
+	var p redactionPolicy
+	if err := yaml.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("failed to decode redaction rules from audit policy file %q: %s",
+			filePath, err)
+	}
+
+	return compileRedactionRules(p.RedactionRules)
+}
+
+func compileRedactionRules(rules []RedactionRule) ([]*redactionRule, error) {
+	var compiled []*redactionRule
+
+	for i, rule := range rules {
+		if len(rule.Resources) == 0 {
+			return nil, fmt.Errorf("redaction rule %d must contain at least one resource", i)
+		}
+
+		r := &redactionRule{
+			group:     rule.Group,
+			resources: make(map[string]bool),
+			names:     sets.NewString(rule.ResourceNames...),
+			selector:  labels.Everything(),
+		}
+
+		for _, resource := range rule.Resources {
+			r.resources[resource] = true
+		}
+
+		if len(rule.LabelSelector) > 0 {
+			selector, err := labels.Parse(rule.LabelSelector)
+			if err != nil {
+				return nil, fmt.Errorf("redaction rule %d has an invalid label selector: %s", i, err)
+			}
+			r.selector = selector
+		}
+
+		for _, path := range rule.Paths {
+			if len(path) == 0 {
+				return nil, fmt.Errorf("redaction rule %d contains an empty path", i)
+			}
+			r.paths = append(r.paths, strings.Split(path, "."))
+		}
+
+		compiled = append(compiled, r)
+	}
+
+	return compiled, nil
+}
+
+func newRedactingBackend(delegate k8saudit.Backend, rules []*redactionRule) k8saudit.Backend {
+	return &redactingBackend{
+		Backend: delegate,
+		rules:   rules,
+	}
+}
+
+func (r *redactingBackend) ProcessEvents(events ...*auditinternal.Event) bool {
+	redacted := make([]*auditinternal.Event, len(events))
+
+	for i, ev := range events {
+		redacted[i] = r.redactEvent(ev)
+	}
+
+	return r.Backend.ProcessEvents(redacted...)
+}
+
+// redactEvent returns the event with its bodies redacted. Events must not be
+// mutated by backends, so a copy is returned if any redaction is needed.
+func (r *redactingBackend) redactEvent(ev *auditinternal.Event) *auditinternal.Event {
+	if ev.ObjectRef == nil || (ev.RequestObject == nil && ev.ResponseObject == nil) {
+		return ev
+	}
+
+	rules := r.matchingRules(ev.ObjectRef)
+	if len(rules) == 0 {
+		return ev
+	}
+
+	ev = ev.DeepCopy()
+	var redacted bool
+
+	if ev.RequestObject != nil {
+		ev.RequestObject, redacted = redactObject(ev.RequestObject, ev.ObjectRef, rules, ev.Verb == "patch")
+	}
+
+	if ev.ResponseObject != nil {
+		var respRedacted bool
+		ev.ResponseObject, respRedacted = redactObject(ev.ResponseObject, ev.ObjectRef, rules, false)
+		redacted = redacted || respRedacted
+	}
+
+	if redacted {
+		k8saudit.LogAnnotation(ev, AnnotationRedacted, "true")
+	}
+
+	return ev
+}
+
+func (r *redactingBackend) matchingRules(ref *auditinternal.ObjectReference) []*redactionRule {
+	var rules []*redactionRule
+	for _, rule := range r.rules {
+		if rule.group == ref.APIGroup && rule.resources[ref.Resource] {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules
+}
+
+func (r *redactingBackend) String() string {
+	return fmt.Sprintf("redacting<%s>", r.Backend)
+}
+
+// redactObject will redact the given object using the rules. Non JSON
+// objects are removed entirely, as they can not be inspected. The labels of a
+// patch body are not those of the patched object, so patches are matched by
+// the resource and name of the object reference only.
+func redactObject(obj *runtime.Unknown, ref *auditinternal.ObjectReference, rules []*redactionRule, patch bool) (*runtime.Unknown, bool) {
+	if len(obj.ContentType) > 0 && obj.ContentType != runtime.ContentTypeJSON {
+		return nil, true
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(obj.Raw, &body); err != nil {
+		return nil, true
+	}
+
+	var redacted bool
+
+	// Apply the rules to each item if this is a list, or each row if this is
+	// a table.
+	rows, isTable := body["rows"].([]interface{})
+	isTable = isTable && body["kind"] == "Table"
+
+	if items, ok := body["items"].([]interface{}); ok {
+		for i, item := range items {
+			itemMap, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			name, lbls := objectMeta(itemMap, "")
+			result, itemRedacted := redactBody(itemMap, rules, name, lbls)
+			if result == nil {
+				result = redactedValue
+			}
+
+			items[i] = result
+			redacted = redacted || itemRedacted
+		}
+	} else if isTable {
+		for _, row := range rows {
+			rowMap, ok := row.(map[string]interface{})
+			if !ok {
+				continue
+			}
+
+			if redactRow(rowMap, rules) {
+				redacted = true
+			}
+		}
+	} else {
+		name, lbls := objectMeta(body, ref.Name)
+		if patch {
+			name, lbls = ref.Name, nil
+		}
+
+		var result interface{}
+		result, redacted = redactBody(body, rules, name, lbls)
+		if result == nil {
+			return nil, true
+		}
+	}
+
+	if !redacted {
+		return obj, false
+	}
+
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return nil, true
+	}
+
+	obj.Raw = raw
+	return obj, true
+}
+
+// redactBody applies the rules matching the name and labels of the body. If a
+// matching rule has no paths, nil is returned.
+func redactBody(body map[string]interface{}, rules []*redactionRule, name string, lbls labels.Set) (interface{}, bool) {
+	var redacted bool
+
+	for _, rule := range rules {
+		if !rule.matches(name, lbls) {
+			continue
+		}
+
+		if len(rule.paths) == 0 {
+			return nil, true
+		}
+
+		for _, path := range rule.paths {
+			if redactPath(body, path) {
+				redacted = true
+			}
+		}
+	}
+
+	return body, redacted
+}
+
+// redactRow redacts a row of a table response. The cells of a matching row can
+// not be mapped to paths, so are always redacted. Rows which do not include
+// their object have no known name or labels, so match every rule.
+func redactRow(row map[string]interface{}, rules []*redactionRule) bool {
+	var (
+		name string
+		lbls labels.Set
+	)
+
+	obj, hasObj := row["object"].(map[string]interface{})
+	if hasObj {
+		name, lbls = objectMeta(obj, "")
+	}
+
+	var matched bool
+	for _, rule := range rules {
+		if rule.matches(name, lbls) {
+			matched = true
+			break
+		}
+	}
+
+	if !matched {
+		return false
+	}
+
+	if cells, ok := row["cells"].([]interface{}); ok {
+		for i := range cells {
+			cells[i] = redactedValue
+		}
+	}
+
+	if hasObj {
+		if result, _ := redactBody(obj, rules, name, lbls); result == nil {
+			row["object"] = redactedValue
+		}
+	}
+
+	return true
+}
+
+// matches returns whether the rule applies to an object with the given name
+// and labels. An empty name or nil labels are unknown, so always match.
+func (r *redactionRule) matches(name string, lbls labels.Set) bool {
+	if len(name) > 0 && r.names.Len() > 0 && !r.names.Has(name) {
+		return false
+	}
+
+	return lbls == nil || r.selector.Matches(lbls)
+}
+
+// redactPath replaces all values found at the path with the redacted value.
+func redactPath(value interface{}, path []string) bool {
+	var redacted bool
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k := range v {
+			if path[0] != "*" && path[0] != k {
+				continue
+			}
+
+			if len(path) == 1 {
+				v[k] = redactedValue
+				redacted = true
+			} else if redactPath(v[k], path[1:]) {
+				redacted = true
+			}
+		}
+
+	case []interface{}:
+		if path[0] != "*" {
+			return false
+		}
+
+		for i := range v {
+			if len(path) == 1 {
+				v[i] = redactedValue
+				redacted = true
+			} else if redactPath(v[i], path[1:]) {
+				redacted = true
+			}
+		}
+	}
+
+	return redacted
+}
+
+// objectMeta returns the name and labels of the body, with the given name if
+// the body has none.
+func objectMeta(body map[string]interface{}, defaultName string) (string, labels.Set) {
+	name, lbls := defaultName, make(labels.Set)
+
+	metadata, ok := body["metadata"].(map[string]interface{})
+	if !ok {
+		return name, lbls
+	}
+
+	if n, ok := metadata["name"].(string); ok && len(n) > 0 {
+		name = n
+	}
+
+	rawLabels, _ := metadata["labels"].(map[string]interface{})
+	for k, v := range rawLabels {
+		if s, ok := v.(string); ok {
+			lbls[k] = s
+		}
+	}
+
+	return name, lbls
+}
@@ -0,0 +1,365 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+	"k8s.io/apiserver/pkg/authentication/user"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/server"
+	apiserveroptions "k8s.io/apiserver/pkg/server/options"
+	fakeaudit "k8s.io/apiserver/plugin/pkg/audit/fake"
+
+	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
+)
+
+func TestLoadRedactionRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-oidc-proxy-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	policyFile := filepath.Join(dir, "policy.yaml")
+	if err := ioutil.WriteFile(policyFile, []byte(`
+apiVersion: audit.k8s.io/v1
+kind: Policy
+rules:
+- level: RequestResponse
+redactionRules:
+- resources: ["secrets"]
+- resources: ["configmaps"]
+  labelSelector: "credentials=true"
+  paths: ["data.*"]
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := loadRedactionRules(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rules) != 2 {
+		t.Fatalf("expected 2 redaction rules, got=%d", len(rules))
+	}
+
+	if !rules[0].resources["secrets"] || len(rules[0].paths) != 0 {
+		t.Errorf("unexpected first redaction rule: %+v", rules[0])
+	}
+
+	if exp := [][]string{{"data", "*"}}; !reflect.DeepEqual(rules[1].paths, exp) {
+		t.Errorf("unexpected redaction paths, exp=%v got=%v", exp, rules[1].paths)
+	}
+
+	if _, err := compileRedactionRules([]RedactionRule{{Resources: []string{"pods"}, LabelSelector: "!!"}}); err == nil {
+		t.Error("expected error for invalid label selector")
+	}
+
+	if _, err := compileRedactionRules([]RedactionRule{{}}); err == nil {
+		t.Error("expected error for rule with no resources")
+	}
+}
+
+func TestRedactingBackend(t *testing.T) {
+	rules, err := compileRedactionRules([]RedactionRule{
+		{
+			Resources: []string{"secrets"},
+		},
+		{
+			Resources:     []string{"configmaps"},
+			LabelSelector: "credentials=true",
+			Paths:         []string{"data.*", "metadata.annotations.token"},
+		},
+		{
+			Group:         "example.com",
+			Resources:     []string{"credentials"},
+			ResourceNames: []string{"db"},
+			Paths:         []string{"spec.password"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newEvent := func(resource, body string) *auditinternal.Event {
+		return &auditinternal.Event{
+			Level:     auditinternal.LevelRequestResponse,
+			Stage:     auditinternal.StageResponseComplete,
+			ObjectRef: &auditinternal.ObjectReference{Resource: resource},
+			RequestObject: &runtime.Unknown{
+				Raw:         []byte(body),
+				ContentType: runtime.ContentTypeJSON,
+			},
+		}
+	}
+
+	newPatchEvent := func(resource, name, body string) *auditinternal.Event {
+		ev := newEvent(resource, body)
+		ev.Verb = "patch"
+		ev.ObjectRef.Name = name
+		return ev
+	}
+
+	newCredentialEvent := func(name, body string) *auditinternal.Event {
+		ev := newEvent("credentials", body)
+		ev.ObjectRef.APIGroup = "example.com"
+		ev.ObjectRef.Name = name
+		return ev
+	}
+
+	tests := map[string]struct {
+		event       *auditinternal.Event
+		expBody     string
+		expRedacted bool
+	}{
+		"a resource with no rules should not be redacted": {
+			event:   newEvent("pods", `{"metadata":{"name":"foo"}}`),
+			expBody: `{"metadata":{"name":"foo"}}`,
+		},
+		"a secret should be redacted entirely": {
+			event:       newEvent("secrets", `{"data":{"a":"b"}}`),
+			expRedacted: true,
+		},
+		"a config map not matching the label selector should not be redacted": {
+			event:   newEvent("configmaps", `{"metadata":{"labels":{"credentials":"false"}},"data":{"a":"b"}}`),
+			expBody: `{"metadata":{"labels":{"credentials":"false"}},"data":{"a":"b"}}`,
+		},
+		"a config map matching the label selector should have paths redacted": {
+			event: newEvent("configmaps",
+				`{"metadata":{"labels":{"credentials":"true"},"annotations":{"token":"abc","foo":"bar"}},"data":{"a":"b","c":"d"}}`),
+			expBody:     `{"metadata":{"labels":{"credentials":"true"},"annotations":{"token":"REDACTED","foo":"bar"}},"data":{"a":"REDACTED","c":"REDACTED"}}`,
+			expRedacted: true,
+		},
+		"a config map list should have matching items redacted": {
+			event: newEvent("configmaps",
+				`{"kind":"ConfigMapList","items":[{"metadata":{"labels":{"credentials":"true"}},"data":{"a":"b"}},{"data":{"c":"d"}}]}`),
+			expBody:     `{"kind":"ConfigMapList","items":[{"metadata":{"labels":{"credentials":"true"}},"data":{"a":"REDACTED"}},{"data":{"c":"d"}}]}`,
+			expRedacted: true,
+		},
+		"a config map table should have matching rows redacted": {
+			event: newEvent("configmaps",
+				`{"kind":"Table","rows":[{"cells":["a",1],"object":{"metadata":{"name":"a","labels":{"credentials":"true"}},"data":{"a":"b"}}},{"cells":["b",1],"object":{"metadata":{"name":"b"},"data":{"c":"d"}}}]}`),
+			expBody:     `{"kind":"Table","rows":[{"cells":["REDACTED","REDACTED"],"object":{"metadata":{"name":"a","labels":{"credentials":"true"}},"data":{"a":"REDACTED"}}},{"cells":["b",1],"object":{"metadata":{"name":"b"},"data":{"c":"d"}}}]}`,
+			expRedacted: true,
+		},
+		"a config map table without objects should have every row redacted": {
+			event:       newEvent("configmaps", `{"kind":"Table","rows":[{"cells":["a",1]}]}`),
+			expBody:     `{"kind":"Table","rows":[{"cells":["REDACTED","REDACTED"]}]}`,
+			expRedacted: true,
+		},
+		"a secret table should have row objects removed": {
+			event:       newEvent("secrets", `{"kind":"Table","rows":[{"cells":["a","Opaque"],"object":{"metadata":{"name":"a"},"data":{"a":"b"}}}]}`),
+			expBody:     `{"kind":"Table","rows":[{"cells":["REDACTED","REDACTED"],"object":"REDACTED"}]}`,
+			expRedacted: true,
+		},
+		"a config map patch should have paths redacted regardless of labels": {
+			event:       newPatchEvent("configmaps", "a", `{"data":{"a":"b"}}`),
+			expBody:     `{"data":{"a":"REDACTED"}}`,
+			expRedacted: true,
+		},
+		"a credential with a matching name should have paths redacted": {
+			event:       newCredentialEvent("db", `{"metadata":{"name":"db"},"spec":{"password":"a","user":"b"}}`),
+			expBody:     `{"metadata":{"name":"db"},"spec":{"password":"REDACTED","user":"b"}}`,
+			expRedacted: true,
+		},
+		"a credential with another name should not be redacted": {
+			event:   newCredentialEvent("cache", `{"metadata":{"name":"cache"},"spec":{"password":"a"}}`),
+			expBody: `{"metadata":{"name":"cache"},"spec":{"password":"a"}}`,
+		},
+		"a credential without a name in its body should be matched by the name of the object reference": {
+			event:       newCredentialEvent("db", `{"spec":{"password":"a"}}`),
+			expBody:     `{"spec":{"password":"REDACTED"}}`,
+			expRedacted: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var events []*auditinternal.Event
+			backend := newRedactingBackend(&fakeaudit.Backend{
+				OnRequest: func(evs []*auditinternal.Event) {
+					events = append(events, evs...)
+				},
+			}, rules)
+
+			original := test.event.DeepCopy()
+			backend.ProcessEvents(test.event)
+
+			if !reflect.DeepEqual(original, test.event) {
+				t.Error("expected original event to not be mutated")
+			}
+
+			if len(events) != 1 {
+				t.Fatalf("expected 1 event, got=%d", len(events))
+			}
+			ev := events[0]
+
+			if redacted := ev.Annotations[AnnotationRedacted] == "true"; redacted != test.expRedacted {
+				t.Errorf("unexpected redacted annotation, exp=%t got=%t", test.expRedacted, redacted)
+			}
+
+			if len(test.expBody) == 0 {
+				if ev.RequestObject != nil {
+					t.Errorf("expected request object to be removed, got=%s", ev.RequestObject.Raw)
+				}
+				return
+			}
+
+			var exp, got interface{}
+			if err := json.Unmarshal([]byte(test.expBody), &exp); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(ev.RequestObject.Raw, &got); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(exp, got) {
+				t.Errorf("unexpected request object, exp=%s got=%s", test.expBody, ev.RequestObject.Raw)
+			}
+		})
+	}
+}
+
+func TestRedactionThroughHandlers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-oidc-proxy-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	policyFile := filepath.Join(dir, "policy.yaml")
+	if err := ioutil.WriteFile(policyFile, []byte(`
+apiVersion: audit.k8s.io/v1
+kind: Policy
+omitStages: ["RequestReceived"]
+rules:
+- level: RequestResponse
+redactionRules:
+- resources: ["secrets"]
+- resources: ["configmaps"]
+  paths: ["data.*"]
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := &options.AuditOptions{AuditOptions: apiserveroptions.NewAuditOptions()}
+	opts.PolicyFile = policyFile
+	opts.MaxObjectSize = 1024
+	opts.FileOptions.Path = filepath.Join(dir, "audit.log")
+
+	a, err := New(opts, "0.0.0.0:1234", new(server.SecureServingInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopCh := make(chan struct{})
+	if err := a.Run(stopCh); err != nil {
+		t.Fatal(err)
+	}
+
+	// The upstream echoes the request body as the response.
+	handler := a.WithRequest(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+		}
+
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write(body)
+	}))
+
+	requests := map[string]string{
+		"/api/v1/namespaces/foo/pods/a":       `{"metadata":{"name":"a"},"spec":{"nodeName":"b"}}`,
+		"/api/v1/namespaces/foo/secrets/a":    `{"metadata":{"name":"a"},"data":{"password":"c2VjcmV0"}}`,
+		"/api/v1/namespaces/foo/configmaps/a": `{"metadata":{"name":"a"},"data":{"password":"secret"}}`,
+	}
+
+	for path, body := range requests {
+		req := httptest.NewRequest(http.MethodPut, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req = req.WithContext(genericapirequest.WithUser(req.Context(), &user.DefaultInfo{Name: "alice"}))
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		// Only audit events are redacted, not the request or response.
+		if rw.Body.String() != body {
+			t.Errorf("unexpected response body, exp=%s got=%s", body, rw.Body.String())
+		}
+	}
+
+	// Flush the buffered file backend.
+	close(stopCh)
+	a.Shutdown()
+
+	log, err := ioutil.ReadFile(opts.FileOptions.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type object struct {
+		Data map[string]string `json:"data"`
+		Spec map[string]string `json:"spec"`
+	}
+
+	type event struct {
+		ObjectRef struct {
+			Resource string `json:"resource"`
+		} `json:"objectRef"`
+		Annotations    map[string]string `json:"annotations"`
+		RequestObject  *object           `json:"requestObject"`
+		ResponseObject *object           `json:"responseObject"`
+	}
+
+	events := make(map[string]event)
+	for _, line := range bytes.Split(bytes.TrimSpace(log), []byte("\n")) {
+		var ev event
+		if err := json.Unmarshal(line, &ev); err != nil {
+			t.Fatal(err)
+		}
+		events[ev.ObjectRef.Resource] = ev
+	}
+
+	if len(events) != 3 {
+		t.Fatalf("expected events for 3 resources, got=%s", log)
+	}
+
+	pod := events["pods"]
+	if pod.RequestObject == nil || pod.ResponseObject == nil ||
+		pod.RequestObject.Spec["nodeName"] != "b" || pod.ResponseObject.Spec["nodeName"] != "b" {
+		t.Errorf("expected pod request and response objects to be logged, got=%s", log)
+	}
+	if _, ok := pod.Annotations[AnnotationRedacted]; ok {
+		t.Error("expected pod event to not be redacted")
+	}
+
+	secret := events["secrets"]
+	if secret.RequestObject != nil || secret.ResponseObject != nil {
+		t.Errorf("expected secret request and response objects to be removed, got=%s", log)
+	}
+	if secret.Annotations[AnnotationRedacted] != "true" {
+		t.Error("expected secret event to be annotated as redacted")
+	}
+
+	configMap := events["configmaps"]
+	if configMap.RequestObject == nil || configMap.ResponseObject == nil ||
+		configMap.RequestObject.Data["password"] != redactedValue ||
+		configMap.ResponseObject.Data["password"] != redactedValue {
+		t.Errorf("expected config map request and response data to be redacted, got=%s", log)
+	}
+	if configMap.Annotations[AnnotationRedacted] != "true" {
+		t.Error("expected config map event to be annotated as redacted")
+	}
+}
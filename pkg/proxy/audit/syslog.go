@@ -0,0 +1,195 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package audit
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+	auditv1 "k8s.io/apiserver/pkg/apis/audit/v1"
+	k8saudit "k8s.io/apiserver/pkg/audit"
+	pluginbuffered "k8s.io/apiserver/plugin/pkg/audit/buffered"
+
+	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
+)
+
+const (
+	SyslogBackendName = "syslog"
+
+	// syslogSeverityInfo is the RFC 5424 informational severity.
+	syslogSeverityInfo = 6
+)
+
+// syslogBackend sends audit events to a syslog server over TCP. Each event is
+// formatted as an RFC 5424 message with the JSON encoded event as the
+// message body, framed using octet counting (RFC 6587).
+type syslogBackend struct {
+	address      string
+	appName      string
+	hostname     string
+	procID       string
+	facility     int
+	dialTimeout  time.Duration
+	writeTimeout time.Duration
+
+	encoder runtime.Encoder
+	dial    func(network, address string, timeout time.Duration) (net.Conn, error)
+
+	conn net.Conn
+	lock sync.Mutex
+}
+
+var _ k8saudit.Backend = &syslogBackend{}
+
+func newSyslogBackend(opts *options.AuditOptions) (k8saudit.Backend, error) {
+	if len(opts.SyslogOptions.Address) == 0 {
+		return nil, nil
+	}
+
+	backend, err := newSyslogBackendForOptions(&opts.SyslogOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	return pluginbuffered.NewBackend(backend, pluginbuffered.BatchConfig{
+		BufferSize:   10000,
+		MaxBatchSize: 400,
+		MaxBatchWait: time.Second,
+	}), nil
+}
+
+func newSyslogBackendForOptions(opts *options.AuditSyslogOptions) (*syslogBackend, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hostname for syslog audit backend: %s", err)
+	}
+
+	return &syslogBackend{
+		address:      opts.Address,
+		appName:      syslogHeaderField(opts.AppName),
+		hostname:     syslogHeaderField(hostname),
+		procID:       strconv.Itoa(os.Getpid()),
+		facility:     opts.Facility,
+		dialTimeout:  opts.DialTimeout,
+		writeTimeout: opts.WriteTimeout,
+		encoder:      k8saudit.Codecs.LegacyCodec(auditv1.SchemeGroupVersion),
+		dial:         net.DialTimeout,
+	}, nil
+}
+
+func (s *syslogBackend) ProcessEvents(events ...*auditinternal.Event) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	success := true
+	for _, ev := range events {
+		msg, err := s.format(ev)
+		if err != nil {
+			k8saudit.HandlePluginError(SyslogBackendName, err, ev)
+			success = false
+			continue
+		}
+
+		if err := s.write(msg); err != nil {
+			k8saudit.HandlePluginError(SyslogBackendName, err, ev)
+			success = false
+		}
+	}
+
+	return success
+}
+
+// write sends the message to the syslog server, re-dialing once if the
+// current connection has failed or the write did not complete within the
+// write timeout. A connection which timed out may have been sent part of the
+// message, so is never written to again.
+func (s *syslogBackend) write(msg []byte) error {
+	var err error
+	for i := 0; i < 2; i++ {
+		if s.conn == nil {
+			s.conn, err = s.dial("tcp", s.address, s.dialTimeout)
+			if err != nil {
+				s.conn = nil
+				continue
+			}
+		}
+
+		if err = s.conn.SetWriteDeadline(time.Now().Add(s.writeTimeout)); err == nil {
+			if _, err = s.conn.Write(msg); err == nil {
+				return nil
+			}
+		}
+
+		s.conn.Close()
+		s.conn = nil
+	}
+
+	return fmt.Errorf("failed to write to syslog server %q: %s", s.address, err)
+}
+
+// format returns the octet counted RFC 5424 message for the event.
+func (s *syslogBackend) format(ev *auditinternal.Event) ([]byte, error) {
+	body, err := runtime.Encode(s.encoder, ev)
+	if err != nil {
+		return nil, err
+	}
+	body = bytes.TrimSpace(body)
+
+	timestamp := ev.StageTimestamp.Time
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+
+	msg := fmt.Sprintf("<%d>1 %s %s %s %s %s - %s",
+		s.facility*8+syslogSeverityInfo,
+		timestamp.UTC().Format(time.RFC3339Nano),
+		s.hostname,
+		s.appName,
+		s.procID,
+		syslogHeaderField(string(ev.Stage)),
+		body,
+	)
+
+	return []byte(fmt.Sprintf("%d %s", len(msg), msg)), nil
+}
+
+func (s *syslogBackend) Run(stopCh <-chan struct{}) error {
+	return nil
+}
+
+func (s *syslogBackend) Shutdown() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *syslogBackend) String() string {
+	return SyslogBackendName
+}
+
+// syslogHeaderField returns the value as a valid RFC 5424 header field, using
+// the nil value when empty and replacing any non printable characters.
+func syslogHeaderField(value string) string {
+	if len(value) == 0 {
+		return "-"
+	}
+
+	b := []byte(value)
+	for i, c := range b {
+		if c < 33 || c > 126 {
+			b[i] = '_'
+		}
+	}
+
+	return string(b)
+}
@@ -0,0 +1,201 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	auditinternal "k8s.io/apiserver/pkg/apis/audit"
+
+	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
+)
+
+func newTestEvent() *auditinternal.Event {
+	return &auditinternal.Event{
+		AuditID:        types.UID("1234"),
+		Level:          auditinternal.LevelMetadata,
+		Stage:          auditinternal.StageResponseComplete,
+		RequestURI:     "/api/v1/namespaces",
+		Verb:           "list",
+		StageTimestamp: metav1.NewMicroTime(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)),
+	}
+}
+
+func TestSyslogFormat(t *testing.T) {
+	s, err := newSyslogBackendForOptions(&options.AuditSyslogOptions{
+		AppName:  "kube oidc proxy",
+		Facility: 13,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.hostname = "my-host"
+	s.procID = "1"
+
+	b, err := s.format(newTestEvent())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.SplitN(string(b), " ", 2)
+	if len(parts) != 2 {
+		t.Fatalf("expected octet counted message, got=%q", b)
+	}
+
+	if n, err := strconv.Atoi(parts[0]); err != nil || n != len(parts[1]) {
+		t.Errorf("unexpected octet count, exp=%d got=%s", len(parts[1]), parts[0])
+	}
+
+	expHeader := "<110>1 2020-01-01T00:00:00Z my-host kube_oidc_proxy 1 ResponseComplete - "
+	if !strings.HasPrefix(parts[1], expHeader) {
+		t.Fatalf("unexpected syslog header, exp=%q got=%q", expHeader, parts[1])
+	}
+
+	var ev map[string]interface{}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(parts[1], expHeader)), &ev); err != nil {
+		t.Fatalf("failed to decode message body as json: %s", err)
+	}
+
+	if ev["auditID"] != "1234" || ev["verb"] != "list" {
+		t.Errorf("unexpected event in message body: %v", ev)
+	}
+}
+
+func TestSyslogProcessEvents(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	msgCh := make(chan string)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		for {
+			var n int
+			if _, err := fmt.Fscanf(r, "%d ", &n); err != nil {
+				return
+			}
+
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return
+			}
+
+			msgCh <- string(buf)
+		}
+	}()
+
+	s, err := newSyslogBackendForOptions(&options.AuditSyslogOptions{
+		Address:      l.Addr().String(),
+		AppName:      "kube-oidc-proxy",
+		DialTimeout:  time.Second,
+		WriteTimeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+
+	if !s.ProcessEvents(newTestEvent(), newTestEvent()) {
+		t.Fatal("expected events to be processed successfully")
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-msgCh:
+			if !strings.Contains(msg, " kube-oidc-proxy ") {
+				t.Errorf("unexpected message received: %s", msg)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out waiting for syslog message")
+		}
+	}
+}
+
+func TestSyslogWriteTimeout(t *testing.T) {
+	s, err := newSyslogBackendForOptions(&options.AuditSyslogOptions{
+		Address:      "syslog.example.com:514",
+		AppName:      "kube-oidc-proxy",
+		WriteTimeout: time.Millisecond * 100,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown()
+
+	// Connections are net.Pipes, whose writes block until the server reads.
+	var servers []net.Conn
+	s.dial = func(string, string, time.Duration) (net.Conn, error) {
+		client, server := net.Pipe()
+		servers = append(servers, server)
+		return client, nil
+	}
+
+	// A server which never reads should not block events forever.
+	if s.ProcessEvents(newTestEvent()) {
+		t.Error("expected events to fail to be processed by a stalled server")
+	}
+
+	if len(servers) != 2 {
+		t.Fatalf("expected a new connection after the write timed out, got=%d connections", len(servers))
+	}
+
+	// The stalled connections should have been closed.
+	for i, server := range servers {
+		if _, err := server.Write([]byte("x")); err != io.ErrClosedPipe {
+			t.Errorf("expected connection %d to be closed, got=%v", i, err)
+		}
+	}
+
+	// A server reading once reconnected should receive the whole message.
+	msgCh := make(chan string)
+	s.dial = func(string, string, time.Duration) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+
+			r := bufio.NewReader(server)
+			var n int
+			if _, err := fmt.Fscanf(r, "%d ", &n); err != nil {
+				return
+			}
+
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return
+			}
+
+			msgCh <- string(buf)
+		}()
+		return client, nil
+	}
+
+	if !s.ProcessEvents(newTestEvent()) {
+		t.Fatal("expected events to be processed successfully after reconnecting")
+	}
+
+	select {
+	case msg := <-msgCh:
+		if !strings.Contains(msg, " kube-oidc-proxy ") {
+			t.Errorf("unexpected message received: %s", msg)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for syslog message")
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package breakglass
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/metrics"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/audit"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/oidc"
+)
+
+var (
+	authenticationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "break_glass",
+		Name:      "authentications_total",
+		Help:      "Number of requests presenting a break-glass token, by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	metrics.MustRegister(authenticationsTotal)
+}
+
+type Options struct {
+	// KeysFile is the path to a file containing the public keys which sign
+	// break-glass tokens, either as a JWKS document or PEM encoded public keys
+	// and certificates.
+	KeysFile string
+
+	// Issuer is the issuer of break-glass tokens. Tokens with this issuer are
+	// only authenticated as break-glass tokens.
+	Issuer string
+
+	// Group is the group of users authenticated with a break-glass token.
+	Group string
+
+	// UsernamePrefix is prepended to the subject of break-glass tokens to give
+	// the username.
+	UsernamePrefix string
+
+	// MaxLifetime is the maximum lifetime of a break-glass token, from when it
+	// was issued until it expires. Tokens with a longer lifetime are rejected.
+	MaxLifetime time.Duration
+}
+
+// Authenticator authenticates short-lived break-glass tokens, signed by keys
+// held locally, so that users can reach the cluster while the OIDC issuer is
+// unavailable.
+type Authenticator struct {
+	keys []jose.JSONWebKey
+
+	issuer         string
+	group          string
+	usernamePrefix string
+	maxLifetime    time.Duration
+
+	now func() time.Time
+}
+
+func New(opts Options) (*Authenticator, error) {
+	data, err := ioutil.ReadFile(opts.KeysFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read break-glass keys file %q: %s", opts.KeysFile, err)
+	}
+
+	keys, err := oidc.ParseKeys(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load break-glass keys from %q: %s", opts.KeysFile, err)
+	}
+
+	return &Authenticator{
+		keys:           keys,
+		issuer:         opts.Issuer,
+		group:          opts.Group,
+		usernamePrefix: opts.UsernamePrefix,
+		maxLifetime:    opts.MaxLifetime,
+		now:            time.Now,
+	}, nil
+}
+
+// Matches returns whether the token has the break-glass issuer. The token is
+// not verified.
+func (a *Authenticator) Matches(token string) bool {
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		return false
+	}
+
+	var claims jwt.Claims
+	if err := parsed.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return false
+	}
+
+	return claims.Issuer == a.issuer
+}
+
+// AuthenticateToken implements the authenticator.Token interface. The user
+// has the break-glass group, and the ID of the token in the break-glass extra.
+func (a *Authenticator) AuthenticateToken(ctx context.Context, token string) (*authenticator.Response, bool, error) {
+	claims, err := a.verify(token)
+	if err != nil {
+		authenticationsTotal.WithLabelValues("failure").Inc()
+		return nil, false, fmt.Errorf("break-glass: %s", err)
+	}
+
+	authenticationsTotal.WithLabelValues("success").Inc()
+
+	return &authenticator.Response{
+		User: &user.DefaultInfo{
+			Name:   a.usernamePrefix + claims.Subject,
+			Groups: []string{a.group},
+			Extra: map[string][]string{
+				audit.AnnotationBreakGlass: []string{claims.ID},
+			},
+		},
+	}, true, nil
+}
+
+// verify will verify the signature and claims of the token, returning the
+// claims.
+func (a *Authenticator) verify(token string) (*jwt.Claims, error) {
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, fmt.Errorf("malformed token: %s", err)
+	}
+
+	claims := new(jwt.Claims)
+	var verified bool
+	for _, key := range a.keys {
+		if err := parsed.Claims(key.Key, claims); err == nil {
+			verified = true
+			break
+		}
+	}
+
+	if !verified {
+		return nil, errors.New("failed to verify token signature")
+	}
+
+	if claims.Issuer != a.issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+
+	if len(claims.Subject) == 0 {
+		return nil, errors.New("token has no subject")
+	}
+
+	if len(claims.ID) == 0 {
+		return nil, errors.New("token has no ID")
+	}
+
+	if claims.IssuedAt == nil || claims.Expiry == nil {
+		return nil, errors.New("token must have issued at and expiry times")
+	}
+
+	now := a.now()
+	issuedAt, expiry := claims.IssuedAt.Time(), claims.Expiry.Time()
+
+	if lifetime := expiry.Sub(issuedAt); lifetime > a.maxLifetime {
+		return nil, fmt.Errorf("token lifetime %s exceeds the maximum of %s", lifetime, a.maxLifetime)
+	}
+
+	if now.Before(issuedAt) {
+		return nil, errors.New("token issued in the future")
+	}
+
+	if claims.NotBefore != nil && now.Before(claims.NotBefore.Time()) {
+		return nil, errors.New("token not yet valid")
+	}
+
+	if !now.Before(expiry) {
+		return nil, fmt.Errorf("token expired at %s", expiry)
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,193 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package breakglass
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	"k8s.io/apiserver/pkg/authentication/user"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/audit"
+)
+
+const testIssuer = "kube-oidc-proxy-break-glass"
+
+func newTestKey(t *testing.T) *rsa.PrivateKey {
+	sk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sk
+}
+
+func signTestToken(t *testing.T, sk *rsa.PrivateKey, claims jwt.Claims) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: sk},
+		(&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func TestAuthenticateToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-oidc-proxy-break-glass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sk, otherSK := newTestKey(t), newTestKey(t)
+
+	pubDER, err := x509.MarshalPKIXPublicKey(sk.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keysFile := filepath.Join(dir, "keys.pem")
+	if err := ioutil.WriteFile(keysFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: pubDER,
+	}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New(Options{
+		KeysFile:       keysFile,
+		Issuer:         testIssuer,
+		Group:          "emergency",
+		UsernamePrefix: "break-glass:",
+		MaxLifetime:    time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	a.now = func() time.Time { return now }
+
+	validClaims := func() jwt.Claims {
+		return jwt.Claims{
+			Issuer:   testIssuer,
+			Subject:  "alice",
+			ID:       "token-1",
+			IssuedAt: jwt.NewNumericDate(now.Add(-time.Minute * 10)),
+			Expiry:   jwt.NewNumericDate(now.Add(time.Minute * 50)),
+		}
+	}
+
+	tests := map[string]struct {
+		sk      *rsa.PrivateKey
+		claims  func(*jwt.Claims)
+		expUser *user.DefaultInfo
+	}{
+		"a valid token should authenticate with the break-glass group": {
+			sk: sk,
+			expUser: &user.DefaultInfo{
+				Name:   "break-glass:alice",
+				Groups: []string{"emergency"},
+				Extra: map[string][]string{
+					audit.AnnotationBreakGlass: []string{"token-1"},
+				},
+			},
+		},
+		"a token signed by another key should fail": {
+			sk: otherSK,
+		},
+		"a token of another issuer should fail": {
+			sk:     sk,
+			claims: func(c *jwt.Claims) { c.Issuer = "https://issuer.example.com" },
+		},
+		"a token with a lifetime over the maximum should fail": {
+			sk: sk,
+			claims: func(c *jwt.Claims) {
+				c.Expiry = jwt.NewNumericDate(c.IssuedAt.Time().Add(time.Hour + time.Second))
+			},
+		},
+		"an expired token should fail": {
+			sk: sk,
+			claims: func(c *jwt.Claims) {
+				c.IssuedAt = jwt.NewNumericDate(now.Add(-time.Hour))
+				c.Expiry = jwt.NewNumericDate(now)
+			},
+		},
+		"a token issued in the future should fail": {
+			sk:     sk,
+			claims: func(c *jwt.Claims) { c.IssuedAt = jwt.NewNumericDate(now.Add(time.Minute)) },
+		},
+		"a token not yet valid should fail": {
+			sk:     sk,
+			claims: func(c *jwt.Claims) { c.NotBefore = jwt.NewNumericDate(now.Add(time.Minute)) },
+		},
+		"a token without an expiry should fail": {
+			sk:     sk,
+			claims: func(c *jwt.Claims) { c.Expiry = nil },
+		},
+		"a token without an ID should fail": {
+			sk:     sk,
+			claims: func(c *jwt.Claims) { c.ID = "" },
+		},
+		"a token without a subject should fail": {
+			sk:     sk,
+			claims: func(c *jwt.Claims) { c.Subject = "" },
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			claims := validClaims()
+			if test.claims != nil {
+				test.claims(&claims)
+			}
+
+			resp, ok, err := a.AuthenticateToken(context.TODO(), signTestToken(t, test.sk, claims))
+			if test.expUser == nil {
+				if err == nil || ok {
+					t.Errorf("expected authentication to fail, got=%v %t", resp, ok)
+				}
+				return
+			}
+
+			if err != nil || !ok {
+				t.Fatalf("unexpected authentication failure: %v", err)
+			}
+
+			if !reflect.DeepEqual(resp.User, test.expUser) {
+				t.Errorf("unexpected user, exp=%+v got=%+v", test.expUser, resp.User)
+			}
+		})
+	}
+}
+
+func TestMatches(t *testing.T) {
+	a := &Authenticator{issuer: testIssuer}
+	sk := newTestKey(t)
+
+	if !a.Matches(signTestToken(t, sk, jwt.Claims{Issuer: testIssuer})) {
+		t.Error("expected token with the break-glass issuer to match")
+	}
+
+	if a.Matches(signTestToken(t, sk, jwt.Claims{Issuer: "https://issuer.example.com"})) {
+		t.Error("expected token with another issuer not to match")
+	}
+
+	if a.Matches("not-a-jwt") {
+		t.Error("expected malformed token not to match")
+	}
+}
@@ -5,12 +5,20 @@ import (
 	"net/http"
 
 	"github.com/sebest/xff"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authentication/user"
 	"k8s.io/apiserver/pkg/endpoints/request"
 	"k8s.io/client-go/transport"
 )
 
 type key int
 
+// requestInfoResolver resolves the RequestInfo of requests to the API server.
+var requestInfoResolver = &request.RequestInfoFactory{
+	APIPrefixes:          sets.NewString("api", "apis"),
+	GrouplessAPIPrefixes: sets.NewString("api"),
+}
+
 const (
 	// noImpersonationKey is the context key for whether to use impersonation.
 	noImpersonationKey key = iota
@@ -23,6 +31,23 @@ const (
 
 	// bearerTokenKey is the context key for the client address.
 	clientAddressKey
+
+	// tenantsKey is the context key for the tenants of the user.
+	tenantsKey
+
+	// responseFilterKey is the context key for the upstream response filters.
+	responseFilterKey
+
+	// claimsKey is the context key for the claims of the token.
+	claimsKey
+
+	// impersonatedUserKey is the context key for the user impersonated by the
+	// authenticated user.
+	impersonatedUserKey
+
+	// grantedGroupsKey is the context key for the groups granted to the user
+	// by time-bound grants.
+	grantedGroupsKey
 )
 
 // WithNoImpersonation returns a copy of the request in which the noImpersonation context value is set.
@@ -58,6 +83,57 @@ func BearerToken(req *http.Request) string {
 	return token
 }
 
+// WithTenants returns a copy of the request which contains the tenants of the
+// user.
+func WithTenants(req *http.Request, tenants []string) *http.Request {
+	return req.WithContext(request.WithValue(req.Context(), tenantsKey, tenants))
+}
+
+// Tenants returns the tenants of the user held in the context, if existing.
+func Tenants(req *http.Request) []string {
+	tenants, _ := req.Context().Value(tenantsKey).([]string)
+	return tenants
+}
+
+// WithResponseFilter returns a copy of the request which contains a filter to
+// be applied to the upstream response, after any filters already added.
+func WithResponseFilter(req *http.Request, filter func(*http.Response) error) *http.Request {
+	filters, _ := req.Context().Value(responseFilterKey).([]func(*http.Response) error)
+	filters = append(filters[:len(filters):len(filters)], filter)
+	return req.WithContext(request.WithValue(req.Context(), responseFilterKey, filters))
+}
+
+// ResponseFilter returns a filter applying all upstream response filters held
+// in the context in order, if existing.
+func ResponseFilter(req *http.Request) func(*http.Response) error {
+	filters, _ := req.Context().Value(responseFilterKey).([]func(*http.Response) error)
+	if len(filters) == 0 {
+		return nil
+	}
+
+	return func(resp *http.Response) error {
+		for _, filter := range filters {
+			if err := filter(resp); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+// WithClaims returns a copy of the request which contains the claims of the
+// token.
+func WithClaims(req *http.Request, claims map[string]interface{}) *http.Request {
+	return req.WithContext(request.WithValue(req.Context(), claimsKey, claims))
+}
+
+// Claims returns the claims of the token held in the context, if existing.
+func Claims(req *http.Request) map[string]interface{} {
+	claims, _ := req.Context().Value(claimsKey).(map[string]interface{})
+	return claims
+}
+
 // RemoteAddress will attempt to return the source client address if available
 // in the request context. If it is not, it will be gathered from the request
 // and entered into the context.
@@ -72,3 +148,50 @@ func RemoteAddr(req *http.Request) (*http.Request, string) {
 
 	return req, clientAddress
 }
+
+// WithImpersonatedUser returns a copy of the request which contains the user
+// impersonated by the authenticated user.
+func WithImpersonatedUser(req *http.Request, u user.Info) *http.Request {
+	return req.WithContext(request.WithValue(req.Context(), impersonatedUserKey, u))
+}
+
+// ImpersonatedUser returns the user impersonated by the authenticated user
+// held in the context, if existing.
+func ImpersonatedUser(req *http.Request) user.Info {
+	u, _ := req.Context().Value(impersonatedUserKey).(user.Info)
+	return u
+}
+
+// WithGrantedGroups returns a copy of the request which contains the groups
+// granted to the user by time-bound grants.
+func WithGrantedGroups(req *http.Request, groups []string) *http.Request {
+	return req.WithContext(request.WithValue(req.Context(), grantedGroupsKey, groups))
+}
+
+// GrantedGroups returns the groups granted to the user by time-bound grants
+// held in the context, if existing.
+func GrantedGroups(req *http.Request) []string {
+	groups, _ := req.Context().Value(grantedGroupsKey).([]string)
+	return groups
+}
+
+// WithRequestInfo returns a copy of the request with its resolved RequestInfo
+// in the context, so that it is resolved once for all handlers.
+func WithRequestInfo(req *http.Request) (*http.Request, error) {
+	info, err := requestInfoResolver.NewRequestInfo(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return req.WithContext(request.WithRequestInfo(req.Context(), info)), nil
+}
+
+// RequestInfo returns the RequestInfo of the request from the context, else
+// resolves it.
+func RequestInfo(req *http.Request) (*request.RequestInfo, error) {
+	if info, ok := request.RequestInfoFrom(req.Context()); ok {
+		return info, nil
+	}
+
+	return requestInfoResolver.NewRequestInfo(req)
+}
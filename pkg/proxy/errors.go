@@ -0,0 +1,135 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/metrics"
+)
+
+const (
+	upstreamErrorClientCanceled = "client_canceled"
+	upstreamErrorTimeout        = "timeout"
+	upstreamErrorTLS            = "tls"
+	upstreamErrorUnavailable    = "unavailable"
+	upstreamErrorUnknown        = "unknown"
+)
+
+var (
+	upstreamErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "upstream",
+		Name:      "errors_total",
+		Help:      "Number of requests which failed to receive a response from the API server, by reason.",
+	}, []string{"reason"})
+)
+
+func init() {
+	metrics.MustRegister(upstreamErrorsTotal)
+}
+
+// upstreamError is returned when a request fails to receive a response from
+// the API server.
+type upstreamError struct {
+	err error
+}
+
+func (e *upstreamError) Error() string {
+	return e.err.Error()
+}
+
+func (e *upstreamError) Unwrap() error {
+	return e.err
+}
+
+// classifyUpstreamError returns the reason a request failed to receive a
+// response from the API server.
+func classifyUpstreamError(r *http.Request, err error) string {
+	if errors.Is(err, context.Canceled) || errors.Is(r.Context().Err(), context.Canceled) {
+		return upstreamErrorClientCanceled
+	}
+
+	var unavailableErr *upstreamUnavailableError
+	if errors.As(err, &unavailableErr) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return upstreamErrorUnavailable
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return upstreamErrorTimeout
+	}
+
+	var (
+		unknownAuthorityErr x509.UnknownAuthorityError
+		certificateErr      x509.CertificateInvalidError
+		hostnameErr         x509.HostnameError
+		recordHeaderErr     tls.RecordHeaderError
+	)
+	if errors.As(err, &unknownAuthorityErr) || errors.As(err, &certificateErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &recordHeaderErr) {
+		return upstreamErrorTLS
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return upstreamErrorUnavailable
+	}
+
+	return upstreamErrorUnknown
+}
+
+// handleUpstreamError will write a Status response for a request which failed
+// to receive a response from the API server.
+func handleUpstreamError(rw http.ResponseWriter, r *http.Request, err error) {
+	reason := classifyUpstreamError(r, err)
+	upstreamErrorsTotal.WithLabelValues(reason).Inc()
+
+	switch reason {
+
+	// The client has gone away, so is not an error of the proxy
+	case upstreamErrorClientCanceled:
+		klog.V(4).Infof("client canceled request before the API server responded (%s): %s", r.RemoteAddr, err)
+		writeStatus(rw, http.StatusBadGateway, metav1.StatusReasonInternalError,
+			"the request was canceled before the API server responded")
+
+	case upstreamErrorUnavailable:
+		klog.Errorf("API server unavailable (%s): %s", r.RemoteAddr, err)
+		rw.Header().Set("Retry-After", "1")
+		writeStatus(rw, http.StatusServiceUnavailable, metav1.StatusReasonServiceUnavailable,
+			"the API server is currently unavailable, please try again later")
+
+	case upstreamErrorTimeout:
+		// The request timeout of the proxy expired
+		if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+			klog.V(2).Infof("request timed out (%s): %s", r.RemoteAddr, err)
+			writeStatus(rw, http.StatusGatewayTimeout, metav1.StatusReasonTimeout,
+				"the request did not complete within the request timeout")
+			return
+		}
+
+		klog.Errorf("timed out waiting for the API server (%s): %s", r.RemoteAddr, err)
+		writeStatus(rw, http.StatusGatewayTimeout, metav1.StatusReasonTimeout,
+			"timed out waiting for the API server to respond")
+
+	case upstreamErrorTLS:
+		klog.Errorf("failed to verify the TLS connection to the API server (%s): %s", r.RemoteAddr, err)
+		writeStatus(rw, http.StatusBadGateway, metav1.StatusReasonInternalError,
+			"the proxy failed to verify the TLS connection to the API server")
+
+	default:
+		klog.Errorf("failed to proxy request to the API server (%s): %s", r.RemoteAddr, err)
+		writeStatus(rw, http.StatusBadGateway, metav1.StatusReasonInternalError,
+			"the proxy failed to receive a response from the API server")
+	}
+}
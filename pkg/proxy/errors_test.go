@@ -0,0 +1,123 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package proxy
+
+import (
+	gocontext "context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestClassifyUpstreamError(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+
+	dialTimeout := func() error {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		// A dialer with an expired deadline always times out.
+		_, err = (&net.Dialer{Deadline: time.Now().Add(-time.Second)}).Dial("tcp", l.Addr().String())
+		return err
+	}()
+
+	canceledCtx, cancel := gocontext.WithCancel(gocontext.Background())
+	cancel()
+
+	expiredCtx, cancel := gocontext.WithTimeout(gocontext.Background(), -time.Second)
+	defer cancel()
+
+	tests := map[string]struct {
+		err       error
+		ctx       gocontext.Context
+		expReason string
+		expCode   int
+	}{
+		"a canceled request should be classified as client canceled": {
+			err:       &url.Error{Op: "Get", URL: "https://kubernetes", Err: gocontext.Canceled},
+			expReason: upstreamErrorClientCanceled,
+			expCode:   http.StatusBadGateway,
+		},
+		"an error after the client disconnected should be classified as client canceled": {
+			err:       errors.New("http2: stream closed"),
+			ctx:       canceledCtx,
+			expReason: upstreamErrorClientCanceled,
+			expCode:   http.StatusBadGateway,
+		},
+		"a refused connection should be classified as unavailable": {
+			err:       refused,
+			expReason: upstreamErrorUnavailable,
+			expCode:   http.StatusServiceUnavailable,
+		},
+		"exhausted retries should be classified as unavailable": {
+			err:       &upstreamUnavailableError{retries: 3, err: refused},
+			expReason: upstreamErrorUnavailable,
+			expCode:   http.StatusServiceUnavailable,
+		},
+		"a dial timeout should be classified as a timeout": {
+			err:       dialTimeout,
+			expReason: upstreamErrorTimeout,
+			expCode:   http.StatusGatewayTimeout,
+		},
+		"an exceeded deadline should be classified as a timeout": {
+			err:       fmt.Errorf("request failed: %w", gocontext.DeadlineExceeded),
+			expReason: upstreamErrorTimeout,
+			expCode:   http.StatusGatewayTimeout,
+		},
+		"an expired request timeout should be classified as a timeout": {
+			err:       &url.Error{Op: "Get", URL: "https://kubernetes", Err: gocontext.DeadlineExceeded},
+			ctx:       expiredCtx,
+			expReason: upstreamErrorTimeout,
+			expCode:   http.StatusGatewayTimeout,
+		},
+		"an unknown certificate authority should be classified as a TLS error": {
+			err:       &url.Error{Op: "Get", URL: "https://kubernetes", Err: x509.UnknownAuthorityError{}},
+			expReason: upstreamErrorTLS,
+			expCode:   http.StatusBadGateway,
+		},
+		"a certificate for another host should be classified as a TLS error": {
+			err:       x509.HostnameError{Certificate: new(x509.Certificate), Host: "kubernetes"},
+			expReason: upstreamErrorTLS,
+			expCode:   http.StatusBadGateway,
+		},
+		"another error should be classified as unknown": {
+			err:       errors.New("malformed HTTP response"),
+			expReason: upstreamErrorUnknown,
+			expCode:   http.StatusBadGateway,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil)
+			if test.ctx != nil {
+				req = req.WithContext(test.ctx)
+			}
+
+			if reason := classifyUpstreamError(req, test.err); reason != test.expReason {
+				t.Errorf("unexpected reason, exp=%s got=%s", test.expReason, reason)
+			}
+
+			rw := httptest.NewRecorder()
+			handleUpstreamError(rw, req, test.err)
+
+			if rw.Code != test.expCode {
+				t.Errorf("unexpected status code, exp=%d got=%d", test.expCode, rw.Code)
+			}
+
+			if ct := rw.Header().Get("Content-Type"); ct != "application/json" {
+				t.Errorf("unexpected content type, exp=application/json got=%s", ct)
+			}
+		})
+	}
+}
@@ -0,0 +1,400 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package expression
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+)
+
+// Expression is a Go template evaluated against the claims of a token. The
+// claims are the root of the template data, so a claim is referenced as
+// '.email', or '(index . "claim-name")' for names which are not identifiers.
+// Referencing a missing claim as '.claim' is an error, so claims which may be
+// missing should be referenced with index, which evaluates to nil.
+//
+// As well as the builtin template functions, the functions in funcs are
+// available for matching claims against values and lists, and comparing times.
+type Expression struct {
+	source string
+	tmpl   *template.Template
+}
+
+const (
+	// noValue is the output of text/template for nil values.
+	noValue = "<no value>"
+
+	// listMarker delimits the markers output by the list function when
+	// evaluating a list.
+	listMarker = "\x00"
+)
+
+var (
+	// now is used for testing.
+	now = time.Now
+
+	regexLock  sync.Mutex
+	regexCache = make(map[string]*regexp.Regexp)
+)
+
+// Compile will parse the expression.
+func Compile(source string) (*Expression, error) {
+	tmpl, err := template.New("expression").
+		Option("missingkey=error").
+		Funcs(funcs).
+		Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse expression %q: %s", source, err)
+	}
+
+	return &Expression{
+		source: source,
+		tmpl:   tmpl,
+	}, nil
+}
+
+// String returns the source of the expression.
+func (e *Expression) String() string {
+	return e.source
+}
+
+// Evaluate will evaluate the expression against the claims, returning the
+// output with surrounding white space removed.
+func (e *Expression) Evaluate(claims map[string]interface{}) (string, error) {
+	return e.evaluate(e.tmpl, claims)
+}
+
+func (e *Expression) evaluate(tmpl *template.Template, claims map[string]interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, claims); err != nil {
+		return "", fmt.Errorf("failed to evaluate expression %q: %s", e.source, err)
+	}
+
+	// Nil values, such as missing claims referenced with index, are output as
+	// "<no value>". An output of only a nil value is empty, but one containing
+	// a nil value would otherwise be used verbatim.
+	out := strings.TrimSpace(buf.String())
+	switch {
+	case out == noValue:
+		out = ""
+	case strings.Contains(out, noValue):
+		return "", fmt.Errorf("failed to evaluate expression %q: output contains a missing value", e.source)
+	}
+
+	return out, nil
+}
+
+// EvaluateList will evaluate the expression against the claims, returning a
+// list. Only an output which is entirely the result of the list function is
+// several items. Any other non empty output is a single item, so claim values
+// which contain delimiters or look like lists can not produce further items.
+func (e *Expression) EvaluateList(claims map[string]interface{}) ([]string, error) {
+	// The list function outputs a marker in place of its items, which can not
+	// be guessed so can not be output by a claim.
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	markerPrefix := listMarker + hex.EncodeToString(nonce)
+
+	lists := make(map[string][]string)
+	tmpl, err := e.tmpl.Clone()
+	if err != nil {
+		return nil, err
+	}
+	tmpl.Funcs(template.FuncMap{
+		"list": func(values ...interface{}) string {
+			marker := fmt.Sprintf("%s-%d%s", markerPrefix, len(lists), listMarker)
+			lists[marker] = listItems(values)
+			return marker
+		},
+	})
+
+	out, err := e.evaluate(tmpl, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	if items, ok := lists[out]; ok {
+		var list []string
+		for _, item := range items {
+			if len(item) > 0 {
+				list = append(list, item)
+			}
+		}
+		return list, nil
+	}
+
+	if strings.Contains(out, markerPrefix) {
+		return nil, fmt.Errorf("failed to evaluate expression %q: the list function must be the whole output", e.source)
+	}
+
+	if len(out) == 0 {
+		return nil, nil
+	}
+
+	return []string{out}, nil
+}
+
+// EvaluateBool will evaluate the expression against the claims, returning
+// whether the output is "true".
+func (e *Expression) EvaluateBool(claims map[string]interface{}) (bool, error) {
+	out, err := e.Evaluate(claims)
+	if err != nil {
+		return false, err
+	}
+
+	return out == "true", nil
+}
+
+// References returns whether the expression may read the claim, either as a
+// field such as '.email', or as a string such as in 'index . "email"'. This is
+// conservative, so a string equal to the claim name anywhere in the expression
+// is a reference.
+func (e *Expression) References(claim string) bool {
+	return referencesClaim(e.tmpl.Tree.Root, claim)
+}
+
+// referencesClaim walks the template parse tree for references to the claim.
+func referencesClaim(node parse.Node, claim string) bool {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return false
+		}
+		for _, child := range n.Nodes {
+			if referencesClaim(child, claim) {
+				return true
+			}
+		}
+
+	case *parse.ActionNode:
+		return referencesClaim(n.Pipe, claim)
+
+	case *parse.IfNode:
+		return referencesClaim(&n.BranchNode, claim)
+
+	case *parse.RangeNode:
+		return referencesClaim(&n.BranchNode, claim)
+
+	case *parse.WithNode:
+		return referencesClaim(&n.BranchNode, claim)
+
+	case *parse.BranchNode:
+		return referencesClaim(n.Pipe, claim) || referencesClaim(n.List, claim) ||
+			referencesClaim(n.ElseList, claim)
+
+	case *parse.PipeNode:
+		if n == nil {
+			return false
+		}
+		for _, cmd := range n.Cmds {
+			if referencesClaim(cmd, claim) {
+				return true
+			}
+		}
+
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			if referencesClaim(arg, claim) {
+				return true
+			}
+		}
+
+	case *parse.FieldNode:
+		return len(n.Ident) > 0 && n.Ident[0] == claim
+
+	case *parse.VariableNode:
+		return len(n.Ident) > 1 && n.Ident[1] == claim
+
+	case *parse.ChainNode:
+		return referencesClaim(n.Node, claim) || (len(n.Field) > 0 && n.Field[0] == claim)
+
+	case *parse.StringNode:
+		return n.Text == claim
+
+	case *parse.TemplateNode:
+		return referencesClaim(n.Pipe, claim)
+	}
+
+	return false
+}
+
+// funcs are the functions available to expressions, in addition to the
+// builtin template functions. Claims which are lists may be given where a
+// single value is expected, and nil claims are treated as empty.
+var funcs = template.FuncMap{
+	"contains":  contains,
+	"in":        in,
+	"matches":   matches,
+	"hasPrefix": func(prefix string, value interface{}) bool { return strings.HasPrefix(toString(value), prefix) },
+	"hasSuffix": func(suffix string, value interface{}) bool { return strings.HasSuffix(toString(value), suffix) },
+	"lower":     func(value interface{}) string { return strings.ToLower(toString(value)) },
+	"upper":     func(value interface{}) string { return strings.ToUpper(toString(value)) },
+	"split":     func(value interface{}, sep string) []string { return strings.Split(toString(value), sep) },
+	"join":      func(list interface{}, sep string) string { return strings.Join(toStrings(list), sep) },
+	"list":      list,
+	"prefix":    prefix,
+	"str":       toString,
+	"default":   defaultValue,
+	"now":       func() float64 { return float64(now().Unix()) },
+	"ago":       ago,
+}
+
+// list returns the values, with list claims flattened, as a JSON array. When
+// evaluating a list, an output of only the list function is its items.
+func list(values ...interface{}) (string, error) {
+	b, err := json.Marshal(listItems(values))
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// listItems returns the values with list claims flattened.
+func listItems(values []interface{}) []string {
+	items := make([]string, 0, len(values))
+	for _, value := range values {
+		items = append(items, toStrings(value)...)
+	}
+
+	return items
+}
+
+// prefix returns each item of the list, which may also be a single value, with
+// the prefix added.
+func prefix(p string, list interface{}) []string {
+	items := toStrings(list)
+	out := make([]string, 0, len(items))
+	for _, item := range items {
+		out = append(out, p+item)
+	}
+
+	return out
+}
+
+// contains returns whether the list, which may also be a single value,
+// contains the value.
+func contains(list, value interface{}) bool {
+	for _, item := range toStrings(list) {
+		if item == toString(value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// in returns whether the value is one of the items.
+func in(value interface{}, items ...interface{}) bool {
+	for _, item := range items {
+		if contains(item, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matches returns whether the value matches the regular expression. Lists
+// match if any item matches.
+func matches(pattern string, value interface{}) (bool, error) {
+	regexLock.Lock()
+	re, ok := regexCache[pattern]
+	if !ok {
+		var err error
+		re, err = regexp.Compile(pattern)
+		if err != nil {
+			regexLock.Unlock()
+			return false, err
+		}
+		regexCache[pattern] = re
+	}
+	regexLock.Unlock()
+
+	for _, item := range toStrings(value) {
+		if re.MatchString(item) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// defaultValue returns the first non empty value, else the default.
+func defaultValue(def interface{}, values ...interface{}) interface{} {
+	for _, value := range values {
+		if !isEmpty(value) {
+			return value
+		}
+	}
+
+	return def
+}
+
+// isEmpty returns whether the value is nil, an empty string or an empty list.
+func isEmpty(value interface{}) bool {
+	items := toStrings(value)
+	return len(items) == 0 || (len(items) == 1 && len(items[0]) == 0)
+}
+
+// ago returns the Unix time the duration before now.
+func ago(duration string) (float64, error) {
+	d, err := time.ParseDuration(duration)
+	if err != nil {
+		return 0, err
+	}
+
+	return float64(now().Add(-d).Unix()), nil
+}
+
+// toString converts a claim value to a string. Nil values are empty.
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		// JSON numbers are decoded as float64, which should not be formatted
+		// with an exponent.
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+// toStrings converts a claim value to a list of strings. Non-list values are
+// treated as a single item list, and nil values as an empty list.
+func toStrings(value interface{}) []string {
+	if value == nil {
+		return nil
+	}
+
+	if s, ok := value.([]string); ok {
+		return s
+	}
+
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return []string{toString(value)}
+	}
+
+	out := make([]string, 0, rv.Len())
+	for i := 0; i < rv.Len(); i++ {
+		out = append(out, toString(rv.Index(i).Interface()))
+	}
+
+	return out
+}
@@ -0,0 +1,254 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package expression
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEvaluate(t *testing.T) {
+	now = func() time.Time {
+		return time.Unix(1585742400, 0)
+	}
+	defer func() {
+		now = time.Now
+	}()
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal([]byte(`{
+		"sub": "1234",
+		"email": "alice@example.com",
+		"email_verified": true,
+		"groups": ["group-a", "group-b"],
+		"hd": "example.com",
+		"auth_time": 1585740600,
+		"preferred_username": ""
+	}`), &claims); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		expression string
+		expOut     string
+		expErr     bool
+	}{
+		"a claim should be output": {
+			expression: "{{ .email }}",
+			expOut:     "alice@example.com",
+		},
+		"a missing claim should error": {
+			expression: "{{ .foo }}",
+			expErr:     true,
+		},
+		"a missing claim referenced with index should be empty": {
+			expression: `{{ index . "foo" }}`,
+			expOut:     "",
+		},
+		"a missing claim in a composite expression should error": {
+			expression: "{{ .sub }}@{{ .foo }}",
+			expErr:     true,
+		},
+		"a missing claim referenced with index in a composite expression should error": {
+			expression: `{{ .sub }}@{{ index . "foo" }}`,
+			expErr:     true,
+		},
+		"a missing claim referenced with index should be guarded": {
+			expression: `{{ .sub }}{{ with index . "foo" }}@{{ . }}{{ end }}`,
+			expOut:     "1234",
+		},
+		"a numeric claim should not be formatted with an exponent": {
+			expression: "{{ str .auth_time }}",
+			expOut:     "1585740600",
+		},
+		"a boolean claim should be comparable": {
+			expression: "{{ eq .email_verified true }}",
+			expOut:     "true",
+		},
+		"a list claim should contain a value": {
+			expression: `{{ contains .groups "group-b" }}`,
+			expOut:     "true",
+		},
+		"a list claim should not contain a missing value": {
+			expression: `{{ contains .groups "group-c" }}`,
+			expOut:     "false",
+		},
+		"a claim should be in a list of values": {
+			expression: `{{ in .hd "example.com" "example.org" }}`,
+			expOut:     "true",
+		},
+		"a missing claim should not be in a list of values": {
+			expression: `{{ in (index . "foo") "example.com" }}`,
+			expOut:     "false",
+		},
+		"a claim should match a regular expression": {
+			expression: `{{ matches "@example\\.com$" .email }}`,
+			expOut:     "true",
+		},
+		"an invalid regular expression should error": {
+			expression: `{{ matches "(" .email }}`,
+			expErr:     true,
+		},
+		"a recent time claim should compare to ago": {
+			expression: `{{ ge .auth_time (ago "1h") }}`,
+			expOut:     "true",
+		},
+		"an old time claim should compare to ago": {
+			expression: `{{ ge .auth_time (ago "15m") }}`,
+			expOut:     "false",
+		},
+		"comparing a missing claim should error": {
+			expression: `{{ ge .foo (ago "15m") }}`,
+			expErr:     true,
+		},
+		"default should return the first non empty value": {
+			expression: `{{ default .sub .preferred_username (index . "foo") .email }}`,
+			expOut:     "alice@example.com",
+		},
+		"default should return the default if all empty": {
+			expression: `{{ default .sub .preferred_username (index . "foo") }}`,
+			expOut:     "1234",
+		},
+		"string functions should be applied": {
+			expression: `{{ index (split (lower .email) "@") 0 }}`,
+			expOut:     "alice",
+		},
+		"lists should be joined": {
+			expression: `{{ join .groups "," }}`,
+			expOut:     "group-a,group-b",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			expr, err := Compile(test.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out, err := expr.Evaluate(claims)
+			if (err != nil) != test.expErr {
+				t.Fatalf("unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+
+			if out != test.expOut {
+				t.Errorf("unexpected output, exp=%q got=%q", test.expOut, out)
+			}
+		})
+	}
+
+	if _, err := Compile("{{ .foo "); err == nil {
+		t.Error("expected error compiling invalid expression")
+	}
+}
+
+func TestReferences(t *testing.T) {
+	tests := map[string]struct {
+		expression string
+		expRef     bool
+	}{
+		"a field should be a reference": {
+			expression: "{{ .email }}",
+			expRef:     true,
+		},
+		"an index should be a reference": {
+			expression: `{{ index . "email" }}`,
+			expRef:     true,
+		},
+		"a field in a branch should be a reference": {
+			expression: `{{ if .email_verified }}{{ lower .email }}{{ end }}`,
+			expRef:     true,
+		},
+		"a field of a variable should be a reference": {
+			expression: `{{ $c := . }}{{ $c.email }}`,
+			expRef:     true,
+		},
+		"another claim should not be a reference": {
+			expression: `{{ .email_verified }}{{ index . "sub" }}`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			expr, err := Compile(test.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ref := expr.References("email"); ref != test.expRef {
+				t.Errorf("unexpected reference, exp=%t got=%t", test.expRef, ref)
+			}
+		})
+	}
+}
+
+func TestEvaluateList(t *testing.T) {
+	var claims map[string]interface{}
+	if err := json.Unmarshal([]byte(`{
+		"tenant": "dev,system:masters",
+		"department": "[\"cluster-admins\",\"ops\"]",
+		"groups": ["group-a", "group-b"]
+	}`), &claims); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		expression string
+		expOut     []string
+		expErr     bool
+	}{
+		"an empty output should be an empty list": {
+			expression: `{{ index . "foo" }}`,
+		},
+		"an output should be a single item, regardless of delimiters": {
+			expression: `tenant:{{ .tenant }}`,
+			expOut:     []string{"tenant:dev,system:masters"},
+		},
+		"a claim which looks like a list should be a single item": {
+			expression: `{{ .department }}`,
+			expOut:     []string{`["cluster-admins","ops"]`},
+		},
+		"a list claim output without the list function should be a single item": {
+			expression: `{{ .groups }}`,
+			expOut:     []string{"[group-a group-b]"},
+		},
+		"a list should be output as items": {
+			expression: `{{ list .tenant .groups }}`,
+			expOut:     []string{"dev,system:masters", "group-a", "group-b"},
+		},
+		"a list should be prefixed": {
+			expression: `{{ list (prefix "group:" .groups) }}`,
+			expOut:     []string{"group:group-a", "group:group-b"},
+		},
+		"a list of a missing claim should be empty": {
+			expression: `{{ list (index . "foo") }}`,
+		},
+		"a list of a claim which looks like a list should be a single item": {
+			expression: `{{ list .department }}`,
+			expOut:     []string{`["cluster-admins","ops"]`},
+		},
+		"a list with further output should error": {
+			expression: `{{ list .groups }},{{ .tenant }}`,
+			expErr:     true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			expr, err := Compile(test.expression)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out, err := expr.EvaluateList(claims)
+			if (err != nil) != test.expErr {
+				t.Fatalf("unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+
+			if !reflect.DeepEqual(out, test.expOut) {
+				t.Errorf("unexpected output, exp=%q got=%q", test.expOut, out)
+			}
+		})
+	}
+}
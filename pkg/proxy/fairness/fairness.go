@@ -0,0 +1,214 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package fairness
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"sigs.k8s.io/yaml"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/metrics"
+)
+
+const (
+	defaultQueues           = 64
+	defaultHandSize         = 8
+	defaultQueueLengthLimit = 50
+)
+
+var (
+	requestsExecuting = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "fairness",
+		Name:      "requests_executing",
+		Help:      "Number of requests executing, by priority level.",
+	}, []string{"priority_level"})
+
+	requestsWaiting = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "fairness",
+		Name:      "requests_waiting",
+		Help:      "Number of requests waiting in queues, by priority level.",
+	}, []string{"priority_level"})
+
+	requestsRejectedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "fairness",
+		Name:      "requests_rejected_total",
+		Help:      "Number of requests rejected, by priority level and reason.",
+	}, []string{"priority_level", "reason"})
+)
+
+func init() {
+	metrics.MustRegister(requestsExecuting, requestsWaiting, requestsRejectedTotal)
+}
+
+// PriorityLevel is a set of queues sharing a number of concurrently executing
+// requests.
+type PriorityLevel struct {
+	// Name is the name of the priority level, referenced by flow schemas.
+	Name string `json:"name"`
+
+	// Exempt priority levels do not queue or limit requests.
+	Exempt bool `json:"exempt,omitempty"`
+
+	// Concurrency is the number of requests of the priority level which may
+	// execute at once. Requests are dispatched from the queues in turn.
+	Concurrency int `json:"concurrency,omitempty"`
+
+	// QueueConcurrency, if given, is the number of requests from a single
+	// queue which may execute at once, even when other queues are empty.
+	QueueConcurrency int `json:"queueConcurrency,omitempty"`
+
+	// Queues is the number of queues. Defaults to 64.
+	Queues int `json:"queues,omitempty"`
+
+	// HandSize is the number of queues each flow is shuffle sharded to,
+	// joining the shortest. Defaults to 8, or the number of queues if fewer.
+	HandSize int `json:"handSize,omitempty"`
+
+	// QueueLengthLimit is the number of requests which may wait in a queue,
+	// beyond which requests are rejected. Defaults to 50.
+	QueueLengthLimit int `json:"queueLengthLimit,omitempty"`
+}
+
+// FlowSchema assigns matching requests to a priority level. Each user's
+// requests matching a flow schema are a flow.
+type FlowSchema struct {
+	// Name is the name of the flow schema.
+	Name string `json:"name"`
+
+	// PriorityLevel is the name of the priority level of matching requests.
+	PriorityLevel string `json:"priorityLevel"`
+
+	// MatchingPrecedence orders flow schemas, the lowest matching first.
+	// Flow schemas with equal precedence are matched in order.
+	MatchingPrecedence int `json:"matchingPrecedence,omitempty"`
+
+	// Groups, if given, matches requests from users in any of the groups.
+	Groups []string `json:"groups,omitempty"`
+
+	// Verbs, if given, matches requests with any of the verbs, such as get,
+	// list or create.
+	Verbs []string `json:"verbs,omitempty"`
+}
+
+// Config is the fairness configuration file.
+type Config struct {
+	PriorityLevels []PriorityLevel `json:"priorityLevels"`
+	FlowSchemas    []FlowSchema    `json:"flowSchemas"`
+}
+
+type flowSchema struct {
+	name          string
+	priorityLevel *priorityLevel
+	groups        sets.String
+	verbs         sets.String
+}
+
+// Fairness queues requests in priority levels, fairly between users, so that
+// one user's burst of requests can not starve others.
+type Fairness struct {
+	flowSchemas []*flowSchema
+}
+
+// LoadConfig will load the fairness configuration file.
+func LoadConfig(filePath string) (*Config, error) {
+	b, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fairness configuration file %q: %s", filePath, err)
+	}
+
+	config := new(Config)
+	if err := yaml.UnmarshalStrict(b, config); err != nil {
+		return nil, fmt.Errorf("failed to decode fairness configuration file %q: %s", filePath, err)
+	}
+
+	return config, nil
+}
+
+func New(config *Config) (*Fairness, error) {
+	priorityLevels := make(map[string]*priorityLevel)
+
+	for i, pl := range config.PriorityLevels {
+		if len(pl.Name) == 0 {
+			return nil, fmt.Errorf("priority level %d must have a name", i)
+		}
+
+		if _, ok := priorityLevels[pl.Name]; ok {
+			return nil, fmt.Errorf("priority level %q is defined more than once", pl.Name)
+		}
+
+		level, err := newPriorityLevel(pl)
+		if err != nil {
+			return nil, fmt.Errorf("priority level %q: %s", pl.Name, err)
+		}
+
+		priorityLevels[pl.Name] = level
+	}
+
+	schemas := make([]FlowSchema, len(config.FlowSchemas))
+	copy(schemas, config.FlowSchemas)
+	sort.SliceStable(schemas, func(i, j int) bool {
+		return schemas[i].MatchingPrecedence < schemas[j].MatchingPrecedence
+	})
+
+	f := new(Fairness)
+	for i, fs := range schemas {
+		if len(fs.Name) == 0 {
+			return nil, fmt.Errorf("flow schema %d must have a name", i)
+		}
+
+		level, ok := priorityLevels[fs.PriorityLevel]
+		if !ok {
+			return nil, fmt.Errorf("flow schema %q references unknown priority level %q",
+				fs.Name, fs.PriorityLevel)
+		}
+
+		f.flowSchemas = append(f.flowSchemas, &flowSchema{
+			name:          fs.Name,
+			priorityLevel: level,
+			groups:        sets.NewString(fs.Groups...),
+			verbs:         sets.NewString(fs.Verbs...),
+		})
+	}
+
+	return f, nil
+}
+
+// Wait will wait until the request of the user, with the given verb, may
+// execute, returning a function which must be called once it has finished.
+// Requests matching no flow schema, or of an exempt priority level, execute
+// immediately. If the request is rejected, because its queue is full or the
+// context is done while waiting, false is returned.
+func (f *Fairness) Wait(ctx context.Context, u user.Info, verb string) (func(), bool) {
+	for _, fs := range f.flowSchemas {
+		if fs.groups.Len() > 0 && !fs.groups.HasAny(u.GetGroups()...) {
+			continue
+		}
+
+		if fs.verbs.Len() > 0 && !fs.verbs.Has(verb) {
+			continue
+		}
+
+		if fs.priorityLevel.config.Exempt {
+			return func() {}, true
+		}
+
+		// Each user's requests of the flow schema are a flow.
+		h := fnv.New64a()
+		h.Write([]byte(fs.name))
+		h.Write([]byte{0})
+		h.Write([]byte(u.GetName()))
+
+		return fs.priorityLevel.wait(ctx, h.Sum64())
+	}
+
+	return func() {}, true
+}
@@ -0,0 +1,228 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package fairness
+
+import (
+	"context"
+	"hash/fnv"
+	"testing"
+	"time"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+func TestNew(t *testing.T) {
+	tests := map[string]struct {
+		config *Config
+		expErr bool
+	}{
+		"a valid configuration should not error": {
+			config: &Config{
+				PriorityLevels: []PriorityLevel{
+					{Name: "exempt", Exempt: true},
+					{Name: "workload", Concurrency: 10},
+				},
+				FlowSchemas: []FlowSchema{
+					{Name: "admins", PriorityLevel: "exempt", Groups: []string{"admins"}},
+					{Name: "users", PriorityLevel: "workload", MatchingPrecedence: 1000},
+				},
+			},
+		},
+		"a priority level without concurrency should error": {
+			config: &Config{
+				PriorityLevels: []PriorityLevel{{Name: "workload"}},
+			},
+			expErr: true,
+		},
+		"a hand size greater than the number of queues should error": {
+			config: &Config{
+				PriorityLevels: []PriorityLevel{{Name: "workload", Concurrency: 10, Queues: 4, HandSize: 5}},
+			},
+			expErr: true,
+		},
+		"a duplicate priority level should error": {
+			config: &Config{
+				PriorityLevels: []PriorityLevel{
+					{Name: "workload", Concurrency: 10},
+					{Name: "workload", Concurrency: 20},
+				},
+			},
+			expErr: true,
+		},
+		"a flow schema with an unknown priority level should error": {
+			config: &Config{
+				PriorityLevels: []PriorityLevel{{Name: "workload", Concurrency: 10}},
+				FlowSchemas:    []FlowSchema{{Name: "users", PriorityLevel: "unknown"}},
+			},
+			expErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := New(test.config)
+			if (err != nil) != test.expErr {
+				t.Errorf("unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+		})
+	}
+}
+
+// queueOf returns the queue index the user is shuffle sharded to, for a hand
+// size of 1.
+func queueOf(f *Fairness, username string) int {
+	fs := f.flowSchemas[len(f.flowSchemas)-1]
+
+	h := fnv.New64a()
+	h.Write([]byte(fs.name))
+	h.Write([]byte{0})
+	h.Write([]byte(username))
+
+	var queue int
+	fs.priorityLevel.dealer.Deal(h.Sum64(), func(i int) { queue = i })
+	return queue
+}
+
+// waiting returns the number of requests waiting in the priority level.
+func waiting(pl *priorityLevel) int {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+
+	var n int
+	for _, q := range pl.queues {
+		n += len(q.waiting)
+	}
+	return n
+}
+
+func TestWaitFairness(t *testing.T) {
+	f, err := New(&Config{
+		PriorityLevels: []PriorityLevel{
+			{Name: "exempt", Exempt: true},
+			{Name: "workload", Concurrency: 1, Queues: 64, HandSize: 1},
+		},
+		FlowSchemas: []FlowSchema{
+			{Name: "admins", PriorityLevel: "exempt", Groups: []string{"admins"}},
+			{Name: "writes", PriorityLevel: "workload", Verbs: []string{"create"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := f.flowSchemas[1].priorityLevel
+
+	alice := &user.DefaultInfo{Name: "alice"}
+	bob := &user.DefaultInfo{Name: "bob"}
+	admin := &user.DefaultInfo{Name: "carol", Groups: []string{"admins"}}
+
+	if queueOf(f, "alice") == queueOf(f, "bob") {
+		t.Fatal("expected alice and bob to be sharded to different queues")
+	}
+
+	done, ok := f.Wait(context.TODO(), alice, "create")
+	if !ok {
+		t.Fatal("expected first request to execute")
+	}
+
+	// Requests matching no flow schema, or of an exempt priority level, are
+	// not queued.
+	for _, test := range []struct {
+		u    user.Info
+		verb string
+	}{
+		{alice, "get"},
+		{admin, "create"},
+	} {
+		if _, ok := f.Wait(context.TODO(), test.u, test.verb); !ok {
+			t.Errorf("expected request of %q to %s to execute", test.u.GetName(), test.verb)
+		}
+	}
+
+	// Queue a burst of requests from alice, followed by one from bob.
+	orderCh := make(chan string, 4)
+	for i, u := range []user.Info{alice, alice, alice, bob} {
+		go func(u user.Info) {
+			done, ok := f.Wait(context.TODO(), u, "create")
+			if !ok {
+				t.Errorf("unexpected rejected request of %q", u.GetName())
+				return
+			}
+			orderCh <- u.GetName()
+			done()
+		}(u)
+
+		for waiting(pl) != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	done()
+
+	var order []string
+	for i := 0; i < 4; i++ {
+		order = append(order, <-orderCh)
+	}
+
+	if order[0] != "bob" {
+		t.Errorf("expected bob's request to be dispatched before alice's burst, got=%v", order)
+	}
+}
+
+func TestWaitRejected(t *testing.T) {
+	f, err := New(&Config{
+		PriorityLevels: []PriorityLevel{
+			{Name: "workload", Concurrency: 1, Queues: 1, QueueLengthLimit: 1},
+		},
+		FlowSchemas: []FlowSchema{
+			{Name: "all", PriorityLevel: "workload"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := f.flowSchemas[0].priorityLevel
+
+	alice := &user.DefaultInfo{Name: "alice"}
+
+	done, ok := f.Wait(context.TODO(), alice, "get")
+	if !ok {
+		t.Fatal("expected first request to execute")
+	}
+
+	// A request waiting until its context is done is rejected.
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Millisecond*10)
+	defer cancel()
+	if _, ok := f.Wait(ctx, alice, "get"); ok {
+		t.Error("expected request to be rejected once its context was done")
+	}
+
+	if n := waiting(pl); n != 0 {
+		t.Errorf("unexpected waiting requests after rejection, exp=0 got=%d", n)
+	}
+
+	// A request to a full queue is rejected.
+	waitCh := make(chan bool)
+	go func() {
+		done, ok := f.Wait(context.TODO(), alice, "get")
+		if ok {
+			done()
+		}
+		waitCh <- ok
+	}()
+
+	for waiting(pl) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, ok := f.Wait(context.TODO(), alice, "get"); ok {
+		t.Error("expected request to a full queue to be rejected")
+	}
+
+	done()
+	if ok := <-waitCh; !ok {
+		t.Error("expected queued request to execute once concurrency was available")
+	}
+
+	if pl.executing != 0 {
+		t.Errorf("unexpected executing requests, exp=0 got=%d", pl.executing)
+	}
+}
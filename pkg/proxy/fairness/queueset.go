@@ -0,0 +1,207 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package fairness
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"k8s.io/apiserver/pkg/util/shufflesharding"
+)
+
+// request is a request waiting in a queue.
+type request struct {
+	queue *queue
+
+	// readyCh is closed once the request has been dispatched.
+	readyCh    chan struct{}
+	dispatched bool
+}
+
+type queue struct {
+	waiting   []*request
+	executing int
+}
+
+// priorityLevel dispatches requests from its queues in turn, up to its
+// concurrency.
+type priorityLevel struct {
+	config PriorityLevel
+	dealer *shufflesharding.Dealer
+
+	lock      sync.Mutex
+	queues    []*queue
+	executing int
+
+	// next is the queue dispatched from next, to dispatch from queues in
+	// turn.
+	next int
+}
+
+func newPriorityLevel(config PriorityLevel) (*priorityLevel, error) {
+	if config.Exempt {
+		return &priorityLevel{config: config}, nil
+	}
+
+	if config.Concurrency <= 0 {
+		return nil, errors.New("concurrency must be positive")
+	}
+
+	if config.QueueConcurrency < 0 {
+		return nil, errors.New("queue concurrency must not be negative")
+	}
+
+	if config.Queues == 0 {
+		config.Queues = defaultQueues
+	}
+
+	if config.HandSize == 0 {
+		config.HandSize = defaultHandSize
+		if config.Queues < config.HandSize {
+			config.HandSize = config.Queues
+		}
+	}
+
+	if config.QueueLengthLimit == 0 {
+		config.QueueLengthLimit = defaultQueueLengthLimit
+	}
+
+	if config.QueueLengthLimit < 0 {
+		return nil, errors.New("queue length limit must not be negative")
+	}
+
+	dealer, err := shufflesharding.NewDealer(config.Queues, config.HandSize)
+	if err != nil {
+		return nil, err
+	}
+
+	pl := &priorityLevel{
+		config: config,
+		dealer: dealer,
+		queues: make([]*queue, config.Queues),
+	}
+
+	for i := range pl.queues {
+		pl.queues[i] = new(queue)
+	}
+
+	return pl, nil
+}
+
+// wait will queue the request of the flow with the hash value, and wait until
+// it is dispatched.
+func (pl *priorityLevel) wait(ctx context.Context, hashValue uint64) (func(), bool) {
+	pl.lock.Lock()
+
+	// Shuffle shard the flow to a hand of queues, joining the shortest.
+	var q *queue
+	pl.dealer.Deal(hashValue, func(i int) {
+		if c := pl.queues[i]; q == nil || len(c.waiting)+c.executing < len(q.waiting)+q.executing {
+			q = c
+		}
+	})
+
+	if len(q.waiting) >= pl.config.QueueLengthLimit {
+		pl.lock.Unlock()
+		requestsRejectedTotal.WithLabelValues(pl.config.Name, "queue-full").Inc()
+		return nil, false
+	}
+
+	r := &request{
+		queue:   q,
+		readyCh: make(chan struct{}),
+	}
+	q.waiting = append(q.waiting, r)
+	requestsWaiting.WithLabelValues(pl.config.Name).Inc()
+
+	pl.dispatch()
+	pl.lock.Unlock()
+
+	select {
+	case <-r.readyCh:
+		return pl.finishFunc(q), true
+
+	case <-ctx.Done():
+		pl.lock.Lock()
+		defer pl.lock.Unlock()
+
+		// The request may have been dispatched while acquiring the lock.
+		if r.dispatched {
+			pl.finish(q)
+		} else {
+			pl.remove(r)
+		}
+
+		reason := "canceled"
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			reason = "timeout"
+		}
+
+		requestsRejectedTotal.WithLabelValues(pl.config.Name, reason).Inc()
+		return nil, false
+	}
+}
+
+// dispatch will dispatch waiting requests from the queues in turn, while
+// there is concurrency available. Must be called with the lock held.
+func (pl *priorityLevel) dispatch() {
+	for pl.executing < pl.config.Concurrency {
+		var q *queue
+		for i := 0; i < len(pl.queues); i++ {
+			c := pl.queues[(pl.next+i)%len(pl.queues)]
+			if len(c.waiting) > 0 &&
+				(pl.config.QueueConcurrency == 0 || c.executing < pl.config.QueueConcurrency) {
+				q = c
+				pl.next = (pl.next + i + 1) % len(pl.queues)
+				break
+			}
+		}
+
+		// No queue has a request which may be dispatched
+		if q == nil {
+			return
+		}
+
+		r := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		requestsWaiting.WithLabelValues(pl.config.Name).Dec()
+
+		r.dispatched = true
+		q.executing++
+		pl.executing++
+		requestsExecuting.WithLabelValues(pl.config.Name).Inc()
+		close(r.readyCh)
+	}
+}
+
+// remove will remove a waiting request from its queue. Must be called with
+// the lock held.
+func (pl *priorityLevel) remove(r *request) {
+	for i, w := range r.queue.waiting {
+		if w == r {
+			r.queue.waiting = append(r.queue.waiting[:i], r.queue.waiting[i+1:]...)
+			requestsWaiting.WithLabelValues(pl.config.Name).Dec()
+			return
+		}
+	}
+}
+
+// finish will release the concurrency of a request from the queue, and
+// dispatch waiting requests. Must be called with the lock held.
+func (pl *priorityLevel) finish(q *queue) {
+	q.executing--
+	pl.executing--
+	requestsExecuting.WithLabelValues(pl.config.Name).Dec()
+	pl.dispatch()
+}
+
+func (pl *priorityLevel) finishFunc(q *queue) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			pl.lock.Lock()
+			defer pl.lock.Unlock()
+			pl.finish(q)
+		})
+	}
+}
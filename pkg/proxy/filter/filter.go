@@ -0,0 +1,764 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	apimachinerypath "k8s.io/apimachinery/pkg/api/validation/path"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer/protobuf"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/yaml"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/expression"
+)
+
+// Rule filters the list and watch responses of resources to the objects
+// matching a selector of the user. The selectors are expressions evaluated
+// against the claims of the user's token.
+type Rule struct {
+	// Group is the API group of the resources. The empty string represents
+	// the core API group.
+	Group string `json:"group"`
+
+	// Resources is a list of resources this rule applies to.
+	Resources []string `json:"resources"`
+
+	// MatchLabels, if given, maps label keys to expressions evaluating to the
+	// values objects may have for the label, either a single value, or
+	// several values when the output is only the list function. Objects must
+	// match all labels, and a label with no values matches no objects.
+	MatchLabels map[string]string `json:"matchLabels,omitempty"`
+
+	// Names, if given, is an expression evaluating to the names of the
+	// objects which may be returned, either a single name, or several names
+	// when the output is only the list function. Names may contain the wildcards '*' and '?', which are not
+	// permitted in the values of the claims referenced by the expression.
+	Names string `json:"names,omitempty"`
+
+	// ExemptGroups are further groups whose members' responses are not
+	// filtered by this rule.
+	ExemptGroups []string `json:"exemptGroups,omitempty"`
+}
+
+// Config is the response filter configuration file.
+type Config struct {
+	// ExemptGroups are groups whose members' responses are not filtered by
+	// any of the rules.
+	ExemptGroups []string `json:"exemptGroups,omitempty"`
+
+	// Rules are the response filter rules.
+	Rules []Rule `json:"rules"`
+}
+
+type rule struct {
+	group        string
+	resources    sets.String
+	matchLabels  map[string]*expression.Expression
+	names        *expression.Expression
+	exemptGroups sets.String
+}
+
+// MatchFunc returns whether an object should be returned. Only the name,
+// namespace and labels of the object are given.
+type MatchFunc func(obj metav1.Object) bool
+
+// protobufSerializer decodes and encodes the protobuf responses of built in
+// resources.
+var protobufSerializer = protobuf.NewSerializer(scheme.Scheme, scheme.Scheme)
+
+// Filter filters list and watch responses of the configured resources to the
+// objects matching the selectors of the user. JSON, YAML and protobuf
+// responses are supported.
+type Filter struct {
+	rules []*rule
+}
+
+// LoadConfig will load the response filter configuration from the file.
+func LoadConfig(filePath string) (*Config, error) {
+	b, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response filter file %q: %s", filePath, err)
+	}
+
+	config := new(Config)
+	if err := yaml.UnmarshalStrict(b, config); err != nil {
+		return nil, fmt.Errorf("failed to decode response filter file %q: %s", filePath, err)
+	}
+
+	return config, nil
+}
+
+func New(config *Config) (*Filter, error) {
+	f := new(Filter)
+
+	for i, r := range config.Rules {
+		if len(r.Resources) == 0 {
+			return nil, fmt.Errorf("response filter rule %d must contain at least one resource", i)
+		}
+
+		if len(r.MatchLabels) == 0 && len(r.Names) == 0 {
+			return nil, fmt.Errorf("response filter rule %d must contain match labels or names", i)
+		}
+
+		compiled := &rule{
+			group:        r.Group,
+			resources:    sets.NewString(r.Resources...),
+			matchLabels:  make(map[string]*expression.Expression),
+			exemptGroups: sets.NewString(config.ExemptGroups...).Insert(r.ExemptGroups...),
+		}
+
+		for key, source := range r.MatchLabels {
+			if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+				return nil, fmt.Errorf("response filter rule %d has an invalid label key %q: %s",
+					i, key, strings.Join(errs, "; "))
+			}
+
+			expr, err := expression.Compile(source)
+			if err != nil {
+				return nil, fmt.Errorf("response filter rule %d: %s", i, err)
+			}
+			compiled.matchLabels[key] = expr
+		}
+
+		if len(r.Names) > 0 {
+			var err error
+			compiled.names, err = expression.Compile(r.Names)
+			if err != nil {
+				return nil, fmt.Errorf("response filter rule %d: %s", i, err)
+			}
+		}
+
+		f.rules = append(f.rules, compiled)
+	}
+
+	return f, nil
+}
+
+// ResponseFilter returns a filter for the upstream response of the request, or
+// nil if the response should not be filtered. The first matching rule the user
+// is not exempt from is used. The Accept-Encoding header of filtered requests
+// is removed, so that the response is decompressed by the transport.
+func (f *Filter) ResponseFilter(req *http.Request, u user.Info, claims map[string]interface{}) (func(*http.Response) error, error) {
+	// Requests whose RequestInfo cannot be resolved are not lists or watches
+	// of a resource.
+	info, err := context.RequestInfo(req)
+	if err != nil || !info.IsResourceRequest || len(info.Subresource) > 0 ||
+		(info.Verb != "list" && info.Verb != "watch") {
+		return nil, nil
+	}
+
+	for _, r := range f.rules {
+		if r.group != info.APIGroup || !r.resources.Has(info.Resource) ||
+			r.exemptGroups.HasAny(u.GetGroups()...) {
+			continue
+		}
+
+		match, err := r.matcher(claims)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Del("Accept-Encoding")
+
+		isWatch := info.Verb == "watch"
+		return func(resp *http.Response) error {
+			return Response(resp, isWatch, match)
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// matcher evaluates the selectors of the rule against the claims, returning a
+// function matching objects against them. The selector is built from
+// requirements, rather than parsed, so claim values can not widen it, and an
+// error is returned if any value is not a valid label value or name.
+func (r *rule) matcher(claims map[string]interface{}) (MatchFunc, error) {
+	selector := labels.NewSelector()
+	for key, expr := range r.matchLabels {
+		values, err := expr.EvaluateList(claims)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(values) == 0 {
+			selector = labels.Nothing()
+			break
+		}
+
+		req, err := labels.NewRequirement(key, selection.In, values)
+		if err != nil {
+			return nil, fmt.Errorf("invalid values for label %q: %s", key, err)
+		}
+		selector = selector.Add(*req)
+	}
+
+	var names []string
+	if r.names != nil {
+		if err := validateNameClaims(r.names, claims); err != nil {
+			return nil, err
+		}
+
+		var err error
+		names, err = r.names.EvaluateList(claims)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, name := range names {
+			// Wildcards are validated as any other character of a name.
+			if errs := apimachinerypath.IsValidPathSegmentName(name); len(errs) > 0 || strings.ContainsAny(name, "[\\") {
+				return nil, fmt.Errorf("invalid name %q", name)
+			}
+		}
+	}
+
+	return func(obj metav1.Object) bool {
+		if !selector.Matches(labels.Set(obj.GetLabels())) {
+			return false
+		}
+
+		if r.names == nil {
+			return true
+		}
+
+		for _, pattern := range names {
+			if ok, _ := path.Match(pattern, obj.GetName()); ok {
+				return true
+			}
+		}
+
+		return false
+	}, nil
+}
+
+// validateNameClaims returns an error if a claim referenced by the names
+// expression contains a wildcard, so that only the expression may add them.
+func validateNameClaims(expr *expression.Expression, claims map[string]interface{}) error {
+	for claim, value := range claims {
+		if !expr.References(claim) {
+			continue
+		}
+
+		values, ok := value.([]interface{})
+		if !ok {
+			values = []interface{}{value}
+		}
+
+		for _, v := range values {
+			if s, ok := v.(string); ok && strings.ContainsAny(s, "*?[\\") {
+				return fmt.Errorf("claim %q contains a wildcard", claim)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Response will filter a successful list or watch response to the objects
+// matching, depending on its content type. Watches must be given by the
+// request, as the API server does not mark JSON watch responses as streams.
+// JSON, YAML and protobuf lists, and JSON and protobuf watches, are supported.
+// The response must not be compressed.
+func Response(resp *http.Response, isWatch bool, match MatchFunc) error {
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	if encoding := resp.Header.Get("Content-Encoding"); len(encoding) > 0 {
+		return fmt.Errorf("unable to filter response with content encoding %q", encoding)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("unable to filter response with content type %q: %s",
+			resp.Header.Get("Content-Type"), err)
+	}
+
+	switch {
+	case mediaType == runtime.ContentTypeJSON && isWatch:
+		filterStream(resp, func(r io.Reader, w io.Writer) error {
+			return filterJSONWatch(r, w, match)
+		})
+		return nil
+
+	case mediaType == runtime.ContentTypeProtobuf && isWatch:
+		filterStream(resp, func(r io.Reader, w io.Writer) error {
+			return filterProtobufWatch(r, w, match)
+		})
+		return nil
+
+	case isWatch:
+		return fmt.Errorf("unable to filter watch response with content type %q", mediaType)
+
+	case mediaType == runtime.ContentTypeJSON:
+		return filterBody(resp, func(body []byte) ([]byte, error) {
+			return filterJSONList(body, match)
+		})
+
+	case mediaType == runtime.ContentTypeYAML:
+		return filterBody(resp, func(body []byte) ([]byte, error) {
+			body, err := yaml.YAMLToJSON(body)
+			if err != nil {
+				return nil, err
+			}
+
+			body, err = filterJSONList(body, match)
+			if err != nil {
+				return nil, err
+			}
+
+			return yaml.JSONToYAML(body)
+		})
+
+	case mediaType == runtime.ContentTypeProtobuf:
+		return filterBody(resp, func(body []byte) ([]byte, error) {
+			return filterProtobufList(body, match)
+		})
+
+	default:
+		return fmt.Errorf("unable to filter response with content type %q", mediaType)
+	}
+}
+
+// filterBody will replace the body of the response with the filtered body.
+func filterBody(resp *http.Response, filter func([]byte) ([]byte, error)) error {
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read response: %s", err)
+	}
+
+	body, err = filter(body)
+	if err != nil {
+		return fmt.Errorf("failed to filter response: %s", err)
+	}
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	return nil
+}
+
+// filterStream will replace the body of the response with a stream of the
+// filtered events, which are filtered as they are received. The upstream body
+// is closed once the filtered body is closed.
+func filterStream(resp *http.Response, filter func(io.Reader, io.Writer) error) {
+	upstream := resp.Body
+	pr, pw := io.Pipe()
+
+	go func() {
+		defer upstream.Close()
+		pw.CloseWithError(filter(upstream, pw))
+	}()
+
+	resp.Body = pr
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+}
+
+// filterJSONList will remove the items, or rows of a table, not matching from
+// a JSON list.
+func filterJSONList(body []byte, match MatchFunc) ([]byte, error) {
+	var list map[string]interface{}
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, err
+	}
+
+	// Tables list objects as rows, each with the object metadata as the
+	// object. Rows without an object can not be matched, so are removed.
+	key, objectKey := "items", ""
+	if list["kind"] == "Table" {
+		key, objectKey = "rows", "object"
+	}
+
+	items, _ := list[key].([]interface{})
+	filtered := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		obj, _ := item.(map[string]interface{})
+		if len(objectKey) > 0 {
+			obj, _ = obj[objectKey].(map[string]interface{})
+		}
+
+		metadata, _ := obj["metadata"].(map[string]interface{})
+		objMeta := &metav1.ObjectMeta{Labels: make(map[string]string)}
+		objMeta.Name, _ = metadata["name"].(string)
+		objMeta.Namespace, _ = metadata["namespace"].(string)
+
+		l, _ := metadata["labels"].(map[string]interface{})
+		for k, v := range l {
+			objMeta.Labels[k], _ = v.(string)
+		}
+
+		if len(objMeta.Name) > 0 && match(objMeta) {
+			filtered = append(filtered, item)
+		}
+	}
+	list[key] = filtered
+
+	// The remaining item count no longer holds once filtered.
+	if metadata, ok := list["metadata"].(map[string]interface{}); ok {
+		delete(metadata, "remainingItemCount")
+	}
+
+	return json.Marshal(list)
+}
+
+// filterProtobufList will remove the items not matching from a protobuf
+// list.
+func filterProtobufList(body []byte, match MatchFunc) ([]byte, error) {
+	obj, gvk, err := protobufSerializer.Decode(body, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := meta.ExtractList(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := make([]runtime.Object, 0, len(items))
+	for _, item := range items {
+		accessor, err := meta.Accessor(item)
+		if err != nil {
+			return nil, err
+		}
+
+		if match(accessor) {
+			filtered = append(filtered, item)
+		}
+	}
+
+	if err := meta.SetList(obj, filtered); err != nil {
+		return nil, err
+	}
+
+	listAccessor, err := meta.ListAccessor(obj)
+	if err != nil {
+		return nil, err
+	}
+	listAccessor.SetRemainingItemCount(nil)
+
+	obj.GetObjectKind().SetGroupVersionKind(*gvk)
+
+	var buf bytes.Buffer
+	if err := protobufSerializer.Encode(obj, &buf); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// filterJSONWatch will filter a stream of JSON watch events.
+func filterJSONWatch(r io.Reader, w io.Writer, match MatchFunc) error {
+	decoder := json.NewDecoder(r)
+	encoder := json.NewEncoder(w)
+
+	events := &eventFilter{
+		match: match,
+		sent:  sets.NewString(),
+		decode: func(raw []byte) (metav1.Object, error) {
+			raw, _, err := jsonWatchObject(raw)
+			if err != nil {
+				return nil, err
+			}
+
+			obj := new(metav1.PartialObjectMetadata)
+			if len(raw) == 0 {
+				return obj, nil
+			}
+
+			if err := json.Unmarshal(raw, obj); err != nil {
+				return nil, err
+			}
+			return obj, nil
+		},
+		strip: func(raw []byte) ([]byte, error) {
+			objRaw, table, err := jsonWatchObject(raw)
+			if err != nil {
+				return nil, err
+			}
+
+			obj := new(metav1.PartialObjectMetadata)
+			if err := json.Unmarshal(objRaw, obj); err != nil {
+				return nil, err
+			}
+
+			stripped := &metav1.PartialObjectMetadata{TypeMeta: obj.TypeMeta}
+			stripObjectMeta(obj, stripped)
+
+			if !table {
+				return json.Marshal(stripped)
+			}
+
+			return stripJSONTableRow(raw, stripped)
+		},
+	}
+
+	for {
+		event := new(metav1.WatchEvent)
+		if err := decoder.Decode(event); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		keep, err := events.filter(event)
+		if err != nil {
+			return err
+		}
+
+		if keep {
+			if err := encoder.Encode(event); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// jsonWatchObject returns the object of a JSON watch event object. Tables, as
+// returned to 'kubectl get --watch', contain the object metadata as the
+// object of their single row. Tables without a single row with an object can
+// not be matched, so nil is returned.
+func jsonWatchObject(raw []byte) ([]byte, bool, error) {
+	var table struct {
+		Kind string `json:"kind"`
+		Rows []struct {
+			Object json.RawMessage `json:"object"`
+		} `json:"rows"`
+	}
+	if err := json.Unmarshal(raw, &table); err != nil {
+		return nil, false, err
+	}
+
+	if table.Kind != "Table" {
+		return raw, false, nil
+	}
+
+	if len(table.Rows) != 1 || len(table.Rows[0].Object) == 0 ||
+		string(table.Rows[0].Object) == "null" {
+		return nil, true, nil
+	}
+
+	return table.Rows[0].Object, true, nil
+}
+
+// stripJSONTableRow replaces the object of the single row of the table with
+// the stripped object, and empties its cells.
+func stripJSONTableRow(raw []byte, stripped *metav1.PartialObjectMetadata) ([]byte, error) {
+	var table map[string]interface{}
+	if err := json.Unmarshal(raw, &table); err != nil {
+		return nil, err
+	}
+
+	rows, _ := table["rows"].([]interface{})
+	if len(rows) != 1 {
+		return nil, errors.New("table does not contain a single row")
+	}
+
+	row, ok := rows[0].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("table row is not an object")
+	}
+
+	cells, _ := row["cells"].([]interface{})
+	for i := range cells {
+		cells[i] = ""
+	}
+
+	row["object"] = stripped
+
+	return json.Marshal(table)
+}
+
+// filterProtobufWatch will filter a stream of protobuf watch events. Each
+// event is framed by its length as a 4 byte big endian integer.
+func filterProtobufWatch(r io.Reader, w io.Writer, match MatchFunc) error {
+	reader := bufio.NewReader(r)
+
+	events := &eventFilter{
+		match: match,
+		sent:  sets.NewString(),
+		decode: func(raw []byte) (metav1.Object, error) {
+			obj, _, err := protobufSerializer.Decode(raw, nil, nil)
+			if err != nil {
+				return nil, err
+			}
+			return meta.Accessor(obj)
+		},
+		strip: func(raw []byte) ([]byte, error) {
+			obj, gvk, err := protobufSerializer.Decode(raw, nil, nil)
+			if err != nil {
+				return nil, err
+			}
+
+			accessor, err := meta.Accessor(obj)
+			if err != nil {
+				return nil, err
+			}
+
+			stripped, err := scheme.Scheme.New(*gvk)
+			if err != nil {
+				return nil, err
+			}
+
+			strippedAccessor, err := meta.Accessor(stripped)
+			if err != nil {
+				return nil, err
+			}
+			stripObjectMeta(accessor, strippedAccessor)
+			stripped.GetObjectKind().SetGroupVersionKind(*gvk)
+
+			var buf bytes.Buffer
+			if err := protobufSerializer.Encode(stripped, &buf); err != nil {
+				return nil, err
+			}
+
+			return buf.Bytes(), nil
+		},
+	}
+
+	for {
+		var length uint32
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		frame := make([]byte, length)
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			return err
+		}
+
+		event := new(metav1.WatchEvent)
+		if err := event.Unmarshal(frame); err != nil {
+			return err
+		}
+
+		keep, err := events.filter(event)
+		if err != nil {
+			return err
+		}
+
+		if !keep {
+			continue
+		}
+
+		frame, err = event.Marshal()
+		if err != nil {
+			return err
+		}
+
+		if err := binary.Write(w, binary.BigEndian, uint32(len(frame))); err != nil {
+			return err
+		}
+
+		if _, err := w.Write(frame); err != nil {
+			return err
+		}
+	}
+}
+
+// eventFilter filters the events of a single watch. Objects sent by the watch
+// which are modified to no longer match are sent as deleted, stripped to their
+// identifying metadata, so that they are removed from the client's view
+// without revealing their contents. Other events, such as bookmarks and
+// errors, are kept.
+type eventFilter struct {
+	match MatchFunc
+
+	// sent holds the keys of the objects sent by the watch, which have not
+	// since been deleted.
+	sent sets.String
+
+	// decode decodes the metadata of an event object.
+	decode func(raw []byte) (metav1.Object, error)
+
+	// strip encodes the event object stripped to its identifying metadata.
+	strip func(raw []byte) ([]byte, error)
+}
+
+// filter returns whether the watch event should be kept, replacing its object
+// if it is to be sent as deleted.
+func (e *eventFilter) filter(event *metav1.WatchEvent) (bool, error) {
+	switch watch.EventType(event.Type) {
+	case watch.Added, watch.Modified, watch.Deleted:
+	default:
+		return true, nil
+	}
+
+	if len(event.Object.Raw) == 0 {
+		return false, errors.New("watch event contains no object")
+	}
+
+	obj, err := e.decode(event.Object.Raw)
+	if err != nil {
+		return false, fmt.Errorf("failed to decode watch event object: %s", err)
+	}
+
+	key := obj.GetNamespace() + "/" + obj.GetName()
+	sent := e.sent.Has(key)
+
+	if watch.EventType(event.Type) == watch.Deleted {
+		e.sent.Delete(key)
+	}
+
+	// Objects without a name, such as tables without objects, can not be
+	// matched.
+	if len(obj.GetName()) > 0 && e.match(obj) {
+		if watch.EventType(event.Type) != watch.Deleted {
+			e.sent.Insert(key)
+		}
+		return true, nil
+	}
+
+	// Objects not sent by this watch are unknown to the client.
+	if !sent {
+		return false, nil
+	}
+	e.sent.Delete(key)
+
+	raw, err := e.strip(event.Object.Raw)
+	if err != nil {
+		return false, fmt.Errorf("failed to strip watch event object: %s", err)
+	}
+
+	event.Type = string(watch.Deleted)
+	event.Object = runtime.RawExtension{Raw: raw}
+
+	return true, nil
+}
+
+// stripObjectMeta copies only the identifying metadata of the object.
+func stripObjectMeta(from, to metav1.Object) {
+	to.SetName(from.GetName())
+	to.SetNamespace(from.GetNamespace())
+	to.SetUID(from.GetUID())
+	to.SetResourceVersion(from.GetResourceVersion())
+}
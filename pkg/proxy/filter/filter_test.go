@@ -0,0 +1,616 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package filter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"sigs.k8s.io/yaml"
+)
+
+func newTestFilter(t *testing.T) *Filter {
+	f, err := New(&Config{
+		ExemptGroups: []string{"cluster-admins"},
+		Rules: []Rule{
+			{
+				Group:       "",
+				Resources:   []string{"namespaces"},
+				MatchLabels: map[string]string{"team": `{{ list (index . "team") }}`},
+			},
+			{
+				Group:     "",
+				Resources: []string{"nodes"},
+				Names:     `{{ list (index . "nodes") (index . "node_pattern") "shared-*" }}`,
+			},
+			{
+				Group:       "",
+				Resources:   []string{"configmaps"},
+				MatchLabels: map[string]string{"team": `{{ index . "team" }}`},
+			},
+			{
+				Group:     "",
+				Resources: []string{"secrets"},
+				Names:     `{{ index . "nodes" }}`,
+			},
+			{
+				Group:        "",
+				Resources:    []string{"persistentvolumes"},
+				Names:        `{{ index . "nodes" }}`,
+				ExemptGroups: []string{"storage-admins"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+func newTestNamespace(name, team string) corev1.Namespace {
+	return corev1.Namespace{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Namespace",
+			APIVersion: "v1",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{"team": team},
+		},
+	}
+}
+
+func newTestRequest(path, query string) *http.Request {
+	return &http.Request{
+		Method: http.MethodGet,
+		URL:    &url.URL{Path: path, RawQuery: query},
+		Header: http.Header{
+			"Accept-Encoding": []string{"gzip"},
+		},
+	}
+}
+
+func TestResponseFilter(t *testing.T) {
+	f := newTestFilter(t)
+
+	tests := map[string]struct {
+		path      string
+		query     string
+		groups    []string
+		expFilter bool
+	}{
+		"a namespace list should be filtered": {
+			path:      "/api/v1/namespaces",
+			expFilter: true,
+		},
+		"a namespace watch should be filtered": {
+			path:      "/api/v1/namespaces",
+			query:     "watch=true",
+			expFilter: true,
+		},
+		"a node list should be filtered": {
+			path:      "/api/v1/nodes",
+			expFilter: true,
+		},
+		"a namespace get should not be filtered": {
+			path: "/api/v1/namespaces/a",
+		},
+		"a pod list should not be filtered": {
+			path: "/api/v1/namespaces/a/pods",
+		},
+		"a non resource request should not be filtered": {
+			path: "/version",
+		},
+		"a namespace list from an exempt group should not be filtered": {
+			path:   "/api/v1/namespaces",
+			groups: []string{"cluster-admins"},
+		},
+		"a persistent volume list from an exempt group of all rules should not be filtered": {
+			path:   "/api/v1/persistentvolumes",
+			groups: []string{"cluster-admins"},
+		},
+		"a persistent volume list from an exempt group of the rule should not be filtered": {
+			path:   "/api/v1/persistentvolumes",
+			groups: []string{"storage-admins"},
+		},
+		"a namespace list from an exempt group of another rule should be filtered": {
+			path:      "/api/v1/namespaces",
+			groups:    []string{"storage-admins"},
+			expFilter: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := newTestRequest(test.path, test.query)
+
+			filter, err := f.ResponseFilter(req, &user.DefaultInfo{Name: "alice", Groups: test.groups}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if (filter != nil) != test.expFilter {
+				t.Errorf("unexpected filter, exp=%t got=%t", test.expFilter, filter != nil)
+			}
+
+			if _, ok := req.Header["Accept-Encoding"]; ok == test.expFilter {
+				t.Errorf("unexpected accept encoding header, exp removed=%t got=%v",
+					test.expFilter, req.Header["Accept-Encoding"])
+			}
+		})
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	f := newTestFilter(t)
+
+	tests := map[string]struct {
+		rule     int
+		claims   map[string]interface{}
+		expErr   bool
+		expMatch []string
+	}{
+		"labels should match any of the claim values": {
+			claims:   map[string]interface{}{"team": []interface{}{"a", "c"}},
+			expMatch: []string{"a", "c"},
+		},
+		"a claim value containing a comma should error": {
+			claims: map[string]interface{}{"team": "a,b"},
+			expErr: true,
+		},
+		"a claim value containing an operator should error": {
+			claims: map[string]interface{}{"team": "a,team!=a"},
+			expErr: true,
+		},
+		"a missing claim should match nothing": {
+			claims: map[string]interface{}{},
+		},
+		"names should match the claim values and wildcards of the expression": {
+			rule:     1,
+			claims:   map[string]interface{}{"nodes": []interface{}{"a", "b"}},
+			expMatch: []string{"a", "b", "shared-a"},
+		},
+		"a name claim containing a comma should not match further names": {
+			rule:   1,
+			claims: map[string]interface{}{"nodes": "a,b"},
+			// Only the wildcard of the expression matches.
+			expMatch: []string{"shared-a"},
+		},
+		"a name claim containing a wildcard should error": {
+			rule:   1,
+			claims: map[string]interface{}{"node_pattern": "*"},
+			expErr: true,
+		},
+		"a label claim value which looks like a list should not match further values": {
+			claims: map[string]interface{}{"team": `["a","b"]`},
+			expErr: true,
+		},
+		"a label claim value which looks like a list should not be decoded": {
+			rule:   2,
+			claims: map[string]interface{}{"team": `["a","b"]`},
+			expErr: true,
+		},
+		"a single label claim value should match only that value": {
+			rule:     2,
+			claims:   map[string]interface{}{"team": "a"},
+			expMatch: []string{"a"},
+		},
+		"a name claim which looks like a list should not be decoded": {
+			rule:   3,
+			claims: map[string]interface{}{"nodes": `["a","b"]`},
+			expErr: true,
+		},
+		"an invalid name should error": {
+			rule:   1,
+			claims: map[string]interface{}{"nodes": "a/b"},
+			expErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			match, err := f.rules[test.rule].matcher(test.claims)
+			if (err != nil) != test.expErr {
+				t.Fatalf("unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+			if err != nil {
+				return
+			}
+
+			var matched []string
+			for _, objName := range []string{"a", "b", "c", "shared-a"} {
+				// Label rules match the team label, name rules the name.
+				obj := &metav1.ObjectMeta{Name: objName, Labels: map[string]string{"team": objName}}
+				if match(obj) {
+					matched = append(matched, objName)
+				}
+			}
+
+			if !reflect.DeepEqual(matched, test.expMatch) {
+				t.Errorf("unexpected matched objects, exp=%v got=%v", test.expMatch, matched)
+			}
+		})
+	}
+}
+
+func TestFilterLists(t *testing.T) {
+	f := newTestFilter(t)
+
+	list := &corev1.NamespaceList{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "NamespaceList",
+			APIVersion: "v1",
+		},
+		Items: []corev1.Namespace{
+			newTestNamespace("a-1", "a"),
+			newTestNamespace("b-1", "b"),
+			newTestNamespace("c-1", "c"),
+			newTestNamespace("a-2", "a"),
+		},
+	}
+
+	jsonBody, err := json.Marshal(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	yamlBody, err := yaml.Marshal(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var protobufBody bytes.Buffer
+	if err := protobufSerializer.Encode(list, &protobufBody); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		contentType string
+		body        []byte
+		claims      map[string]interface{}
+		decode      func([]byte) (*corev1.NamespaceList, error)
+		expNames    []string
+	}{
+		"a JSON list should be filtered": {
+			contentType: runtime.ContentTypeJSON,
+			body:        jsonBody,
+			claims:      map[string]interface{}{"team": []interface{}{"a", "c"}},
+			decode: func(b []byte) (*corev1.NamespaceList, error) {
+				list := new(corev1.NamespaceList)
+				return list, json.Unmarshal(b, list)
+			},
+			expNames: []string{"a-1", "c-1", "a-2"},
+		},
+		"a YAML list should be filtered": {
+			contentType: runtime.ContentTypeYAML,
+			body:        yamlBody,
+			claims:      map[string]interface{}{"team": "b"},
+			decode: func(b []byte) (*corev1.NamespaceList, error) {
+				list := new(corev1.NamespaceList)
+				return list, yaml.Unmarshal(b, list)
+			},
+			expNames: []string{"b-1"},
+		},
+		"a protobuf list should be filtered": {
+			contentType: runtime.ContentTypeProtobuf,
+			body:        protobufBody.Bytes(),
+			claims:      map[string]interface{}{"team": "a"},
+			decode: func(b []byte) (*corev1.NamespaceList, error) {
+				obj, _, err := protobufSerializer.Decode(b, nil, nil)
+				if err != nil {
+					return nil, err
+				}
+				return obj.(*corev1.NamespaceList), nil
+			},
+			expNames: []string{"a-1", "a-2"},
+		},
+		"a list for a user without the claim should be empty": {
+			contentType: runtime.ContentTypeJSON,
+			body:        jsonBody,
+			decode: func(b []byte) (*corev1.NamespaceList, error) {
+				list := new(corev1.NamespaceList)
+				return list, json.Unmarshal(b, list)
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			filter, err := f.ResponseFilter(newTestRequest("/api/v1/namespaces", ""),
+				&user.DefaultInfo{Name: "alice"}, test.claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp := &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": []string{test.contentType}},
+				Body:       ioutil.NopCloser(bytes.NewReader(test.body)),
+			}
+
+			if err := filter(resp); err != nil {
+				t.Fatal(err)
+			}
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.ContentLength != int64(len(body)) {
+				t.Errorf("unexpected content length, exp=%d got=%d", len(body), resp.ContentLength)
+			}
+
+			list, err := test.decode(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var names []string
+			for _, ns := range list.Items {
+				names = append(names, ns.Name)
+			}
+
+			if !reflect.DeepEqual(names, test.expNames) {
+				t.Errorf("unexpected namespaces, exp=%v got=%v", test.expNames, names)
+			}
+		})
+	}
+}
+
+func TestFilterWatches(t *testing.T) {
+	f := newTestFilter(t)
+
+	type event struct {
+		eventType string
+		name      string
+		team      string
+	}
+
+	events := []event{
+		{"ADDED", "a-1", "a"},
+		{"ADDED", "b-1", "b"},
+		{"MODIFIED", "a-1", "b"},
+		{"MODIFIED", "b-1", "a"},
+		{"MODIFIED", "c-1", "c"},
+		{"DELETED", "c-1", "c"},
+		{"MODIFIED", "b-1", "c"},
+		{"DELETED", "b-1", "c"},
+	}
+
+	// Objects sent by the watch which are modified to no longer match are
+	// sent as deleted, stripped of their labels and other contents. Events of
+	// objects never sent are dropped, so their contents never reach the
+	// client.
+	expEvents := []event{
+		{"ADDED", "a-1", "a"},
+		{"DELETED", "a-1", ""},
+		{"MODIFIED", "b-1", "a"},
+		{"DELETED", "b-1", ""},
+	}
+
+	jsonEncode := func(t *testing.T, events []event) []byte {
+		var buf bytes.Buffer
+		for _, e := range events {
+			ns := newTestNamespace(e.name, e.team)
+			raw, err := json.Marshal(&ns)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := json.NewEncoder(&buf).Encode(&metav1.WatchEvent{
+				Type:   e.eventType,
+				Object: runtime.RawExtension{Raw: raw},
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return buf.Bytes()
+	}
+
+	jsonDecode := func(t *testing.T, b []byte) []event {
+		var events []event
+		decoder := json.NewDecoder(bytes.NewReader(b))
+		for decoder.More() {
+			var e metav1.WatchEvent
+			if err := decoder.Decode(&e); err != nil {
+				t.Fatal(err)
+			}
+
+			var ns corev1.Namespace
+			if err := json.Unmarshal(e.Object.Raw, &ns); err != nil {
+				t.Fatal(err)
+			}
+
+			events = append(events, event{e.Type, ns.Name, ns.Labels["team"]})
+		}
+		return events
+	}
+
+	// Tables, as watched by 'kubectl get --watch', carry the object metadata
+	// as the object of their single row.
+	tableEncode := func(t *testing.T, events []event) []byte {
+		var buf bytes.Buffer
+		for _, e := range events {
+			ns := newTestNamespace(e.name, e.team)
+			obj, err := json.Marshal(&metav1.PartialObjectMetadata{
+				TypeMeta:   metav1.TypeMeta{Kind: "PartialObjectMetadata", APIVersion: "meta.k8s.io/v1"},
+				ObjectMeta: ns.ObjectMeta,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			raw, err := json.Marshal(&metav1.Table{
+				TypeMeta: metav1.TypeMeta{Kind: "Table", APIVersion: "meta.k8s.io/v1"},
+				Rows: []metav1.TableRow{{
+					Cells:  []interface{}{e.name, e.team},
+					Object: runtime.RawExtension{Raw: obj},
+				}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := json.NewEncoder(&buf).Encode(&metav1.WatchEvent{
+				Type:   e.eventType,
+				Object: runtime.RawExtension{Raw: raw},
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return buf.Bytes()
+	}
+
+	tableDecode := func(t *testing.T, b []byte) []event {
+		var events []event
+		decoder := json.NewDecoder(bytes.NewReader(b))
+		for decoder.More() {
+			var e metav1.WatchEvent
+			if err := decoder.Decode(&e); err != nil {
+				t.Fatal(err)
+			}
+
+			var table metav1.Table
+			if err := json.Unmarshal(e.Object.Raw, &table); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(table.Rows) != 1 {
+				t.Fatalf("expected a single table row, got=%d", len(table.Rows))
+			}
+			row := table.Rows[0]
+
+			var obj metav1.PartialObjectMetadata
+			if err := json.Unmarshal(row.Object.Raw, &obj); err != nil {
+				t.Fatal(err)
+			}
+
+			// The cells of stripped rows must not leak the team either.
+			if len(row.Cells) != 2 || row.Cells[1] != obj.Labels["team"] {
+				t.Errorf("unexpected cells of %q, got=%v", obj.Name, row.Cells)
+			}
+
+			events = append(events, event{e.Type, obj.Name, obj.Labels["team"]})
+		}
+		return events
+	}
+
+	protobufEncode := func(t *testing.T, events []event) []byte {
+		var buf bytes.Buffer
+		for _, e := range events {
+			ns := newTestNamespace(e.name, e.team)
+
+			var raw bytes.Buffer
+			if err := protobufSerializer.Encode(&ns, &raw); err != nil {
+				t.Fatal(err)
+			}
+
+			frame, err := (&metav1.WatchEvent{
+				Type:   e.eventType,
+				Object: runtime.RawExtension{Raw: raw.Bytes()},
+			}).Marshal()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := binary.Write(&buf, binary.BigEndian, uint32(len(frame))); err != nil {
+				t.Fatal(err)
+			}
+			buf.Write(frame)
+		}
+		return buf.Bytes()
+	}
+
+	protobufDecode := func(t *testing.T, b []byte) []event {
+		var events []event
+		r := bytes.NewReader(b)
+		for r.Len() > 0 {
+			var length uint32
+			if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+				t.Fatal(err)
+			}
+
+			frame := make([]byte, length)
+			if _, err := r.Read(frame); err != nil {
+				t.Fatal(err)
+			}
+
+			var e metav1.WatchEvent
+			if err := e.Unmarshal(frame); err != nil {
+				t.Fatal(err)
+			}
+
+			obj, _, err := protobufSerializer.Decode(e.Object.Raw, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ns := obj.(*corev1.Namespace)
+
+			events = append(events, event{e.Type, ns.Name, ns.Labels["team"]})
+		}
+		return events
+	}
+
+	tests := map[string]struct {
+		contentType string
+		encode      func(*testing.T, []event) []byte
+		decode      func(*testing.T, []byte) []event
+	}{
+		"a JSON watch should be filtered": {
+			contentType: "application/json",
+			encode:      jsonEncode,
+			decode:      jsonDecode,
+		},
+		"a JSON table watch should be filtered by the row objects": {
+			contentType: "application/json",
+			encode:      tableEncode,
+			decode:      tableDecode,
+		},
+		"a protobuf watch should be filtered": {
+			contentType: "application/vnd.kubernetes.protobuf;stream=watch",
+			encode:      protobufEncode,
+			decode:      protobufDecode,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			filter, err := f.ResponseFilter(newTestRequest("/api/v1/namespaces", "watch=true"),
+				&user.DefaultInfo{Name: "alice"}, map[string]interface{}{"team": "a"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp := &http.Response{
+				StatusCode:    http.StatusOK,
+				Header:        http.Header{"Content-Type": []string{test.contentType}},
+				Body:          ioutil.NopCloser(bytes.NewReader(test.encode(t, events))),
+				ContentLength: -1,
+			}
+
+			if err := filter(resp); err != nil {
+				t.Fatal(err)
+			}
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := test.decode(t, body); !reflect.DeepEqual(got, expEvents) {
+				t.Errorf("unexpected events, exp=%v got=%v", expEvents, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package grants
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/metrics"
+	"github.com/jetstack/kube-oidc-proxy/pkg/util"
+)
+
+const (
+	filePollInterval = time.Second * 10
+)
+
+var (
+	grantedRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "grants",
+		Name:      "granted_requests_total",
+		Help:      "Number of requests made with a group granted by a time-bound grant, by group.",
+	}, []string{"group"})
+)
+
+func init() {
+	metrics.MustRegister(grantedRequestsTotal)
+}
+
+// Grant is a time-bound grant of membership of groups to a user.
+type Grant struct {
+	// User is the username the groups are granted to.
+	User string `json:"user"`
+
+	// Groups are the groups granted to the user.
+	Groups []string `json:"groups"`
+
+	// NotBefore, if given, is the time from which the grant is valid.
+	NotBefore *metav1.Time `json:"notBefore,omitempty"`
+
+	// Expires is the time the grant expires.
+	Expires metav1.Time `json:"expires"`
+
+	// Reason is why the groups were granted, such as a ticket reference.
+	Reason string `json:"reason,omitempty"`
+}
+
+// List is the list of grants, loaded from a file as YAML or JSON.
+type List struct {
+	Grants []Grant `json:"grants"`
+}
+
+// Grants holds time-bound grants of groups to users.
+type Grants struct {
+	run func(stopCh <-chan struct{})
+	now func() time.Time
+
+	// lock guards all fields below.
+	lock   sync.RWMutex
+	grants map[string][]Grant
+}
+
+func newGrants() *Grants {
+	return &Grants{
+		now:    time.Now,
+		grants: make(map[string][]Grant),
+	}
+}
+
+// NewStatic returns Grants with the given, unchanging, list of grants.
+func NewStatic(list *List) (*Grants, error) {
+	g := newGrants()
+	if err := g.set(list); err != nil {
+		return nil, err
+	}
+
+	g.run = func(<-chan struct{}) {}
+
+	return g, nil
+}
+
+// NewFromFile returns Grants whose list of grants is loaded from the given
+// file, which is watched for changes.
+func NewFromFile(path string) (*Grants, error) {
+	g := newGrants()
+
+	watcher, err := util.NewFileWatcher(path, filePollInterval, g.load)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load group grants from %q: %s", path, err)
+	}
+
+	g.run = watcher.Run
+
+	return g, nil
+}
+
+// Run will start watching the source of the grants until the stop channel is
+// closed.
+func (g *Grants) Run(stopCh <-chan struct{}) {
+	g.run(stopCh)
+}
+
+// Groups returns the groups granted to the user by grants which are currently
+// valid, without duplicates, along with the grants.
+func (g *Grants) Groups(username string) ([]string, []Grant) {
+	now := g.now()
+
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	var (
+		groups []string
+		active []Grant
+		seen   = make(map[string]bool)
+	)
+
+	for _, grant := range g.grants[username] {
+		if grant.NotBefore != nil && now.Before(grant.NotBefore.Time) {
+			continue
+		}
+
+		if !now.Before(grant.Expires.Time) {
+			continue
+		}
+
+		active = append(active, grant)
+		for _, group := range grant.Groups {
+			if !seen[group] {
+				seen[group] = true
+				groups = append(groups, group)
+			}
+		}
+	}
+
+	for _, group := range groups {
+		grantedRequestsTotal.WithLabelValues(group).Inc()
+	}
+
+	return groups, active
+}
+
+// load parses the list of grants and replaces the current grants.
+func (g *Grants) load(data []byte) error {
+	list := new(List)
+	if err := yaml.UnmarshalStrict(data, list); err != nil {
+		return fmt.Errorf("failed to decode group grants: %s", err)
+	}
+
+	return g.set(list)
+}
+
+func (g *Grants) set(list *List) error {
+	grants := make(map[string][]Grant)
+	for i, grant := range list.Grants {
+		if err := validate(grant); err != nil {
+			return fmt.Errorf("invalid grant %d: %s", i, err)
+		}
+
+		grants[grant.User] = append(grants[grant.User], grant)
+	}
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.grants = grants
+
+	klog.V(2).Infof("loaded group grants: %d grants for %d users", len(list.Grants), len(grants))
+
+	return nil
+}
+
+func validate(grant Grant) error {
+	if len(grant.User) == 0 {
+		return errors.New("must have a user")
+	}
+
+	if len(grant.Groups) == 0 {
+		return errors.New("must grant at least one group")
+	}
+
+	if grant.Expires.IsZero() {
+		return errors.New("must have an expiry time")
+	}
+
+	if grant.NotBefore != nil && !grant.NotBefore.Before(&grant.Expires) {
+		return errors.New("must not expire before it is valid")
+	}
+
+	return nil
+}
@@ -0,0 +1,170 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package grants
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGroups(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) metav1.Time {
+		return metav1.NewTime(now.Add(d))
+	}
+	notBefore := at(time.Minute)
+
+	g, err := NewStatic(&List{
+		Grants: []Grant{
+			{
+				User:    "a-user",
+				Groups:  []string{"cluster-admins"},
+				Expires: at(time.Hour),
+				Reason:  "INC-1234",
+			},
+			{
+				User:    "a-user",
+				Groups:  []string{"cluster-admins", "db-admins"},
+				Expires: at(time.Minute * 30),
+			},
+			{
+				User:    "a-user",
+				Groups:  []string{"expired"},
+				Expires: at(-time.Minute),
+			},
+			{
+				User:      "a-user",
+				Groups:    []string{"not-yet-valid"},
+				NotBefore: &notBefore,
+				Expires:   at(time.Hour),
+			},
+			{
+				User:    "b-user",
+				Groups:  []string{"b-admins"},
+				Expires: at(time.Hour),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.now = func() time.Time { return now }
+
+	tests := map[string]struct {
+		user      string
+		expGroups []string
+		expGrants int
+	}{
+		"a user with valid grants should have the groups without duplicates": {
+			user:      "a-user",
+			expGroups: []string{"cluster-admins", "db-admins"},
+			expGrants: 2,
+		},
+		"another user should only have their own groups": {
+			user:      "b-user",
+			expGroups: []string{"b-admins"},
+			expGrants: 1,
+		},
+		"a user without grants should have no groups": {
+			user: "c-user",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			groups, active := g.Groups(test.user)
+			if !reflect.DeepEqual(groups, test.expGroups) {
+				t.Errorf("unexpected groups, exp=%v got=%v", test.expGroups, groups)
+			}
+
+			if len(active) != test.expGrants {
+				t.Errorf("unexpected number of grants, exp=%d got=%d", test.expGrants, len(active))
+			}
+		})
+	}
+
+	// Once expired, the grant no longer applies.
+	g.now = func() time.Time { return now.Add(time.Hour) }
+	if groups, _ := g.Groups("a-user"); len(groups) != 0 {
+		t.Errorf("unexpected groups after expiry, exp=[] got=%v", groups)
+	}
+}
+
+func TestNewFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-oidc-proxy-grants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := map[string]struct {
+		data   string
+		expErr bool
+	}{
+		"a valid list should load": {
+			data: `grants:
+- user: a-user
+  groups: [cluster-admins]
+  expires: "2020-01-01T13:00:00Z"
+  reason: INC-1234
+`,
+		},
+		"a grant without a user should fail": {
+			data: `grants:
+- groups: [cluster-admins]
+  expires: "2020-01-01T13:00:00Z"
+`,
+			expErr: true,
+		},
+		"a grant without groups should fail": {
+			data: `grants:
+- user: a-user
+  expires: "2020-01-01T13:00:00Z"
+`,
+			expErr: true,
+		},
+		"a grant without an expiry should fail": {
+			data: `grants:
+- user: a-user
+  groups: [cluster-admins]
+`,
+			expErr: true,
+		},
+		"a grant expiring before it is valid should fail": {
+			data: `grants:
+- user: a-user
+  groups: [cluster-admins]
+  notBefore: "2020-01-01T13:00:00Z"
+  expires: "2020-01-01T12:00:00Z"
+`,
+			expErr: true,
+		},
+		"an unknown field should fail": {
+			data: `grants:
+- user: a-user
+  group: cluster-admins
+  expires: "2020-01-01T13:00:00Z"
+`,
+			expErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, "grants.yaml")
+			if err := ioutil.WriteFile(path, []byte(test.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := NewFromFile(path)
+			if test.expErr != (err != nil) {
+				t.Errorf("unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+		})
+	}
+}
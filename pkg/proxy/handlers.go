@@ -2,23 +2,45 @@
 package proxy
 
 import (
+	"encoding/json"
+	"errors"
 	"net/http"
 	"strings"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	k8saudit "k8s.io/apiserver/pkg/audit"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/request/bearertoken"
 	authuser "k8s.io/apiserver/pkg/authentication/user"
 	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
 	"k8s.io/client-go/transport"
 	"k8s.io/klog"
 
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/accessreview"
 	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/audit"
 	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/filter"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/impersonation"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/mutation"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/oidc"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/tenancy"
+	"github.com/jetstack/kube-oidc-proxy/pkg/util"
 )
 
 func (p *Proxy) withHandlers(handler http.Handler) http.Handler {
 	// Set up proxy handlers
+	handler = p.withImpersonationAudit(handler)
 	handler = p.auditor.WithRequest(handler)
+	handler = p.withRequestMutation(handler)
+	handler = p.withResponseFilter(handler)
+	handler = p.withTenancy(handler)
+	handler = p.withAccessReview(handler)
 	handler = p.withImpersonateRequest(handler)
+	handler = p.withMaxInFlight(handler)
+	handler = p.withFairness(handler)
 	handler = p.withAuthenticateRequest(handler)
+	handler = p.withTimeout(handler)
 
 	// Add the auditor backend as a shutdown hook
 	p.hooks.AddPreShutdownHook("AuditBackend", p.auditor.Shutdown)
@@ -29,13 +51,54 @@ func (p *Proxy) withHandlers(handler http.Handler) http.Handler {
 // withAuthenticateRequest adds the proxy authentication handler to a chain.
 func (p *Proxy) withAuthenticateRequest(handler http.Handler) http.Handler {
 	tokenReviewHandler := p.withTokenReview(handler)
+	introspectionHandler := p.withTokenIntrospection(handler, tokenReviewHandler)
+
+	var breakGlassRequestAuther *bearertoken.Authenticator
+	if p.config.BreakGlass != nil {
+		breakGlassRequestAuther = bearertoken.New(p.config.BreakGlass)
+	}
 
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-		// Auth request and handle unauthed
-		info, ok, err := p.oidcRequestAuther.AuthenticateRequest(req)
+		// The bearer token is removed from the request once authenticated so
+		// is kept for checking revocation.
+		token, _ := util.ParseTokenFromRequest(req)
+
+		// Break-glass tokens are verified locally, so are authenticated without
+		// the OIDC issuer. They are never passed to other authentication
+		// methods.
+		var (
+			info *authenticator.Response
+			ok   bool
+			err  error
+		)
+
+		if breakGlassRequestAuther != nil && p.config.BreakGlass.Matches(token) {
+			info, ok, err = breakGlassRequestAuther.AuthenticateRequest(req)
+			if err != nil || !ok {
+				klog.Warningf("rejected break-glass token (%s): %v", req.RemoteAddr, err)
+				p.handleError(rw, req, errUnauthorized)
+				return
+			}
+
+			klog.Warningf("break-glass access by %q with token %q (%s)", info.User.GetName(),
+				info.User.GetExtra()[audit.AnnotationBreakGlass][0], req.RemoteAddr)
+		} else {
+			// Auth request and handle unauthed
+			info, ok, err = p.oidcRequestAuther.AuthenticateRequest(req)
+		}
+
+		// Verified OIDC tokens which fail claim validation are rejected
+		// outright, rather than falling back to other authentication methods.
+		var validationErr *oidc.ClaimValidationError
+		if errors.As(err, &validationErr) {
+			p.handleError(rw, req, validationErr)
+			return
+		}
+
 		if err != nil {
-			// Since we have failed OIDC auth, we will try a token review, if enabled.
-			tokenReviewHandler.ServeHTTP(rw, req)
+			// Since we have failed OIDC auth, we will try token introspection
+			// then a token review, if enabled.
+			introspectionHandler.ServeHTTP(rw, req)
 			return
 		}
 
@@ -50,6 +113,86 @@ func (p *Proxy) withAuthenticateRequest(handler http.Handler) http.Handler {
 
 		klog.V(4).Infof("authenticated request: %s", remoteAddr)
 
+		// Add the user info to the request context
+		req = req.WithContext(genericapirequest.WithUser(req.Context(), info.User))
+
+		// Reject tokens which have been revoked since being issued
+		if p.config.TokenRevoker != nil {
+			reason, revoked, err := p.config.TokenRevoker.Revoked(token)
+			if err != nil {
+				klog.Errorf("failed to check token revocation (%s): %s", remoteAddr, err)
+				p.handleError(rw, req, errUnauthorized)
+				return
+			}
+
+			if revoked {
+				klog.V(2).Infof("revoked token used by %q (%s): %s",
+					info.User.GetName(), remoteAddr, reason)
+				p.handleError(rw, req, errTokenRevoked)
+				return
+			}
+		}
+
+		// Add the tenants of the user from the token to the request context
+		if p.config.Tenancy != nil {
+			tenants, err := p.config.Tenancy.Tenants(token)
+			if err != nil {
+				klog.V(2).Infof("failed to get tenants of %q (%s): %s",
+					info.User.GetName(), remoteAddr, err)
+				p.handleError(rw, req, errUnauthorized)
+				return
+			}
+
+			req = context.WithTenants(req, tenants)
+		}
+
+		// Add the claims of the token to the request context for filtering
+		// responses. Proxy policies may add a response filter at any time, so
+		// the claims are always added when enabled.
+		if p.config.ResponseFilter != nil || p.config.Policy != nil {
+			claims, err := util.UnverifiedTokenClaims(token)
+			if err != nil {
+				klog.V(2).Infof("failed to get claims of %q (%s): %s",
+					info.User.GetName(), remoteAddr, err)
+				p.handleError(rw, req, errUnauthorized)
+				return
+			}
+
+			req = context.WithClaims(req, claims)
+		}
+
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// withTokenIntrospection will attempt to authenticate the request using token
+// introspection, if enabled, falling back to the next handler if
+// unsuccessful. Introspected tokens are opaque, so token revocation, tenancy
+// and response filtering may not be enabled with token introspection.
+func (p *Proxy) withTokenIntrospection(handler, fallback http.Handler) http.Handler {
+	if p.config.TokenIntrospector == nil {
+		return fallback
+	}
+
+	introspectionRequestAuther := bearertoken.New(p.config.TokenIntrospector)
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var remoteAddr string
+		req, remoteAddr = context.RemoteAddr(req)
+
+		info, ok, err := introspectionRequestAuther.AuthenticateRequest(req)
+		if err != nil || !ok {
+			if err != nil {
+				klog.V(4).Infof("failed to authenticate request using token introspection (%s): %s",
+					remoteAddr, err)
+			}
+
+			fallback.ServeHTTP(rw, req)
+			return
+		}
+
+		klog.V(4).Infof("authenticated request using token introspection: %s", remoteAddr)
+
 		// Add the user info to the request context
 		req = req.WithContext(genericapirequest.WithUser(req.Context(), info.User))
 		handler.ServeHTTP(rw, req)
@@ -101,7 +244,7 @@ func (p *Proxy) withImpersonateRequest(handler http.Handler) http.Handler {
 			return
 		}
 
-		if p.hasImpersonation(req.Header) {
+		if p.hasImpersonation(req.Header) && p.config.ImpersonationAuthorizer == nil {
 			p.handleError(rw, req, errImpersonateHeader)
 			return
 		}
@@ -126,7 +269,64 @@ func (p *Proxy) withImpersonateRequest(handler http.Handler) http.Handler {
 			groups = append(groups, authuser.AllAuthenticated)
 		}
 
-		extra := user.GetExtra()
+		name, extra := user.GetName(), user.GetExtra()
+
+		// If the user has requested impersonation, and is authorized to do so,
+		// impersonate the requested identity instead, recording the user in the
+		// extras.
+		if p.config.ImpersonationAuthorizer != nil {
+			requested, err := impersonation.Requested(req.Header)
+			if err != nil {
+				p.handleError(rw, req, err)
+				return
+			}
+
+			if requested != nil {
+				if err := p.config.ImpersonationAuthorizer.Authorize(req.Context(), user, requested); err != nil {
+					p.handleError(rw, req, err)
+					return
+				}
+
+				klog.V(2).Infof("user %q impersonating %q: %s", user.GetName(), requested.UserName, remoteAddr)
+
+				chained := impersonation.Chain(user, requested)
+				name, groups, extra = chained.UserName, chained.Groups, chained.Extra
+
+				req = context.WithImpersonatedUser(req, &authuser.DefaultInfo{
+					Name:   requested.UserName,
+					Groups: requested.Groups,
+					Extra:  requested.Extra,
+				})
+			}
+
+			// The impersonation headers are replaced by those of the proxy.
+			removeImpersonation(req.Header)
+		}
+
+		// Add the groups granted to the user by any time-bound grants currently
+		// valid. Grants do not apply to identities impersonated by the user.
+		if p.config.Grants != nil && context.ImpersonatedUser(req) == nil {
+			if granted, active := p.config.Grants.Groups(name); len(granted) > 0 {
+				reasons := make([]string, 0, len(active))
+				for _, grant := range active {
+					if len(grant.Reason) > 0 {
+						reasons = append(reasons, grant.Reason)
+					}
+				}
+
+				klog.Infof("user %q using granted groups %q (reasons: %q): %s",
+					name, granted, reasons, remoteAddr)
+
+				existing := sets.NewString(groups...)
+				for _, group := range granted {
+					if !existing.Has(group) {
+						groups = append(groups, group)
+					}
+				}
+
+				req = context.WithGrantedGroups(req, granted)
+			}
+		}
 
 		if extra == nil {
 			extra = make(map[string][]string)
@@ -152,7 +352,7 @@ func (p *Proxy) withImpersonateRequest(handler http.Handler) http.Handler {
 		}
 
 		conf := &transport.ImpersonationConfig{
-			UserName: user.GetName(),
+			UserName: name,
 			Groups:   groups,
 			Extra:    extra,
 		}
@@ -163,6 +363,196 @@ func (p *Proxy) withImpersonateRequest(handler http.Handler) http.Handler {
 	})
 }
 
+// withAccessReview will deny requests not allowed for the impersonated
+// identity by a SubjectAccessReview against the upstream cluster, if enabled.
+// Requests forwarded without impersonation are not reviewed.
+func (p *Proxy) withAccessReview(handler http.Handler) http.Handler {
+	if p.config.AccessReview == nil {
+		return handler
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conf := context.ImpersonationConfig(req)
+		if context.NoImpersonation(req) || conf == nil {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		if err := p.config.AccessReview.Review(req, conf); err != nil {
+			p.handleError(rw, req, err)
+			return
+		}
+
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// withImpersonationAudit will record the user impersonated by the
+// authenticated user, and the groups granted to the user by time-bound grants,
+// in the audit event of the request, if any.
+func (p *Proxy) withImpersonationAudit(handler http.Handler) http.Handler {
+	if p.config.ImpersonationAuthorizer == nil && p.config.Grants == nil {
+		return handler
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if ev := genericapirequest.AuditEventFrom(req.Context()); ev != nil {
+			if u := context.ImpersonatedUser(req); u != nil {
+				k8saudit.LogImpersonatedUser(ev, u)
+			}
+
+			if groups := context.GrantedGroups(req); len(groups) > 0 {
+				k8saudit.LogAnnotation(ev, audit.AnnotationGrantedGroups, strings.Join(groups, ","))
+			}
+		}
+
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// withFairness will queue requests fairly between users, if enabled.
+// Long-running requests, requests whose RequestInfo cannot be resolved, and
+// requests passed through with token review, are not queued.
+func (p *Proxy) withFairness(handler http.Handler) http.Handler {
+	if p.config.Fairness == nil {
+		return handler
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		user, ok := genericapirequest.UserFrom(req.Context())
+		if !ok {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		info, err := context.RequestInfo(req)
+		if err != nil {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		if p.auditor.LongRunningFunc()(req, info) {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		done, ok := p.config.Fairness.Wait(req.Context(), user, info.Verb)
+		if !ok {
+			klog.V(2).Infof("fairness queue rejected request from %q (%s)", user.GetName(), req.RemoteAddr)
+			p.handleError(rw, req, errTooManyRequests)
+			return
+		}
+		defer done()
+
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// withTenancy will deny requests accessing namespaces not owned by the tenants
+// of the user, if enabled. Requests passed through with token review are not
+// restricted.
+func (p *Proxy) withTenancy(handler http.Handler) http.Handler {
+	if p.config.Tenancy == nil {
+		return handler
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		user, ok := genericapirequest.UserFrom(req.Context())
+		if !ok {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		filter, err := p.config.Tenancy.Authorize(req, user, context.Tenants(req))
+		if err != nil {
+			p.handleError(rw, req, err)
+			return
+		}
+
+		if filter != nil {
+			req = context.WithResponseFilter(req, filter)
+		}
+
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// withResponseFilter will filter the upstream list and watch responses of the
+// configured resources to the objects matching the selectors of the user, if
+// enabled.
+func (p *Proxy) withResponseFilter(handler http.Handler) http.Handler {
+	if p.config.ResponseFilter == nil && p.config.Policy == nil {
+		return handler
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		responseFilter := p.responseFilter()
+
+		user, ok := genericapirequest.UserFrom(req.Context())
+		if !ok || responseFilter == nil {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		filter, err := responseFilter.ResponseFilter(req, user, context.Claims(req))
+		if err != nil {
+			p.handleError(rw, req, err)
+			return
+		}
+
+		if filter != nil {
+			req = context.WithResponseFilter(req, filter)
+		}
+
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// withRequestMutation will apply the configured mutators to the bodies of
+// requests, if enabled.
+func (p *Proxy) withRequestMutation(handler http.Handler) http.Handler {
+	if p.config.RequestMutation == nil && p.config.Policy == nil {
+		return handler
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requestMutation := p.requestMutation()
+
+		user, ok := genericapirequest.UserFrom(req.Context())
+		if !ok || requestMutation == nil {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		if err := requestMutation.Mutate(req, user); err != nil {
+			p.handleError(rw, req, err)
+			return
+		}
+
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// responseFilter returns the response filter, from the proxy policies if
+// enabled.
+func (p *Proxy) responseFilter() *filter.Filter {
+	if p.config.Policy != nil {
+		return p.config.Policy.ResponseFilter()
+	}
+
+	return p.config.ResponseFilter
+}
+
+// requestMutation returns the request mutation, from the proxy policies if
+// enabled.
+func (p *Proxy) requestMutation() *mutation.Mutation {
+	if p.config.Policy != nil {
+		return p.config.Policy.RequestMutation()
+	}
+
+	return p.config.RequestMutation
+}
+
 // newErrorHandler returns a handler failed requests.
 func (p *Proxy) newErrorHandler() func(rw http.ResponseWriter, r *http.Request, err error) {
 	unauthedHandler := audit.NewUnauthenticatedHandler(p.auditor, func(rw http.ResponseWriter, r *http.Request) {
@@ -170,6 +560,29 @@ func (p *Proxy) newErrorHandler() func(rw http.ResponseWriter, r *http.Request,
 		http.Error(rw, "Unauthorized", http.StatusUnauthorized)
 	})
 
+	// Requests rejected by the proxy after authentication are audited along
+	// with the reason for their rejection.
+	impersonateHeaderHandler := audit.NewRejectedHandler(p.auditor, errImpersonateHeader.Error(), func(rw http.ResponseWriter, r *http.Request) {
+		klog.V(2).Infof("impersonation user request %s", r.RemoteAddr)
+		http.Error(rw, "Impersonation requests are disabled when using kube-oidc-proxy", http.StatusForbidden)
+	})
+
+	noNameHandler := audit.NewRejectedHandler(p.auditor, errNoName.Error(), func(rw http.ResponseWriter, r *http.Request) {
+		klog.V(2).Infof("no name available in oidc info %s", r.RemoteAddr)
+		http.Error(rw, "Username claim not available in OIDC Issuer response", http.StatusForbidden)
+	})
+
+	revokedHandler := audit.NewRejectedHandler(p.auditor, errTokenRevoked.Error(), func(rw http.ResponseWriter, r *http.Request) {
+		http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+	})
+
+	tooManyRequestsHandler := audit.NewRejectedHandler(p.auditor, errTooManyRequests.Error(), func(rw http.ResponseWriter, r *http.Request) {
+		klog.V(2).Infof("too many requests in flight, rejecting request %s", r.RemoteAddr)
+		rw.Header().Set("Retry-After", "1")
+		writeStatus(rw, http.StatusTooManyRequests, metav1.StatusReasonTooManyRequests,
+			"Too many requests, please try again later.")
+	})
+
 	return func(rw http.ResponseWriter, r *http.Request, err error) {
 		if err == nil {
 			klog.Error("error was called with no error")
@@ -177,6 +590,57 @@ func (p *Proxy) newErrorHandler() func(rw http.ResponseWriter, r *http.Request,
 			return
 		}
 
+		// Failed OIDC claim validation, with a message for the user
+		if validationErr, ok := err.(*oidc.ClaimValidationError); ok {
+			audit.NewUnauthenticatedHandler(p.auditor, func(rw http.ResponseWriter, r *http.Request) {
+				klog.V(2).Infof("unauthenticated user request %s: %s", r.RemoteAddr, validationErr)
+				writeStatus(rw, http.StatusUnauthorized, metav1.StatusReasonUnauthorized, validationErr.Message)
+			}).ServeHTTP(rw, r)
+			return
+		}
+
+		// Denied access to a namespace of another tenant
+		if forbiddenErr, ok := err.(*tenancy.ForbiddenError); ok {
+			audit.NewRejectedHandler(p.auditor, errTenancyForbidden.Error(), func(rw http.ResponseWriter, r *http.Request) {
+				klog.V(2).Infof("tenancy forbidden request %s: %s", r.RemoteAddr, forbiddenErr)
+				writeStatus(rw, http.StatusForbidden, metav1.StatusReasonForbidden, forbiddenErr.Message)
+			}).ServeHTTP(rw, r)
+			return
+		}
+
+		// Denied by a SubjectAccessReview of the impersonated identity
+		if forbiddenErr, ok := err.(*accessreview.ForbiddenError); ok {
+			audit.NewRejectedHandler(p.auditor, errAccessReviewForbidden.Error(), func(rw http.ResponseWriter, r *http.Request) {
+				klog.V(2).Infof("access review forbidden request %s: %s", r.RemoteAddr, forbiddenErr)
+				writeStatus(rw, http.StatusForbidden, metav1.StatusReasonForbidden, forbiddenErr.Message)
+			}).ServeHTTP(rw, r)
+			return
+		}
+
+		// Request body unable to be mutated
+		if mutationErr, ok := err.(*mutation.Error); ok {
+			audit.NewRejectedHandler(p.auditor, errMutationRejected.Error(), func(rw http.ResponseWriter, r *http.Request) {
+				klog.V(2).Infof("request mutation rejected request %s: %s", r.RemoteAddr, mutationErr)
+				writeStatus(rw, mutationErr.Code, mutationErr.Reason, mutationErr.Message)
+			}).ServeHTTP(rw, r)
+			return
+		}
+
+		// Requested impersonation not allowed
+		if impersonationErr, ok := err.(*impersonation.Error); ok {
+			audit.NewRejectedHandler(p.auditor, errImpersonationRejected.Error(), func(rw http.ResponseWriter, r *http.Request) {
+				klog.V(2).Infof("impersonation rejected request %s: %s", r.RemoteAddr, impersonationErr)
+				writeStatus(rw, impersonationErr.Code, impersonationErr.Reason, impersonationErr.Message)
+			}).ServeHTTP(rw, r)
+			return
+		}
+
+		// Failed to receive a response from the API server
+		if upstreamErr, ok := err.(*upstreamError); ok {
+			handleUpstreamError(rw, r, upstreamErr)
+			return
+		}
+
 		switch err {
 
 		// Failed auth
@@ -187,14 +651,22 @@ func (p *Proxy) newErrorHandler() func(rw http.ResponseWriter, r *http.Request,
 
 			// User request with impersonation
 		case errImpersonateHeader:
-			klog.V(2).Infof("impersonation user request %s", r.RemoteAddr)
-			http.Error(rw, "Impersonation requests are disabled when using kube-oidc-proxy", http.StatusForbidden)
+			impersonateHeaderHandler.ServeHTTP(rw, r)
 			return
 
 			// No name given or available in oidc request
 		case errNoName:
-			klog.V(2).Infof("no name available in oidc info %s", r.RemoteAddr)
-			http.Error(rw, "Username claim not available in OIDC Issuer response", http.StatusForbidden)
+			noNameHandler.ServeHTTP(rw, r)
+			return
+
+			// Authenticated with a revoked token
+		case errTokenRevoked:
+			revokedHandler.ServeHTTP(rw, r)
+			return
+
+			// Over the max-in-flight limits
+		case errTooManyRequests:
+			tooManyRequestsHandler.ServeHTTP(rw, r)
 			return
 
 			// No impersonation configuration found in context
@@ -211,6 +683,29 @@ func (p *Proxy) newErrorHandler() func(rw http.ResponseWriter, r *http.Request,
 	}
 }
 
+// writeStatus will write a Kubernetes Status response with the given code,
+// reason and message.
+func writeStatus(rw http.ResponseWriter, code int, reason metav1.StatusReason, message string) {
+	status := &metav1.Status{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       "Status",
+			APIVersion: "v1",
+		},
+		Status:  metav1.StatusFailure,
+		Code:    int32(code),
+		Reason:  reason,
+		Message: message,
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(code)
+
+	if err := json.NewEncoder(rw).Encode(status); err != nil {
+		klog.Errorf("failed to write status response: %s", err)
+	}
+}
+
 func (p *Proxy) hasImpersonation(header http.Header) bool {
 	for h := range header {
 		if strings.ToLower(h) == impersonateUserHeader ||
@@ -223,3 +718,15 @@ func (p *Proxy) hasImpersonation(header http.Header) bool {
 
 	return false
 }
+
+// removeImpersonation will remove all impersonation headers.
+func removeImpersonation(header http.Header) {
+	for h := range header {
+		if strings.ToLower(h) == impersonateUserHeader ||
+			strings.ToLower(h) == impersonateGroupHeader ||
+			strings.HasPrefix(strings.ToLower(h), impersonateExtraHeader) {
+
+			header.Del(h)
+		}
+	}
+}
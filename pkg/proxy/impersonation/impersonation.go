@@ -0,0 +1,213 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package impersonation
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/authentication/serviceaccount"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/client-go/kubernetes"
+	authorizationv1client "k8s.io/client-go/kubernetes/typed/authorization/v1"
+	"k8s.io/client-go/transport"
+)
+
+const (
+	// ImpersonatorUserExtraKey is the extra key recording the username of the
+	// user who requested the impersonation.
+	ImpersonatorUserExtraKey = "kube-oidc-proxy.jetstack.io/impersonator"
+
+	// ImpersonatorGroupsExtraKey is the extra key recording the groups of the
+	// user who requested the impersonation.
+	ImpersonatorGroupsExtraKey = "kube-oidc-proxy.jetstack.io/impersonator-groups"
+)
+
+// Error is returned when a requested impersonation is rejected.
+type Error struct {
+	Code    int
+	Reason  metav1.StatusReason
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Authorizer authorizes users to impersonate other users, groups and extras
+// using SubjectAccessReviews, in the same way as the API server.
+type Authorizer struct {
+	client authorizationv1client.SubjectAccessReviewInterface
+}
+
+func New(client kubernetes.Interface) *Authorizer {
+	return &Authorizer{
+		client: client.AuthorizationV1().SubjectAccessReviews(),
+	}
+}
+
+// Requested returns the impersonation requested by the headers, or nil if
+// none was requested.
+func Requested(header http.Header) (*transport.ImpersonationConfig, error) {
+	conf := &transport.ImpersonationConfig{
+		UserName: header.Get(authenticationv1.ImpersonateUserHeader),
+		Groups:   header[http.CanonicalHeaderKey(authenticationv1.ImpersonateGroupHeader)],
+	}
+
+	for name, values := range header {
+		if !strings.HasPrefix(name, authenticationv1.ImpersonateUserExtraHeaderPrefix) {
+			continue
+		}
+
+		key := strings.ToLower(name[len(authenticationv1.ImpersonateUserExtraHeaderPrefix):])
+		if unescaped, err := url.PathUnescape(key); err == nil {
+			key = unescaped
+		}
+
+		if conf.Extra == nil {
+			conf.Extra = make(map[string][]string)
+		}
+		conf.Extra[key] = append(conf.Extra[key], values...)
+	}
+
+	if len(conf.UserName) == 0 {
+		if len(conf.Groups) > 0 || len(conf.Extra) > 0 {
+			return nil, &Error{
+				Code:    http.StatusBadRequest,
+				Reason:  metav1.StatusReasonBadRequest,
+				Message: "impersonating groups or extras requires impersonating a user",
+			}
+		}
+
+		return nil, nil
+	}
+
+	// Like the API server, if no groups are given they are derived from the
+	// user. Otherwise the given groups are the authority.
+	if len(conf.Groups) == 0 {
+		if namespace, _, err := serviceaccount.SplitUsername(conf.UserName); err == nil {
+			conf.Groups = serviceaccount.MakeGroupNames(namespace)
+		}
+
+		if conf.UserName != user.Anonymous {
+			conf.Groups = append(conf.Groups, user.AllAuthenticated)
+		}
+	}
+
+	return conf, nil
+}
+
+// Authorize will authorize the user to impersonate the requested user, groups
+// and extras. If any are not allowed, an Error is returned.
+func (a *Authorizer) Authorize(ctx context.Context, u user.Info, requested *transport.ImpersonationConfig) error {
+	var attrs []*authorizationv1.ResourceAttributes
+
+	if namespace, name, err := serviceaccount.SplitUsername(requested.UserName); err == nil {
+		attrs = append(attrs, &authorizationv1.ResourceAttributes{
+			Namespace: namespace,
+			Resource:  "serviceaccounts",
+			Name:      name,
+		})
+	} else {
+		attrs = append(attrs, &authorizationv1.ResourceAttributes{
+			Resource: "users",
+			Name:     requested.UserName,
+		})
+	}
+
+	for _, group := range requested.Groups {
+		attrs = append(attrs, &authorizationv1.ResourceAttributes{
+			Resource: "groups",
+			Name:     group,
+		})
+	}
+
+	for key, values := range requested.Extra {
+		for _, value := range values {
+			attrs = append(attrs, &authorizationv1.ResourceAttributes{
+				Group:       authenticationv1.SchemeGroupVersion.Group,
+				Resource:    "userextras",
+				Subresource: key,
+				Name:        value,
+			})
+		}
+	}
+
+	extra := make(map[string]authorizationv1.ExtraValue)
+	for k, v := range u.GetExtra() {
+		extra[k] = v
+	}
+
+	for _, attr := range attrs {
+		attr.Verb = "impersonate"
+
+		review, err := a.client.Create(ctx, &authorizationv1.SubjectAccessReview{
+			Spec: authorizationv1.SubjectAccessReviewSpec{
+				ResourceAttributes: attr,
+				User:               u.GetName(),
+				Groups:             u.GetGroups(),
+				Extra:              extra,
+				UID:                u.GetUID(),
+			},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to review impersonation: %s", err)
+		}
+
+		if !review.Status.Allowed || review.Status.Denied {
+			return &Error{
+				Code:    http.StatusForbidden,
+				Reason:  metav1.StatusReasonForbidden,
+				Message: forbiddenMessage(u, attr, review.Status.Reason),
+			}
+		}
+	}
+
+	return nil
+}
+
+// Chain returns the impersonation configuration of the requested identity,
+// recording the user who requested it in the extras.
+func Chain(u user.Info, requested *transport.ImpersonationConfig) *transport.ImpersonationConfig {
+	extra := make(map[string][]string)
+	for k, v := range requested.Extra {
+		extra[k] = append([]string(nil), v...)
+	}
+
+	extra[ImpersonatorUserExtraKey] = []string{u.GetName()}
+	if groups := u.GetGroups(); len(groups) > 0 {
+		extra[ImpersonatorGroupsExtraKey] = append([]string(nil), groups...)
+	}
+
+	return &transport.ImpersonationConfig{
+		UserName: requested.UserName,
+		Groups:   append([]string(nil), requested.Groups...),
+		Extra:    extra,
+	}
+}
+
+// forbiddenMessage returns a message in the form of the API server's.
+func forbiddenMessage(u user.Info, attr *authorizationv1.ResourceAttributes, reason string) string {
+	resource := attr.Resource
+	if len(attr.Subresource) > 0 {
+		resource = resource + "/" + attr.Subresource
+	}
+
+	scope := "at the cluster scope"
+	if len(attr.Namespace) > 0 {
+		scope = fmt.Sprintf("in the namespace %q", attr.Namespace)
+	}
+
+	msg := fmt.Sprintf("%s %q is forbidden: User %q cannot impersonate resource %q in API group %q %s",
+		attr.Resource, attr.Name, u.GetName(), resource, attr.Group, scope)
+	if len(reason) > 0 {
+		msg = msg + ": " + reason
+	}
+
+	return msg
+}
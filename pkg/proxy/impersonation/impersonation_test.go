@@ -0,0 +1,217 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package impersonation
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/transport"
+)
+
+func TestRequested(t *testing.T) {
+	tests := map[string]struct {
+		header  http.Header
+		expConf *transport.ImpersonationConfig
+		expErr  bool
+	}{
+		"no impersonation headers should return nil": {
+			header: http.Header{
+				"Authorization": []string{"bearer fake-token"},
+			},
+		},
+		"a user without groups should be given the authenticated group": {
+			header: http.Header{
+				"Impersonate-User": []string{"a-user"},
+			},
+			expConf: &transport.ImpersonationConfig{
+				UserName: "a-user",
+				Groups:   []string{user.AllAuthenticated},
+			},
+		},
+		"a service account without groups should be given the service account groups": {
+			header: http.Header{
+				"Impersonate-User": []string{"system:serviceaccount:foo:bar"},
+			},
+			expConf: &transport.ImpersonationConfig{
+				UserName: "system:serviceaccount:foo:bar",
+				Groups: []string{
+					"system:serviceaccounts",
+					"system:serviceaccounts:foo",
+					user.AllAuthenticated,
+				},
+			},
+		},
+		"a user with groups and escaped extras should return them": {
+			header: http.Header{
+				"Impersonate-User":                    []string{"a-user"},
+				"Impersonate-Group":                   []string{"a-group", "b-group"},
+				"Impersonate-Extra-Example.com%2fFoo": []string{"bar"},
+			},
+			expConf: &transport.ImpersonationConfig{
+				UserName: "a-user",
+				Groups:   []string{"a-group", "b-group"},
+				Extra: map[string][]string{
+					"example.com/foo": []string{"bar"},
+				},
+			},
+		},
+		"groups without a user should error": {
+			header: http.Header{
+				"Impersonate-Group": []string{"a-group"},
+			},
+			expErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			conf, err := Requested(test.header)
+			if (err != nil) != test.expErr {
+				t.Errorf("unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+
+			if !reflect.DeepEqual(conf, test.expConf) {
+				t.Errorf("unexpected impersonation config, exp=%+v got=%+v", test.expConf, conf)
+			}
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	var reviews []*authorizationv1.SubjectAccessReview
+
+	// The user may impersonate anything other than the "root" user, or the
+	// "system:masters" group.
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "subjectaccessreviews", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		sar := action.(clienttesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		reviews = append(reviews, sar)
+
+		switch sar.Spec.ResourceAttributes.Name {
+		case "root", user.SystemPrivilegedGroup:
+			sar.Status.Reason = "no RBAC policy matched"
+		default:
+			sar.Status.Allowed = true
+		}
+
+		return true, sar, nil
+	})
+
+	a := New(client)
+	u := &user.DefaultInfo{
+		Name:   "a-user",
+		Groups: []string{"sre"},
+	}
+
+	tests := map[string]struct {
+		requested  *transport.ImpersonationConfig
+		expReviews []authorizationv1.ResourceAttributes
+		expErr     string
+	}{
+		"an allowed user, group and extra should be authorized": {
+			requested: &transport.ImpersonationConfig{
+				UserName: "b-user",
+				Groups:   []string{"b-group"},
+				Extra:    map[string][]string{"scopes": []string{"view"}},
+			},
+			expReviews: []authorizationv1.ResourceAttributes{
+				{Verb: "impersonate", Resource: "users", Name: "b-user"},
+				{Verb: "impersonate", Resource: "groups", Name: "b-group"},
+				{Verb: "impersonate", Group: "authentication.k8s.io", Resource: "userextras", Subresource: "scopes", Name: "view"},
+			},
+		},
+		"an allowed service account should be authorized in its namespace": {
+			requested: &transport.ImpersonationConfig{
+				UserName: "system:serviceaccount:foo:bar",
+			},
+			expReviews: []authorizationv1.ResourceAttributes{
+				{Verb: "impersonate", Namespace: "foo", Resource: "serviceaccounts", Name: "bar"},
+			},
+		},
+		"a denied user should be forbidden": {
+			requested: &transport.ImpersonationConfig{
+				UserName: "root",
+			},
+			expReviews: []authorizationv1.ResourceAttributes{
+				{Verb: "impersonate", Resource: "users", Name: "root"},
+			},
+			expErr: `users "root" is forbidden: User "a-user" cannot impersonate resource "users" in API group "" at the cluster scope: no RBAC policy matched`,
+		},
+		"a denied group should be forbidden": {
+			requested: &transport.ImpersonationConfig{
+				UserName: "b-user",
+				Groups:   []string{user.SystemPrivilegedGroup},
+			},
+			expReviews: []authorizationv1.ResourceAttributes{
+				{Verb: "impersonate", Resource: "users", Name: "b-user"},
+				{Verb: "impersonate", Resource: "groups", Name: user.SystemPrivilegedGroup},
+			},
+			expErr: `groups "system:masters" is forbidden: User "a-user" cannot impersonate resource "groups" in API group "" at the cluster scope: no RBAC policy matched`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			reviews = nil
+
+			err := a.Authorize(context.TODO(), u, test.requested)
+			if len(test.expErr) > 0 {
+				impersonationErr, ok := err.(*Error)
+				if !ok || impersonationErr.Code != http.StatusForbidden || impersonationErr.Message != test.expErr {
+					t.Errorf("unexpected error, exp=%q got=%v", test.expErr, err)
+				}
+			} else if err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+
+			var attrs []authorizationv1.ResourceAttributes
+			for _, review := range reviews {
+				if review.Spec.User != u.Name || !reflect.DeepEqual(review.Spec.Groups, u.Groups) {
+					t.Errorf("unexpected review user, exp=%s %v got=%s %v",
+						u.Name, u.Groups, review.Spec.User, review.Spec.Groups)
+				}
+
+				attrs = append(attrs, *review.Spec.ResourceAttributes)
+			}
+
+			if !reflect.DeepEqual(attrs, test.expReviews) {
+				t.Errorf("unexpected reviews, exp=%+v got=%+v", test.expReviews, attrs)
+			}
+		})
+	}
+}
+
+func TestChain(t *testing.T) {
+	requested := &transport.ImpersonationConfig{
+		UserName: "b-user",
+		Groups:   []string{"b-group"},
+		Extra:    map[string][]string{"scopes": []string{"view"}},
+	}
+
+	conf := Chain(&user.DefaultInfo{Name: "a-user", Groups: []string{"sre"}}, requested)
+
+	exp := &transport.ImpersonationConfig{
+		UserName: "b-user",
+		Groups:   []string{"b-group"},
+		Extra: map[string][]string{
+			"scopes":                   []string{"view"},
+			ImpersonatorUserExtraKey:   []string{"a-user"},
+			ImpersonatorGroupsExtraKey: []string{"sre"},
+		},
+	}
+
+	if !reflect.DeepEqual(conf, exp) {
+		t.Errorf("unexpected chained impersonation config, exp=%+v got=%+v", exp, conf)
+	}
+
+	if _, ok := requested.Extra[ImpersonatorUserExtraKey]; ok {
+		t.Error("expected requested extras not to be modified")
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/sets"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/metrics"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+)
+
+const (
+	readOnlyKind = "readOnly"
+	mutatingKind = "mutating"
+)
+
+var (
+	requestsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Name:      "requests_in_flight",
+		Help:      "Number of requests in flight subject to the max-in-flight limits, by request kind.",
+	}, []string{"request_kind"})
+
+	requestsRejectedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Name:      "requests_rejected_total",
+		Help:      "Number of requests rejected for exceeding the max-in-flight limits, by request kind.",
+	}, []string{"request_kind"})
+
+	// nonMutatingRequestVerbs are the verbs of read-only requests, matching
+	// the API server.
+	nonMutatingRequestVerbs = sets.NewString("get", "list", "watch")
+)
+
+func init() {
+	metrics.MustRegister(requestsInFlight, requestsRejectedTotal)
+}
+
+// withMaxInFlight limits the number of read-only and mutating requests in
+// flight, rejecting requests over the limits. Like the API server, long-running
+// requests are not limited, nor are requests whose RequestInfo cannot be
+// resolved.
+func (p *Proxy) withMaxInFlight(handler http.Handler) http.Handler {
+	if p.config.MaxRequestsInFlight <= 0 && p.config.MaxMutatingRequestsInFlight <= 0 {
+		return handler
+	}
+
+	var readOnlyCh, mutatingCh chan struct{}
+	if p.config.MaxRequestsInFlight > 0 {
+		readOnlyCh = make(chan struct{}, p.config.MaxRequestsInFlight)
+	}
+	if p.config.MaxMutatingRequestsInFlight > 0 {
+		mutatingCh = make(chan struct{}, p.config.MaxMutatingRequestsInFlight)
+	}
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		info, err := context.RequestInfo(req)
+		if err != nil {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		if p.auditor.LongRunningFunc()(req, info) {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		kind, ch := readOnlyKind, readOnlyCh
+		if !nonMutatingRequestVerbs.Has(info.Verb) {
+			kind, ch = mutatingKind, mutatingCh
+		}
+
+		// No limit for this kind of request
+		if ch == nil {
+			handler.ServeHTTP(rw, req)
+			return
+		}
+
+		select {
+		case ch <- struct{}{}:
+			requestsInFlight.WithLabelValues(kind).Inc()
+			defer func() {
+				<-ch
+				requestsInFlight.WithLabelValues(kind).Dec()
+			}()
+
+			handler.ServeHTTP(rw, req)
+
+		default:
+			requestsRejectedTotal.WithLabelValues(kind).Inc()
+			p.handleError(rw, req, errTooManyRequests)
+		}
+	})
+}
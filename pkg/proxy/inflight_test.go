@@ -0,0 +1,78 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithMaxInFlight(t *testing.T) {
+	p := newTestProxy(t)
+	p.config.MaxRequestsInFlight = 1
+	p.config.MaxMutatingRequestsInFlight = 1
+
+	// Requests to the blocking path are held in flight until released.
+	releaseCh, blockedCh := make(chan struct{}), make(chan struct{})
+	handler := p.withMaxInFlight(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Query().Get("block") == "true" {
+			blockedCh <- struct{}{}
+			<-releaseCh
+		}
+	}))
+
+	serve := func(method, url string) int {
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, httptest.NewRequest(method, url, nil))
+		return rw.Code
+	}
+
+	doneCh := make(chan struct{})
+	go func() {
+		serve(http.MethodGet, "/api/v1/pods?block=true")
+		close(doneCh)
+	}()
+	<-blockedCh
+
+	tests := map[string]struct {
+		method  string
+		url     string
+		expCode int
+	}{
+		"a read-only request over the limit should be rejected": {
+			method:  http.MethodGet,
+			url:     "/api/v1/namespaces/default/pods/a",
+			expCode: http.StatusTooManyRequests,
+		},
+		"a non resource request over the limit should be rejected": {
+			method:  http.MethodGet,
+			url:     "/version",
+			expCode: http.StatusTooManyRequests,
+		},
+		"a mutating request should not be limited by read-only requests": {
+			method:  http.MethodPost,
+			url:     "/api/v1/namespaces/default/pods",
+			expCode: http.StatusOK,
+		},
+		"a watch should not be limited": {
+			method:  http.MethodGet,
+			url:     "/api/v1/pods?watch=true",
+			expCode: http.StatusOK,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if code := serve(test.method, test.url); code != test.expCode {
+				t.Errorf("unexpected status code, exp=%d got=%d", test.expCode, code)
+			}
+		})
+	}
+
+	close(releaseCh)
+	<-doneCh
+
+	if code := serve(http.MethodGet, "/api/v1/pods"); code != http.StatusOK {
+		t.Errorf("unexpected status code once under the limit, exp=%d got=%d", http.StatusOK, code)
+	}
+}
@@ -0,0 +1,351 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package introspection
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/cache"
+	"k8s.io/apimachinery/pkg/util/clock"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+	certutil "k8s.io/client-go/util/cert"
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/klog"
+)
+
+const (
+	timeout = time.Second * 10
+
+	// cacheSize is the maximum number of introspection results cached.
+	cacheSize = 4096
+
+	// inactiveCacheTTL is the duration inactive tokens are cached for, to
+	// prevent repeated requests with the same bad token from flooding the
+	// introspection endpoint.
+	inactiveCacheTTL = time.Second * 10
+)
+
+type Options struct {
+	// URL is the introspection endpoint of the issuer.
+	URL string
+
+	// ClientID and ClientSecret are the client credentials used to
+	// authenticate to the introspection endpoint. ClientSecretFile, if
+	// specified, is a file containing the client secret.
+	ClientID         string
+	ClientSecret     string
+	ClientSecretFile string
+
+	// Audiences are the audiences, or client IDs, that introspected tokens
+	// must have been issued to one of.
+	Audiences []string
+
+	// QPS and Burst limit the rate of requests to the introspection endpoint
+	// of tokens not cached. If QPS is 0, requests are not limited.
+	QPS   float32
+	Burst int
+
+	// Path to a PEM encoded root certificate of the introspection endpoint.
+	CAFile string
+
+	// UsernameClaim is the introspection response field to use as the
+	// user's username.
+	UsernameClaim string
+
+	// UsernamePrefix, if specified, is prefixed to all usernames.
+	UsernamePrefix string
+
+	// GroupsClaim, if specified, is the introspection response field to use
+	// as the user's groups.
+	GroupsClaim string
+
+	// GroupsPrefix, if specified, is prefixed to all groups.
+	GroupsPrefix string
+}
+
+// Authenticator authenticates opaque access tokens using an OAuth 2.0 token
+// introspection endpoint, as defined in RFC 7662.
+type Authenticator struct {
+	url          string
+	clientID     string
+	clientSecret string
+	client       *http.Client
+	audiences    sets.String
+	limiter      flowcontrol.RateLimiter
+
+	usernameClaim  string
+	usernamePrefix string
+	groupsClaim    string
+	groupsPrefix   string
+
+	clock clock.Clock
+	cache *cache.LRUExpireCache
+}
+
+var _ authenticator.Token = &Authenticator{}
+
+// cacheEntry is a cached introspection result. A nil response means the token
+// was inactive.
+type cacheEntry struct {
+	resp *authenticator.Response
+}
+
+type stringOrArray []string
+
+func (s *stringOrArray) UnmarshalJSON(b []byte) error {
+	var a []string
+	if err := json.Unmarshal(b, &a); err == nil {
+		*s = a
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return err
+	}
+	*s = []string{str}
+	return nil
+}
+
+func New(opts Options) (*Authenticator, error) {
+	u, err := url.Parse(opts.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("'token-introspection-url' (%q) has invalid scheme (%q), require 'https'", opts.URL, u.Scheme)
+	}
+
+	if len(opts.UsernameClaim) == 0 {
+		return nil, errors.New("no username claim provided")
+	}
+
+	if len(opts.Audiences) == 0 {
+		return nil, errors.New("no audiences provided")
+	}
+
+	if len(opts.ClientSecretFile) > 0 {
+		secret, err := ioutil.ReadFile(opts.ClientSecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the client secret file: %s", err)
+		}
+		opts.ClientSecret = strings.TrimSpace(string(secret))
+	}
+
+	var roots *x509.CertPool
+	if len(opts.CAFile) > 0 {
+		roots, err = certutil.NewPool(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the CA file: %s", err)
+		}
+	}
+
+	tr := utilnet.SetTransportDefaults(&http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	})
+
+	return newAuthenticator(opts, &http.Client{Transport: tr, Timeout: timeout}, clock.RealClock{}), nil
+}
+
+func newAuthenticator(opts Options, client *http.Client, clock clock.Clock) *Authenticator {
+	var limiter flowcontrol.RateLimiter
+	if opts.QPS > 0 {
+		limiter = flowcontrol.NewTokenBucketRateLimiterWithClock(opts.QPS, opts.Burst, clock)
+	}
+
+	return &Authenticator{
+		url:            opts.URL,
+		clientID:       opts.ClientID,
+		clientSecret:   opts.ClientSecret,
+		client:         client,
+		audiences:      sets.NewString(opts.Audiences...),
+		limiter:        limiter,
+		usernameClaim:  opts.UsernameClaim,
+		usernamePrefix: opts.UsernamePrefix,
+		groupsClaim:    opts.GroupsClaim,
+		groupsPrefix:   opts.GroupsPrefix,
+		clock:          clock,
+		cache:          cache.NewLRUExpireCacheWithClock(cacheSize, clock),
+	}
+}
+
+// AuthenticateToken will authenticate the token using the introspection
+// endpoint. Results are cached by the hash of the token until the token
+// expires. Tokens not cached are not introspected while over the rate limit.
+func (a *Authenticator) AuthenticateToken(ctx context.Context, token string) (*authenticator.Response, bool, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+
+	if entry, ok := a.cache.Get(key); ok {
+		resp := entry.(*cacheEntry).resp
+		if resp == nil {
+			return nil, false, nil
+		}
+		return copyResponse(resp), true, nil
+	}
+
+	if a.limiter != nil && !a.limiter.TryAccept() {
+		return nil, false, errors.New("introspection: rate limit exceeded")
+	}
+
+	resp, exp, err := a.introspect(ctx, token)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ttl := inactiveCacheTTL
+	if resp != nil {
+		if exp.IsZero() {
+			// Tokens with no expiry are not cached so that revocations at
+			// the issuer are observed.
+			return resp, true, nil
+		}
+
+		ttl = exp.Sub(a.clock.Now())
+		if ttl <= 0 {
+			return nil, false, errors.New("introspection: token has expired")
+		}
+	}
+
+	a.cache.Add(key, &cacheEntry{resp: resp}, ttl)
+
+	if resp == nil {
+		return nil, false, nil
+	}
+
+	return copyResponse(resp), true, nil
+}
+
+// copyResponse copies the cached response so that it may be modified by the
+// caller.
+func copyResponse(resp *authenticator.Response) *authenticator.Response {
+	return &authenticator.Response{
+		User: &user.DefaultInfo{
+			Name:   resp.User.GetName(),
+			Groups: append([]string(nil), resp.User.GetGroups()...),
+		},
+	}
+}
+
+// introspect calls the introspection endpoint, returning the user of an
+// active token along with its expiry, or a nil response if the token is
+// inactive or not issued to one of the audiences.
+func (a *Authenticator) introspect(ctx context.Context, token string) (*authenticator.Response, time.Time, error) {
+	form := url.Values{
+		"token":           []string{token},
+		"token_type_hint": []string{"access_token"},
+	}
+
+	req, err := http.NewRequest(http.MethodPost, a.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(a.clientID), url.QueryEscape(a.clientSecret))
+
+	resp, err := a.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("introspection: request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("introspection: unable to read response body: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("introspection: unexpected response %s: %s", resp.Status, body)
+	}
+
+	var claims map[string]json.RawMessage
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, time.Time{}, fmt.Errorf("introspection: failed to decode response: %s", err)
+	}
+
+	var active bool
+	if raw, ok := claims["active"]; ok {
+		if err := json.Unmarshal(raw, &active); err != nil {
+			return nil, time.Time{}, fmt.Errorf("introspection: failed to parse 'active': %s", err)
+		}
+	}
+
+	if !active {
+		klog.V(4).Info("introspection: token is not active")
+		return nil, time.Time{}, nil
+	}
+
+	// Tokens issued to other clients of the issuer must not be accepted.
+	var audiences stringOrArray
+	if raw, ok := claims["aud"]; ok {
+		if err := json.Unmarshal(raw, &audiences); err != nil {
+			return nil, time.Time{}, fmt.Errorf("introspection: failed to parse 'aud': %s", err)
+		}
+	}
+
+	var clientID string
+	if raw, ok := claims["client_id"]; ok {
+		if err := json.Unmarshal(raw, &clientID); err != nil {
+			return nil, time.Time{}, fmt.Errorf("introspection: failed to parse 'client_id': %s", err)
+		}
+	}
+
+	if !a.audiences.HasAny(audiences...) && !a.audiences.Has(clientID) {
+		klog.V(4).Infof("introspection: token audiences %v and client ID %q are not accepted", []string(audiences), clientID)
+		return nil, time.Time{}, nil
+	}
+
+	var exp time.Time
+	if raw, ok := claims["exp"]; ok {
+		var unix float64
+		if err := json.Unmarshal(raw, &unix); err != nil {
+			return nil, time.Time{}, fmt.Errorf("introspection: failed to parse 'exp': %s", err)
+		}
+		exp = time.Unix(int64(unix), 0)
+	}
+
+	var username string
+	raw, ok := claims[a.usernameClaim]
+	if !ok {
+		return nil, time.Time{}, fmt.Errorf("introspection: username claim %q not present", a.usernameClaim)
+	}
+	if err := json.Unmarshal(raw, &username); err != nil {
+		return nil, time.Time{}, fmt.Errorf("introspection: failed to parse username claim %q: %s", a.usernameClaim, err)
+	}
+	if len(username) == 0 {
+		return nil, time.Time{}, fmt.Errorf("introspection: username claim %q is empty", a.usernameClaim)
+	}
+
+	info := &user.DefaultInfo{Name: a.usernamePrefix + username}
+
+	if len(a.groupsClaim) > 0 {
+		if raw, ok := claims[a.groupsClaim]; ok {
+			var groups stringOrArray
+			if err := json.Unmarshal(raw, &groups); err != nil {
+				return nil, time.Time{}, fmt.Errorf("introspection: failed to parse groups claim %q: %s", a.groupsClaim, err)
+			}
+
+			for _, group := range groups {
+				info.Groups = append(info.Groups, a.groupsPrefix+group)
+			}
+		}
+	}
+
+	return &authenticator.Response{User: info}, exp, nil
+}
@@ -0,0 +1,279 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package introspection
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+func TestAuthenticateToken(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+
+	responses := map[string]map[string]interface{}{
+		"active-token": {
+			"active":   true,
+			"aud":      []string{"kubernetes", "other"},
+			"sub":      "1234",
+			"username": "alice",
+			"groups":   []string{"group-a", "group-b"},
+			"exp":      fakeClock.Now().Add(time.Minute).Unix(),
+		},
+		"single-group-token": {
+			"active":    true,
+			"client_id": "kube-oidc-proxy",
+			"username":  "bob",
+			"groups":    "group-a",
+			"exp":       fakeClock.Now().Add(time.Minute).Unix(),
+		},
+		"no-username-token": {
+			"active": true,
+			"aud":    "kubernetes",
+			"exp":    fakeClock.Now().Add(time.Minute).Unix(),
+		},
+		"other-client-token": {
+			"active":    true,
+			"aud":       "other",
+			"client_id": "other",
+			"username":  "mallory",
+			"exp":       fakeClock.Now().Add(time.Minute).Unix(),
+		},
+		"no-audience-token": {
+			"active":   true,
+			"username": "mallory",
+			"exp":      fakeClock.Now().Add(time.Minute).Unix(),
+		},
+		"inactive-token": {
+			"active": false,
+		},
+	}
+
+	requests := make(map[string]int)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if user, pass, ok := req.BasicAuth(); !ok || user != "client" || pass != "secret" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if err := req.ParseForm(); err != nil {
+			t.Error(err)
+		}
+
+		token := req.PostForm.Get("token")
+		requests[token]++
+
+		if err := json.NewEncoder(rw).Encode(responses[token]); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	a := newAuthenticator(Options{
+		URL:            server.URL,
+		ClientID:       "client",
+		ClientSecret:   "secret",
+		Audiences:      []string{"kube-oidc-proxy", "kubernetes"},
+		UsernameClaim:  "username",
+		UsernamePrefix: "introspect:",
+		GroupsClaim:    "groups",
+		GroupsPrefix:   "introspect:",
+	}, server.Client(), fakeClock)
+
+	tests := map[string]struct {
+		token     string
+		expOK     bool
+		expErr    bool
+		expUser   string
+		expGroups []string
+	}{
+		"an active token should authenticate": {
+			token:     "active-token",
+			expOK:     true,
+			expUser:   "introspect:alice",
+			expGroups: []string{"introspect:group-a", "introspect:group-b"},
+		},
+		"an active token with a single group should authenticate": {
+			token:     "single-group-token",
+			expOK:     true,
+			expUser:   "introspect:bob",
+			expGroups: []string{"introspect:group-a"},
+		},
+		"an active token with no username should error": {
+			token:  "no-username-token",
+			expErr: true,
+		},
+		"an active token issued to another client should not authenticate": {
+			token: "other-client-token",
+		},
+		"an active token with no audience or client ID should not authenticate": {
+			token: "no-audience-token",
+		},
+		"an inactive token should not authenticate": {
+			token: "inactive-token",
+		},
+		"an unknown token should not authenticate": {
+			token: "unknown-token",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			resp, ok, err := a.AuthenticateToken(context.TODO(), test.token)
+			if (err != nil) != test.expErr {
+				t.Fatalf("unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+
+			if ok != test.expOK {
+				t.Fatalf("unexpected ok, exp=%t got=%t", test.expOK, ok)
+			}
+
+			if !ok {
+				return
+			}
+
+			if resp.User.GetName() != test.expUser {
+				t.Errorf("unexpected username, exp=%s got=%s", test.expUser, resp.User.GetName())
+			}
+
+			if !reflect.DeepEqual(resp.User.GetGroups(), test.expGroups) {
+				t.Errorf("unexpected groups, exp=%v got=%v", test.expGroups, resp.User.GetGroups())
+			}
+		})
+	}
+
+	// Results should be cached until the token expires.
+	for _, token := range []string{"active-token", "inactive-token"} {
+		if _, _, err := a.AuthenticateToken(context.TODO(), token); err != nil {
+			t.Fatal(err)
+		}
+
+		if requests[token] != 1 {
+			t.Errorf("expected token %q to be introspected once, got=%d", token, requests[token])
+		}
+	}
+
+	fakeClock.Step(time.Minute)
+
+	for _, token := range []string{"active-token", "inactive-token"} {
+		if _, _, err := a.AuthenticateToken(context.TODO(), token); err != nil && token != "active-token" {
+			t.Fatal(err)
+		}
+
+		if requests[token] != 2 {
+			t.Errorf("expected token %q to be introspected again once expired, got=%d", token, requests[token])
+		}
+	}
+}
+
+func TestAuthenticateTokenRateLimit(t *testing.T) {
+	fakeClock := clock.NewFakeClock(time.Now())
+
+	var requests int
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests++
+		if err := json.NewEncoder(rw).Encode(map[string]interface{}{"active": false}); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	a := newAuthenticator(Options{
+		URL:           server.URL,
+		Audiences:     []string{"kubernetes"},
+		UsernameClaim: "sub",
+		QPS:           1,
+		Burst:         2,
+	}, server.Client(), fakeClock)
+
+	// Distinct tokens are not cached, so should only be introspected up to
+	// the burst.
+	for i, expErr := range []bool{false, false, true} {
+		if _, _, err := a.AuthenticateToken(context.TODO(), fmt.Sprintf("token-%d", i)); (err != nil) != expErr {
+			t.Errorf("unexpected error of token %d, exp=%t got=%v", i, expErr, err)
+		}
+	}
+
+	// Cached tokens should not be limited.
+	if _, _, err := a.AuthenticateToken(context.TODO(), "token-0"); err != nil {
+		t.Errorf("unexpected error of cached token: %s", err)
+	}
+
+	fakeClock.Step(time.Second)
+
+	if _, _, err := a.AuthenticateToken(context.TODO(), "token-3"); err != nil {
+		t.Errorf("unexpected error once under the rate limit: %s", err)
+	}
+
+	if requests != 3 {
+		t.Errorf("unexpected introspection requests, exp=3 got=%d", requests)
+	}
+}
+
+func TestNewClientSecretFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if user, pass, ok := req.BasicAuth(); !ok || user != "client" || pass != "secret" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if err := json.NewEncoder(rw).Encode(map[string]interface{}{
+			"active":    true,
+			"client_id": "kubernetes",
+			"sub":       "alice",
+		}); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "kube-oidc-proxy-introspection")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	secretFile := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(secretFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New(Options{
+		URL:              server.URL,
+		ClientID:         "client",
+		ClientSecretFile: secretFile,
+		Audiences:        []string{"kubernetes"},
+		CAFile:           caFile,
+		UsernameClaim:    "sub",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, ok, err := a.AuthenticateToken(context.TODO(), "token")
+	if err != nil || !ok {
+		t.Fatalf("expected token to authenticate with the client secret of the file, got=%t %v", ok, err)
+	}
+
+	if resp.User.GetName() != "alice" {
+		t.Errorf("unexpected username, exp=alice got=%s", resp.User.GetName())
+	}
+}
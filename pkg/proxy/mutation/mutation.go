@@ -0,0 +1,280 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package mutation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authentication/user"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+)
+
+const (
+	// maxRequestBodyBytes is the maximum size of request bodies which will be
+	// mutated, matching the limit of the API server.
+	maxRequestBodyBytes = 3 * 1024 * 1024
+)
+
+// Attributes are the attributes of the request being mutated.
+type Attributes struct {
+	User        user.Info
+	RequestInfo *genericapirequest.RequestInfo
+}
+
+// Mutator mutates the JSON body of a create or update request, or the JSON
+// merge patch or server side apply configuration of a patch request, in place.
+type Mutator interface {
+	Mutate(obj map[string]interface{}, attrs *Attributes) error
+}
+
+// Factory builds a mutator from the options given to it in the request
+// mutation file.
+type Factory func(options json.RawMessage) (Mutator, error)
+
+var (
+	factoriesLock sync.Mutex
+	factories     = make(map[string]Factory)
+)
+
+func init() {
+	Register(StampUserName, newStampUser)
+}
+
+// Register registers a mutator factory under the given name, which is used to
+// reference the mutator in the request mutation file.
+func Register(name string, factory Factory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+
+	if _, ok := factories[name]; ok {
+		klog.Fatalf("request mutator %q was registered twice", name)
+	}
+
+	factories[name] = factory
+}
+
+// Rule applies a mutator to requests for resources of an API group.
+type Rule struct {
+	// Mutator is the name of the registered mutator.
+	Mutator string `json:"mutator"`
+
+	// Options are passed to the mutator factory.
+	Options json.RawMessage `json:"options,omitempty"`
+
+	// Group is the API group of the resources. The empty string represents
+	// the core API group.
+	Group string `json:"group"`
+
+	// Resources is a list of resources this rule applies to.
+	Resources []string `json:"resources"`
+
+	// Verbs is a list of the verbs this rule applies to, out of create,
+	// update and patch. Defaults to all of them.
+	Verbs []string `json:"verbs,omitempty"`
+}
+
+// Config is the request mutation file.
+type Config struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Error is returned when the body of a request to be mutated can not be
+// mutated, and the request should be rejected.
+type Error struct {
+	Code    int
+	Reason  metav1.StatusReason
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+type rule struct {
+	mutator   Mutator
+	group     string
+	resources sets.String
+	verbs     sets.String
+}
+
+// Mutation applies the configured mutators to the bodies of requests.
+type Mutation struct {
+	rules []*rule
+}
+
+var supportedVerbs = sets.NewString("create", "update", "patch")
+
+// LoadConfig will load the request mutation file.
+func LoadConfig(filePath string) (*Config, error) {
+	b, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request mutation file %q: %s", filePath, err)
+	}
+
+	config := new(Config)
+	if err := yaml.UnmarshalStrict(b, config); err != nil {
+		return nil, fmt.Errorf("failed to decode request mutation file %q: %s", filePath, err)
+	}
+
+	return config, nil
+}
+
+func New(config *Config) (*Mutation, error) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+
+	m := &Mutation{}
+
+	for i, r := range config.Rules {
+		factory, ok := factories[r.Mutator]
+		if !ok {
+			names := make([]string, 0, len(factories))
+			for name := range factories {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			return nil, fmt.Errorf("request mutation rule %d has unknown mutator %q, expecting one of %v",
+				i, r.Mutator, names)
+		}
+
+		if len(r.Resources) == 0 {
+			return nil, fmt.Errorf("request mutation rule %d must contain at least one resource", i)
+		}
+
+		verbs := supportedVerbs
+		if len(r.Verbs) > 0 {
+			verbs = sets.NewString(r.Verbs...)
+			if unsupported := verbs.Difference(supportedVerbs); unsupported.Len() > 0 {
+				return nil, fmt.Errorf("request mutation rule %d has unsupported verbs %v",
+					i, unsupported.List())
+			}
+		}
+
+		mutator, err := factory(r.Options)
+		if err != nil {
+			return nil, fmt.Errorf("request mutation rule %d: %s", i, err)
+		}
+
+		m.rules = append(m.rules, &rule{
+			mutator:   mutator,
+			group:     r.Group,
+			resources: sets.NewString(r.Resources...),
+			verbs:     verbs,
+		})
+	}
+
+	return m, nil
+}
+
+// Mutate will apply the mutators of all matching rules, in order, to the body
+// of the request. Only JSON bodies, JSON merge and strategic merge patches, and
+// server side apply configurations, can be mutated. Other bodies, such as JSON
+// patches whose operations can not safely be extended without the object
+// being patched, are rejected with an Error.
+func (m *Mutation) Mutate(req *http.Request, u user.Info) error {
+	// Subresources, such as status or scale, and requests whose RequestInfo
+	// cannot be resolved, are not mutated.
+	info, err := context.RequestInfo(req)
+	if err != nil || !info.IsResourceRequest || len(info.Subresource) > 0 {
+		return nil
+	}
+
+	var mutators []Mutator
+	for _, r := range m.rules {
+		if r.group == info.APIGroup && r.resources.Has(info.Resource) && r.verbs.Has(info.Verb) {
+			mutators = append(mutators, r.mutator)
+		}
+	}
+
+	if len(mutators) == 0 || req.Body == nil {
+		return nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = req.Header.Get("Content-Type")
+	}
+
+	// Server side apply configurations are YAML, which are decoded as such
+	// and sent on as JSON, itself valid YAML.
+	var isYAML bool
+	switch mediaType {
+	case "application/json", string(types.MergePatchType), string(types.StrategicMergePatchType):
+	case string(types.ApplyPatchType):
+		isYAML = true
+	default:
+		return &Error{
+			Code:   http.StatusUnsupportedMediaType,
+			Reason: metav1.StatusReasonUnsupportedMediaType,
+			Message: fmt.Sprintf("the body of %s requests for %s must be JSON, a JSON merge patch, or a server side apply configuration, to be mutated by the proxy, got %q",
+				info.Verb, info.Resource, mediaType),
+		}
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, maxRequestBodyBytes+1))
+	req.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read request body: %s", err)
+	}
+
+	if len(body) > maxRequestBodyBytes {
+		return &Error{
+			Code:    http.StatusRequestEntityTooLarge,
+			Reason:  metav1.StatusReasonRequestEntityTooLarge,
+			Message: "the request body is too large to be mutated by the proxy",
+		}
+	}
+
+	var obj map[string]interface{}
+	if isYAML {
+		err = yaml.Unmarshal(body, &obj)
+	} else {
+		err = json.Unmarshal(body, &obj)
+	}
+	if err != nil || obj == nil {
+		return &Error{
+			Code:    http.StatusBadRequest,
+			Reason:  metav1.StatusReasonBadRequest,
+			Message: "the request body must be an object to be mutated by the proxy",
+		}
+	}
+
+	attrs := &Attributes{
+		User:        u,
+		RequestInfo: info,
+	}
+
+	for _, mutator := range mutators {
+		if err := mutator.Mutate(obj, attrs); err != nil {
+			return err
+		}
+	}
+
+	body, err = json.Marshal(obj)
+	if err != nil {
+		return fmt.Errorf("failed to encode mutated request body: %s", err)
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.TransferEncoding = nil
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	return nil
+}
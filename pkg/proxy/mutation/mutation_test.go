@@ -0,0 +1,241 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package mutation
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"k8s.io/apiserver/pkg/authentication/user"
+)
+
+func TestNew(t *testing.T) {
+	tests := map[string]struct {
+		rule   Rule
+		expErr bool
+	}{
+		"a stamp-user rule with an annotation should be valid": {
+			rule: Rule{
+				Mutator:   StampUserName,
+				Options:   json.RawMessage(`{"annotation":"example.com/created-by"}`),
+				Resources: []string{"configmaps"},
+			},
+		},
+		"an unknown mutator should error": {
+			rule: Rule{
+				Mutator:   "unknown",
+				Resources: []string{"configmaps"},
+			},
+			expErr: true,
+		},
+		"a rule with no resources should error": {
+			rule: Rule{
+				Mutator: StampUserName,
+				Options: json.RawMessage(`{"annotation":"example.com/created-by"}`),
+			},
+			expErr: true,
+		},
+		"a rule with an unsupported verb should error": {
+			rule: Rule{
+				Mutator:   StampUserName,
+				Options:   json.RawMessage(`{"annotation":"example.com/created-by"}`),
+				Resources: []string{"configmaps"},
+				Verbs:     []string{"create", "delete"},
+			},
+			expErr: true,
+		},
+		"a stamp-user rule with no keys should error": {
+			rule: Rule{
+				Mutator:   StampUserName,
+				Resources: []string{"configmaps"},
+			},
+			expErr: true,
+		},
+		"a stamp-user rule with an invalid key should error": {
+			rule: Rule{
+				Mutator:   StampUserName,
+				Options:   json.RawMessage(`{"label":"created by"}`),
+				Resources: []string{"configmaps"},
+			},
+			expErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := New(&Config{Rules: []Rule{test.rule}})
+			if (err != nil) != test.expErr {
+				t.Errorf("unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+		})
+	}
+}
+
+func TestMutate(t *testing.T) {
+	m, err := New(&Config{
+		Rules: []Rule{
+			{
+				Mutator:   StampUserName,
+				Options:   json.RawMessage(`{"annotation":"example.com/created-by","label":"example.com/created-by"}`),
+				Group:     "",
+				Resources: []string{"configmaps"},
+			},
+			{
+				Mutator:   StampUserName,
+				Options:   json.RawMessage(`{"annotation":"example.com/created-by"}`),
+				Group:     "apps",
+				Resources: []string{"deployments"},
+				Verbs:     []string{"create"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := &user.DefaultInfo{Name: "oidc:alice@example.com"}
+
+	tests := map[string]struct {
+		method      string
+		path        string
+		contentType string
+		body        string
+
+		expBody string
+		expCode int
+	}{
+		"a created object should be stamped": {
+			method:      http.MethodPost,
+			path:        "/api/v1/namespaces/default/configmaps",
+			contentType: "application/json",
+			body:        `{"kind":"ConfigMap","metadata":{"name":"a"}}`,
+			expBody:     `{"kind":"ConfigMap","metadata":{"annotations":{"example.com/created-by":"oidc:alice@example.com"},"labels":{"example.com/created-by":"oidc_alice_example.com"},"name":"a"}}`,
+		},
+		"an updated object should have a given value overwritten": {
+			method:      http.MethodPut,
+			path:        "/api/v1/namespaces/default/configmaps/a",
+			contentType: "application/json",
+			body:        `{"metadata":{"name":"a","annotations":{"example.com/created-by":"bob","other":"value"},"labels":{"example.com/created-by":"bob"}}}`,
+			expBody:     `{"metadata":{"annotations":{"example.com/created-by":"oidc:alice@example.com","other":"value"},"labels":{"example.com/created-by":"oidc_alice_example.com"},"name":"a"}}`,
+		},
+		"a merge patch should be stamped": {
+			method:      http.MethodPatch,
+			path:        "/api/v1/namespaces/default/configmaps/a",
+			contentType: "application/merge-patch+json",
+			body:        `{"data":{"a":"b"}}`,
+			expBody:     `{"data":{"a":"b"},"metadata":{"annotations":{"example.com/created-by":"oidc:alice@example.com"},"labels":{"example.com/created-by":"oidc_alice_example.com"}}}`,
+		},
+		"a server side apply configuration should be stamped": {
+			method:      http.MethodPatch,
+			path:        "/api/v1/namespaces/default/configmaps/a",
+			contentType: "application/apply-patch+yaml",
+			body:        "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\ndata:\n  a: b\n",
+			expBody:     `{"apiVersion":"v1","data":{"a":"b"},"kind":"ConfigMap","metadata":{"annotations":{"example.com/created-by":"oidc:alice@example.com"},"labels":{"example.com/created-by":"oidc_alice_example.com"},"name":"a"}}`,
+		},
+		"a server side apply configuration which is not an object should be rejected": {
+			method:      http.MethodPatch,
+			path:        "/api/v1/namespaces/default/configmaps/a",
+			contentType: "application/apply-patch+yaml",
+			body:        "- a\n",
+			expCode:     http.StatusBadRequest,
+		},
+		"a request for a verb not configured should not be mutated": {
+			method:      http.MethodPut,
+			path:        "/apis/apps/v1/namespaces/default/deployments/a",
+			contentType: "application/json",
+			body:        `{"metadata":{"name":"a"}}`,
+			expBody:     `{"metadata":{"name":"a"}}`,
+		},
+		"a request for a subresource should not be mutated": {
+			method:      http.MethodPut,
+			path:        "/api/v1/namespaces/default/configmaps/a/status",
+			contentType: "application/json",
+			body:        `{"metadata":{"name":"a"}}`,
+			expBody:     `{"metadata":{"name":"a"}}`,
+		},
+		"a request for another resource should not be mutated": {
+			method:      http.MethodPost,
+			path:        "/api/v1/namespaces/default/secrets",
+			contentType: "application/vnd.kubernetes.protobuf",
+			body:        `not-json`,
+			expBody:     `not-json`,
+		},
+		"a protobuf body should be rejected": {
+			method:      http.MethodPost,
+			path:        "/api/v1/namespaces/default/configmaps",
+			contentType: "application/vnd.kubernetes.protobuf",
+			body:        `not-json`,
+			expCode:     http.StatusUnsupportedMediaType,
+		},
+		"a JSON patch should be rejected": {
+			method:      http.MethodPatch,
+			path:        "/api/v1/namespaces/default/configmaps/a",
+			contentType: "application/json-patch+json",
+			body:        `[]`,
+			expCode:     http.StatusUnsupportedMediaType,
+		},
+		"a body which is not an object should be rejected": {
+			method:      http.MethodPost,
+			path:        "/api/v1/namespaces/default/configmaps",
+			contentType: "application/json",
+			body:        `[]`,
+			expCode:     http.StatusBadRequest,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := &http.Request{
+				Method:        test.method,
+				URL:           &url.URL{Path: test.path},
+				Header:        http.Header{"Content-Type": []string{test.contentType}},
+				Body:          ioutil.NopCloser(bytes.NewReader([]byte(test.body))),
+				ContentLength: int64(len(test.body)),
+			}
+
+			err := m.Mutate(req, u)
+			if test.expCode != 0 {
+				mutationErr, ok := err.(*Error)
+				if !ok || mutationErr.Code != test.expCode {
+					t.Fatalf("expected error with code %d, got=%v", test.expCode, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(body) != test.expBody {
+				t.Errorf("unexpected body, exp=%s got=%s", test.expBody, body)
+			}
+
+			if req.ContentLength != int64(len(body)) {
+				t.Errorf("unexpected content length, exp=%d got=%d", len(body), req.ContentLength)
+			}
+		})
+	}
+}
+
+func TestLabelValue(t *testing.T) {
+	tests := map[string]string{
+		"alice":                  "alice",
+		"oidc:alice@example.com": "oidc_alice_example.com",
+		"-alice-":                "alice",
+		"system:serviceaccount:kube-system:a-very-long-service-account-name-over-limit": "system_serviceaccount_kube-system_a-very-long-service-account-n",
+	}
+
+	for username, exp := range tests {
+		if got := labelValue(username); got != exp {
+			t.Errorf("unexpected label value for %q, exp=%s got=%s", username, exp, got)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package mutation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// StampUserName is the name of the mutator stamping the username of the
+	// user onto objects.
+	StampUserName = "stamp-user"
+)
+
+// invalidLabelValueChars matches characters which are not allowed in label
+// values.
+var invalidLabelValueChars = regexp.MustCompile(`[^-A-Za-z0-9_.]`)
+
+// StampUserOptions are the options of the stamp-user mutator.
+type StampUserOptions struct {
+	// Annotation, if given, is the annotation key set to the username.
+	Annotation string `json:"annotation,omitempty"`
+
+	// Label, if given, is the label key set to the username. Characters not
+	// allowed in label values are replaced with '_', and the value truncated
+	// to 63 characters.
+	Label string `json:"label,omitempty"`
+}
+
+// stampUser sets an annotation or label of objects to the username of the
+// user, overwriting any value given by the user.
+type stampUser struct {
+	annotation string
+	label      string
+}
+
+func newStampUser(options json.RawMessage) (Mutator, error) {
+	var opts StampUserOptions
+	if len(options) > 0 {
+		if err := yaml.UnmarshalStrict(options, &opts); err != nil {
+			return nil, fmt.Errorf("invalid %s options: %s", StampUserName, err)
+		}
+	}
+
+	if len(opts.Annotation) == 0 && len(opts.Label) == 0 {
+		return nil, errors.New(StampUserName + " requires an annotation or label")
+	}
+
+	for _, key := range []string{opts.Annotation, opts.Label} {
+		if len(key) == 0 {
+			continue
+		}
+
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid %s key %q: %s", StampUserName, key, strings.Join(errs, ", "))
+		}
+	}
+
+	return &stampUser{
+		annotation: opts.Annotation,
+		label:      opts.Label,
+	}, nil
+}
+
+func (s *stampUser) Mutate(obj map[string]interface{}, attrs *Attributes) error {
+	username := attrs.User.GetName()
+
+	metadata, ok := obj["metadata"].(map[string]interface{})
+	if !ok {
+		metadata = make(map[string]interface{})
+		obj["metadata"] = metadata
+	}
+
+	if len(s.annotation) > 0 {
+		setField(metadata, "annotations", s.annotation, username)
+	}
+
+	if len(s.label) > 0 {
+		setField(metadata, "labels", s.label, labelValue(username))
+	}
+
+	return nil
+}
+
+// setField sets the key of the map field of the metadata to the value,
+// creating the field if needed.
+func setField(metadata map[string]interface{}, field, key, value string) {
+	values, ok := metadata[field].(map[string]interface{})
+	if !ok {
+		values = make(map[string]interface{})
+		metadata[field] = values
+	}
+
+	values[key] = value
+}
+
+// labelValue converts the username into a valid label value.
+func labelValue(username string) string {
+	value := invalidLabelValueChars.ReplaceAllString(username, "_")
+
+	if len(value) > validation.LabelValueMaxLength {
+		value = value[:validation.LabelValueMaxLength]
+	}
+
+	// Label values must begin and end with an alphanumeric character.
+	return strings.Trim(value, "-_.")
+}
@@ -0,0 +1,375 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package oidc
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	gooidc "github.com/coreos/go-oidc"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+// The claims handling in this file has been adapted from the Kubernetes API
+// server OIDC authenticator, k8s.io/apiserver/plugin/pkg/authenticator/token/oidc.
+
+type claims map[string]json.RawMessage
+
+func (c claims) unmarshalClaim(name string, v interface{}) error {
+	val, ok := c[name]
+	if !ok {
+		return fmt.Errorf("claim not present")
+	}
+	return json.Unmarshal([]byte(val), v)
+}
+
+// verifyEmail returns an error if the email_verified claim is present, but not
+// true.
+// https://openid.net/specs/openid-connect-core-1_0.html#StandardClaims
+func (c claims) verifyEmail() error {
+	if !c.hasClaim("email_verified") {
+		return nil
+	}
+
+	var emailVerified bool
+	if err := c.unmarshalClaim("email_verified", &emailVerified); err != nil {
+		return fmt.Errorf("parse 'email_verified' claim: %v", err)
+	}
+
+	if !emailVerified {
+		return errors.New("email not verified")
+	}
+
+	return nil
+}
+
+func (c claims) hasClaim(name string) bool {
+	_, ok := c[name]
+	return ok
+}
+
+// scopes returns the scopes of the token, from either the space separated
+// "scope" claim (RFC 8693), or the "scp" claim which may be a string or array.
+func (c claims) scopes() (sets.String, error) {
+	scopes := sets.NewString()
+
+	if c.hasClaim("scope") {
+		var scope string
+		if err := c.unmarshalClaim("scope", &scope); err != nil {
+			return nil, fmt.Errorf("parse 'scope' claim: %v", err)
+		}
+		scopes.Insert(strings.Fields(scope)...)
+	}
+
+	if c.hasClaim("scp") {
+		var scp stringOrArray
+		if err := c.unmarshalClaim("scp", &scp); err != nil {
+			return nil, fmt.Errorf("parse 'scp' claim: %v", err)
+		}
+		for _, scope := range scp {
+			scopes.Insert(strings.Fields(scope)...)
+		}
+	}
+
+	return scopes, nil
+}
+
+type stringOrArray []string
+
+func (s *stringOrArray) UnmarshalJSON(b []byte) error {
+	var a []string
+	if err := json.Unmarshal(b, &a); err == nil {
+		*s = a
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return err
+	}
+	*s = []string{str}
+	return nil
+}
+
+// untrustedIssuer extracts an untrusted "iss" claim from the given JWT token,
+// or returns an error if the token can not be parsed. Since the JWT is not
+// verified, the returned issuer should not be trusted.
+func untrustedIssuer(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("error decoding token: %v", err)
+	}
+	claims := struct {
+		// WARNING: this JWT is not verified. Do not trust these claims.
+		Issuer string `json:"iss"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("while unmarshaling token: %v", err)
+	}
+	// Coalesce the legacy GoogleIss with the new one.
+	//
+	// http://openid.net/specs/openid-connect-core-1_0.html#GoogleIss
+	if claims.Issuer == "accounts.google.com" {
+		return "https://accounts.google.com", nil
+	}
+	return claims.Issuer, nil
+}
+
+func hasCorrectIssuer(iss, tokenData string) bool {
+	uiss, err := untrustedIssuer(tokenData)
+	if err != nil {
+		return false
+	}
+	return uiss == iss
+}
+
+// endpoint represents an OIDC distributed claims endpoint.
+type endpoint struct {
+	// URL to use to request the distributed claim. This URL is expected to be
+	// prefixed by one of the known issuer URLs.
+	URL string `json:"endpoint,omitempty"`
+	// AccessToken is the bearer token to use for access. If empty, it is
+	// not used. Access token is optional per the OIDC distributed claims
+	// specification.
+	// See: http://openid.net/specs/openid-connect-core-1_0.html#DistributedExample
+	AccessToken string `json:"access_token,omitempty"`
+	// JWT is the container for aggregated claims. Not supported at the moment.
+	// See: http://openid.net/specs/openid-connect-core-1_0.html#AggregatedExample
+	JWT string `json:"JWT,omitempty"`
+}
+
+// claimResolver expands distributed claims by calling respective claim source
+// endpoints.
+type claimResolver struct {
+	// claim is the distributed claim that may be resolved.
+	claim string
+
+	// client is the to use for resolving distributed claims
+	client *http.Client
+
+	// config is the OIDC configuration used for resolving distributed claims.
+	config *gooidc.Config
+
+	// audiences, if not empty, is the set of audiences distributed claim JWTs
+	// may be issued for, in place of the client ID check of config.
+	audiences sets.String
+
+	// verifierPerIssuer contains, for each issuer, the appropriate verifier to
+	// use for this claim. It is assumed that there will be very few entries in
+	// this map.
+	// Guarded by m.
+	verifierPerIssuer map[string]*asyncIDTokenVerifier
+
+	m sync.Mutex
+}
+
+func newClaimResolver(claim string, client *http.Client, config *gooidc.Config, audiences sets.String) *claimResolver {
+	return &claimResolver{
+		claim:             claim,
+		client:            client,
+		config:            config,
+		audiences:         audiences,
+		verifierPerIssuer: map[string]*asyncIDTokenVerifier{},
+	}
+}
+
+// Verifier returns either the verifier for the specified issuer, or error.
+func (r *claimResolver) Verifier(iss string) (*gooidc.IDTokenVerifier, error) {
+	r.m.Lock()
+	av := r.verifierPerIssuer[iss]
+	if av == nil {
+		ctx := gooidc.ClientContext(context.Background(), r.client)
+		av = newAsyncIDTokenVerifier(ctx, r.config, iss)
+		r.verifierPerIssuer[iss] = av
+	}
+	r.m.Unlock()
+
+	v := av.verifier()
+	if v == nil {
+		return nil, fmt.Errorf("verifier not initialized for issuer: %q", iss)
+	}
+	return v, nil
+}
+
+// expand extracts the distributed claims from claim names and claim sources.
+// The extracted claim value is pulled up into the supplied claims.
+//
+// Distributed claims are defined in the OIDC Connect Core 1.0, section 5.6.2.
+// See: https://openid.net/specs/openid-connect-core-1_0.html#AggregatedDistributedClaims
+func (r *claimResolver) expand(c claims) error {
+	const (
+		// The claim containing a map of endpoint references per claim.
+		// OIDC Connect Core 1.0, section 5.6.2.
+		claimNamesKey = "_claim_names"
+		// The claim containing endpoint specifications.
+		// OIDC Connect Core 1.0, section 5.6.2.
+		claimSourcesKey = "_claim_sources"
+	)
+
+	if _, ok := c[r.claim]; ok {
+		// There already is a normal claim, skip resolving.
+		return nil
+	}
+	names, ok := c[claimNamesKey]
+	if !ok {
+		// No _claim_names, no keys to look up.
+		return nil
+	}
+
+	claimToSource := map[string]string{}
+	if err := json.Unmarshal([]byte(names), &claimToSource); err != nil {
+		return fmt.Errorf("oidc: error parsing distributed claim names: %v", err)
+	}
+
+	rawSources, ok := c[claimSourcesKey]
+	if !ok {
+		// Having _claim_names claim, but no _claim_sources is not an expected
+		// state.
+		return fmt.Errorf("oidc: no claim sources")
+	}
+
+	var sources map[string]endpoint
+	if err := json.Unmarshal([]byte(rawSources), &sources); err != nil {
+		// The claims sources claim is malformed, this is not an expected state.
+		return fmt.Errorf("oidc: could not parse claim sources: %v", err)
+	}
+
+	src, ok := claimToSource[r.claim]
+	if !ok {
+		// No distributed claim present.
+		return nil
+	}
+	ep, ok := sources[src]
+	if !ok {
+		return fmt.Errorf("id token _claim_names contained a source %s missing in _claims_sources", src)
+	}
+	if ep.URL == "" {
+		// This is maybe an aggregated claim (ep.JWT != "").
+		return nil
+	}
+	return r.resolve(ep, c)
+}
+
+// resolve requests distributed claims from all endpoints passed in, and
+// inserts the lookup results into allClaims.
+func (r *claimResolver) resolve(endpoint endpoint, allClaims claims) error {
+	jwt, err := getClaimJWT(r.client, endpoint.URL, endpoint.AccessToken)
+	if err != nil {
+		return fmt.Errorf("while getting distributed claim %q: %v", r.claim, err)
+	}
+	untrustedIss, err := untrustedIssuer(jwt)
+	if err != nil {
+		return fmt.Errorf("getting untrusted issuer from endpoint %v failed for claim %q: %v", endpoint.URL, r.claim, err)
+	}
+	v, err := r.Verifier(untrustedIss)
+	if err != nil {
+		return fmt.Errorf("verifying untrusted issuer %v failed: %v", untrustedIss, err)
+	}
+	t, err := v.Verify(context.Background(), jwt)
+	if err != nil {
+		return fmt.Errorf("verify distributed claim token: %v", err)
+	}
+	if r.audiences.Len() > 0 && !r.audiences.HasAny(t.Audience...) {
+		return fmt.Errorf("verify distributed claim token: expected audience in %q got %q", r.audiences.List(), t.Audience)
+	}
+	var distClaims claims
+	if err := t.Claims(&distClaims); err != nil {
+		return fmt.Errorf("could not parse distributed claims for claim %v: %v", r.claim, err)
+	}
+	value, ok := distClaims[r.claim]
+	if !ok {
+		return fmt.Errorf("jwt returned by distributed claim endpoint %s did not contain claim: %v", endpoint.URL, r.claim)
+	}
+	allClaims[r.claim] = value
+	return nil
+}
+
+// getClaimJWT gets a distributed claim JWT from url, using the supplied access
+// token as bearer token. If the access token is "", the authorization header
+// will not be set.
+func getClaimJWT(client *http.Client, url, accessToken string) (string, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", fmt.Errorf("while calling %v: %v", url, err)
+	}
+	if accessToken != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", accessToken))
+	}
+	response, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	// Report non-OK status code as an error.
+	if response.StatusCode < http.StatusOK || response.StatusCode > http.StatusIMUsed {
+		return "", fmt.Errorf("error while getting distributed claim JWT: %v", response.Status)
+	}
+	responseBytes, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", fmt.Errorf("could not decode distributed claim response")
+	}
+	return string(responseBytes), nil
+}
+
+// asyncIDTokenVerifier is an ID token verifier that allows async
+// initialization of the issuer check. Must be passed by reference as it wraps
+// sync.Mutex.
+type asyncIDTokenVerifier struct {
+	m sync.Mutex
+
+	// v is the ID token verifier initialized asynchronously. It remains nil
+	// up until it is eventually initialized.
+	// Guarded by m
+	v *gooidc.IDTokenVerifier
+}
+
+// newAsyncIDTokenVerifier creates a new asynchronous token verifier. The
+// verifier is available immediately, but may remain uninitialized for some
+// time after creation.
+func newAsyncIDTokenVerifier(ctx context.Context, c *gooidc.Config, iss string) *asyncIDTokenVerifier {
+	t := &asyncIDTokenVerifier{}
+
+	// Polls indefinitely in an attempt to initialize the distributed claims
+	// verifier, or until context canceled.
+	initFn := func() (done bool, err error) {
+		klog.V(4).Infof("oidc authenticator: attempting init: iss=%v", iss)
+		provider, err := gooidc.NewProvider(ctx, iss)
+		if err != nil {
+			klog.Errorf("oidc authenticator: async token verifier for issuer: %q: %v", iss, err)
+			return false, nil
+		}
+		t.m.Lock()
+		defer t.m.Unlock()
+		t.v = provider.Verifier(c)
+		return true, nil
+	}
+
+	go func() {
+		if done, _ := initFn(); !done {
+			go wait.PollUntil(time.Second*10, initFn, ctx.Done())
+		}
+	}()
+
+	return t
+}
+
+// verifier returns the underlying ID token verifier, or nil if one is not yet
+// initialized.
+func (a *asyncIDTokenVerifier) verifier() *gooidc.IDTokenVerifier {
+	a.m.Lock()
+	defer a.m.Unlock()
+	return a.v
+}
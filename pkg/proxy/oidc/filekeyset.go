@@ -0,0 +1,205 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package oidc
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/util"
+)
+
+const (
+	refreshTriggerFile = "file"
+
+	keysFilePollInterval = time.Second * 10
+)
+
+// fileKeySet is a go-oidc KeySet which loads the issuer keys from a local
+// file, either as a JWKS document or PEM encoded public keys and
+// certificates. The file is watched for changes.
+type fileKeySet struct {
+	watcher *util.FileWatcher
+
+	now func() time.Time
+
+	// lock guards all fields below.
+	lock     sync.RWMutex
+	keys     []jose.JSONWebKey
+	lastLoad time.Time
+}
+
+func newFileKeySet(path string, now func() time.Time) (*fileKeySet, error) {
+	f := &fileKeySet{
+		now: now,
+	}
+
+	watcher, err := util.NewFileWatcher(path, keysFilePollInterval, f.load)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: failed to load issuer keys from %q: %s", path, err)
+	}
+	f.watcher = watcher
+
+	return f, nil
+}
+
+// Run will watch the keys file for changes until the context is cancelled.
+func (f *fileKeySet) Run(ctx context.Context) {
+	f.watcher.Run(ctx.Done())
+}
+
+// VerifySignature implements the go-oidc KeySet interface.
+func (f *fileKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: malformed jwt: %v", err)
+	}
+
+	// We don't support JWTs signed with multiple signatures.
+	var keyID string
+	for _, sig := range jws.Signatures {
+		keyID = sig.Header.KeyID
+		break
+	}
+
+	f.lock.RLock()
+	keys := f.keys
+	f.lock.RUnlock()
+
+	for _, key := range keys {
+		// PEM encoded keys have no key ID so are tried for all tokens.
+		if keyID == "" || key.KeyID == "" || key.KeyID == keyID {
+			if payload, err := jws.Verify(&key); err == nil {
+				return payload, nil
+			}
+		}
+	}
+
+	return nil, errors.New("failed to verify id token signature")
+}
+
+// Refresh will force a reload of the keys file.
+func (f *fileKeySet) Refresh(ctx context.Context) error {
+	if err := f.watcher.Sync(); err != nil {
+		keySetFetchesTotal.WithLabelValues(refreshTriggerForced, "error").Inc()
+		return fmt.Errorf("oidc: failed to load issuer keys: %s", err)
+	}
+
+	return nil
+}
+
+// load is called by the file watcher on each change to the keys file.
+func (f *fileKeySet) load(data []byte) error {
+	keys, err := ParseKeys(data)
+	if err != nil {
+		keySetFetchesTotal.WithLabelValues(refreshTriggerFile, "error").Inc()
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.keys = keys
+	f.lastLoad = f.now()
+
+	keySetFetchesTotal.WithLabelValues(refreshTriggerFile, "success").Inc()
+	keySetLastSuccessfulFetch.Set(float64(f.lastLoad.Unix()))
+	keySetKeys.Reset()
+	for _, key := range keys {
+		keySetKeys.WithLabelValues(key.KeyID).Set(1)
+	}
+
+	return nil
+}
+
+// Status returns the current state of the key set.
+func (f *fileKeySet) Status() *KeySetStatus {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	status := &KeySetStatus{
+		LastSuccessfulFetch: f.lastLoad,
+	}
+
+	for _, key := range f.keys {
+		status.KeyIDs = append(status.KeyIDs, key.KeyID)
+	}
+	sort.Strings(status.KeyIDs)
+
+	return status
+}
+
+// ParseKeys parses either a JWKS document, or a list of PEM encoded public
+// keys and certificates.
+func ParseKeys(data []byte) ([]jose.JSONWebKey, error) {
+	data = bytes.TrimSpace(data)
+
+	if bytes.HasPrefix(data, []byte("{")) {
+		var keySet jose.JSONWebKeySet
+		if err := json.Unmarshal(data, &keySet); err != nil {
+			return nil, fmt.Errorf("failed to decode JWKS: %s", err)
+		}
+
+		if len(keySet.Keys) == 0 {
+			return nil, errors.New("no keys found in JWKS")
+		}
+
+		for _, key := range keySet.Keys {
+			if !key.IsPublic() {
+				return nil, fmt.Errorf("key %q is not a public key", key.KeyID)
+			}
+		}
+
+		return keySet.Keys, nil
+	}
+
+	var keys []jose.JSONWebKey
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		var (
+			pub interface{}
+			err error
+		)
+
+		switch block.Type {
+		case "PUBLIC KEY":
+			pub, err = x509.ParsePKIXPublicKey(block.Bytes)
+		case "RSA PUBLIC KEY":
+			pub, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		case "CERTIFICATE":
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				pub = cert.PublicKey
+			}
+		default:
+			return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse PEM block %q: %s", block.Type, err)
+		}
+
+		keys = append(keys, jose.JSONWebKey{Key: pub})
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no JWKS or PEM encoded keys found")
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,306 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/square/go-jose.v2"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/metrics"
+)
+
+const (
+	refreshTriggerPeriodic   = "periodic"
+	refreshTriggerUnknownKey = "unknown_key"
+	refreshTriggerForced     = "forced"
+
+	// keySetFetchTimeout is the timeout of each fetch of the key set.
+	keySetFetchTimeout = time.Second * 10
+)
+
+var (
+	keySetFetchesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "oidc",
+		Name:      "jwks_fetches_total",
+		Help:      "Number of fetches of the OIDC issuer key set, by trigger and result.",
+	}, []string{"trigger", "result"})
+
+	keySetLastSuccessfulFetch = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "oidc",
+		Name:      "jwks_last_successful_fetch_timestamp_seconds",
+		Help:      "Unix timestamp of the last successful fetch of the OIDC issuer key set.",
+	})
+
+	keySetKeys = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "oidc",
+		Name:      "jwks_keys",
+		Help:      "The key IDs currently held in the OIDC issuer key set.",
+	}, []string{"kid"})
+)
+
+func init() {
+	metrics.MustRegister(keySetFetchesTotal, keySetLastSuccessfulFetch, keySetKeys)
+}
+
+// remoteKeySet is a go-oidc KeySet which manages the keys of the issuer
+// itself. Keys are refreshed periodically, as well as when a token is signed
+// by an unknown key. Refreshes triggered by unknown keys are rate limited,
+// backing off exponentially on failure, so that tokens with random key IDs
+// can not be used to flood the issuer. Fetches are not cancelled with the
+// request triggering them, so that clients cancelling requests are not able to
+// fail fetches and so cause refreshes to back off.
+type remoteKeySet struct {
+	jwksURL      string
+	client       *http.Client
+	fetchTimeout time.Duration
+
+	refreshInterval    time.Duration
+	minRefreshInterval time.Duration
+	maxRefreshInterval time.Duration
+
+	now func() time.Time
+
+	// refreshLock serialises fetches of the remote key set.
+	refreshLock sync.Mutex
+
+	// lock guards all fields below.
+	lock      sync.RWMutex
+	keys      []jose.JSONWebKey
+	lastFetch time.Time
+	failures  int
+	nextFetch time.Time
+}
+
+// KeySetStatus describes the current state of the issuer key set.
+type KeySetStatus struct {
+	KeyIDs              []string  `json:"keyIDs"`
+	LastSuccessfulFetch time.Time `json:"lastSuccessfulFetch"`
+}
+
+func newRemoteKeySet(jwksURL string, client *http.Client, refreshInterval, minRefreshInterval time.Duration) *remoteKeySet {
+	return &remoteKeySet{
+		jwksURL:            jwksURL,
+		client:             client,
+		fetchTimeout:       keySetFetchTimeout,
+		refreshInterval:    refreshInterval,
+		minRefreshInterval: minRefreshInterval,
+		maxRefreshInterval: minRefreshInterval * 32,
+		now:                time.Now,
+	}
+}
+
+// Run will periodically refresh the key set until the context is cancelled.
+// The first refresh is run immediately.
+func (r *remoteKeySet) Run(ctx context.Context) {
+	if r.refreshInterval <= 0 {
+		return
+	}
+
+	go wait.Until(func() {
+		if err := r.refresh(refreshTriggerPeriodic); err != nil {
+			klog.Errorf("oidc: failed to periodically refresh issuer keys: %s", err)
+		}
+	}, r.refreshInterval, ctx.Done())
+}
+
+// VerifySignature implements the go-oidc KeySet interface.
+func (r *remoteKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: malformed jwt: %v", err)
+	}
+
+	// We don't support JWTs signed with multiple signatures.
+	var keyID string
+	for _, sig := range jws.Signatures {
+		keyID = sig.Header.KeyID
+		break
+	}
+
+	payload, found, err := r.verify(jws, keyID)
+	if found {
+		return payload, err
+	}
+
+	// The token is signed by a key we do not know about so attempt to refresh
+	// the keys, if not backing off.
+	if err := r.refreshForKey(keyID); err != nil {
+		return nil, err
+	}
+
+	payload, found, err = r.verify(jws, keyID)
+	if !found {
+		return nil, fmt.Errorf("oidc: no issuer key found with key id %q", keyID)
+	}
+
+	return payload, err
+}
+
+// verify will attempt to verify the signature using the cached keys. Returns
+// whether any key with the given ID was found.
+func (r *remoteKeySet) verify(jws *jose.JSONWebSignature, keyID string) ([]byte, bool, error) {
+	r.lock.RLock()
+	keys := r.keys
+	r.lock.RUnlock()
+
+	var found bool
+	for _, key := range keys {
+		if keyID == "" || key.KeyID == keyID {
+			found = true
+			if payload, err := jws.Verify(&key); err == nil {
+				return payload, true, nil
+			}
+		}
+	}
+
+	return nil, found, errors.New("failed to verify id token signature")
+}
+
+// refreshForKey will refresh the key set for the given unknown key ID, unless
+// refreshes are currently backing off.
+func (r *remoteKeySet) refreshForKey(keyID string) error {
+	r.refreshLock.Lock()
+	defer r.refreshLock.Unlock()
+
+	// Another request may have refreshed the keys while we were waiting.
+	if r.hasKey(keyID) {
+		return nil
+	}
+
+	r.lock.RLock()
+	nextFetch := r.nextFetch
+	r.lock.RUnlock()
+
+	if r.now().Before(nextFetch) {
+		return fmt.Errorf("oidc: no issuer key found with key id %q, not refreshing keys until %s",
+			keyID, nextFetch.Format(time.RFC3339))
+	}
+
+	return r.fetch(refreshTriggerUnknownKey)
+}
+
+// Refresh will force a refresh of the key set, ignoring any back off.
+func (r *remoteKeySet) Refresh(_ context.Context) error {
+	return r.refresh(refreshTriggerForced)
+}
+
+func (r *remoteKeySet) refresh(trigger string) error {
+	r.refreshLock.Lock()
+	defer r.refreshLock.Unlock()
+
+	return r.fetch(trigger)
+}
+
+// fetch must be called with the refresh lock held.
+func (r *remoteKeySet) fetch(trigger string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.fetchTimeout)
+	defer cancel()
+
+	keys, err := r.fetchKeys(ctx)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := r.now()
+
+	if err != nil {
+		r.failures++
+		backoff := r.minRefreshInterval << uint(r.failures)
+		if backoff > r.maxRefreshInterval || backoff <= 0 {
+			backoff = r.maxRefreshInterval
+		}
+		r.nextFetch = now.Add(backoff)
+
+		keySetFetchesTotal.WithLabelValues(trigger, "error").Inc()
+		return fmt.Errorf("oidc: failed to fetch issuer keys: %s", err)
+	}
+
+	r.keys = keys
+	r.lastFetch = now
+	r.failures = 0
+	r.nextFetch = now.Add(r.minRefreshInterval)
+
+	keySetFetchesTotal.WithLabelValues(trigger, "success").Inc()
+	keySetLastSuccessfulFetch.Set(float64(now.Unix()))
+	keySetKeys.Reset()
+	for _, key := range keys {
+		keySetKeys.WithLabelValues(key.KeyID).Set(1)
+	}
+
+	klog.V(4).Infof("oidc: refreshed %d issuer keys (%s)", len(keys), trigger)
+
+	return nil
+}
+
+func (r *remoteKeySet) fetchKeys(ctx context.Context) ([]jose.JSONWebKey, error) {
+	req, err := http.NewRequest("GET", r.jwksURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read response body: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, body)
+	}
+
+	var keySet jose.JSONWebKeySet
+	if err := json.Unmarshal(body, &keySet); err != nil {
+		return nil, fmt.Errorf("failed to decode keys: %s", err)
+	}
+
+	return keySet.Keys, nil
+}
+
+func (r *remoteKeySet) hasKey(keyID string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	for _, key := range r.keys {
+		if keyID == "" || key.KeyID == keyID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Status returns the current state of the key set.
+func (r *remoteKeySet) Status() *KeySetStatus {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	status := &KeySetStatus{
+		LastSuccessfulFetch: r.lastFetch,
+	}
+
+	for _, key := range r.keys {
+		status.KeyIDs = append(status.KeyIDs, key.KeyID)
+	}
+	sort.Strings(status.KeyIDs)
+
+	return status
+}
@@ -0,0 +1,265 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+)
+
+type testJWKSServer struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	keys     []jose.JSONWebKey
+	fail     bool
+	delay    time.Duration
+	requests int
+}
+
+func newTestJWKSServer(t *testing.T) *testJWKSServer {
+	s := new(testJWKSServer)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		s.lock.Lock()
+		delay := s.delay
+		s.lock.Unlock()
+
+		time.Sleep(delay)
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		s.requests++
+
+		if s.fail {
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if err := json.NewEncoder(rw).Encode(jose.JSONWebKeySet{Keys: s.keys}); err != nil {
+			t.Error(err)
+		}
+	}))
+
+	return s
+}
+
+func (s *testJWKSServer) setKeys(fail bool, keys ...jose.JSONWebKey) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.fail = fail
+	s.keys = keys
+}
+
+func (s *testJWKSServer) setDelay(delay time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.delay = delay
+}
+
+func (s *testJWKSServer) requestCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests
+}
+
+func newTestSigningKey(t *testing.T, keyID string) (*rsa.PrivateKey, jose.JSONWebKey) {
+	sk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sk, jose.JSONWebKey{
+		Key:       sk.Public(),
+		KeyID:     keyID,
+		Algorithm: string(jose.RS256),
+		Use:       "sig",
+	}
+}
+
+func signTestPayload(t *testing.T, sk *rsa.PrivateKey, keyID string, payload []byte) string {
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.RS256,
+		Key:       jose.JSONWebKey{Key: sk, KeyID: keyID},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwt, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return jwt
+}
+
+func TestRemoteKeySetRotation(t *testing.T) {
+	server := newTestJWKSServer(t)
+	defer server.Close()
+
+	skA, keyA := newTestSigningKey(t, "a")
+	skB, keyB := newTestSigningKey(t, "b")
+	server.setKeys(false, keyA)
+
+	now := time.Now()
+	keySet := newRemoteKeySet(server.URL, server.Client(), 0, time.Minute)
+	keySet.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	payload := []byte(`{"foo":"bar"}`)
+
+	// The first token should trigger a fetch of the keys.
+	got, err := keySet.VerifySignature(ctx, signTestPayload(t, skA, "a", payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(payload) {
+		t.Errorf("unexpected payload, exp=%s got=%s", payload, got)
+	}
+	if c := server.requestCount(); c != 1 {
+		t.Errorf("expected 1 fetch, got=%d", c)
+	}
+
+	// A known key should not trigger a fetch.
+	if _, err := keySet.VerifySignature(ctx, signTestPayload(t, skA, "a", payload)); err != nil {
+		t.Fatal(err)
+	}
+	if c := server.requestCount(); c != 1 {
+		t.Errorf("expected 1 fetch, got=%d", c)
+	}
+
+	// The issuer rotates its keys, but the minimum refresh interval has not
+	// passed.
+	server.setKeys(false, keyA, keyB)
+	if _, err := keySet.VerifySignature(ctx, signTestPayload(t, skB, "b", payload)); err == nil {
+		t.Error("expected error verifying unknown key during minimum refresh interval")
+	}
+	if c := server.requestCount(); c != 1 {
+		t.Errorf("expected 1 fetch, got=%d", c)
+	}
+
+	// Once passed, the unknown key should trigger a refresh.
+	now = now.Add(time.Minute)
+	if _, err := keySet.VerifySignature(ctx, signTestPayload(t, skB, "b", payload)); err != nil {
+		t.Fatal(err)
+	}
+	if c := server.requestCount(); c != 2 {
+		t.Errorf("expected 2 fetches, got=%d", c)
+	}
+
+	if exp, got := []string{"a", "b"}, keySet.Status().KeyIDs; !reflect.DeepEqual(exp, got) {
+		t.Errorf("unexpected key IDs, exp=%v got=%v", exp, got)
+	}
+
+	// A token signed with the right key ID but wrong key should fail without
+	// a refresh.
+	if _, err := keySet.VerifySignature(ctx, signTestPayload(t, skA, "b", payload)); err == nil {
+		t.Error("expected error verifying token signed by the wrong key")
+	}
+	if c := server.requestCount(); c != 2 {
+		t.Errorf("expected 2 fetches, got=%d", c)
+	}
+}
+
+func TestRemoteKeySetBackoff(t *testing.T) {
+	server := newTestJWKSServer(t)
+	defer server.Close()
+
+	sk, key := newTestSigningKey(t, "a")
+	server.setKeys(true)
+
+	now := time.Now()
+	keySet := newRemoteKeySet(server.URL, server.Client(), 0, time.Second)
+	keySet.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	jwt := signTestPayload(t, sk, "a", []byte(`{}`))
+
+	// Each failure should double the time until the next fetch.
+	for i, backoff := range []time.Duration{0, time.Second * 2, time.Second * 4} {
+		now = now.Add(backoff)
+
+		if _, err := keySet.VerifySignature(ctx, jwt); err == nil {
+			t.Fatal("expected error whilst issuer failing")
+		}
+		if c := server.requestCount(); c != i+1 {
+			t.Errorf("expected %d fetches, got=%d", i+1, c)
+		}
+
+		// Tokens during the back off should not trigger a fetch.
+		if _, err := keySet.VerifySignature(ctx, jwt); err == nil {
+			t.Fatal("expected error whilst backing off")
+		}
+		if c := server.requestCount(); c != i+1 {
+			t.Errorf("expected %d fetches, got=%d", i+1, c)
+		}
+	}
+
+	// A forced refresh should ignore the back off.
+	server.setKeys(false, key)
+	if err := keySet.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := keySet.VerifySignature(ctx, jwt); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := keySet.Status(); !status.LastSuccessfulFetch.Equal(now) {
+		t.Errorf("unexpected last successful fetch, exp=%s got=%s",
+			now, status.LastSuccessfulFetch)
+	}
+}
+
+func TestRemoteKeySetFetchContext(t *testing.T) {
+	server := newTestJWKSServer(t)
+	defer server.Close()
+
+	skA, keyA := newTestSigningKey(t, "a")
+	skB, keyB := newTestSigningKey(t, "b")
+	server.setKeys(false, keyA)
+
+	now := time.Now()
+	keySet := newRemoteKeySet(server.URL, server.Client(), 0, time.Second)
+	keySet.now = func() time.Time { return now }
+	keySet.fetchTimeout = time.Millisecond * 100
+
+	// A request cancelled by the client should not cancel the fetch it
+	// triggers, so should not cause refreshes to back off.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := keySet.VerifySignature(ctx, signTestPayload(t, skA, "a", []byte(`{}`))); err != nil {
+		t.Fatalf("expected fetch not to be cancelled with the request: %s", err)
+	}
+	if keySet.failures != 0 {
+		t.Errorf("expected no fetch failures, got=%d", keySet.failures)
+	}
+
+	// Fetches should time out on their own.
+	now = now.Add(time.Second)
+	server.setKeys(false, keyA, keyB)
+	server.setDelay(time.Millisecond * 500)
+
+	if _, err := keySet.VerifySignature(context.Background(), signTestPayload(t, skB, "b", []byte(`{}`))); err == nil {
+		t.Error("expected error when the fetch times out")
+	}
+	if keySet.failures != 1 {
+		t.Errorf("expected the timed out fetch to fail, got=%d failures", keySet.failures)
+	}
+}
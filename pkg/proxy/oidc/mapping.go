@@ -0,0 +1,139 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package oidc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/expression"
+)
+
+// systemPrefix is reserved by the API server for system users and groups, so
+// may not be used by usernames and groups derived from claims.
+const systemPrefix = "system:"
+
+// ClaimMapping holds compiled groups expressions and claim validation rules,
+// applied in addition to those of the authenticator options.
+type ClaimMapping struct {
+	groupsExpressions    []*expression.Expression
+	claimValidationRules []claimValidationRule
+}
+
+// CompileClaimMapping compiles the groups expressions and claim validation
+// rules into a ClaimMapping.
+func CompileClaimMapping(groupsExpressions []string, rules []ClaimValidationRule) (*ClaimMapping, error) {
+	exprs, err := compileExpressions("groups expression", groupsExpressions)
+	if err != nil {
+		return nil, err
+	}
+
+	compiled, err := compileClaimValidationRules(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ClaimMapping{
+		groupsExpressions:    exprs,
+		claimValidationRules: compiled,
+	}, nil
+}
+
+// mapping returns the groups expressions and claim validation rules of the
+// authenticator options, followed by those of the claim mapping, if any.
+func (a *Authenticator) mapping() ([]*expression.Expression, []claimValidationRule) {
+	if a.claimMapping == nil {
+		return a.groupsExpressions, a.claimValidationRules
+	}
+
+	m := a.claimMapping()
+	if m == nil {
+		return a.groupsExpressions, a.claimValidationRules
+	}
+
+	exprs := make([]*expression.Expression, 0, len(a.groupsExpressions)+len(m.groupsExpressions))
+	exprs = append(append(exprs, a.groupsExpressions...), m.groupsExpressions...)
+
+	rules := make([]claimValidationRule, 0, len(a.claimValidationRules)+len(m.claimValidationRules))
+	rules = append(append(rules, a.claimValidationRules...), m.claimValidationRules...)
+
+	return exprs, rules
+}
+
+func compileExpressions(name string, sources []string) ([]*expression.Expression, error) {
+	var exprs []*expression.Expression
+
+	for _, source := range sources {
+		expr, err := expression.Compile(source)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+
+		exprs = append(exprs, expr)
+	}
+
+	return exprs, nil
+}
+
+// evaluateUsername returns the output of the first username expression which
+// evaluates without error and is not empty, so that later expressions act as
+// fallbacks, such as when a claim is missing. Like the email username claim,
+// an expression reading the email claim fails if the email is not verified.
+// Usernames with the reserved system prefix are rejected, rather than falling
+// back.
+func evaluateUsername(exprs []*expression.Expression, values map[string]interface{}, verifyEmail func() error) (string, error) {
+	var errs []string
+
+	for _, expr := range exprs {
+		username, err := expr.Evaluate(values)
+		if err == nil && len(username) > 0 && expr.References("email") {
+			if verr := verifyEmail(); verr != nil {
+				err = fmt.Errorf("expression %q: %v", expr, verr)
+			}
+		}
+
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		if len(username) > 0 {
+			if strings.HasPrefix(username, systemPrefix) {
+				return "", fmt.Errorf("expression %q: username %q must not have the %q prefix", expr, username, systemPrefix)
+			}
+
+			return username, nil
+		}
+	}
+
+	if len(errs) > 0 {
+		return "", fmt.Errorf("no username expression evaluated to a username: %s", strings.Join(errs, ", "))
+	}
+
+	return "", errors.New("all username expressions evaluated to an empty username")
+}
+
+// evaluateGroups returns the combined groups of all group expressions. Each
+// expression may output a single group, or several groups from the list
+// function.
+// Like the API server, groups with the reserved system prefix are rejected.
+func evaluateGroups(exprs []*expression.Expression, values map[string]interface{}) ([]string, error) {
+	var groups []string
+
+	for _, expr := range exprs {
+		out, err := expr.EvaluateList(values)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, group := range out {
+			if strings.HasPrefix(group, systemPrefix) {
+				return nil, fmt.Errorf("expression %q: group %q must not have the %q prefix", expr, group, systemPrefix)
+			}
+
+			groups = append(groups, group)
+		}
+	}
+
+	return groups, nil
+}
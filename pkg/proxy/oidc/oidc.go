@@ -0,0 +1,538 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package oidc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	gooidc "github.com/coreos/go-oidc"
+	"k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+	certutil "k8s.io/client-go/util/cert"
+	"k8s.io/klog"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/expression"
+)
+
+var (
+	errNotInitialized = errors.New("oidc: authenticator not initialized")
+
+	// whitelist of signing algorithms to ensure users don't mistakenly pass
+	// something goofy.
+	allowedSigningAlgs = map[string]bool{
+		gooidc.RS256: true,
+		gooidc.RS384: true,
+		gooidc.RS512: true,
+		gooidc.ES256: true,
+		gooidc.ES384: true,
+		gooidc.ES512: true,
+		gooidc.PS256: true,
+		gooidc.PS384: true,
+		gooidc.PS512: true,
+	}
+)
+
+type Options struct {
+	// IssuerURL is the URL the provider signs ID Tokens as. This will be the
+	// "iss" field of all tokens produced by the provider and is used for
+	// configuration discovery. The URL is usually the provider's URL without
+	// a path, for example "https://accounts.google.com".
+	IssuerURL string
+
+	// ClientID the JWT must be issued for, the "aud" field.
+	ClientID string
+
+	// Audiences, if specified, are further audiences the JWT may be issued
+	// for, in addition to the ClientID.
+	Audiences []string
+
+	// RequiredScopes, if specified, are scopes which must all be present in
+	// the "scope" or "scp" claim of the JWT.
+	RequiredScopes []string
+
+	// ScopeGroups, if specified, maps scopes of the JWT to groups the user
+	// is given.
+	ScopeGroups map[string]string
+
+	// Path to a PEM encoded root certificate of the provider.
+	CAFile string
+
+	// UsernameClaim is the JWT field to use as the user's username.
+	UsernameClaim string
+
+	// UsernamePrefix, if specified, causes claims mapping to username to be
+	// prefix with the provided value.
+	UsernamePrefix string
+
+	// GroupsClaim, if specified, causes the OIDCAuthenticator to try to
+	// populate the user's groups with an ID Token field.
+	GroupsClaim string
+
+	// GroupsPrefix, if specified, causes claims mapping to group names to be
+	// prefixed with the value.
+	GroupsPrefix string
+
+	// SupportedSigningAlgs sets the accepted set of JOSE signing algorithms
+	// that can be used by the provider to sign tokens.
+	SupportedSigningAlgs []string
+
+	// RequiredClaims, if specified, causes the OIDCAuthenticator to verify
+	// that all the required claims key value pairs are present in the ID
+	// Token.
+	RequiredClaims map[string]string
+
+	// UsernameExpressions, if specified, are expressions evaluated against
+	// the claims of the token to derive the username, in place of the
+	// UsernameClaim and UsernamePrefix. The first expression with a non empty
+	// output is used, so later expressions act as fallbacks.
+	UsernameExpressions []string
+
+	// GroupsExpressions, if specified, are expressions evaluated against the
+	// claims of the token to derive further groups of the user. Each
+	// expression may output a single group, or several groups from the list
+	// function.
+	GroupsExpressions []string
+
+	// ClaimValidationRules, if specified, are expressions which must all
+	// evaluate to true against the claims of the token.
+	ClaimValidationRules []ClaimValidationRule
+
+	// ClaimMapping, if specified, returns further groups expressions and
+	// claim validation rules, applied after those above, which may change
+	// while running. It may return nil.
+	ClaimMapping func() *ClaimMapping
+
+	// KeySetRefreshInterval is the interval at which the issuer keys are
+	// proactively refreshed. If zero, keys are only refreshed when a token is
+	// signed by an unknown key.
+	KeySetRefreshInterval time.Duration
+
+	// KeySetMinRefreshInterval is the minimum interval between refreshes of
+	// the issuer keys triggered by tokens signed with an unknown key. Failed
+	// refreshes back off exponentially from this interval.
+	KeySetMinRefreshInterval time.Duration
+
+	// KeysFile, if specified, is the path to a file containing the issuer
+	// keys, either as a JWKS document or PEM encoded public keys. Issuer
+	// discovery is skipped and the file is watched for changes.
+	KeysFile string
+
+	// now is used for testing. It defaults to time.Now.
+	now func() time.Time
+}
+
+// keySet is a go-oidc KeySet whose keys are managed by the authenticator.
+type keySet interface {
+	gooidc.KeySet
+
+	Run(ctx context.Context)
+	Refresh(ctx context.Context) error
+	Status() *KeySetStatus
+}
+
+// verifier holds the initialised token verifier along with the key set it
+// uses.
+type verifier struct {
+	*gooidc.IDTokenVerifier
+	keySet keySet
+}
+
+// Authenticator is an OIDC token authenticator which, unlike the Kubernetes
+// API server authenticator, manages the issuer key set itself.
+type Authenticator struct {
+	issuerURL string
+
+	usernameClaim  string
+	usernamePrefix string
+	groupsClaim    string
+	groupsPrefix   string
+	requiredClaims map[string]string
+
+	// audiences is the set of audiences the JWT may be issued for. If empty,
+	// the audience is checked by the token verifier.
+	audiences      sets.String
+	requiredScopes []string
+	scopeGroups    map[string]string
+
+	claimValidationRules []claimValidationRule
+	usernameExpressions  []*expression.Expression
+	groupsExpressions    []*expression.Expression
+	claimMapping         func() *ClaimMapping
+
+	// Contains a *verifier. Do not access directly use the idTokenVerifier
+	// method.
+	verifier atomic.Value
+
+	cancel context.CancelFunc
+
+	// resolver is used to resolve distributed claims.
+	resolver *claimResolver
+}
+
+var _ authenticator.Token = &Authenticator{}
+
+// New creates a new OIDC token authenticator. The issuer discovery document
+// is fetched asynchronously, until which the authenticator will return an
+// error for all tokens.
+func New(opts Options) (*Authenticator, error) {
+	url, err := url.Parse(opts.IssuerURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if url.Scheme != "https" {
+		return nil, fmt.Errorf("'oidc-issuer-url' (%q) has invalid scheme (%q), require 'https'", opts.IssuerURL, url.Scheme)
+	}
+
+	if opts.UsernameClaim == "" && len(opts.UsernameExpressions) == 0 {
+		return nil, errors.New("no username claim provided")
+	}
+
+	supportedSigningAlgs := opts.SupportedSigningAlgs
+	if len(supportedSigningAlgs) == 0 {
+		// RS256 is the default recommended by OpenID Connect and an 'alg' value
+		// providers are required to implement.
+		supportedSigningAlgs = []string{gooidc.RS256}
+	}
+	for _, alg := range supportedSigningAlgs {
+		if !allowedSigningAlgs[alg] {
+			return nil, fmt.Errorf("oidc: unsupported signing alg: %q", alg)
+		}
+	}
+
+	claimValidationRules, err := compileClaimValidationRules(opts.ClaimValidationRules)
+	if err != nil {
+		return nil, err
+	}
+
+	usernameExpressions, err := compileExpressions("username expression", opts.UsernameExpressions)
+	if err != nil {
+		return nil, err
+	}
+
+	groupsExpressions, err := compileExpressions("groups expression", opts.GroupsExpressions)
+	if err != nil {
+		return nil, err
+	}
+
+	var roots *x509.CertPool
+	if opts.CAFile != "" {
+		roots, err = certutil.NewPool(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read the CA file: %v", err)
+		}
+	} else {
+		klog.Info("OIDC: No x509 certificates provided, will use host's root CA set")
+	}
+
+	// Copied from http.DefaultTransport.
+	tr := net.SetTransportDefaults(&http.Transport{
+		// According to golang's doc, if RootCAs is nil,
+		// TLS uses the host's root CA set.
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+	})
+
+	client := &http.Client{Transport: tr, Timeout: 30 * time.Second}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = gooidc.ClientContext(ctx, client)
+
+	now := opts.now
+	if now == nil {
+		now = time.Now
+	}
+
+	verifierConfig := &gooidc.Config{
+		ClientID:             opts.ClientID,
+		SupportedSigningAlgs: supportedSigningAlgs,
+		Now:                  now,
+	}
+
+	// If further audiences are given, the audience is checked by the
+	// authenticator instead.
+	var audiences sets.String
+	if len(opts.Audiences) > 0 {
+		audiences = sets.NewString(opts.Audiences...)
+		audiences.Insert(opts.ClientID)
+		verifierConfig.SkipClientIDCheck = true
+	}
+
+	var resolver *claimResolver
+	if opts.GroupsClaim != "" {
+		// The resolver has its own copy of the config, and checks the audiences
+		// of distributed claim JWTs itself.
+		resolverConfig := *verifierConfig
+		resolver = newClaimResolver(opts.GroupsClaim, client, &resolverConfig, audiences)
+	}
+
+	a := &Authenticator{
+		issuerURL:      opts.IssuerURL,
+		usernameClaim:  opts.UsernameClaim,
+		usernamePrefix: opts.UsernamePrefix,
+		groupsClaim:    opts.GroupsClaim,
+		groupsPrefix:   opts.GroupsPrefix,
+		requiredClaims: opts.RequiredClaims,
+		audiences:      audiences,
+		requiredScopes: opts.RequiredScopes,
+		scopeGroups:    opts.ScopeGroups,
+		cancel:         cancel,
+		resolver:       resolver,
+
+		claimValidationRules: claimValidationRules,
+		usernameExpressions:  usernameExpressions,
+		groupsExpressions:    groupsExpressions,
+		claimMapping:         opts.ClaimMapping,
+	}
+
+	// If the issuer keys are given locally, discovery is skipped and the
+	// authenticator is initialised immediately.
+	if len(opts.KeysFile) > 0 {
+		keySet, err := newFileKeySet(opts.KeysFile, now)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+
+		a.initVerifier(ctx, keySet, verifierConfig)
+
+		return a, nil
+	}
+
+	// Asynchronously attempt to initialize the authenticator. This enables
+	// self-hosted providers, providers that run on top of Kubernetes itself.
+	go wait.PollUntil(time.Second*10, func() (done bool, err error) {
+		provider, err := gooidc.NewProvider(ctx, a.issuerURL)
+		if err != nil {
+			klog.Errorf("oidc authenticator: initializing plugin: %v", err)
+			return false, nil
+		}
+
+		var discovery struct {
+			JWKSURL string `json:"jwks_uri"`
+		}
+		if err := provider.Claims(&discovery); err != nil || len(discovery.JWKSURL) == 0 {
+			klog.Errorf("oidc authenticator: no jwks_uri found in discovery document: %v", err)
+			return false, nil
+		}
+
+		keySet := newRemoteKeySet(discovery.JWKSURL, client,
+			opts.KeySetRefreshInterval, opts.KeySetMinRefreshInterval)
+		keySet.now = now
+
+		a.initVerifier(ctx, keySet, verifierConfig)
+
+		return true, nil
+	}, ctx.Done())
+
+	return a, nil
+}
+
+// initVerifier will start managing the given key set and initialise the
+// authenticator token verifier with it.
+func (a *Authenticator) initVerifier(ctx context.Context, keySet keySet, config *gooidc.Config) {
+	keySet.Run(ctx)
+
+	a.setVerifier(&verifier{
+		IDTokenVerifier: gooidc.NewVerifier(a.issuerURL, keySet, config),
+		keySet:          keySet,
+	})
+}
+
+func (a *Authenticator) setVerifier(v *verifier) {
+	a.verifier.Store(v)
+}
+
+func (a *Authenticator) idTokenVerifier() (*verifier, bool) {
+	if v := a.verifier.Load(); v != nil {
+		return v.(*verifier), true
+	}
+	return nil, false
+}
+
+// Close will stop the authenticator from refreshing keys and initialising.
+func (a *Authenticator) Close() {
+	a.cancel()
+}
+
+func (a *Authenticator) AuthenticateToken(ctx context.Context, token string) (*authenticator.Response, bool, error) {
+	if !hasCorrectIssuer(a.issuerURL, token) {
+		return nil, false, nil
+	}
+
+	verifier, ok := a.idTokenVerifier()
+	if !ok {
+		return nil, false, errNotInitialized
+	}
+
+	idToken, err := verifier.Verify(ctx, token)
+	if err != nil {
+		return nil, false, fmt.Errorf("oidc: verify token: %v", err)
+	}
+
+	var c claims
+	if err := idToken.Claims(&c); err != nil {
+		return nil, false, fmt.Errorf("oidc: parse claims: %v", err)
+	}
+	if a.resolver != nil {
+		if err := a.resolver.expand(c); err != nil {
+			return nil, false, fmt.Errorf("oidc: could not expand distributed claims: %v", err)
+		}
+	}
+
+	if a.audiences.Len() > 0 {
+		var audiences stringOrArray
+		if err := c.unmarshalClaim("aud", &audiences); err != nil {
+			return nil, false, fmt.Errorf("oidc: parse 'aud' claim: %v", err)
+		}
+
+		if !a.audiences.HasAny(audiences...) {
+			return nil, false, fmt.Errorf("oidc: expected audience in %q got %q", a.audiences.List(), []string(audiences))
+		}
+	}
+
+	scopes, err := c.scopes()
+	if err != nil {
+		return nil, false, fmt.Errorf("oidc: parse scopes: %v", err)
+	}
+
+	for _, scope := range a.requiredScopes {
+		if !scopes.Has(scope) {
+			return nil, false, fmt.Errorf("oidc: required scope %s not present in ID token", scope)
+		}
+	}
+
+	groupsExpressions, claimValidationRules := a.mapping()
+
+	// Claim values are only decoded when needed for evaluating expressions.
+	var values map[string]interface{}
+	if len(claimValidationRules) > 0 || len(a.usernameExpressions) > 0 || len(groupsExpressions) > 0 {
+		values, err = c.values()
+		if err != nil {
+			return nil, false, fmt.Errorf("oidc: %v", err)
+		}
+	}
+
+	var username string
+	if len(a.usernameExpressions) > 0 {
+		username, err = evaluateUsername(a.usernameExpressions, values, c.verifyEmail)
+		if err != nil {
+			return nil, false, fmt.Errorf("oidc: derive username: %v", err)
+		}
+	} else {
+		if err := c.unmarshalClaim(a.usernameClaim, &username); err != nil {
+			return nil, false, fmt.Errorf("oidc: parse username claims %q: %v", a.usernameClaim, err)
+		}
+
+		if a.usernameClaim == "email" {
+			if err := c.verifyEmail(); err != nil {
+				return nil, false, fmt.Errorf("oidc: %v", err)
+			}
+		}
+
+		if a.usernamePrefix != "" {
+			username = a.usernamePrefix + username
+		}
+	}
+
+	info := &user.DefaultInfo{Name: username}
+	if a.groupsClaim != "" {
+		if _, ok := c[a.groupsClaim]; ok {
+			// Some admins want to use string claims like "role" as the group
+			// value. Allow the group claim to be a single string instead of an
+			// array.
+			var groups stringOrArray
+			if err := c.unmarshalClaim(a.groupsClaim, &groups); err != nil {
+				return nil, false, fmt.Errorf("oidc: parse groups claim %q: %v", a.groupsClaim, err)
+			}
+			info.Groups = []string(groups)
+		}
+	}
+
+	if a.groupsPrefix != "" {
+		for i, group := range info.Groups {
+			info.Groups[i] = a.groupsPrefix + group
+		}
+	}
+
+	// Scope groups are not prefixed since they are given explicitly.
+	for _, scope := range scopes.List() {
+		if group, ok := a.scopeGroups[scope]; ok {
+			info.Groups = append(info.Groups, group)
+		}
+	}
+
+	if len(groupsExpressions) > 0 {
+		groups, err := evaluateGroups(groupsExpressions, values)
+		if err != nil {
+			return nil, false, fmt.Errorf("oidc: derive groups: %v", err)
+		}
+		info.Groups = append(info.Groups, groups...)
+	}
+
+	// check to ensure all required claims are present in the ID token and
+	// have matching values.
+	for claim, value := range a.requiredClaims {
+		if !c.hasClaim(claim) {
+			return nil, false, fmt.Errorf("oidc: required claim %s not present in ID token", claim)
+		}
+
+		// NOTE: Only string values are supported as valid required claim values.
+		var claimValue string
+		if err := c.unmarshalClaim(claim, &claimValue); err != nil {
+			return nil, false, fmt.Errorf("oidc: parse claim %s: %v", claim, err)
+		}
+		if claimValue != value {
+			return nil, false, fmt.Errorf("oidc: required claim %s value does not match. Got = %s, want = %s", claim, claimValue, value)
+		}
+	}
+
+	if len(claimValidationRules) > 0 {
+		if err := validateClaims(claimValidationRules, values); err != nil {
+			return nil, false, err
+		}
+	}
+
+	return &authenticator.Response{User: info}, true, nil
+}
+
+// KeySetRefreshHandler returns an http.Handler which forces a refresh of the
+// issuer keys on POST requests, responding with the current key IDs.
+func (a *Authenticator) KeySetRefreshHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			rw.Header().Set("Allow", http.MethodPost)
+			http.Error(rw, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		verifier, ok := a.idTokenVerifier()
+		if !ok {
+			http.Error(rw, errNotInitialized.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		if err := verifier.keySet.Refresh(req.Context()); err != nil {
+			klog.Errorf("oidc: forced refresh of issuer keys failed: %s", err)
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		klog.Info("oidc: forced refresh of issuer keys succeeded")
+
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(verifier.keySet.Status()); err != nil {
+			klog.Errorf("oidc: failed to write key set status: %s", err)
+		}
+	})
+}
@@ -0,0 +1,644 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package oidc
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const testIssuerURL = "https://issuer.example.com"
+
+func TestAuthenticatorKeysFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-oidc-proxy-oidc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	skA, _ := newTestSigningKey(t, "a")
+	skB, keyB := newTestSigningKey(t, "b")
+
+	pubDER, err := x509.MarshalPKIXPublicKey(skA.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keysFile := filepath.Join(dir, "keys.pem")
+	if err := ioutil.WriteFile(keysFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: pubDER,
+	}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	a, err := New(Options{
+		IssuerURL:      testIssuerURL,
+		ClientID:       "kube-oidc-proxy",
+		UsernameClaim:  "sub",
+		RequiredClaims: map[string]string{"team": "foo"},
+		KeysFile:       keysFile,
+		now:            func() time.Time { return now },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	newToken := func(claims map[string]interface{}) map[string]interface{} {
+		token := map[string]interface{}{
+			"iss":  testIssuerURL,
+			"aud":  "kube-oidc-proxy",
+			"sub":  "user-1",
+			"team": "foo",
+			"exp":  now.Add(time.Minute).Unix(),
+		}
+		for k, v := range claims {
+			token[k] = v
+		}
+		return token
+	}
+
+	sign := func(claims map[string]interface{}, keyID string) string {
+		payload, err := json.Marshal(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sk := skA
+		if keyID == "b" {
+			sk = skB
+		}
+
+		return signTestPayload(t, sk, keyID, payload)
+	}
+
+	tests := map[string]struct {
+		token  string
+		expErr bool
+	}{
+		"a valid token should authenticate": {
+			token: sign(newToken(nil), "a"),
+		},
+		"a token for a different audience should fail": {
+			token:  sign(newToken(map[string]interface{}{"aud": "foo"}), "a"),
+			expErr: true,
+		},
+		"an expired token should fail": {
+			token:  sign(newToken(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()}), "a"),
+			expErr: true,
+		},
+		"a token without the required claim should fail": {
+			token:  sign(newToken(map[string]interface{}{"team": "bar"}), "a"),
+			expErr: true,
+		},
+		"a token signed by an unknown key should fail": {
+			token:  sign(newToken(nil), "b"),
+			expErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			resp, ok, err := a.AuthenticateToken(context.TODO(), test.token)
+			if test.expErr {
+				if err == nil {
+					t.Error("expected error, got none")
+				}
+				return
+			}
+
+			if err != nil || !ok {
+				t.Fatalf("unexpected failure to authenticate, ok=%t err=%v", ok, err)
+			}
+
+			if resp.User.GetName() != "user-1" {
+				t.Errorf("unexpected username, exp=user-1 got=%s", resp.User.GetName())
+			}
+		})
+	}
+
+	// Replacing the keys file with a JWKS document should rotate the keys.
+	jwks, err := json.Marshal(map[string]interface{}{
+		"keys": []interface{}{keyB},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keysFile, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	v, _ := a.idTokenVerifier()
+	if err := v.keySet.Refresh(context.TODO()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := a.AuthenticateToken(context.TODO(), sign(newToken(nil), "b")); err != nil {
+		t.Errorf("expected token signed by rotated key to authenticate, got=%v", err)
+	}
+
+	if _, _, err := a.AuthenticateToken(context.TODO(), sign(newToken(nil), "a")); err == nil {
+		t.Error("expected token signed by old key to fail")
+	}
+
+	// An invalid keys file should keep the current keys.
+	if err := ioutil.WriteFile(keysFile, []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.keySet.Refresh(context.TODO()); err == nil {
+		t.Error("expected error loading invalid keys file")
+	}
+	if _, _, err := a.AuthenticateToken(context.TODO(), sign(newToken(nil), "b")); err != nil {
+		t.Errorf("expected token to authenticate with previous keys, got=%v", err)
+	}
+}
+
+func TestAuthenticatorAudiencesScopes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-oidc-proxy-oidc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sk, key := newTestSigningKey(t, "a")
+
+	jwks, err := json.Marshal(map[string]interface{}{
+		"keys": []interface{}{key},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keysFile := filepath.Join(dir, "keys.json")
+	if err := ioutil.WriteFile(keysFile, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New(Options{
+		IssuerURL:      testIssuerURL,
+		ClientID:       "kube-oidc-proxy",
+		Audiences:      []string{"aud-a", "aud-b"},
+		UsernameClaim:  "sub",
+		GroupsClaim:    "groups",
+		GroupsPrefix:   "oidc:",
+		RequiredScopes: []string{"k8s"},
+		ClaimValidationRules: []ClaimValidationRule{
+			{
+				Expression: `{{ not (contains .groups "banned") }}`,
+				Message:    "user is banned",
+			},
+		},
+		ScopeGroups: map[string]string{
+			"k8s:read":  "oidc:readonly",
+			"k8s:write": "oidc:readwrite",
+		},
+		KeysFile: keysFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	sign := func(claims map[string]interface{}) string {
+		token := map[string]interface{}{
+			"iss":    testIssuerURL,
+			"sub":    "user-1",
+			"groups": []string{"group-1"},
+			"exp":    time.Now().Add(time.Minute).Unix(),
+		}
+		for k, v := range claims {
+			token[k] = v
+		}
+
+		payload, err := json.Marshal(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return signTestPayload(t, sk, "a", payload)
+	}
+
+	tests := map[string]struct {
+		claims    map[string]interface{}
+		expErr    bool
+		expReject string
+		expGroups []string
+	}{
+		"a token for the client ID should authenticate": {
+			claims:    map[string]interface{}{"aud": "kube-oidc-proxy", "scope": "k8s"},
+			expGroups: []string{"oidc:group-1"},
+		},
+		"a token for a further audience should authenticate": {
+			claims:    map[string]interface{}{"aud": []string{"foo", "aud-b"}, "scope": "k8s"},
+			expGroups: []string{"oidc:group-1"},
+		},
+		"a token for an unknown audience should fail": {
+			claims: map[string]interface{}{"aud": []string{"foo", "bar"}, "scope": "k8s"},
+			expErr: true,
+		},
+		"a token without the required scope should fail": {
+			claims: map[string]interface{}{"aud": "aud-a", "scope": "openid k8s:read"},
+			expErr: true,
+		},
+		"a token with mapped scopes should be given groups": {
+			claims:    map[string]interface{}{"aud": "aud-a", "scope": "openid k8s k8s:read"},
+			expGroups: []string{"oidc:group-1", "oidc:readonly"},
+		},
+		"a token failing claim validation should fail with the message": {
+			claims:    map[string]interface{}{"aud": "aud-a", "scope": "k8s", "groups": []string{"banned"}},
+			expErr:    true,
+			expReject: "user is banned",
+		},
+		"a token with mapped scp entries should be given groups": {
+			claims:    map[string]interface{}{"aud": "aud-a", "scp": []string{"k8s", "k8s:read", "k8s:write"}},
+			expGroups: []string{"oidc:group-1", "oidc:readonly", "oidc:readwrite"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			resp, ok, err := a.AuthenticateToken(context.TODO(), sign(test.claims))
+			if test.expErr {
+				if err == nil {
+					t.Error("expected error, got none")
+				}
+
+				validationErr, isValidationErr := err.(*ClaimValidationError)
+				if len(test.expReject) > 0 && (!isValidationErr || validationErr.Message != test.expReject) {
+					t.Errorf("expected claim validation error %q, got=%v", test.expReject, err)
+				}
+
+				return
+			}
+
+			if err != nil || !ok {
+				t.Fatalf("unexpected failure to authenticate, ok=%t err=%v", ok, err)
+			}
+
+			if groups := resp.User.GetGroups(); !reflect.DeepEqual(groups, test.expGroups) {
+				t.Errorf("unexpected groups, exp=%v got=%v", test.expGroups, groups)
+			}
+		})
+	}
+}
+
+func TestAuthenticatorDistributedClaimsAudiences(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-oidc-proxy-oidc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sk, key := newTestSigningKey(t, "a")
+	claimsSK, claimsKey := newTestSigningKey(t, "claims")
+
+	// The claims server is the issuer of the distributed groups claim, with
+	// the audience of the query.
+	var claimsServer *httptest.Server
+	claimsServer = httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var resp interface{}
+		switch req.URL.Path {
+		case "/.well-known/openid-configuration":
+			resp = map[string]interface{}{
+				"issuer":   claimsServer.URL,
+				"jwks_uri": claimsServer.URL + "/keys",
+			}
+		case "/keys":
+			resp = map[string]interface{}{"keys": []interface{}{claimsKey}}
+		case "/groups":
+			payload, err := json.Marshal(map[string]interface{}{
+				"iss":    claimsServer.URL,
+				"aud":    req.URL.Query().Get("aud"),
+				"groups": []string{"distributed"},
+				"exp":    time.Now().Add(time.Minute).Unix(),
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			rw.Write([]byte(signTestPayload(t, claimsSK, "claims", payload)))
+			return
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if err := json.NewEncoder(rw).Encode(resp); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer claimsServer.Close()
+
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: claimsServer.Certificate().Raw,
+	}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	jwks, err := json.Marshal(map[string]interface{}{
+		"keys": []interface{}{key},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keysFile := filepath.Join(dir, "keys.json")
+	if err := ioutil.WriteFile(keysFile, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := New(Options{
+		IssuerURL:     testIssuerURL,
+		ClientID:      "kube-oidc-proxy",
+		Audiences:     []string{"aud-a"},
+		CAFile:        caFile,
+		UsernameClaim: "sub",
+		GroupsClaim:   "groups",
+		KeysFile:      keysFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	authenticate := func(claimsAudience string) ([]string, error) {
+		payload, err := json.Marshal(map[string]interface{}{
+			"iss":          testIssuerURL,
+			"aud":          "aud-a",
+			"sub":          "user-1",
+			"exp":          time.Now().Add(time.Minute).Unix(),
+			"_claim_names": map[string]string{"groups": "src"},
+			"_claim_sources": map[string]interface{}{
+				"src": map[string]string{"endpoint": claimsServer.URL + "/groups?aud=" + claimsAudience},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, _, err := a.AuthenticateToken(context.TODO(), signTestPayload(t, sk, "a", payload))
+		if err != nil {
+			return nil, err
+		}
+		return resp.User.GetGroups(), nil
+	}
+
+	// The verifier of the claims issuer is initialised asynchronously.
+	if err := wait.PollImmediate(time.Millisecond*10, time.Second*5, func() (bool, error) {
+		_, err := authenticate("aud-a")
+		return err == nil, nil
+	}); err != nil {
+		t.Fatalf("expected distributed claims to be resolved: %s", err)
+	}
+
+	for _, test := range []struct {
+		audience string
+		expErr   bool
+	}{
+		{"aud-a", false},
+		{"kube-oidc-proxy", false},
+		{"other", true},
+		{"", true},
+	} {
+		groups, err := authenticate(test.audience)
+		if (err != nil) != test.expErr {
+			t.Errorf("unexpected error for distributed claims with audience %q, exp=%t got=%v", test.audience, test.expErr, err)
+			continue
+		}
+
+		if !test.expErr && !reflect.DeepEqual(groups, []string{"distributed"}) {
+			t.Errorf("unexpected groups for distributed claims with audience %q, got=%v", test.audience, groups)
+		}
+	}
+}
+
+func TestAuthenticatorExpressions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-oidc-proxy-oidc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sk, key := newTestSigningKey(t, "a")
+
+	jwks, err := json.Marshal(map[string]interface{}{
+		"keys": []interface{}{key},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keysFile := filepath.Join(dir, "keys.json")
+	if err := ioutil.WriteFile(keysFile, jwks, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The claim mapping is only set once the expressions of the options have
+	// been tested.
+	var claimMapping *ClaimMapping
+
+	a, err := New(Options{
+		IssuerURL: testIssuerURL,
+		ClientID:  "kube-oidc-proxy",
+		UsernameExpressions: []string{
+			`{{ .preferred_username }}@{{ .tenant }}`,
+			`{{ if .email_verified }}{{ .email }}{{ end }}`,
+			`{{ index . "upn" }}`,
+		},
+		GroupsExpressions: []string{
+			`{{ if index . "tenant" }}tenant:{{ .tenant }}{{ end }}`,
+			`{{ list (prefix "role:" (index . "roles")) }}`,
+			`{{ index . "team" }}`,
+		},
+		ClaimMapping: func() *ClaimMapping { return claimMapping },
+		KeysFile:     keysFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	sign := func(claims map[string]interface{}) string {
+		token := map[string]interface{}{
+			"iss": testIssuerURL,
+			"aud": "kube-oidc-proxy",
+			"sub": "1234",
+			"exp": time.Now().Add(time.Minute).Unix(),
+		}
+		for k, v := range claims {
+			token[k] = v
+		}
+
+		payload, err := json.Marshal(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return signTestPayload(t, sk, "a", payload)
+	}
+
+	tests := map[string]struct {
+		claims    map[string]interface{}
+		expErr    bool
+		expUser   string
+		expGroups []string
+	}{
+		"the first expression should derive the username": {
+			claims: map[string]interface{}{
+				"preferred_username": "alice",
+				"tenant":             "team-a",
+				"email":              "alice@example.com",
+				"roles":              []string{"admin", "dev"},
+			},
+			expUser:   "alice@team-a",
+			expGroups: []string{"tenant:team-a", "role:admin", "role:dev"},
+		},
+		"claim values containing delimiters should not produce further groups": {
+			claims: map[string]interface{}{
+				"preferred_username": "alice",
+				"tenant":             "dev,system:masters",
+				"roles":              []string{"admin\nsystem:masters"},
+				"team":               "a,system:masters",
+			},
+			expUser:   "alice@dev,system:masters",
+			expGroups: []string{"tenant:dev,system:masters", "role:admin\nsystem:masters", "a,system:masters"},
+		},
+		"claim values which look like lists should not produce further groups": {
+			claims: map[string]interface{}{
+				"preferred_username": "alice",
+				"tenant":             "team-a",
+				"team":               `["cluster-admins","ops"]`,
+			},
+			expUser:   "alice@team-a",
+			expGroups: []string{"tenant:team-a", `["cluster-admins","ops"]`},
+		},
+		"a group with the system prefix should fail": {
+			claims: map[string]interface{}{
+				"preferred_username": "alice",
+				"tenant":             "team-a",
+				"team":               "system:masters",
+			},
+			expErr: true,
+		},
+		"a username with the system prefix should fail": {
+			claims: map[string]interface{}{
+				"preferred_username": "system:admin",
+				"tenant":             "team-a",
+				"upn":                "alice@corp.example.com",
+			},
+			expErr: true,
+		},
+		"a missing claim in a composite expression should fall back to the next expression": {
+			claims: map[string]interface{}{
+				"preferred_username": "alice",
+				"email":              "alice@example.com",
+				"email_verified":     true,
+			},
+			expUser: "alice@example.com",
+		},
+		"an expression evaluating empty should fall back to the next expression": {
+			claims: map[string]interface{}{
+				"preferred_username": "alice",
+				"email":              "alice@example.com",
+				"email_verified":     false,
+				"upn":                "alice@corp.example.com",
+			},
+			expUser: "alice@corp.example.com",
+		},
+		"an email which is not verified should fall back to the next expression": {
+			claims: map[string]interface{}{
+				"email":          "alice@example.com",
+				"email_verified": "false",
+				"upn":            "alice@corp.example.com",
+			},
+			expUser: "alice@corp.example.com",
+		},
+		"an email which is not verified should fail without a fallback": {
+			claims: map[string]interface{}{
+				"email":          "alice@example.com",
+				"email_verified": "false",
+			},
+			expErr: true,
+		},
+		"erroring expressions should fall back to a valid expression": {
+			claims: map[string]interface{}{
+				"upn": "alice@corp.example.com",
+			},
+			expUser: "alice@corp.example.com",
+		},
+		"all expressions erroring or evaluating empty should fail": {
+			claims: map[string]interface{}{
+				"preferred_username": "alice",
+			},
+			expErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			resp, ok, err := a.AuthenticateToken(context.TODO(), sign(test.claims))
+			if test.expErr {
+				if err == nil {
+					t.Error("expected error, got none")
+				}
+				return
+			}
+
+			if err != nil || !ok {
+				t.Fatalf("unexpected failure to authenticate, ok=%t err=%v", ok, err)
+			}
+
+			if name := resp.User.GetName(); name != test.expUser {
+				t.Errorf("unexpected username, exp=%s got=%s", test.expUser, name)
+			}
+
+			if groups := resp.User.GetGroups(); !reflect.DeepEqual(groups, test.expGroups) {
+				t.Errorf("unexpected groups, exp=%v got=%v", test.expGroups, groups)
+			}
+		})
+	}
+
+	// A claim mapping, set while running, adds groups and validation rules.
+	claimMapping, err = CompileClaimMapping([]string{`mapped:{{ .email }}`}, []ClaimValidationRule{
+		{Expression: `{{ ne .tenant "banned" }}`, Message: "tenant is banned"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, ok, err := a.AuthenticateToken(context.TODO(), sign(map[string]interface{}{
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"tenant":         "team-a",
+	}))
+	if err != nil || !ok {
+		t.Fatalf("unexpected failure to authenticate, ok=%t err=%v", ok, err)
+	}
+
+	expGroups := []string{"tenant:team-a", "mapped:alice@example.com"}
+	if groups := resp.User.GetGroups(); !reflect.DeepEqual(groups, expGroups) {
+		t.Errorf("unexpected groups, exp=%v got=%v", expGroups, groups)
+	}
+
+	if _, _, err := a.AuthenticateToken(context.TODO(), sign(map[string]interface{}{
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"tenant":         "banned",
+	})); err == nil {
+		t.Error("expected the claim validation rule of the claim mapping to fail")
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package oidc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"sigs.k8s.io/yaml"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/expression"
+)
+
+// ClaimValidationRule is an expression evaluated against the claims of a
+// verified token. Tokens are rejected with the message unless the expression
+// evaluates to "true".
+type ClaimValidationRule struct {
+	Expression string `json:"expression"`
+	Message    string `json:"message"`
+}
+
+// ClaimValidationRules is the format of the claim validation rules file.
+type ClaimValidationRules struct {
+	Rules []ClaimValidationRule `json:"rules"`
+}
+
+// ClaimValidationError is returned when a verified token fails a claim
+// validation rule.
+type ClaimValidationError struct {
+	Message string
+}
+
+func (c *ClaimValidationError) Error() string {
+	return "oidc: claim validation failed: " + c.Message
+}
+
+type claimValidationRule struct {
+	expression *expression.Expression
+	message    string
+}
+
+// LoadClaimValidationRules will load the claim validation rules from the
+// given YAML or JSON file.
+func LoadClaimValidationRules(path string) ([]ClaimValidationRule, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read claim validation rules: %s", err)
+	}
+
+	rules := new(ClaimValidationRules)
+	if err := yaml.UnmarshalStrict(data, rules); err != nil {
+		return nil, fmt.Errorf("failed to decode claim validation rules: %s", err)
+	}
+
+	return rules.Rules, nil
+}
+
+func compileClaimValidationRules(rules []ClaimValidationRule) ([]claimValidationRule, error) {
+	var compiled []claimValidationRule
+
+	for i, rule := range rules {
+		if len(rule.Message) == 0 {
+			return nil, fmt.Errorf("claim validation rule %d has no message", i)
+		}
+
+		expr, err := expression.Compile(rule.Expression)
+		if err != nil {
+			return nil, fmt.Errorf("claim validation rule %d: %s", i, err)
+		}
+
+		compiled = append(compiled, claimValidationRule{
+			expression: expr,
+			message:    rule.Message,
+		})
+	}
+
+	return compiled, nil
+}
+
+// values decodes the claims for evaluating expressions.
+func (c claims) values() (map[string]interface{}, error) {
+	values := make(map[string]interface{}, len(c))
+	for name, raw := range c {
+		var value interface{}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return nil, fmt.Errorf("parse claim %s: %v", name, err)
+		}
+		values[name] = value
+	}
+
+	return values, nil
+}
+
+// validateClaims will evaluate the claim validation rules, returning a
+// ClaimValidationError for the first rule that fails. Rules which fail to
+// evaluate, for example due to a missing claim, also reject the token.
+func validateClaims(rules []claimValidationRule, values map[string]interface{}) error {
+	for _, rule := range rules {
+		ok, err := rule.expression.EvaluateBool(values)
+		if err != nil || !ok {
+			return &ClaimValidationError{Message: rule.message}
+		}
+	}
+
+	return nil
+}
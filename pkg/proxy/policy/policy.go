@@ -0,0 +1,441 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/filter"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/mutation"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/oidc"
+)
+
+const (
+	// resyncPeriod is the interval at which all objects are synced again,
+	// retrying any failed status updates.
+	resyncPeriod = time.Minute * 10
+
+	// syncTimeout is how long to wait for the objects to be synced at start,
+	// such as when the CRDs are not installed or may not be listed.
+	syncTimeout = time.Minute
+
+	reasonApplied = "Applied"
+	reasonInvalid = "Invalid"
+)
+
+type Options struct {
+	// ResponseFilter is the response filter file configuration, if any,
+	// whose rules are applied before those of ProxyPolicies.
+	ResponseFilter *filter.Config
+
+	// RequestMutation is the request mutation file configuration, if any,
+	// whose rules are applied before those of ProxyPolicies.
+	RequestMutation *mutation.Config
+}
+
+// Policy watches ProxyPolicy and ClaimMapping objects on the upstream
+// cluster, applying those which are valid live. Whether each object is valid
+// is reported by its Valid status condition.
+type Policy struct {
+	client   dynamic.Interface
+	factory  dynamicinformer.DynamicSharedInformerFactory
+	policies informers.GenericInformer
+	mappings informers.GenericInformer
+
+	responseFilter  filter.Config
+	requestMutation mutation.Config
+
+	now         func() time.Time
+	syncTimeout time.Duration
+
+	// syncLock serialises syncs, which are only made once started.
+	syncLock sync.Mutex
+	started  bool
+
+	// lock guards all fields below.
+	lock         sync.RWMutex
+	filter       *filter.Filter
+	mutation     *mutation.Mutation
+	claimMapping *oidc.ClaimMapping
+}
+
+func New(client dynamic.Interface, opts Options) *Policy {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, resyncPeriod)
+
+	p := &Policy{
+		client:      client,
+		factory:     factory,
+		policies:    factory.ForResource(ProxyPolicyResource),
+		mappings:    factory.ForResource(ClaimMappingResource),
+		now:         time.Now,
+		syncTimeout: syncTimeout,
+	}
+
+	if opts.ResponseFilter != nil {
+		p.responseFilter = *opts.ResponseFilter
+	}
+
+	if opts.RequestMutation != nil {
+		p.requestMutation = *opts.RequestMutation
+	}
+
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { p.resync() },
+		UpdateFunc: func(interface{}, interface{}) { p.resync() },
+		DeleteFunc: func(interface{}) { p.resync() },
+	}
+	p.policies.Informer().AddEventHandler(handler)
+	p.mappings.Informer().AddEventHandler(handler)
+
+	return p
+}
+
+// Run will start watching ProxyPolicies and ClaimMappings until the stop
+// channel is closed. Returns once the objects have been synced and applied,
+// or an error if they fail to sync in time.
+func (p *Policy) Run(stopCh <-chan struct{}) error {
+	p.factory.Start(stopCh)
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.syncTimeout)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if !cache.WaitForCacheSync(ctx.Done(), p.policies.Informer().HasSynced, p.mappings.Informer().HasSynced) {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("timed out after %s waiting for %s and %s to sync, "+
+				"ensure their CRDs are installed and the proxy may list and watch them",
+				p.syncTimeout, ProxyPolicyResource.GroupResource(), ClaimMappingResource.GroupResource())
+		}
+
+		return fmt.Errorf("failed to sync proxy policies")
+	}
+
+	p.syncLock.Lock()
+	defer p.syncLock.Unlock()
+
+	p.started = true
+
+	// The configuration is applied even if statuses fail to be updated, which
+	// are retried at the next resync.
+	if err := p.sync(); err != nil {
+		klog.Errorf("failed to sync proxy policies: %s", err)
+	}
+
+	return nil
+}
+
+// ResponseFilter returns the response filter of the file and valid
+// ProxyPolicies, or nil if there are no rules.
+func (p *Policy) ResponseFilter() *filter.Filter {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.filter
+}
+
+// RequestMutation returns the request mutation of the file and valid
+// ProxyPolicies, or nil if there are no rules.
+func (p *Policy) RequestMutation() *mutation.Mutation {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.mutation
+}
+
+// ClaimMapping returns the claim mapping of valid ClaimMappings, or nil if
+// there are none.
+func (p *Policy) ClaimMapping() *oidc.ClaimMapping {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return p.claimMapping
+}
+
+func (p *Policy) resync() {
+	p.syncLock.Lock()
+	defer p.syncLock.Unlock()
+
+	if !p.started {
+		return
+	}
+
+	if err := p.sync(); err != nil {
+		klog.Errorf("failed to sync proxy policies: %s", err)
+	}
+}
+
+// sync validates all objects, reporting their status, and applies those
+// which are valid. Must be called with the sync lock held.
+func (p *Policy) sync() error {
+	policies, err := list(p.policies)
+	if err != nil {
+		return err
+	}
+
+	mappings, err := list(p.mappings)
+	if err != nil {
+		return err
+	}
+
+	var statusErrs []string
+
+	// The exempt groups of the file and each ProxyPolicy only apply to their
+	// own rules.
+	filterConfig := filter.Config{
+		Rules: exemptRules(&p.responseFilter),
+	}
+
+	mutationConfig := p.requestMutation
+	mutationConfig.Rules = append([]mutation.Rule(nil), mutationConfig.Rules...)
+
+	for _, obj := range policies {
+		spec := new(ProxyPolicySpec)
+		err := validateProxyPolicy(obj, spec)
+		if err == nil {
+			if spec.ResponseFilter != nil {
+				filterConfig.Rules = append(filterConfig.Rules, exemptRules(spec.ResponseFilter)...)
+			}
+
+			if spec.RequestMutation != nil {
+				mutationConfig.Rules = append(mutationConfig.Rules, spec.RequestMutation.Rules...)
+			}
+		}
+
+		if err := p.updateStatus(ProxyPolicyResource, obj, err); err != nil {
+			statusErrs = append(statusErrs, err.Error())
+		}
+	}
+
+	var (
+		groupsExpressions    []string
+		claimValidationRules []oidc.ClaimValidationRule
+	)
+
+	for _, obj := range mappings {
+		spec := new(ClaimMappingSpec)
+		err := validateClaimMapping(obj, spec)
+		if err == nil {
+			groupsExpressions = append(groupsExpressions, spec.GroupsExpressions...)
+			claimValidationRules = append(claimValidationRules, spec.ClaimValidationRules...)
+		}
+
+		if err := p.updateStatus(ClaimMappingResource, obj, err); err != nil {
+			statusErrs = append(statusErrs, err.Error())
+		}
+	}
+
+	// Each object has been validated, so the combined configuration is
+	// expected to be valid. If not, the current configuration is kept.
+	var (
+		responseFilter  *filter.Filter
+		requestMutation *mutation.Mutation
+		claimMapping    *oidc.ClaimMapping
+	)
+
+	if len(filterConfig.Rules) > 0 {
+		responseFilter, err = filter.New(&filterConfig)
+		if err != nil {
+			return fmt.Errorf("failed to apply response filter: %s", err)
+		}
+	}
+
+	if len(mutationConfig.Rules) > 0 {
+		requestMutation, err = mutation.New(&mutationConfig)
+		if err != nil {
+			return fmt.Errorf("failed to apply request mutation: %s", err)
+		}
+	}
+
+	if len(groupsExpressions) > 0 || len(claimValidationRules) > 0 {
+		claimMapping, err = oidc.CompileClaimMapping(groupsExpressions, claimValidationRules)
+		if err != nil {
+			return fmt.Errorf("failed to apply claim mapping: %s", err)
+		}
+	}
+
+	p.lock.Lock()
+	p.filter = responseFilter
+	p.mutation = requestMutation
+	p.claimMapping = claimMapping
+	p.lock.Unlock()
+
+	klog.V(2).Infof("applied proxy policies: %d ProxyPolicies, %d ClaimMappings",
+		len(policies), len(mappings))
+
+	if len(statusErrs) > 0 {
+		return fmt.Errorf("failed to update status: %v", statusErrs)
+	}
+
+	return nil
+}
+
+// exemptRules returns a copy of the rules of the response filter config, with
+// the exempt groups of the config added to each rule.
+func exemptRules(config *filter.Config) []filter.Rule {
+	var rules []filter.Rule
+	for _, r := range config.Rules {
+		r.ExemptGroups = append(append([]string(nil), r.ExemptGroups...), config.ExemptGroups...)
+		rules = append(rules, r)
+	}
+
+	return rules
+}
+
+// updateStatus sets the Valid condition of the object, if changed, from the
+// validation error.
+func (p *Policy) updateStatus(gvr schema.GroupVersionResource, obj *unstructured.Unstructured, validationErr error) error {
+	cond := Condition{
+		Type:               ConditionValid,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: obj.GetGeneration(),
+		Reason:             reasonApplied,
+		Message:            "Applied by kube-oidc-proxy",
+	}
+
+	if validationErr != nil {
+		cond.Status = metav1.ConditionFalse
+		cond.Reason = reasonInvalid
+		cond.Message = validationErr.Error()
+	}
+
+	// An unexpected status is replaced.
+	status := new(Status)
+	if raw, ok := obj.Object["status"]; ok {
+		_ = decode(raw, status, false)
+	}
+
+	var existing *Condition
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == ConditionValid {
+			existing = &status.Conditions[i]
+			break
+		}
+	}
+
+	switch {
+	case existing == nil:
+		cond.LastTransitionTime = metav1.NewTime(p.now())
+		status.Conditions = append(status.Conditions, cond)
+
+	case existing.Status == cond.Status && existing.Reason == cond.Reason &&
+		existing.Message == cond.Message && existing.ObservedGeneration == cond.ObservedGeneration:
+		return nil
+
+	default:
+		cond.LastTransitionTime = existing.LastTransitionTime
+		if existing.Status != cond.Status {
+			cond.LastTransitionTime = metav1.NewTime(p.now())
+		}
+		*existing = cond
+	}
+
+	if validationErr != nil {
+		klog.Errorf("invalid %s %q: %s", gvr.Resource, obj.GetName(), validationErr)
+	}
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	updated := obj.DeepCopy()
+	updated.Object["status"] = raw
+
+	if _, err := p.client.Resource(gvr).UpdateStatus(context.TODO(), updated, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("%s %q: %s", gvr.Resource, obj.GetName(), err)
+	}
+
+	return nil
+}
+
+func validateProxyPolicy(obj *unstructured.Unstructured, spec *ProxyPolicySpec) error {
+	if err := decode(obj.Object["spec"], spec, true); err != nil {
+		return fmt.Errorf("failed to decode spec: %s", err)
+	}
+
+	if spec.ResponseFilter != nil {
+		if _, err := filter.New(spec.ResponseFilter); err != nil {
+			return err
+		}
+	}
+
+	if spec.RequestMutation != nil {
+		if _, err := mutation.New(spec.RequestMutation); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateClaimMapping(obj *unstructured.Unstructured, spec *ClaimMappingSpec) error {
+	if err := decode(obj.Object["spec"], spec, true); err != nil {
+		return fmt.Errorf("failed to decode spec: %s", err)
+	}
+
+	_, err := oidc.CompileClaimMapping(spec.GroupsExpressions, spec.ClaimValidationRules)
+	return err
+}
+
+// decode decodes the unstructured value into out, by way of JSON so that
+// fields holding raw JSON are preserved.
+func decode(in, out interface{}, strict bool) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+
+	return dec.Decode(out)
+}
+
+// list returns the objects of the informer, sorted by name.
+func list(informer informers.GenericInformer) ([]*unstructured.Unstructured, error) {
+	objs, err := informer.Lister().List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*unstructured.Unstructured
+	for _, obj := range objs {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			return nil, fmt.Errorf("unexpected object %T", obj)
+		}
+		list = append(list, u)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].GetName() < list[j].GetName()
+	})
+
+	return list, nil
+}
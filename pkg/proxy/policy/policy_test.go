@@ -0,0 +1,275 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package policy
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/client-go/dynamic/fake"
+	clienttesting "k8s.io/client-go/testing"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/filter"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/mutation"
+)
+
+func newObject(kind, name string, generation int64, spec map[string]interface{}) *unstructured.Unstructured {
+	obj := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"spec": spec,
+		},
+	}
+	obj.SetAPIVersion(GroupName + "/" + Version)
+	obj.SetKind(kind)
+	obj.SetName(name)
+	obj.SetGeneration(generation)
+	return obj
+}
+
+// statusRecorder records the status updates of objects, rather than storing
+// them, so that stale objects of status updates do not overwrite updates of
+// the spec made by the tests.
+type statusRecorder struct {
+	lock     sync.Mutex
+	statuses map[string]*Status
+}
+
+func newStatusRecorder(client *fake.FakeDynamicClient) *statusRecorder {
+	r := &statusRecorder{statuses: make(map[string]*Status)}
+
+	client.PrependReactor("update", "*", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "status" {
+			return false, nil, nil
+		}
+
+		obj := action.(clienttesting.UpdateAction).GetObject().(*unstructured.Unstructured)
+
+		status := new(Status)
+		if err := decode(obj.Object["status"], status, true); err != nil {
+			return true, nil, err
+		}
+
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.statuses[action.GetResource().Resource+"/"+obj.GetName()] = status
+
+		return true, obj, nil
+	})
+
+	return r
+}
+
+// validCondition returns the last reported Valid condition of the object.
+func (r *statusRecorder) validCondition(gvr schema.GroupVersionResource, name string) *Condition {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	status, ok := r.statuses[gvr.Resource+"/"+name]
+	if !ok {
+		return nil
+	}
+
+	for i := range status.Conditions {
+		if status.Conditions[i].Type == ConditionValid {
+			return &status.Conditions[i]
+		}
+	}
+
+	return nil
+}
+
+func TestPolicy(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme(),
+		newObject("ProxyPolicy", "a-valid-policy", 1, map[string]interface{}{
+			"responseFilter": map[string]interface{}{
+				"exemptGroups": []interface{}{"pod-admins"},
+				"rules": []interface{}{
+					map[string]interface{}{
+						"group":       "",
+						"resources":   []interface{}{"pods"},
+						"matchLabels": map[string]interface{}{"team": `{{ .team }}`},
+					},
+				},
+			},
+			"requestMutation": map[string]interface{}{
+				"rules": []interface{}{
+					map[string]interface{}{
+						"mutator":   mutation.StampUserName,
+						"options":   map[string]interface{}{"annotation": "example.com/owner"},
+						"group":     "",
+						"resources": []interface{}{"configmaps"},
+					},
+				},
+			},
+		}),
+		newObject("ProxyPolicy", "another-valid-policy", 1, map[string]interface{}{
+			"responseFilter": map[string]interface{}{
+				"exemptGroups": []interface{}{"node-admins"},
+				"rules": []interface{}{
+					map[string]interface{}{
+						"group":     "",
+						"resources": []interface{}{"nodes"},
+						"names":     `{{ .team }}-*`,
+					},
+				},
+			},
+		}),
+		newObject("ProxyPolicy", "an-invalid-policy", 2, map[string]interface{}{
+			"requestMutation": map[string]interface{}{
+				"rules": []interface{}{
+					map[string]interface{}{
+						"mutator":   "unknown",
+						"resources": []interface{}{"configmaps"},
+					},
+				},
+			},
+		}),
+		newObject("ClaimMapping", "an-invalid-mapping", 1, map[string]interface{}{
+			"groupsExpressions": []interface{}{`{{ .groups`},
+		}),
+	)
+
+	statuses := newStatusRecorder(client)
+
+	p := New(client, Options{
+		ResponseFilter: &filter.Config{
+			ExemptGroups: []string{"admins"},
+		},
+	})
+
+	if err := p.Run(stopCh); err != nil {
+		t.Fatal(err)
+	}
+
+	if p.ResponseFilter() == nil {
+		t.Error("expected the response filter of the valid policy to be applied")
+	}
+
+	if p.RequestMutation() == nil {
+		t.Error("expected the request mutation of the valid policy to be applied")
+	}
+
+	if p.ClaimMapping() != nil {
+		t.Error("expected the invalid claim mapping not to be applied")
+	}
+
+	// Exempt groups should only apply to the rules of their own policy, or
+	// the file.
+	for _, test := range []struct {
+		path      string
+		group     string
+		expFilter bool
+	}{
+		{"/api/v1/pods", "pod-admins", false},
+		{"/api/v1/pods", "node-admins", true},
+		{"/api/v1/pods", "admins", true},
+		{"/api/v1/nodes", "node-admins", false},
+		{"/api/v1/nodes", "pod-admins", true},
+	} {
+		req := &http.Request{Method: http.MethodGet, URL: &url.URL{Path: test.path}, Header: http.Header{}}
+		u := &user.DefaultInfo{Name: "alice", Groups: []string{test.group}}
+
+		filter, err := p.ResponseFilter().ResponseFilter(req, u, map[string]interface{}{"team": "a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if (filter != nil) != test.expFilter {
+			t.Errorf("unexpected filter of %s for group %q, exp=%t got=%t", test.path, test.group, test.expFilter, filter != nil)
+		}
+	}
+
+	for _, test := range []struct {
+		gvr        schema.GroupVersionResource
+		name       string
+		expStatus  metav1.ConditionStatus
+		expReason  string
+		generation int64
+	}{
+		{ProxyPolicyResource, "a-valid-policy", metav1.ConditionTrue, reasonApplied, 1},
+		{ProxyPolicyResource, "another-valid-policy", metav1.ConditionTrue, reasonApplied, 1},
+		{ProxyPolicyResource, "an-invalid-policy", metav1.ConditionFalse, reasonInvalid, 2},
+		{ClaimMappingResource, "an-invalid-mapping", metav1.ConditionFalse, reasonInvalid, 1},
+	} {
+		cond := statuses.validCondition(test.gvr, test.name)
+		if cond == nil {
+			t.Errorf("expected %s %q to have a Valid condition", test.gvr.Resource, test.name)
+			continue
+		}
+
+		if cond.Status != test.expStatus || cond.Reason != test.expReason ||
+			cond.ObservedGeneration != test.generation {
+			t.Errorf("unexpected condition of %s %q, exp=%s/%s/%d got=%+v",
+				test.gvr.Resource, test.name, test.expStatus, test.expReason, test.generation, cond)
+		}
+
+		if test.expStatus == metav1.ConditionFalse && len(cond.Message) == 0 {
+			t.Errorf("expected %s %q to have a message of the error", test.gvr.Resource, test.name)
+		}
+	}
+
+	// Fixing the claim mapping should apply it live.
+	fixed := newObject("ClaimMapping", "an-invalid-mapping", 2, map[string]interface{}{
+		"groupsExpressions": []interface{}{`{{ .groups }}`},
+	})
+	if _, err := client.Resource(ClaimMappingResource).Update(context.TODO(), fixed, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := wait.PollImmediate(time.Millisecond*10, time.Second*5, func() (bool, error) {
+		return p.ClaimMapping() != nil, nil
+	}); err != nil {
+		t.Fatalf("expected the fixed claim mapping to be applied: %s", err)
+	}
+
+	if err := wait.PollImmediate(time.Millisecond*10, time.Second*5, func() (bool, error) {
+		cond := statuses.validCondition(ClaimMappingResource, "an-invalid-mapping")
+		return cond != nil && cond.Status == metav1.ConditionTrue && cond.ObservedGeneration == 2, nil
+	}); err != nil {
+		t.Errorf("expected the fixed claim mapping to be reported valid: %s", err)
+	}
+
+	// Deleting the valid policies should remove their rules, leaving none.
+	for _, name := range []string{"a-valid-policy", "another-valid-policy"} {
+		if err := client.Resource(ProxyPolicyResource).Delete(context.TODO(), name, metav1.DeleteOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := wait.PollImmediate(time.Millisecond*10, time.Second*5, func() (bool, error) {
+		return p.ResponseFilter() == nil && p.RequestMutation() == nil, nil
+	}); err != nil {
+		t.Errorf("expected the rules of the deleted policies to be removed: %s", err)
+	}
+}
+
+func TestPolicySyncTimeout(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	// Listing fails as it would were the CRDs not installed.
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme())
+	client.PrependReactor("list", "*", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.NewNotFound(action.GetResource().GroupResource(), "")
+	})
+
+	p := New(client, Options{})
+	p.syncTimeout = time.Millisecond * 100
+
+	if err := p.Run(stopCh); err == nil {
+		t.Error("expected error waiting for proxy policies to sync, got=nil")
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package policy
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/filter"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/mutation"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/oidc"
+)
+
+const (
+	// GroupName is the API group of the proxy policy resources.
+	GroupName = "kube-oidc-proxy.jetstack.io"
+
+	// Version is the API version of the proxy policy resources.
+	Version = "v1alpha1"
+
+	// ConditionValid is the type of the condition reporting whether the spec
+	// of an object is valid, and so applied by the proxy.
+	ConditionValid = "Valid"
+)
+
+var (
+	// ProxyPolicyResource is the cluster scoped ProxyPolicy resource.
+	ProxyPolicyResource = schema.GroupVersionResource{
+		Group:    GroupName,
+		Version:  Version,
+		Resource: "proxypolicies",
+	}
+
+	// ClaimMappingResource is the cluster scoped ClaimMapping resource.
+	ClaimMappingResource = schema.GroupVersionResource{
+		Group:    GroupName,
+		Version:  Version,
+		Resource: "claimmappings",
+	}
+)
+
+// ProxyPolicySpec is the spec of a ProxyPolicy. The rules of all valid
+// ProxyPolicies are applied after those of the response filter and request
+// mutation files, in order of name.
+type ProxyPolicySpec struct {
+	// ResponseFilter, in the form of the response filter file, filters the
+	// list and watch responses of resources.
+	ResponseFilter *filter.Config `json:"responseFilter,omitempty"`
+
+	// RequestMutation, in the form of the request mutation file, mutates the
+	// bodies of requests for resources.
+	RequestMutation *mutation.Config `json:"requestMutation,omitempty"`
+}
+
+// ClaimMappingSpec is the spec of a ClaimMapping. The expressions and rules of
+// all valid ClaimMappings are applied after those of the OIDC flags, in order
+// of name.
+type ClaimMappingSpec struct {
+	// GroupsExpressions are expressions evaluated against the claims of the
+	// token to derive further groups of the user.
+	GroupsExpressions []string `json:"groupsExpressions,omitempty"`
+
+	// ClaimValidationRules are expressions which must all evaluate to true
+	// against the claims of the token.
+	ClaimValidationRules []oidc.ClaimValidationRule `json:"claimValidationRules,omitempty"`
+}
+
+// Status is the status of a ProxyPolicy or ClaimMapping.
+type Status struct {
+	// Conditions are the conditions of the object. The proxy reports the
+	// Valid condition.
+	Conditions []Condition `json:"conditions,omitempty"`
+}
+
+// Condition is a condition of a ProxyPolicy or ClaimMapping.
+type Condition struct {
+	Type               string                 `json:"type"`
+	Status             metav1.ConditionStatus `json:"status"`
+	ObservedGeneration int64                  `json:"observedGeneration,omitempty"`
+	LastTransitionTime metav1.Time            `json:"lastTransitionTime,omitempty"`
+	Reason             string                 `json:"reason,omitempty"`
+	Message            string                 `json:"message,omitempty"`
+}
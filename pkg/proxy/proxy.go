@@ -13,16 +13,27 @@ import (
 	"k8s.io/apiserver/pkg/authentication/authenticator"
 	"k8s.io/apiserver/pkg/authentication/request/bearertoken"
 	"k8s.io/apiserver/pkg/server"
-	"k8s.io/apiserver/plugin/pkg/authenticator/token/oidc"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/transport"
 	"k8s.io/klog"
 
 	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/accessreview"
 	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/audit"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/breakglass"
 	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/fairness"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/filter"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/grants"
 	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/hooks"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/impersonation"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/mutation"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/oidc"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/policy"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/revocation"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/tenancy"
 	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/tokenreview"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/upstream"
 )
 
 const (
@@ -34,6 +45,12 @@ var (
 	errImpersonateHeader     = errors.New("Impersonate-User in header")
 	errNoName                = errors.New("No name in OIDC info")
 	errNoImpersonationConfig = errors.New("No impersonation configuration in context")
+	errTokenRevoked          = errors.New("Token revoked")
+	errTenancyForbidden      = errors.New("Forbidden by tenancy")
+	errMutationRejected      = errors.New("Request mutation rejected")
+	errTooManyRequests       = errors.New("Too many requests")
+	errImpersonationRejected = errors.New("Impersonation rejected")
+	errAccessReviewForbidden = errors.New("Forbidden by access review")
 
 	// http headers are case-insensitive
 	impersonateUserHeader  = strings.ToLower(transport.ImpersonateUserHeader)
@@ -46,10 +63,31 @@ type Config struct {
 	TokenReview          bool
 
 	FlushInterval   time.Duration
+	RequestTimeout  time.Duration
 	ExternalAddress string
 
+	MaxRequestsInFlight         int
+	MaxMutatingRequestsInFlight int
+
+	Transport TransportConfig
+	Upstream  *upstream.Pool
+	Retry     RetryConfig
+
 	ExtraUserHeaders                map[string][]string
 	ExtraUserHeadersClientIPEnabled bool
+
+	TokenRevoker      *revocation.Revoker
+	TokenIntrospector authenticator.Token
+	BreakGlass        *breakglass.Authenticator
+	Grants            *grants.Grants
+	Tenancy           *tenancy.Tenancy
+	ResponseFilter    *filter.Filter
+	RequestMutation   *mutation.Mutation
+	Fairness          *fairness.Fairness
+	Policy            *policy.Policy
+
+	ImpersonationAuthorizer *impersonation.Authorizer
+	AccessReview            *accessreview.AccessReview
 }
 
 type errorHandlerFn func(http.ResponseWriter, *http.Request, error)
@@ -57,6 +95,7 @@ type errorHandlerFn func(http.ResponseWriter, *http.Request, error)
 type Proxy struct {
 	oidcRequestAuther *bearertoken.Authenticator
 	tokenAuther       authenticator.Token
+	oidcAuther        *oidc.Authenticator
 	tokenReviewer     *tokenreview.TokenReview
 	secureServingInfo *server.SecureServingInfo
 	auditor           *audit.Audit
@@ -78,10 +117,28 @@ func New(restConfig *rest.Config,
 	ssinfo *server.SecureServingInfo,
 	config *Config) (*Proxy, error) {
 
+	var claimValidationRules []oidc.ClaimValidationRule
+	if len(oidcOptions.ClaimValidationRulesFile) > 0 {
+		var err error
+		claimValidationRules, err = oidc.LoadClaimValidationRules(oidcOptions.ClaimValidationRulesFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Claims are also mapped by the ClaimMappings of the proxy policies
+	var claimMapping func() *oidc.ClaimMapping
+	if config.Policy != nil {
+		claimMapping = config.Policy.ClaimMapping
+	}
+
 	// generate tokenAuther from oidc config
 	tokenAuther, err := oidc.New(oidc.Options{
 		CAFile:               oidcOptions.CAFile,
 		ClientID:             oidcOptions.ClientID,
+		Audiences:            oidcOptions.Audiences,
+		RequiredScopes:       oidcOptions.RequiredScopes,
+		ScopeGroups:          oidcOptions.ScopeGroups,
 		GroupsClaim:          oidcOptions.GroupsClaim,
 		GroupsPrefix:         oidcOptions.GroupsPrefix,
 		IssuerURL:            oidcOptions.IssuerURL,
@@ -89,6 +146,15 @@ func New(restConfig *rest.Config,
 		SupportedSigningAlgs: oidcOptions.SigningAlgs,
 		UsernameClaim:        oidcOptions.UsernameClaim,
 		UsernamePrefix:       oidcOptions.UsernamePrefix,
+
+		KeySetRefreshInterval:    oidcOptions.JWKSRefreshInterval,
+		KeySetMinRefreshInterval: oidcOptions.JWKSMinRefreshInterval,
+		KeysFile:                 oidcOptions.KeysFile,
+
+		ClaimValidationRules: claimValidationRules,
+		UsernameExpressions:  oidcOptions.UsernameExpressions,
+		GroupsExpressions:    oidcOptions.GroupsExpressions,
+		ClaimMapping:         claimMapping,
 	})
 	if err != nil {
 		return nil, err
@@ -107,18 +173,29 @@ func New(restConfig *rest.Config,
 		config:            config,
 		oidcRequestAuther: bearertoken.New(tokenAuther),
 		tokenAuther:       tokenAuther,
+		oidcAuther:        tokenAuther,
 		auditor:           auditor,
 	}, nil
 }
 
 func (p *Proxy) Run(stopCh <-chan struct{}) (<-chan struct{}, error) {
 	// standard round tripper for proxy to API Server
-	clientRT, err := p.roundTripperForRestConfig(p.restConfig)
+	clientRT, err := p.roundTripperForRestConfig(p.restConfig, p.config.Upstream)
 	if err != nil {
 		return nil, err
 	}
 	p.clientTransport = clientRT
 
+	// Health check upstream endpoints directly, rather than through the pool
+	if p.config.Upstream != nil {
+		healthCheckRT, err := p.roundTripperForRestConfig(p.restConfig, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		p.config.Upstream.Run(healthCheckRT, stopCh)
+	}
+
 	// No auth round tripper for no impersonation
 	if p.config.DisableImpersonation || p.config.TokenReview {
 		noAuthClientRT, err := p.roundTripperForRestConfig(&rest.Config{
@@ -129,7 +206,7 @@ func (p *Proxy) Run(stopCh <-chan struct{}) (<-chan struct{}, error) {
 				CAFile: p.restConfig.CAFile,
 				CAData: p.restConfig.CAData,
 			},
-		})
+		}, p.config.Upstream)
 		if err != nil {
 			return nil, err
 		}
@@ -149,6 +226,7 @@ func (p *Proxy) Run(stopCh <-chan struct{}) (<-chan struct{}, error) {
 	proxyHandler := httputil.NewSingleHostReverseProxy(url)
 	proxyHandler.Transport = p
 	proxyHandler.ErrorHandler = p.handleError
+	proxyHandler.ModifyResponse = p.modifyResponse
 	proxyHandler.FlushInterval = p.config.FlushInterval
 
 	waitCh, err := p.serve(proxyHandler, stopCh)
@@ -187,7 +265,7 @@ func (p *Proxy) RoundTrip(req *http.Request) (*http.Response, error) {
 	if context.NoImpersonation(req) {
 		token := context.BearerToken(req)
 		req.Header.Add("Authorization", token)
-		return p.noAuthClientTransport.RoundTrip(req)
+		return p.roundTripUpstream(p.noAuthClientTransport, req)
 	}
 
 	// Get the impersonation headers from the context.
@@ -200,7 +278,28 @@ func (p *Proxy) RoundTrip(req *http.Request) (*http.Response, error) {
 	rt := transport.NewImpersonatingRoundTripper(*conf, p.clientTransport)
 
 	// Push request through round trippers to the API server.
-	return rt.RoundTrip(req)
+	return p.roundTripUpstream(rt, req)
+}
+
+// roundTripUpstream sends the request to the API server, wrapping any error so
+// that it is handled as an upstream error.
+func (p *Proxy) roundTripUpstream(rt http.RoundTripper, req *http.Request) (*http.Response, error) {
+	resp, err := p.roundTripWithRetries(rt, req)
+	if err != nil {
+		return nil, &upstreamError{err: err}
+	}
+
+	return resp, nil
+}
+
+// modifyResponse applies the response filter of the request, if any, to the
+// upstream response.
+func (p *Proxy) modifyResponse(resp *http.Response) error {
+	if filter := context.ResponseFilter(resp.Request); filter != nil {
+		return filter(resp)
+	}
+
+	return nil
 }
 
 func (p *Proxy) reviewToken(rw http.ResponseWriter, req *http.Request) bool {
@@ -228,7 +327,9 @@ func (p *Proxy) reviewToken(rw http.ResponseWriter, req *http.Request) bool {
 	return true
 }
 
-func (p *Proxy) roundTripperForRestConfig(config *rest.Config) (http.RoundTripper, error) {
+// roundTripperForRestConfig returns a round tripper to the API server. If an
+// upstream pool is given, requests are balanced over its endpoints.
+func (p *Proxy) roundTripperForRestConfig(config *rest.Config, pool *upstream.Pool) (http.RoundTripper, error) {
 	// get golang tls config to the API server
 	tlsConfig, err := rest.TLSConfigFor(config)
 	if err != nil {
@@ -236,9 +337,9 @@ func (p *Proxy) roundTripperForRestConfig(config *rest.Config) (http.RoundTrippe
 	}
 
 	// create tls transport to request
-	tlsTransport := &http.Transport{
-		Proxy:           http.ProxyFromEnvironment,
-		TLSClientConfig: tlsConfig,
+	tlsTransport := newUpgradeAwareTransport(tlsConfig, p.config.Transport)
+	if pool != nil {
+		tlsTransport = pool.RoundTripper(tlsTransport)
 	}
 
 	// get kube transport config form rest client config
@@ -261,6 +362,11 @@ func (p *Proxy) OIDCTokenAuthenticator() authenticator.Token {
 	return p.tokenAuther
 }
 
+// Return a handler which forces a refresh of the OIDC issuer keys
+func (p *Proxy) OIDCKeySetRefreshHandler() http.Handler {
+	return p.oidcAuther.KeySetRefreshHandler()
+}
+
 func (p *Proxy) RunPreShutdownHooks() error {
 	return p.hooks.RunPreShutdownHooks()
 }
@@ -3,27 +3,50 @@ package proxy
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
 	"sort"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apiserver/pkg/authentication/authenticator"
 	"k8s.io/apiserver/pkg/authentication/request/bearertoken"
 	"k8s.io/apiserver/pkg/authentication/user"
 	"k8s.io/apiserver/pkg/server"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
 
 	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
 	"github.com/jetstack/kube-oidc-proxy/pkg/mocks"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/accessreview"
 	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/audit"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/breakglass"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/grants"
 	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/hooks"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/impersonation"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/oidc"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/revocation"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/tenancy"
+	"github.com/jetstack/kube-oidc-proxy/pkg/util"
 )
 
 type fakeProxy struct {
@@ -162,6 +185,13 @@ func TestError(t *testing.T) {
 		t.Errorf("unexpected response, exp='%s' got='%s'", exp, frw.buffer)
 	}
 
+	frw = tryError(t, http.StatusServiceUnavailable, &upstreamError{
+		err: &upstreamUnavailableError{retries: 3, err: errors.New("connection refused")},
+	})
+	if exp := "1"; frw.header.Get("Retry-After") != exp {
+		t.Errorf("unexpected Retry-After header, exp=%s got=%s", exp, frw.header.Get("Retry-After"))
+	}
+
 	frw = tryError(t, http.StatusInternalServerError, errors.New("foo"))
 	if exp := []byte("\n"); !bytes.Equal(frw.buffer, exp) {
 		t.Errorf("unexpected response, exp='%s' got='%s'", exp, frw.buffer)
@@ -290,6 +320,66 @@ func TestHandlers(t *testing.T) {
 		err  error
 	}
 
+	revokedToken, err := util.FakeJWT("https://issuer.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tenancyStopCh := make(chan struct{})
+	defer close(tenancyStopCh)
+
+	proxyTenancy := tenancy.New(fake.NewSimpleClientset(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "team-b",
+			Labels: map[string]string{"team": "b"},
+		},
+	}), tenancy.Options{
+		Claim:          "team",
+		NamespaceLabel: "team",
+	})
+	if err := proxyTenancy.Run(tenancyStopCh); err != nil {
+		t.Fatal(err)
+	}
+
+	// Users may impersonate anyone other than "root".
+	impersonationClient := fake.NewSimpleClientset()
+	impersonationClient.PrependReactor("create", "subjectaccessreviews", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		sar := action.(clienttesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		sar.Status.Allowed = sar.Spec.ResourceAttributes.Name != "root"
+		return true, sar, nil
+	})
+	impersonationAuthorizer := impersonation.New(impersonationClient)
+
+	// Users may only get pods.
+	accessReviewClient := fake.NewSimpleClientset()
+	accessReviewClient.PrependReactor("create", "subjectaccessreviews", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		sar := action.(clienttesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		attr := sar.Spec.ResourceAttributes
+		sar.Status.Allowed = attr != nil && attr.Resource == "pods" && attr.Verb == "get"
+		return true, sar, nil
+	})
+	accessReview := accessreview.New(accessReviewClient, accessreview.Options{})
+
+	// "a-user" is granted "cluster-admins" for an hour, and was granted
+	// "db-admins" until a minute ago.
+	groupGrants, err := grants.NewStatic(&grants.List{
+		Grants: []grants.Grant{
+			{
+				User:    "a-user",
+				Groups:  []string{"cluster-admins", "a-group"},
+				Expires: metav1.NewTime(time.Now().Add(time.Hour)),
+			},
+			{
+				User:    "a-user",
+				Groups:  []string{"db-admins"},
+				Expires: metav1.NewTime(time.Now().Add(-time.Minute)),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	tests := map[string]struct {
 		req    *http.Request
 		config *Config
@@ -533,6 +623,353 @@ func TestHandlers(t *testing.T) {
 			expGroup: nil,
 			expExtra: nil,
 		},
+		"a request failing claim validation should 401 with the rejection message": {
+			req: &http.Request{
+				Header: http.Header{
+					"Authorization": []string{"bearer fake-token"},
+				},
+			},
+			expAuthToken: "fake-token",
+			authResponse: &authResponse{
+				resp: nil,
+				pass: false,
+				err:  &oidc.ClaimValidationError{Message: "email must be verified"},
+			},
+			expCode: http.StatusUnauthorized,
+			expBody: `{"kind":"Status","apiVersion":"v1","metadata":{},"status":"Failure","message":"email must be verified","reason":"Unauthorized","code":401}`,
+		},
+		"an authed request with a revoked token should 401": {
+			req: &http.Request{
+				Header: http.Header{
+					"Authorization": []string{"bearer " + revokedToken},
+				},
+			},
+			expAuthToken: revokedToken,
+			authResponse: &authResponse{
+				resp: &authenticator.Response{
+					User: &user.DefaultInfo{
+						Name: "a-user",
+					},
+				},
+				pass: true,
+				err:  nil,
+			},
+			config: &Config{
+				TokenRevoker: revocation.NewStatic(&revocation.List{
+					Subjects: []string{"fake"},
+				}),
+			},
+			expCode: http.StatusUnauthorized,
+			expBody: errUnauthorized.Error(),
+		},
+		"an authed request with a token not revoked should succeed": {
+			req: &http.Request{
+				Header: http.Header{
+					"Authorization": []string{"bearer " + revokedToken},
+				},
+			},
+			expAuthToken: revokedToken,
+			authResponse: &authResponse{
+				resp: &authenticator.Response{
+					User: &user.DefaultInfo{
+						Name: "a-user",
+					},
+				},
+				pass: true,
+				err:  nil,
+			},
+			config: &Config{
+				TokenRevoker: revocation.NewStatic(&revocation.List{
+					Subjects: []string{"another-subject"},
+				}),
+			},
+			expCode:  http.StatusOK,
+			expBody:  "",
+			expUser:  "a-user",
+			expGroup: []string{"system:authenticated"},
+		},
+		"an authed request to a namespace of another tenant should 403": {
+			req: &http.Request{
+				Method: http.MethodGet,
+				URL:    &url.URL{Path: "/api/v1/namespaces/team-b/pods"},
+				Header: http.Header{
+					"Authorization": []string{"bearer " + revokedToken},
+				},
+			},
+			expAuthToken: revokedToken,
+			authResponse: &authResponse{
+				resp: &authenticator.Response{
+					User: &user.DefaultInfo{
+						Name: "a-user",
+					},
+				},
+				pass: true,
+				err:  nil,
+			},
+			config: &Config{
+				Tenancy: proxyTenancy,
+			},
+			expCode: http.StatusForbidden,
+			expBody: `{"kind":"Status","apiVersion":"v1","metadata":{},"status":"Failure","message":"namespaces \"team-b\" is forbidden: User \"a-user\" is not a member of the tenant owning the namespace","reason":"Forbidden","code":403}`,
+		},
+		"an authed request outside of a namespace should succeed with tenancy": {
+			req: &http.Request{
+				Method: http.MethodGet,
+				URL:    &url.URL{Path: "/version"},
+				Header: http.Header{
+					"Authorization": []string{"bearer " + revokedToken},
+				},
+			},
+			expAuthToken: revokedToken,
+			authResponse: &authResponse{
+				resp: &authenticator.Response{
+					User: &user.DefaultInfo{
+						Name: "a-user",
+					},
+				},
+				pass: true,
+				err:  nil,
+			},
+			config: &Config{
+				Tenancy: proxyTenancy,
+			},
+			expCode:  http.StatusOK,
+			expBody:  "",
+			expUser:  "a-user",
+			expGroup: []string{"system:authenticated"},
+		},
+		"an authed request with authorized impersonation should impersonate the requested user": {
+			req: &http.Request{
+				Header: http.Header{
+					"Authorization":         []string{"bearer fake-token"},
+					"Impersonate-User":      []string{"b-user"},
+					"Impersonate-Group":     []string{"b-group"},
+					"Impersonate-Extra-Foo": []string{"bar"},
+				},
+			},
+			expAuthToken: "fake-token",
+			authResponse: &authResponse{
+				resp: &authenticator.Response{
+					User: &user.DefaultInfo{
+						Name:   "a-user",
+						Groups: []string{"a-group"},
+					},
+				},
+				pass: true,
+				err:  nil,
+			},
+			config: &Config{
+				ImpersonationAuthorizer: impersonationAuthorizer,
+			},
+			expCode:  http.StatusOK,
+			expBody:  "",
+			expUser:  "b-user",
+			expGroup: []string{"b-group"},
+			expExtra: map[string][]string{
+				"Impersonate-Extra-Foo": []string{"bar"},
+				"Impersonate-Extra-Kube-Oidc-Proxy.jetstack.io%2fimpersonator":        []string{"a-user"},
+				"Impersonate-Extra-Kube-Oidc-Proxy.jetstack.io%2fimpersonator-Groups": []string{"a-group"},
+			},
+		},
+		"an authed request without impersonation should not impersonate when impersonation allowed": {
+			req: &http.Request{
+				Header: http.Header{
+					"Authorization": []string{"bearer fake-token"},
+				},
+			},
+			expAuthToken: "fake-token",
+			authResponse: &authResponse{
+				resp: &authenticator.Response{
+					User: &user.DefaultInfo{
+						Name: "a-user",
+					},
+				},
+				pass: true,
+				err:  nil,
+			},
+			config: &Config{
+				ImpersonationAuthorizer: impersonationAuthorizer,
+			},
+			expCode:  http.StatusOK,
+			expBody:  "",
+			expUser:  "a-user",
+			expGroup: []string{"system:authenticated"},
+		},
+		"an authed request with unauthorized impersonation should 403": {
+			req: &http.Request{
+				Header: http.Header{
+					"Authorization":    []string{"bearer fake-token"},
+					"Impersonate-User": []string{"root"},
+				},
+			},
+			expAuthToken: "fake-token",
+			authResponse: &authResponse{
+				resp: &authenticator.Response{
+					User: &user.DefaultInfo{
+						Name: "a-user",
+					},
+				},
+				pass: true,
+				err:  nil,
+			},
+			config: &Config{
+				ImpersonationAuthorizer: impersonationAuthorizer,
+			},
+			expCode: http.StatusForbidden,
+			expBody: `{"kind":"Status","apiVersion":"v1","metadata":{},"status":"Failure","message":"users \"root\" is forbidden: User \"a-user\" cannot impersonate resource \"users\" in API group \"\" at the cluster scope","reason":"Forbidden","code":403}`,
+		},
+		"an authed request allowed by access review should succeed": {
+			req: &http.Request{
+				Method: http.MethodGet,
+				URL:    &url.URL{Path: "/api/v1/namespaces/foo/pods/bar"},
+				Header: http.Header{
+					"Authorization": []string{"bearer fake-token"},
+				},
+			},
+			expAuthToken: "fake-token",
+			authResponse: &authResponse{
+				resp: &authenticator.Response{
+					User: &user.DefaultInfo{
+						Name: "a-user",
+					},
+				},
+				pass: true,
+				err:  nil,
+			},
+			config: &Config{
+				AccessReview: accessReview,
+			},
+			expCode:  http.StatusOK,
+			expBody:  "",
+			expUser:  "a-user",
+			expGroup: []string{"system:authenticated"},
+		},
+		"an authed request denied by access review should 403": {
+			req: &http.Request{
+				Method: http.MethodDelete,
+				URL:    &url.URL{Path: "/api/v1/namespaces/foo/pods/bar"},
+				Header: http.Header{
+					"Authorization": []string{"bearer fake-token"},
+				},
+			},
+			expAuthToken: "fake-token",
+			authResponse: &authResponse{
+				resp: &authenticator.Response{
+					User: &user.DefaultInfo{
+						Name: "a-user",
+					},
+				},
+				pass: true,
+				err:  nil,
+			},
+			config: &Config{
+				AccessReview: accessReview,
+			},
+			expCode: http.StatusForbidden,
+			expBody: `{"kind":"Status","apiVersion":"v1","metadata":{},"status":"Failure","message":"pods \"bar\" is forbidden: User \"a-user\" cannot delete resource \"pods\" in API group \"\" in the namespace \"foo\"","reason":"Forbidden","code":403}`,
+		},
+		"an authed request of a user with a valid grant should have the granted groups": {
+			req: &http.Request{
+				Header: http.Header{
+					"Authorization": []string{"bearer fake-token"},
+				},
+			},
+			expAuthToken: "fake-token",
+			authResponse: &authResponse{
+				resp: &authenticator.Response{
+					User: &user.DefaultInfo{
+						Name:   "a-user",
+						Groups: []string{"a-group"},
+					},
+				},
+				pass: true,
+				err:  nil,
+			},
+			config: &Config{
+				Grants: groupGrants,
+			},
+			expCode:  http.StatusOK,
+			expBody:  "",
+			expUser:  "a-user",
+			expGroup: []string{"a-group", "system:authenticated", "cluster-admins"},
+		},
+		"an authed request of a user without a grant should not have granted groups": {
+			req: &http.Request{
+				Header: http.Header{
+					"Authorization": []string{"bearer fake-token"},
+				},
+			},
+			expAuthToken: "fake-token",
+			authResponse: &authResponse{
+				resp: &authenticator.Response{
+					User: &user.DefaultInfo{
+						Name: "b-user",
+					},
+				},
+				pass: true,
+				err:  nil,
+			},
+			config: &Config{
+				Grants: groupGrants,
+			},
+			expCode:  http.StatusOK,
+			expBody:  "",
+			expUser:  "b-user",
+			expGroup: []string{"system:authenticated"},
+		},
+		"an authed request impersonating another user should not have granted groups": {
+			req: &http.Request{
+				Header: http.Header{
+					"Authorization":     []string{"bearer fake-token"},
+					"Impersonate-User":  []string{"b-user"},
+					"Impersonate-Group": []string{"b-group"},
+				},
+			},
+			expAuthToken: "fake-token",
+			authResponse: &authResponse{
+				resp: &authenticator.Response{
+					User: &user.DefaultInfo{
+						Name: "a-user",
+					},
+				},
+				pass: true,
+				err:  nil,
+			},
+			config: &Config{
+				ImpersonationAuthorizer: impersonationAuthorizer,
+				Grants:                  groupGrants,
+			},
+			expCode:  http.StatusOK,
+			expBody:  "",
+			expUser:  "b-user",
+			expGroup: []string{"b-group"},
+			expExtra: map[string][]string{
+				"Impersonate-Extra-Kube-Oidc-Proxy.jetstack.io%2fimpersonator": []string{"a-user"},
+			},
+		},
+		"an authed request impersonating a group without a user should 400": {
+			req: &http.Request{
+				Header: http.Header{
+					"Authorization":     []string{"bearer fake-token"},
+					"Impersonate-Group": []string{"b-group"},
+				},
+			},
+			expAuthToken: "fake-token",
+			authResponse: &authResponse{
+				resp: &authenticator.Response{
+					User: &user.DefaultInfo{
+						Name: "a-user",
+					},
+				},
+				pass: true,
+				err:  nil,
+			},
+			config: &Config{
+				ImpersonationAuthorizer: impersonationAuthorizer,
+			},
+			expCode: http.StatusBadRequest,
+			expBody: `{"kind":"Status","apiVersion":"v1","metadata":{},"status":"Failure","message":"impersonating groups or extras requires impersonating a user","reason":"BadRequest","code":400}`,
+		},
 	}
 
 	for name, test := range tests {
@@ -563,7 +1000,9 @@ func TestHandlers(t *testing.T) {
 				}
 			})
 
-			test.req.URL = new(url.URL)
+			if test.req.URL == nil {
+				test.req.URL = new(url.URL)
+			}
 
 			handler = p.withHandlers(handler)
 			handler.ServeHTTP(w, test.req)
@@ -689,3 +1128,114 @@ func TestHeadersConfig(t *testing.T) {
 		})
 	}
 }
+
+func TestBreakGlass(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-oidc-proxy-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pubDER, err := x509.MarshalPKIXPublicKey(sk.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keysFile := filepath.Join(dir, "keys.pem")
+	if err := ioutil.WriteFile(keysFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: pubDER,
+	}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	breakGlass, err := breakglass.New(breakglass.Options{
+		KeysFile:       keysFile,
+		Issuer:         "break-glass",
+		Group:          "emergency",
+		UsernamePrefix: "break-glass:",
+		MaxLifetime:    time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: sk},
+		(&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signToken := func(lifetime time.Duration) string {
+		token, err := jwt.Signed(signer).Claims(jwt.Claims{
+			Issuer:   "break-glass",
+			Subject:  "alice",
+			ID:       "token-1",
+			IssuedAt: jwt.NewNumericDate(time.Now().Add(-time.Minute)),
+			Expiry:   jwt.NewNumericDate(time.Now().Add(lifetime - time.Minute)),
+		}).CompactSerialize()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	tests := map[string]struct {
+		token   string
+		expCode int
+	}{
+		"a valid break-glass token should impersonate the emergency group": {
+			token:   signToken(time.Minute * 30),
+			expCode: http.StatusOK,
+		},
+		"a break-glass token over the maximum lifetime should 401": {
+			token:   signToken(time.Hour * 2),
+			expCode: http.StatusUnauthorized,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			// The OIDC authenticator is never called with break-glass tokens.
+			p := newTestProxy(t)
+			p.config = &Config{BreakGlass: breakGlass}
+
+			p.fakeRT.expUser = "break-glass:alice"
+			p.fakeRT.expGroup = []string{"emergency", user.AllAuthenticated}
+			p.fakeRT.expExtra = map[string][]string{
+				"Impersonate-Extra-Kube-Oidc-Proxy.jetstack.io%2fbreak-Glass": []string{"token-1"},
+			}
+
+			handler := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if auth := req.Header.Get("Authorization"); len(auth) > 0 {
+					t.Errorf("expected break-glass token to be removed from request, got=%q", auth)
+				}
+
+				if _, err := p.RoundTrip(req); err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+			})
+
+			req := &http.Request{
+				Header: http.Header{
+					"Authorization": []string{"bearer " + test.token},
+				},
+				URL: new(url.URL),
+			}
+
+			w := httptest.NewRecorder()
+			p.withHandlers(handler).ServeHTTP(w, req)
+
+			if w.Code != test.expCode {
+				t.Errorf("unexpected response code, exp=%d got=%d", test.expCode, w.Code)
+			}
+
+			p.ctrl.Finish()
+		})
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/metrics"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+)
+
+var (
+	upstreamRetriesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "upstream",
+		Name:      "request_retries_total",
+		Help:      "Number of retries of requests after a connection error to the API server.",
+	})
+
+	upstreamRetriesExhaustedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "upstream",
+		Name:      "request_retries_exhausted_total",
+		Help:      "Number of requests which failed after exhausting their retries.",
+	})
+)
+
+func init() {
+	metrics.MustRegister(upstreamRetriesTotal, upstreamRetriesExhaustedTotal)
+}
+
+// RetryConfig configures the retrying of idempotent requests which fail to
+// connect to the API server.
+type RetryConfig struct {
+	// MaxRetries is the maximum number of retries of a request. If 0,
+	// requests are not retried.
+	MaxRetries int
+
+	// Backoff is the wait before the first retry, which doubles with each
+	// retry. Each wait is jittered by up to the same again.
+	Backoff time.Duration
+
+	// MaxBackoff is the maximum wait before a retry, before jitter.
+	MaxBackoff time.Duration
+}
+
+// upstreamUnavailableError is returned when the retries of a request were
+// exhausted.
+type upstreamUnavailableError struct {
+	retries int
+	err     error
+}
+
+func (e *upstreamUnavailableError) Error() string {
+	return fmt.Sprintf("API server unavailable after %d retries: %s", e.retries, e.err)
+}
+
+func (e *upstreamUnavailableError) Unwrap() error {
+	return e.err
+}
+
+// isRetryableRequest returns whether the request is idempotent and not
+// streaming, so may be safely sent again. This is GET requests, other than
+// watches, log follows and upgrades, and HEAD requests.
+func isRetryableRequest(req *http.Request) bool {
+	if req.Method == http.MethodHead {
+		return true
+	}
+
+	if req.Method != http.MethodGet || httpstream.IsUpgradeRequest(req) {
+		return false
+	}
+
+	if follow, _ := strconv.ParseBool(req.URL.Query().Get("follow")); follow {
+		return false
+	}
+
+	info, err := context.RequestInfo(req)
+	if err != nil {
+		return false
+	}
+
+	return info.Verb != "watch"
+}
+
+// isRetryableError returns whether the connection to the API server was
+// refused or reset before a response was received.
+func isRetryableError(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// roundTripWithRetries sends the request with the round tripper, retrying
+// idempotent requests with a jittered exponential backoff when the connection
+// to the API server is refused or reset.
+func (p *Proxy) roundTripWithRetries(rt http.RoundTripper, req *http.Request) (*http.Response, error) {
+	config := p.config.Retry
+
+	if config.MaxRetries <= 0 || !isRetryableRequest(req) {
+		return rt.RoundTrip(req)
+	}
+
+	backoff := config.Backoff
+	for retry := 0; ; retry++ {
+		resp, err := rt.RoundTrip(req)
+		if err == nil || !isRetryableError(err) {
+			return resp, err
+		}
+
+		if retry == config.MaxRetries {
+			upstreamRetriesExhaustedTotal.Inc()
+			return nil, &upstreamUnavailableError{retries: retry, err: err}
+		}
+
+		delay := wait.Jitter(backoff, 1.0)
+		klog.V(2).Infof("retrying request %s %s in %s after connection error (%d/%d): %s",
+			req.Method, req.URL.Path, delay, retry+1, config.MaxRetries, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+
+		upstreamRetriesTotal.Inc()
+
+		backoff *= 2
+		if config.MaxBackoff > 0 && backoff > config.MaxBackoff {
+			backoff = config.MaxBackoff
+		}
+	}
+}
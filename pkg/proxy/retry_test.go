@@ -0,0 +1,186 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// failingRT fails the given number of requests with the error before
+// responding.
+type failingRT struct {
+	failures int
+	err      error
+	calls    int
+}
+
+func (f *failingRT) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return nil, f.err
+	}
+
+	return &http.Response{StatusCode: http.StatusOK}, nil
+}
+
+func TestIsRetryableRequest(t *testing.T) {
+	tests := map[string]struct {
+		method   string
+		url      string
+		upgrade  bool
+		expRetry bool
+	}{
+		"a get should be retried": {
+			method:   http.MethodGet,
+			url:      "/api/v1/namespaces/default/pods/a",
+			expRetry: true,
+		},
+		"a list should be retried": {
+			method:   http.MethodGet,
+			url:      "/apis/apps/v1/deployments",
+			expRetry: true,
+		},
+		"a non resource get should be retried": {
+			method:   http.MethodGet,
+			url:      "/version",
+			expRetry: true,
+		},
+		"a head should be retried": {
+			method:   http.MethodHead,
+			url:      "/api/v1/namespaces/default/pods/a",
+			expRetry: true,
+		},
+		"a watch should not be retried": {
+			method: http.MethodGet,
+			url:    "/api/v1/namespaces/default/pods?watch=true",
+		},
+		"a legacy watch should not be retried": {
+			method: http.MethodGet,
+			url:    "/api/v1/watch/namespaces/default/pods",
+		},
+		"a log follow should not be retried": {
+			method: http.MethodGet,
+			url:    "/api/v1/namespaces/default/pods/a/log?follow=true",
+		},
+		"an upgrade should not be retried": {
+			method:  http.MethodGet,
+			url:     "/api/v1/namespaces/default/pods/a/portforward",
+			upgrade: true,
+		},
+		"a create should not be retried": {
+			method: http.MethodPost,
+			url:    "/api/v1/namespaces/default/pods",
+		},
+		"a delete should not be retried": {
+			method: http.MethodDelete,
+			url:    "/api/v1/namespaces/default/pods/a",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, "https://kubernetes.default"+test.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.upgrade {
+				req.Header.Set("Connection", "Upgrade")
+				req.Header.Set("Upgrade", "SPDY/3.1")
+			}
+
+			if got := isRetryableRequest(req); got != test.expRetry {
+				t.Errorf("unexpected retryable request, exp=%t got=%t", test.expRetry, got)
+			}
+		})
+	}
+}
+
+func TestRoundTripWithRetries(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+
+	tests := map[string]struct {
+		method   string
+		failures int
+		err      error
+
+		expCalls       int
+		expUnavailable bool
+		expErr         bool
+	}{
+		"a get should succeed after refused connections": {
+			method:   http.MethodGet,
+			failures: 2,
+			err:      refused,
+			expCalls: 3,
+		},
+		"a get should succeed after a reset connection": {
+			method:   http.MethodGet,
+			failures: 1,
+			err:      reset,
+			expCalls: 2,
+		},
+		"a get should be unavailable after exhausting retries": {
+			method:         http.MethodGet,
+			failures:       5,
+			err:            refused,
+			expCalls:       4,
+			expUnavailable: true,
+			expErr:         true,
+		},
+		"a create should not be retried": {
+			method:   http.MethodPost,
+			failures: 1,
+			err:      refused,
+			expCalls: 1,
+			expErr:   true,
+		},
+		"a get with another error should not be retried": {
+			method:   http.MethodGet,
+			failures: 1,
+			err:      errors.New("x509: certificate signed by unknown authority"),
+			expCalls: 1,
+			expErr:   true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := &Proxy{
+				config: &Config{
+					Retry: RetryConfig{
+						MaxRetries: 3,
+						Backoff:    time.Millisecond,
+						MaxBackoff: time.Millisecond * 2,
+					},
+				},
+			}
+
+			req, err := http.NewRequest(test.method, "https://kubernetes.default/api/v1/namespaces/default/pods", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rt := &failingRT{failures: test.failures, err: test.err}
+			_, err = p.roundTripWithRetries(rt, req)
+
+			if (err != nil) != test.expErr {
+				t.Errorf("unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+
+			if _, ok := err.(*upstreamUnavailableError); ok != test.expUnavailable {
+				t.Errorf("unexpected unavailable error, exp=%t got=%v", test.expUnavailable, err)
+			}
+
+			if rt.calls != test.expCalls {
+				t.Errorf("unexpected number of attempts, exp=%d got=%d", test.expCalls, rt.calls)
+			}
+		})
+	}
+}
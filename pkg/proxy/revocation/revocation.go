@@ -0,0 +1,220 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package revocation
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/util"
+)
+
+const (
+	// ConfigMapKey is the key of the ConfigMap data holding the revocation
+	// list.
+	ConfigMapKey = "revocations.yaml"
+
+	filePollInterval = time.Second * 10
+)
+
+// List is the revocation list, loaded from a file or ConfigMap as YAML or
+// JSON.
+type List struct {
+	// TokenIDs are revoked token IDs, matched against the "jti" claim.
+	TokenIDs []string `json:"tokenIDs,omitempty"`
+
+	// Subjects are subjects whose tokens are all revoked, matched against the
+	// "sub" claim.
+	Subjects []string `json:"subjects,omitempty"`
+
+	// IssuedBefore maps subjects to a time, before which all tokens issued to
+	// that subject, according to the "iat" claim, are revoked.
+	IssuedBefore map[string]metav1.Time `json:"issuedBefore,omitempty"`
+}
+
+// Revoker checks tokens which have passed OIDC authentication against a
+// revocation list.
+type Revoker struct {
+	run func(stopCh <-chan struct{}) error
+
+	// lock guards all fields below.
+	lock         sync.RWMutex
+	tokenIDs     sets.String
+	subjects     sets.String
+	issuedBefore map[string]time.Time
+}
+
+func newRevoker() *Revoker {
+	return &Revoker{
+		tokenIDs:     sets.NewString(),
+		subjects:     sets.NewString(),
+		issuedBefore: make(map[string]time.Time),
+	}
+}
+
+// NewStatic returns a Revoker with the given, unchanging, revocation list.
+func NewStatic(list *List) *Revoker {
+	r := newRevoker()
+	r.set(list)
+
+	r.run = func(<-chan struct{}) error {
+		return nil
+	}
+
+	return r
+}
+
+// NewFromFile returns a Revoker whose revocation list is loaded from the given
+// file, which is watched for changes.
+func NewFromFile(path string) (*Revoker, error) {
+	r := newRevoker()
+
+	watcher, err := util.NewFileWatcher(path, filePollInterval, r.load)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load token revocation list from %q: %s", path, err)
+	}
+
+	r.run = func(stopCh <-chan struct{}) error {
+		watcher.Run(stopCh)
+		return nil
+	}
+
+	return r, nil
+}
+
+// NewFromConfigMap returns a Revoker whose revocation list is loaded from the
+// ConfigMapKey of the given ConfigMap, which is watched for changes. A
+// ConfigMap missing at start up is treated as an empty revocation list, while
+// deleting the ConfigMap keeps the last loaded list.
+func NewFromConfigMap(client kubernetes.Interface, namespace, name string) *Revoker {
+	r := newRevoker()
+
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}),
+	)
+
+	syncConfigMap := func(obj interface{}) {
+		cm, ok := obj.(*corev1.ConfigMap)
+		if !ok {
+			return
+		}
+
+		if err := r.load([]byte(cm.Data[ConfigMapKey])); err != nil {
+			klog.Errorf("failed to load token revocation list from ConfigMap %s/%s: %s",
+				namespace, name, err)
+		}
+	}
+
+	informer := factory.Core().V1().ConfigMaps().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: syncConfigMap,
+		UpdateFunc: func(_, obj interface{}) {
+			syncConfigMap(obj)
+		},
+		// Deleting the ConfigMap must not unrevoke every token, so the last
+		// loaded revocation list remains in use until it is recreated.
+		DeleteFunc: func(interface{}) {
+			klog.Errorf("token revocation ConfigMap %s/%s deleted, the last loaded revocation list remains in use until it is recreated",
+				namespace, name)
+		},
+	})
+
+	r.run = func(stopCh <-chan struct{}) error {
+		factory.Start(stopCh)
+
+		if !cache.WaitForCacheSync(stopCh, informer.HasSynced) {
+			return fmt.Errorf("failed to sync token revocation ConfigMap %s/%s", namespace, name)
+		}
+
+		return nil
+	}
+
+	return r
+}
+
+// Run will start watching the revocation list source until the stop channel
+// is closed. Returns once the initial revocation list has been loaded.
+func (r *Revoker) Run(stopCh <-chan struct{}) error {
+	return r.run(stopCh)
+}
+
+// Revoked returns whether the given token has been revoked, along with the
+// reason. The token must have already been verified.
+func (r *Revoker) Revoked(token string) (string, bool, error) {
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to parse token: %s", err)
+	}
+
+	var claims jwt.Claims
+	if err := parsed.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return "", false, fmt.Errorf("failed to parse token claims: %s", err)
+	}
+
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if len(claims.ID) > 0 && r.tokenIDs.Has(claims.ID) {
+		return fmt.Sprintf("token ID %q revoked", claims.ID), true, nil
+	}
+
+	if r.subjects.Has(claims.Subject) {
+		return fmt.Sprintf("subject %q revoked", claims.Subject), true, nil
+	}
+
+	if before, ok := r.issuedBefore[claims.Subject]; ok {
+		// Tokens with no issued at time can not be shown to have been issued
+		// after the revocation, so are revoked.
+		if claims.IssuedAt == nil || claims.IssuedAt.Time().Before(before) {
+			return fmt.Sprintf("tokens issued to subject %q before %s revoked",
+				claims.Subject, before.Format(time.RFC3339)), true, nil
+		}
+	}
+
+	return "", false, nil
+}
+
+// load parses the revocation list and replaces the current list. Unknown
+// fields are rejected, so that a misspelt key does not silently revoke
+// nothing.
+func (r *Revoker) load(data []byte) error {
+	list := new(List)
+	if err := yaml.UnmarshalStrict(data, list); err != nil {
+		return fmt.Errorf("failed to decode token revocation list: %s", err)
+	}
+
+	r.set(list)
+
+	return nil
+}
+
+func (r *Revoker) set(list *List) {
+	issuedBefore := make(map[string]time.Time)
+	for subject, before := range list.IssuedBefore {
+		issuedBefore[subject] = before.Time
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.tokenIDs = sets.NewString(list.TokenIDs...)
+	r.subjects = sets.NewString(list.Subjects...)
+	r.issuedBefore = issuedBefore
+
+	klog.V(2).Infof("loaded token revocation list: %d token IDs, %d subjects, %d issued before times",
+		len(list.TokenIDs), len(list.Subjects), len(list.IssuedBefore))
+}
@@ -0,0 +1,198 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package revocation
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestToken(t *testing.T, claims jwt.Claims) string {
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.HS256,
+		Key:       []byte("secret"),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func TestRevoked(t *testing.T) {
+	revokeTime := time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	r := newRevoker()
+	if err := r.load([]byte(`
+tokenIDs: ["token-1"]
+subjects: ["user-1"]
+issuedBefore:
+  user-2: "2020-04-01T12:00:00Z"
+`)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		claims     jwt.Claims
+		expRevoked bool
+	}{
+		"a token with no matching claims should not be revoked": {
+			claims: jwt.Claims{ID: "token-2", Subject: "user-3"},
+		},
+		"a token with a revoked ID should be revoked": {
+			claims:     jwt.Claims{ID: "token-1", Subject: "user-3"},
+			expRevoked: true,
+		},
+		"a token with a revoked subject should be revoked": {
+			claims:     jwt.Claims{Subject: "user-1"},
+			expRevoked: true,
+		},
+		"a token issued before the revocation time should be revoked": {
+			claims: jwt.Claims{
+				Subject:  "user-2",
+				IssuedAt: jwt.NewNumericDate(revokeTime.Add(-time.Minute)),
+			},
+			expRevoked: true,
+		},
+		"a token with no issued at time should be revoked": {
+			claims:     jwt.Claims{Subject: "user-2"},
+			expRevoked: true,
+		},
+		"a token issued after the revocation time should not be revoked": {
+			claims: jwt.Claims{
+				Subject:  "user-2",
+				IssuedAt: jwt.NewNumericDate(revokeTime.Add(time.Minute)),
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			reason, revoked, err := r.Revoked(newTestToken(t, test.claims))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if revoked != test.expRevoked {
+				t.Errorf("unexpected revoked, exp=%t got=%t (%s)", test.expRevoked, revoked, reason)
+			}
+
+			if revoked && len(reason) == 0 {
+				t.Error("expected reason for revoked token")
+			}
+		})
+	}
+
+	if _, _, err := r.Revoked("foo"); err == nil {
+		t.Error("expected error for malformed token")
+	}
+}
+
+func TestNewFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kube-oidc-proxy-revocation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "revocations.yaml")
+
+	tests := map[string]struct {
+		data   string
+		expErr bool
+	}{
+		"a valid list should load": {
+			data: `subjects: ["user-1"]`,
+		},
+		"an empty list should load": {
+			data: ``,
+		},
+		"a list with a misspelt key should fail": {
+			data:   `subject: ["user-1"]`,
+			expErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := ioutil.WriteFile(path, []byte(test.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := NewFromFile(path)
+			if test.expErr != (err != nil) {
+				t.Errorf("unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+		})
+	}
+}
+
+func TestNewFromConfigMap(t *testing.T) {
+	client := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "kube-oidc-proxy",
+			Name:      "revocations",
+		},
+		Data: map[string]string{
+			ConfigMapKey: `subjects: ["user-1"]`,
+		},
+	})
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	r := NewFromConfigMap(client, "kube-oidc-proxy", "revocations")
+	if err := r.Run(stopCh); err != nil {
+		t.Fatal(err)
+	}
+
+	token := newTestToken(t, jwt.Claims{Subject: "user-1"})
+
+	if _, revoked, err := r.Revoked(token); err != nil || !revoked {
+		t.Errorf("expected token to be revoked, revoked=%t err=%v", revoked, err)
+	}
+
+	if err := client.CoreV1().ConfigMaps("kube-oidc-proxy").Delete(
+		context.TODO(), "revocations", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The token should remain revoked once the deletion has been observed.
+	if err := wait.Poll(time.Millisecond*10, time.Millisecond*200, func() (bool, error) {
+		_, revoked, err := r.Revoked(token)
+		return !revoked, err
+	}); err != wait.ErrWaitTimeout {
+		t.Errorf("expected token to remain revoked after ConfigMap deleted: %v", err)
+	}
+
+	if _, err := client.CoreV1().ConfigMaps("kube-oidc-proxy").Create(context.TODO(), &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "kube-oidc-proxy",
+			Name:      "revocations",
+		},
+	}, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := wait.PollImmediate(time.Millisecond*10, time.Second*5, func() (bool, error) {
+		_, revoked, err := r.Revoked(token)
+		return !revoked, err
+	}); err != nil {
+		t.Errorf("expected token to no longer be revoked after ConfigMap recreated without it: %s", err)
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package tenancy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gopkg.in/square/go-jose.v2/jwt"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/filter"
+)
+
+type Options struct {
+	// Claim is the token claim holding the tenants of the user, as a string
+	// or array of strings.
+	Claim string
+
+	// NamespaceLabel is the namespace label whose value is the tenant owning
+	// the namespace.
+	NamespaceLabel string
+
+	// ExemptGroups are groups whose members are not restricted to the
+	// namespaces of their tenants.
+	ExemptGroups []string
+}
+
+// ForbiddenError is returned when a request is denied for accessing a
+// namespace not owned by a tenant of the user.
+type ForbiddenError struct {
+	Message string
+}
+
+func (e *ForbiddenError) Error() string {
+	return e.Message
+}
+
+// ResponseFilter modifies the upstream response of an authorized request.
+type ResponseFilter func(*http.Response) error
+
+// Tenancy restricts users to the namespaces owned by their tenants, where the
+// tenants of a user are given by a token claim and the owner of a namespace by
+// a namespace label. Namespaces are watched on the upstream cluster.
+type Tenancy struct {
+	claim        string
+	label        string
+	exemptGroups sets.String
+
+	informer cache.SharedIndexInformer
+	lister   corelisters.NamespaceLister
+	factory  informers.SharedInformerFactory
+}
+
+func New(client kubernetes.Interface, opts Options) *Tenancy {
+	factory := informers.NewSharedInformerFactory(client, 0)
+	namespaces := factory.Core().V1().Namespaces()
+
+	return &Tenancy{
+		claim:        opts.Claim,
+		label:        opts.NamespaceLabel,
+		exemptGroups: sets.NewString(opts.ExemptGroups...),
+
+		informer: namespaces.Informer(),
+		lister:   namespaces.Lister(),
+		factory:  factory,
+	}
+}
+
+// Run will start watching namespaces until the stop channel is closed.
+// Returns once the namespaces have been synced.
+func (t *Tenancy) Run(stopCh <-chan struct{}) error {
+	t.factory.Start(stopCh)
+
+	if !cache.WaitForCacheSync(stopCh, t.informer.HasSynced) {
+		return fmt.Errorf("failed to sync namespaces for tenancy")
+	}
+
+	return nil
+}
+
+// Tenants returns the tenants of the user from the tenants claim of the
+// token. The token must have already been verified.
+func (t *Tenancy) Tenants(token string) ([]string, error) {
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse token: %s", err)
+	}
+
+	var claims map[string]interface{}
+	if err := parsed.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return nil, fmt.Errorf("failed to parse token claims: %s", err)
+	}
+
+	switch v := claims[t.claim].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []interface{}:
+		var tenants []string
+		for _, item := range v {
+			tenant, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("tenants claim %q is not a string or array of strings", t.claim)
+			}
+			tenants = append(tenants, tenant)
+		}
+		return tenants, nil
+	default:
+		return nil, fmt.Errorf("tenants claim %q is not a string or array of strings", t.claim)
+	}
+}
+
+// Authorize returns an error if the request accesses a namespace not owned by
+// one of the tenants of the user. Requests listing or watching resources
+// across all namespaces are authorized, and have their Accept header changed
+// so the returned filter is able to remove the objects in namespaces not owned
+// by a tenant, and namespaces not owned by a tenant, from the response.
+// Objects of cluster scoped resources, and requests whose RequestInfo cannot be
+// resolved, are left to the authorization of the upstream cluster, and
+// deleting collections across all namespaces is denied.
+func (t *Tenancy) Authorize(req *http.Request, u user.Info, tenants []string) (ResponseFilter, error) {
+	for _, group := range u.GetGroups() {
+		if t.exemptGroups.Has(group) {
+			return nil, nil
+		}
+	}
+
+	info, err := context.RequestInfo(req)
+	if err != nil || !info.IsResourceRequest {
+		return nil, nil
+	}
+
+	owners := sets.NewString(tenants...)
+
+	if len(info.Namespace) > 0 {
+		if !t.owned(info.Namespace, owners) {
+			return nil, &ForbiddenError{
+				Message: fmt.Sprintf("namespaces %q is forbidden: User %q is not a member of the tenant owning the namespace",
+					info.Namespace, u.GetName()),
+			}
+		}
+
+		return nil, nil
+	}
+
+	if len(info.Subresource) > 0 {
+		return nil, nil
+	}
+
+	switch info.Verb {
+	case "list", "watch":
+		setJSONAccept(req.Header)
+
+		namespaces := len(info.APIGroup) == 0 && info.Resource == "namespaces"
+		isWatch := info.Verb == "watch"
+
+		return func(resp *http.Response) error {
+			return filter.Response(resp, isWatch, func(obj metav1.Object) bool {
+				if namespaces {
+					return t.owned(obj.GetName(), owners)
+				}
+
+				// Objects of cluster scoped resources have no namespace.
+				return len(obj.GetNamespace()) == 0 || t.owned(obj.GetNamespace(), owners)
+			})
+		}, nil
+
+	case "deletecollection":
+		return nil, &ForbiddenError{
+			Message: fmt.Sprintf("%s is forbidden: User %q may not delete collections across all namespaces",
+				info.Resource, u.GetName()),
+		}
+	}
+
+	return nil, nil
+}
+
+// owned returns whether the namespace is owned by one of the tenants.
+// Namespaces which do not exist are not owned.
+func (t *Tenancy) owned(name string, tenants sets.String) bool {
+	ns, err := t.lister.Get(name)
+	if err != nil {
+		return false
+	}
+
+	owner, ok := ns.Labels[t.label]
+	return ok && tenants.Has(owner)
+}
+
+// setJSONAccept will remove media types other than JSON from the Accept
+// header, so that the response can be decoded. The Accept-Encoding header is
+// also removed, so that the response is decompressed by the transport.
+func setJSONAccept(header http.Header) {
+	var accept []string
+	for _, value := range header["Accept"] {
+		for _, mediaType := range strings.Split(value, ",") {
+			if strings.Contains(mediaType, "json") {
+				accept = append(accept, strings.TrimSpace(mediaType))
+			}
+		}
+	}
+
+	if len(accept) == 0 {
+		accept = []string{"application/json"}
+	}
+
+	header.Set("Accept", strings.Join(accept, ","))
+	header.Del("Accept-Encoding")
+}
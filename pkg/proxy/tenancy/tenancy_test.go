@@ -0,0 +1,482 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package tenancy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestTenancy(t *testing.T, stopCh <-chan struct{}) *Tenancy {
+	namespace := func(name, team string) *corev1.Namespace {
+		ns := &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+		}
+		if len(team) > 0 {
+			ns.Labels = map[string]string{"team": team}
+		}
+		return ns
+	}
+
+	tenancy := New(fake.NewSimpleClientset(
+		namespace("a-1", "a"),
+		namespace("a-2", "a"),
+		namespace("b-1", "b"),
+		namespace("kube-system", ""),
+	), Options{
+		Claim:          "team",
+		NamespaceLabel: "team",
+		ExemptGroups:   []string{"cluster-admins"},
+	})
+
+	if err := tenancy.Run(stopCh); err != nil {
+		t.Fatal(err)
+	}
+
+	return tenancy
+}
+
+func TestTenants(t *testing.T) {
+	tenancy := New(fake.NewSimpleClientset(), Options{Claim: "team"})
+
+	signer, err := jose.NewSigner(jose.SigningKey{
+		Algorithm: jose.HS256,
+		Key:       []byte("secret"),
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		claims     map[string]interface{}
+		expTenants []string
+		expErr     bool
+	}{
+		"a token with no tenants claim should have no tenants": {
+			claims: map[string]interface{}{"sub": "alice"},
+		},
+		"a token with a string tenants claim should have one tenant": {
+			claims:     map[string]interface{}{"team": "a"},
+			expTenants: []string{"a"},
+		},
+		"a token with an array tenants claim should have many tenants": {
+			claims:     map[string]interface{}{"team": []string{"a", "b"}},
+			expTenants: []string{"a", "b"},
+		},
+		"a token with a numeric tenants claim should error": {
+			claims: map[string]interface{}{"team": 1},
+			expErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			token, err := jwt.Signed(signer).Claims(test.claims).CompactSerialize()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tenants, err := tenancy.Tenants(token)
+			if (err != nil) != test.expErr {
+				t.Fatalf("unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+
+			if !reflect.DeepEqual(tenants, test.expTenants) {
+				t.Errorf("unexpected tenants, exp=%v got=%v", test.expTenants, tenants)
+			}
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	tenancy := newTestTenancy(t, stopCh)
+
+	tests := map[string]struct {
+		method    string
+		path      string
+		query     string
+		groups    []string
+		expDenied bool
+		expFilter bool
+	}{
+		"a request to a namespace of the tenant should be allowed": {
+			path: "/api/v1/namespaces/a-1/pods",
+		},
+		"a request for a namespace of the tenant should be allowed": {
+			path: "/api/v1/namespaces/a-2",
+		},
+		"a request to a group resource of the tenant should be allowed": {
+			method: http.MethodPost,
+			path:   "/apis/apps/v1/namespaces/a-1/deployments",
+		},
+		"a request to a namespace of another tenant should be denied": {
+			path:      "/api/v1/namespaces/b-1/pods",
+			expDenied: true,
+		},
+		"a request for a namespace of another tenant should be denied": {
+			method:    http.MethodDelete,
+			path:      "/api/v1/namespaces/b-1",
+			expDenied: true,
+		},
+		"a request to an unowned namespace should be denied": {
+			path:      "/api/v1/namespaces/kube-system/secrets",
+			expDenied: true,
+		},
+		"a request to a missing namespace should be denied": {
+			path:      "/api/v1/namespaces/missing/pods",
+			expDenied: true,
+		},
+		"a request to another tenant from an exempt group should be allowed": {
+			path:   "/api/v1/namespaces/b-1/pods",
+			groups: []string{"cluster-admins"},
+		},
+		"a cluster scoped request should be allowed": {
+			path: "/api/v1/nodes/node-1",
+		},
+		"a cluster scoped list should be filtered": {
+			path:      "/api/v1/nodes",
+			expFilter: true,
+		},
+		"a non resource request should be allowed": {
+			path: "/version",
+		},
+		"a request listing namespaces should be filtered": {
+			path:      "/api/v1/namespaces",
+			expFilter: true,
+		},
+		"a request watching namespaces should be filtered": {
+			path:      "/api/v1/namespaces",
+			query:     "watch=true",
+			expFilter: true,
+		},
+		"a request listing across all namespaces should be filtered": {
+			path:      "/api/v1/pods",
+			expFilter: true,
+		},
+		"a request watching across all namespaces should be filtered": {
+			path:      "/apis/apps/v1/deployments",
+			query:     "watch=true",
+			expFilter: true,
+		},
+		"a request deleting a collection across all namespaces should be denied": {
+			method:    http.MethodDelete,
+			path:      "/api/v1/pods",
+			expDenied: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			method := test.method
+			if len(method) == 0 {
+				method = http.MethodGet
+			}
+
+			req := &http.Request{
+				Method: method,
+				URL:    &url.URL{Path: test.path, RawQuery: test.query},
+				Header: make(http.Header),
+			}
+
+			u := &user.DefaultInfo{Name: "alice", Groups: test.groups}
+
+			filter, err := tenancy.Authorize(req, u, []string{"a"})
+			if _, denied := err.(*ForbiddenError); denied != test.expDenied {
+				t.Errorf("unexpected denial, exp=%t got=%v", test.expDenied, err)
+			}
+
+			if (filter != nil) != test.expFilter {
+				t.Errorf("unexpected filter, exp=%t got=%t", test.expFilter, filter != nil)
+			}
+		})
+	}
+}
+
+func TestFilterLists(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	tenancy := newTestTenancy(t, stopCh)
+
+	tests := map[string]struct {
+		path      string
+		accept    string
+		resp      map[string]interface{}
+		expAccept string
+		expNames  []string
+	}{
+		"a namespace list should be filtered": {
+			accept:    "application/vnd.kubernetes.protobuf, application/json",
+			expAccept: "application/json",
+			resp: map[string]interface{}{
+				"kind": "NamespaceList",
+				"metadata": map[string]interface{}{
+					"remainingItemCount": 10,
+				},
+				"items": []interface{}{
+					map[string]interface{}{"metadata": map[string]interface{}{"name": "a-1"}},
+					map[string]interface{}{"metadata": map[string]interface{}{"name": "b-1"}},
+					map[string]interface{}{"metadata": map[string]interface{}{"name": "kube-system"}},
+					map[string]interface{}{"metadata": map[string]interface{}{"name": "a-2"}},
+				},
+			},
+			expNames: []string{"a-1", "a-2"},
+		},
+		"a namespace table should be filtered": {
+			accept:    "application/json;as=Table;v=v1;g=meta.k8s.io,application/json",
+			expAccept: "application/json;as=Table;v=v1;g=meta.k8s.io,application/json",
+			resp: map[string]interface{}{
+				"kind": "Table",
+				"rows": []interface{}{
+					map[string]interface{}{"object": map[string]interface{}{"metadata": map[string]interface{}{"name": "b-1"}}},
+					map[string]interface{}{"object": map[string]interface{}{"metadata": map[string]interface{}{"name": "a-2"}}},
+					map[string]interface{}{"cells": []interface{}{"a-1"}},
+				},
+			},
+			expNames: []string{"a-2"},
+		},
+		"a pod list across all namespaces should be filtered": {
+			path:      "/api/v1/pods",
+			accept:    "application/json",
+			expAccept: "application/json",
+			resp: map[string]interface{}{
+				"kind": "PodList",
+				"items": []interface{}{
+					map[string]interface{}{"metadata": map[string]interface{}{"name": "pod-a-1", "namespace": "a-1"}},
+					map[string]interface{}{"metadata": map[string]interface{}{"name": "pod-b-1", "namespace": "b-1"}},
+					map[string]interface{}{"metadata": map[string]interface{}{"name": "pod-kube-system", "namespace": "kube-system"}},
+					map[string]interface{}{"metadata": map[string]interface{}{"name": "pod-a-2", "namespace": "a-2"}},
+				},
+			},
+			expNames: []string{"pod-a-1", "pod-a-2"},
+		},
+		"a cluster scoped list should not be filtered": {
+			path:      "/api/v1/nodes",
+			accept:    "application/json",
+			expAccept: "application/json",
+			resp: map[string]interface{}{
+				"kind": "NodeList",
+				"items": []interface{}{
+					map[string]interface{}{"metadata": map[string]interface{}{"name": "node-1"}},
+					map[string]interface{}{"metadata": map[string]interface{}{"name": "node-2"}},
+				},
+			},
+			expNames: []string{"node-1", "node-2"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := test.path
+			if len(path) == 0 {
+				path = "/api/v1/namespaces"
+			}
+
+			req := &http.Request{
+				Method: http.MethodGet,
+				URL:    &url.URL{Path: path},
+				Header: http.Header{
+					"Accept":          []string{test.accept},
+					"Accept-Encoding": []string{"gzip"},
+				},
+			}
+
+			filter, err := tenancy.Authorize(req, &user.DefaultInfo{Name: "alice"}, []string{"a"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if accept := req.Header.Get("Accept"); accept != test.expAccept {
+				t.Errorf("unexpected accept header, exp=%s got=%s", test.expAccept, accept)
+			}
+
+			if encoding := req.Header.Get("Accept-Encoding"); len(encoding) > 0 {
+				t.Errorf("expected accept encoding header to be removed, got=%s", encoding)
+			}
+
+			body, err := json.Marshal(test.resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp := &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": []string{"application/json"}},
+				Body:       ioutil.NopCloser(bytes.NewReader(body)),
+			}
+
+			if err := filter(resp); err != nil {
+				t.Fatal(err)
+			}
+
+			body, err = ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.ContentLength != int64(len(body)) {
+				t.Errorf("unexpected content length, exp=%d got=%d", len(body), resp.ContentLength)
+			}
+
+			var list struct {
+				Metadata map[string]interface{} `json:"metadata"`
+				Items    []struct {
+					Metadata metav1.ObjectMeta `json:"metadata"`
+				} `json:"items"`
+				Rows []struct {
+					Object struct {
+						Metadata metav1.ObjectMeta `json:"metadata"`
+					} `json:"object"`
+				} `json:"rows"`
+			}
+			if err := json.Unmarshal(body, &list); err != nil {
+				t.Fatal(err)
+			}
+
+			var names []string
+			for _, item := range list.Items {
+				names = append(names, item.Metadata.Name)
+			}
+			for _, row := range list.Rows {
+				names = append(names, row.Object.Metadata.Name)
+			}
+
+			if !reflect.DeepEqual(names, test.expNames) {
+				t.Errorf("unexpected objects, exp=%v got=%v", test.expNames, names)
+			}
+
+			if _, ok := list.Metadata["remainingItemCount"]; ok {
+				t.Error("expected remaining item count to be removed")
+			}
+		})
+	}
+}
+
+func TestFilterWatch(t *testing.T) {
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	tenancy := newTestTenancy(t, stopCh)
+
+	namespaces := []string{"a-1", "b-1", "kube-system", "a-2"}
+
+	tests := map[string]struct {
+		path     string
+		query    string
+		newObj   func(namespace string) runtime.Object
+		expNames []string
+	}{
+		"a pod watch across all namespaces should be filtered": {
+			path:  "/api/v1/pods",
+			query: "watch=true",
+			newObj: func(namespace string) runtime.Object {
+				return &corev1.Pod{
+					TypeMeta:   metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+					ObjectMeta: metav1.ObjectMeta{Name: "pod-" + namespace, Namespace: namespace},
+				}
+			},
+			expNames: []string{"pod-a-1", "pod-a-2"},
+		},
+		"a namespace watch should be filtered": {
+			path:  "/api/v1/namespaces",
+			query: "watch=true",
+			newObj: func(namespace string) runtime.Object {
+				return &corev1.Namespace{
+					TypeMeta:   metav1.TypeMeta{Kind: "Namespace", APIVersion: "v1"},
+					ObjectMeta: metav1.ObjectMeta{Name: namespace},
+				}
+			},
+			expNames: []string{"a-1", "a-2"},
+		},
+		"a legacy namespace watch should be filtered": {
+			path: "/api/v1/watch/namespaces",
+			newObj: func(namespace string) runtime.Object {
+				return &corev1.Namespace{
+					TypeMeta:   metav1.TypeMeta{Kind: "Namespace", APIVersion: "v1"},
+					ObjectMeta: metav1.ObjectMeta{Name: namespace},
+				}
+			},
+			expNames: []string{"a-1", "a-2"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := &http.Request{
+				Method: http.MethodGet,
+				URL:    &url.URL{Path: test.path, RawQuery: test.query},
+				Header: make(http.Header),
+			}
+
+			filter, err := tenancy.Authorize(req, &user.DefaultInfo{Name: "alice"}, []string{"a"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			for _, namespace := range namespaces {
+				raw, err := json.Marshal(test.newObj(namespace))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if err := json.NewEncoder(&buf).Encode(&metav1.WatchEvent{
+					Type:   "ADDED",
+					Object: runtime.RawExtension{Raw: raw},
+				}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The API server does not mark JSON watch responses as streams.
+			resp := &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Content-Type": []string{"application/json"}},
+				Body:       ioutil.NopCloser(&buf),
+			}
+
+			if err := filter(resp); err != nil {
+				t.Fatal(err)
+			}
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var names []string
+			decoder := json.NewDecoder(bytes.NewReader(body))
+			for decoder.More() {
+				var event metav1.WatchEvent
+				if err := decoder.Decode(&event); err != nil {
+					t.Fatal(err)
+				}
+
+				var obj metav1.PartialObjectMetadata
+				if err := json.Unmarshal(event.Object.Raw, &obj); err != nil {
+					t.Fatal(err)
+				}
+				names = append(names, obj.Name)
+			}
+
+			if !reflect.DeepEqual(names, test.expNames) {
+				t.Errorf("unexpected objects, exp=%v got=%v", test.expNames, names)
+			}
+		})
+	}
+}
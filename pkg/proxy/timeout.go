@@ -0,0 +1,59 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package proxy
+
+import (
+	gocontext "context"
+	"net/http"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+)
+
+// withTimeout adds a deadline to requests which are not long-running, after
+// which the request to the API server is canceled and a timeout is returned to
+// the client. As the first handler, the RequestInfo of the request is resolved
+// and added to the request context for all other handlers. Requests whose
+// RequestInfo cannot be resolved are passed on without it.
+func (p *Proxy) withTimeout(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if infoReq, err := context.WithRequestInfo(req); err != nil {
+			klog.V(4).Infof("failed to resolve request info of %q (%s): %s", req.URL.Path, req.RemoteAddr, err)
+		} else {
+			req = infoReq
+		}
+
+		if timeout := p.requestTimeout(req); timeout > 0 {
+			ctx, cancel := gocontext.WithTimeout(req.Context(), timeout)
+			defer cancel()
+			req = req.WithContext(ctx)
+		}
+
+		handler.ServeHTTP(rw, req)
+	})
+}
+
+// requestTimeout returns the timeout of the request, or 0 if it has none. Like
+// the API server, the timeout query parameter may shorten, but not lengthen,
+// the configured timeout. Long-running requests have no timeout.
+func (p *Proxy) requestTimeout(req *http.Request) time.Duration {
+	timeout := p.config.RequestTimeout
+
+	if param := req.URL.Query().Get("timeout"); len(param) > 0 {
+		if d, err := time.ParseDuration(param); err == nil && d > 0 && (timeout == 0 || d < timeout) {
+			timeout = d
+		}
+	}
+
+	if timeout == 0 {
+		return 0
+	}
+
+	info, err := context.RequestInfo(req)
+	if err != nil || p.auditor.LongRunningFunc()(req, info) {
+		return 0
+	}
+
+	return timeout
+}
@@ -0,0 +1,256 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang/mock/gomock"
+	"k8s.io/apiserver/pkg/authentication/authenticator"
+	"k8s.io/apiserver/pkg/authentication/user"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/server"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/jetstack/kube-oidc-proxy/cmd/app/options"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/audit"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/fairness"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/filter"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/mutation"
+	"github.com/jetstack/kube-oidc-proxy/pkg/proxy/tenancy"
+	"github.com/jetstack/kube-oidc-proxy/pkg/util"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	auditor, err := audit.New(new(options.AuditOptions), "0.0.0.0:1234", new(server.SecureServingInfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		timeout    time.Duration
+		url        string
+		expTimeout time.Duration
+	}{
+		"a get should have the configured timeout": {
+			timeout:    time.Minute,
+			url:        "/api/v1/namespaces/default/pods/a",
+			expTimeout: time.Minute,
+		},
+		"a non resource request should have the configured timeout": {
+			timeout:    time.Minute,
+			url:        "/version",
+			expTimeout: time.Minute,
+		},
+		"a shorter timeout parameter should be honored": {
+			timeout:    time.Minute,
+			url:        "/api/v1/pods?timeout=10s",
+			expTimeout: time.Second * 10,
+		},
+		"a longer timeout parameter should not be honored": {
+			timeout:    time.Minute,
+			url:        "/api/v1/pods?timeout=10m",
+			expTimeout: time.Minute,
+		},
+		"an invalid timeout parameter should be ignored": {
+			timeout:    time.Minute,
+			url:        "/api/v1/pods?timeout=10",
+			expTimeout: time.Minute,
+		},
+		"a timeout parameter should be honored with no configured timeout": {
+			url:        "/api/v1/pods?timeout=10s",
+			expTimeout: time.Second * 10,
+		},
+		"no configured timeout should have no timeout": {
+			url: "/api/v1/pods",
+		},
+		"a watch should have no timeout": {
+			timeout: time.Minute,
+			url:     "/api/v1/pods?watch=true&timeout=10s",
+		},
+		"a legacy watch should have no timeout": {
+			timeout: time.Minute,
+			url:     "/apis/apps/v1/watch/deployments",
+		},
+		"an exec should have no timeout": {
+			timeout: time.Minute,
+			url:     "/api/v1/namespaces/default/pods/a/exec?command=sh",
+		},
+		"logs should have no timeout": {
+			timeout: time.Minute,
+			url:     "/api/v1/namespaces/default/pods/a/log?follow=true",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := &Proxy{
+				auditor: auditor,
+				config:  &Config{RequestTimeout: test.timeout},
+			}
+
+			req := httptest.NewRequest(http.MethodGet, test.url, nil)
+			if timeout := p.requestTimeout(req); timeout != test.expTimeout {
+				t.Errorf("unexpected timeout, exp=%s got=%s", test.expTimeout, timeout)
+			}
+		})
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	p := newTestProxy(t)
+	p.config.RequestTimeout = time.Millisecond
+
+	var expired bool
+	handler := p.withTimeout(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+		expired = true
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/pods", nil))
+
+	if !expired {
+		t.Error("expected request context to expire")
+	}
+}
+
+func TestWithTimeoutUnresolvedRequestInfo(t *testing.T) {
+	tests := map[string]struct {
+		url     string
+		expInfo bool
+	}{
+		"a watch request without a resource should be passed on without request info": {
+			url: "/api/v1/watch",
+		},
+		"a non resource request should be passed on with request info": {
+			url:     "/version",
+			expInfo: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := newTestProxy(t)
+
+			var called bool
+			handler := p.withTimeout(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				called = true
+				if _, ok := genericapirequest.RequestInfoFrom(req.Context()); ok != test.expInfo {
+					t.Errorf("unexpected request info in context, exp=%t got=%t", test.expInfo, ok)
+				}
+			}))
+
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, test.url, nil))
+
+			if !called {
+				t.Error("expected request to be passed to the next handler")
+			}
+
+			// Unauthenticated requests through all handlers should be
+			// rejected as unauthorized, rather than failing to resolve.
+			w := httptest.NewRecorder()
+			p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				t.Error("unexpected unauthenticated request passed through handlers")
+			})).ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.url, nil))
+
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("unexpected response code, exp=%d got=%d", http.StatusUnauthorized, w.Code)
+			}
+
+			p.ctrl.Finish()
+		})
+	}
+}
+
+func TestWithHandlersUnresolvedRequestInfo(t *testing.T) {
+	token, err := util.FakeJWT("https://issuer.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	tests := map[string]func(*testing.T, *Config){
+		"max in flight": func(t *testing.T, config *Config) {
+			config.MaxRequestsInFlight = 1
+			config.MaxMutatingRequestsInFlight = 1
+		},
+		"fairness": func(t *testing.T, config *Config) {
+			f, err := fairness.New(&fairness.Config{
+				PriorityLevels: []fairness.PriorityLevel{{Name: "default", Concurrency: 1}},
+				FlowSchemas:    []fairness.FlowSchema{{Name: "all", PriorityLevel: "default"}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.Fairness = f
+		},
+		"response filter": func(t *testing.T, config *Config) {
+			f, err := filter.New(&filter.Config{
+				Rules: []filter.Rule{{Resources: []string{"pods"}, Names: "{{ .sub }}"}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.ResponseFilter = f
+		},
+		"request mutation": func(t *testing.T, config *Config) {
+			m, err := mutation.New(&mutation.Config{
+				Rules: []mutation.Rule{{
+					Mutator:   mutation.StampUserName,
+					Options:   json.RawMessage(`{"annotation": "example.com/owner"}`),
+					Resources: []string{"configmaps"},
+				}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			config.RequestMutation = m
+		},
+		"tenancy": func(t *testing.T, config *Config) {
+			config.Tenancy = tenancy.New(fake.NewSimpleClientset(), tenancy.Options{
+				Claim:          "team",
+				NamespaceLabel: "team",
+			})
+			if err := config.Tenancy.Run(stopCh); err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+
+	for name, configure := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := newTestProxy(t)
+			configure(t, p.config)
+
+			p.fakeToken.EXPECT().AuthenticateToken(gomock.Any(), token).Return(&authenticator.Response{
+				User: &user.DefaultInfo{
+					Name:   "a-user",
+					Groups: []string{user.AllAuthenticated},
+				},
+			}, true, nil)
+
+			// Authenticated requests whose request info cannot be resolved
+			// should be passed on, rather than failing to resolve.
+			var called bool
+			handler := p.withHandlers(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				called = true
+			}))
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/watch", nil)
+			req.Header.Set("Authorization", "bearer "+token)
+			handler.ServeHTTP(w, req)
+
+			if !called {
+				t.Errorf("expected request to be passed on, got=%d %s", w.Code, w.Body)
+			}
+
+			p.ctrl.Finish()
+		})
+	}
+}
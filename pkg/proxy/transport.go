@@ -0,0 +1,115 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/httpstream"
+)
+
+// TransportConfig tunes the transport used to connect to the upstream API
+// server. Zero values mean no limit or timeout.
+type TransportConfig struct {
+	// EnableHTTP2 will attempt HTTP/2 connections to the API server. Upgrade
+	// requests, such as exec and port-forward, always use HTTP/1.1 as they can
+	// not be made over HTTP/2.
+	EnableHTTP2 bool
+
+	// MaxIdleConns is the maximum number of idle connections kept open.
+	MaxIdleConns int
+
+	// MaxIdleConnsPerHost is the maximum number of idle connections kept open
+	// per API server.
+	MaxIdleConnsPerHost int
+
+	// MaxConnsPerHost is the maximum number of connections per API server,
+	// including those in use.
+	MaxConnsPerHost int
+
+	// IdleConnTimeout is how long an idle connection is kept open.
+	IdleConnTimeout time.Duration
+
+	// DialTimeout is the timeout for establishing a TCP connection.
+	DialTimeout time.Duration
+
+	// KeepAlive is the interval of TCP keepalive probes. If negative,
+	// keepalives are disabled.
+	KeepAlive time.Duration
+
+	// TLSHandshakeTimeout is the timeout for the TLS handshake.
+	TLSHandshakeTimeout time.Duration
+
+	// ResponseHeaderTimeout is the timeout for receiving the response
+	// headers, once the request has been written.
+	ResponseHeaderTimeout time.Duration
+}
+
+// newTransport returns a transport to the API server using the TLS and
+// transport configuration. Unless HTTP/2 is enabled, only HTTP/1.1 is used.
+func newTransport(tlsConfig *tls.Config, config TransportConfig) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   config.DialTimeout,
+		KeepAlive: config.KeepAlive,
+	}
+
+	tr := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		ForceAttemptHTTP2:     config.EnableHTTP2,
+		MaxIdleConns:          config.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       config.MaxConnsPerHost,
+		IdleConnTimeout:       config.IdleConnTimeout,
+		TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+	}
+
+	if !config.EnableHTTP2 {
+		// A non-nil, empty map disables HTTP/2, and only HTTP/1.1 is
+		// negotiated with the API server.
+		tr.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+		if tlsConfig != nil {
+			tr.TLSClientConfig = tlsConfig.Clone()
+			tr.TLSClientConfig.NextProtos = []string{"http/1.1"}
+		}
+	}
+
+	return tr
+}
+
+// upgradeAwareTransport sends upgrade requests over HTTP/1.1, and all other
+// requests over a transport which may use HTTP/2.
+type upgradeAwareTransport struct {
+	transport        http.RoundTripper
+	upgradeTransport http.RoundTripper
+}
+
+// newUpgradeAwareTransport returns a transport to the API server using the
+// TLS and transport configuration. If HTTP/2 is enabled, upgrade requests are
+// sent over a separate transport with HTTP/2 disabled.
+func newUpgradeAwareTransport(tlsConfig *tls.Config, config TransportConfig) http.RoundTripper {
+	tr := newTransport(tlsConfig, config)
+	if !config.EnableHTTP2 {
+		return tr
+	}
+
+	upgradeConfig := config
+	upgradeConfig.EnableHTTP2 = false
+
+	return &upgradeAwareTransport{
+		transport:        tr,
+		upgradeTransport: newTransport(tlsConfig, upgradeConfig),
+	}
+}
+
+func (u *upgradeAwareTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if httpstream.IsUpgradeRequest(req) {
+		return u.upgradeTransport.RoundTrip(req)
+	}
+
+	return u.transport.RoundTrip(req)
+}
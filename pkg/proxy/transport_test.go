@@ -0,0 +1,133 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/httpstream/spdy"
+)
+
+func TestNewTransport(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	tests := map[string]struct {
+		config        TransportConfig
+		expProtoMajor int
+	}{
+		"a transport with HTTP/2 enabled should use HTTP/2": {
+			config: TransportConfig{
+				EnableHTTP2:         true,
+				MaxIdleConns:        10,
+				MaxIdleConnsPerHost: 5,
+				DialTimeout:         time.Second * 5,
+				TLSHandshakeTimeout: time.Second * 5,
+			},
+			expProtoMajor: 2,
+		},
+		"a transport with HTTP/2 disabled should use HTTP/1.1": {
+			config: TransportConfig{
+				DialTimeout:         time.Second * 5,
+				TLSHandshakeTimeout: time.Second * 5,
+			},
+			expProtoMajor: 1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			tr := newTransport(&tls.Config{RootCAs: roots}, test.config)
+			defer tr.CloseIdleConnections()
+
+			if tr.MaxIdleConnsPerHost != test.config.MaxIdleConnsPerHost {
+				t.Errorf("unexpected max idle conns per host, exp=%d got=%d",
+					test.config.MaxIdleConnsPerHost, tr.MaxIdleConnsPerHost)
+			}
+
+			resp, err := (&http.Client{Transport: tr}).Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.ProtoMajor != test.expProtoMajor {
+				t.Errorf("unexpected protocol, exp=%d got=%s", test.expProtoMajor, resp.Proto)
+			}
+		})
+	}
+}
+
+func TestUpgradeAwareTransport(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !httpstream.IsUpgradeRequest(req) {
+			rw.WriteHeader(http.StatusOK)
+			return
+		}
+
+		// Upgrading fails over HTTP/2, as the connection can not be hijacked.
+		conn := spdy.NewResponseUpgrader().UpgradeResponse(rw, req,
+			func(httpstream.Stream, <-chan struct{}) error { return nil })
+		if conn != nil {
+			conn.Close()
+		}
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	tr := newUpgradeAwareTransport(&tls.Config{RootCAs: roots}, TransportConfig{
+		EnableHTTP2:         true,
+		DialTimeout:         time.Second * 5,
+		TLSHandshakeTimeout: time.Second * 5,
+	})
+
+	// Other requests should use HTTP/2.
+	resp, err := (&http.Client{Transport: tr}).Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.ProtoMajor != 2 {
+		t.Errorf("unexpected protocol, exp=2 got=%s", resp.Proto)
+	}
+
+	// A SPDY upgrade request should use HTTP/1.1, and succeed.
+	req, err := http.NewRequest(http.MethodPost, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(httpstream.HeaderConnection, httpstream.HeaderUpgrade)
+	req.Header.Set(httpstream.HeaderUpgrade, spdy.HeaderSpdy31)
+
+	resp, err = tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.ProtoMajor != 1 {
+		t.Errorf("unexpected protocol of upgrade, exp=1 got=%s", resp.Proto)
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Errorf("unexpected status code of upgrade, exp=%d got=%d",
+			http.StatusSwitchingProtocols, resp.StatusCode)
+	}
+}
@@ -0,0 +1,364 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+
+	"github.com/jetstack/kube-oidc-proxy/pkg/metrics"
+	proxycontext "github.com/jetstack/kube-oidc-proxy/pkg/proxy/context"
+)
+
+const (
+	// RoundRobin balances requests over the available endpoints in turn.
+	RoundRobin = "round-robin"
+
+	// LeastConnections balances requests to the available endpoint with the
+	// fewest requests in flight.
+	LeastConnections = "least-connections"
+
+	// healthCheckPath is the path of the API server readiness endpoint.
+	healthCheckPath = "/readyz"
+)
+
+var (
+	endpointHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "upstream",
+		Name:      "endpoint_available",
+		Help:      "Whether the upstream API server endpoint is available to receive requests.",
+	}, []string{"endpoint"})
+
+	endpointEjectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "upstream",
+		Name:      "endpoint_ejections_total",
+		Help:      "Number of times the upstream API server endpoint was ejected after a connection error.",
+	}, []string{"endpoint"})
+
+	endpointRequestsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metrics.Namespace,
+		Subsystem: "upstream",
+		Name:      "endpoint_requests_in_flight",
+		Help:      "Number of requests in flight to the upstream API server endpoint.",
+	}, []string{"endpoint"})
+)
+
+func init() {
+	metrics.MustRegister(endpointHealthy, endpointEjectionsTotal, endpointRequestsInFlight)
+}
+
+type Options struct {
+	// Endpoints are the URLs of the API servers.
+	Endpoints []string
+
+	// Balancer is the load balancing algorithm, either RoundRobin or
+	// LeastConnections.
+	Balancer string
+
+	// HealthCheckInterval is the interval of active health checks against
+	// the readiness endpoint of each API server. If 0, active health checks
+	// are disabled.
+	HealthCheckInterval time.Duration
+
+	// HealthCheckTimeout is the timeout of each health check.
+	HealthCheckTimeout time.Duration
+
+	// EjectionDuration is how long an endpoint is ejected from load balancing
+	// after a connection error.
+	EjectionDuration time.Duration
+}
+
+// endpoint is an upstream API server.
+type endpoint struct {
+	url *url.URL
+
+	// inFlight is the number of requests in flight, accessed atomically.
+	inFlight int64
+
+	// lock guards the fields below.
+	lock         sync.RWMutex
+	healthy      bool
+	ejectedUntil time.Time
+}
+
+// Pool balances requests over multiple upstream API server endpoints.
+// Endpoints failing active health checks, or ejected after a connection
+// error, do not receive requests unless no endpoint is available.
+type Pool struct {
+	endpoints []*endpoint
+	balancer  string
+
+	healthCheckInterval time.Duration
+	healthCheckTimeout  time.Duration
+	ejectionDuration    time.Duration
+
+	clock clock.Clock
+	next  uint64
+}
+
+func New(opts Options) (*Pool, error) {
+	if len(opts.Endpoints) == 0 {
+		return nil, errors.New("no upstream endpoints given")
+	}
+
+	switch opts.Balancer {
+	case RoundRobin, LeastConnections:
+	default:
+		return nil, fmt.Errorf("unknown upstream load balancer %q, expecting %q or %q",
+			opts.Balancer, RoundRobin, LeastConnections)
+	}
+
+	p := &Pool{
+		balancer:            opts.Balancer,
+		healthCheckInterval: opts.HealthCheckInterval,
+		healthCheckTimeout:  opts.HealthCheckTimeout,
+		ejectionDuration:    opts.EjectionDuration,
+		clock:               clock.RealClock{},
+	}
+
+	for _, e := range opts.Endpoints {
+		u, err := url.Parse(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream endpoint %q: %s", e, err)
+		}
+
+		if u.Scheme != "https" && u.Scheme != "http" || len(u.Host) == 0 {
+			return nil, fmt.Errorf("invalid upstream endpoint %q, expecting a URL such as https://10.0.0.1:6443", e)
+		}
+
+		p.endpoints = append(p.endpoints, &endpoint{
+			url:     u,
+			healthy: true,
+		})
+		endpointHealthy.WithLabelValues(u.Host).Set(1)
+	}
+
+	return p, nil
+}
+
+// Run will actively health check the endpoints until the stop channel is
+// closed, using the given round tripper which must authenticate to the API
+// server.
+func (p *Pool) Run(rt http.RoundTripper, stopCh <-chan struct{}) {
+	if p.healthCheckInterval <= 0 {
+		return
+	}
+
+	client := &http.Client{
+		Transport: rt,
+		Timeout:   p.healthCheckTimeout,
+	}
+
+	for _, e := range p.endpoints {
+		e := e
+		go wait.Until(func() {
+			p.healthCheck(client, e)
+		}, p.healthCheckInterval, stopCh)
+	}
+}
+
+// healthCheck will update the health of the endpoint from its readiness
+// endpoint.
+func (p *Pool) healthCheck(client *http.Client, e *endpoint) {
+	healthy := false
+
+	resp, err := client.Get(e.url.Scheme + "://" + e.url.Host + healthCheckPath)
+	if err != nil {
+		klog.V(2).Infof("upstream endpoint %s failed health check: %s", e.url.Host, err)
+	} else {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		healthy = resp.StatusCode == http.StatusOK
+		if !healthy {
+			klog.V(2).Infof("upstream endpoint %s failed health check: %s", e.url.Host, resp.Status)
+		}
+	}
+
+	e.lock.Lock()
+	if e.healthy != healthy {
+		klog.Infof("upstream endpoint %s is now healthy=%t", e.url.Host, healthy)
+	}
+	e.healthy = healthy
+	e.lock.Unlock()
+
+	p.updateAvailable(e)
+}
+
+// available returns whether the endpoint may receive requests.
+func (p *Pool) available(e *endpoint) bool {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.healthy && !p.clock.Now().Before(e.ejectedUntil)
+}
+
+func (p *Pool) updateAvailable(e *endpoint) {
+	var value float64
+	if p.available(e) {
+		value = 1
+	}
+	endpointHealthy.WithLabelValues(e.url.Host).Set(value)
+}
+
+// eject will remove the endpoint from load balancing for the ejection
+// duration.
+func (p *Pool) eject(e *endpoint, err error) {
+	klog.Warningf("ejecting upstream endpoint %s for %s after connection error: %s",
+		e.url.Host, p.ejectionDuration, err)
+
+	e.lock.Lock()
+	e.ejectedUntil = p.clock.Now().Add(p.ejectionDuration)
+	e.lock.Unlock()
+
+	endpointEjectionsTotal.WithLabelValues(e.url.Host).Inc()
+	p.updateAvailable(e)
+}
+
+// pick returns the endpoint to send the request to. Upgrade requests are
+// routed by the client address, so that a client's upgrade connections are
+// sent to the same endpoint while it remains available.
+func (p *Pool) pick(req *http.Request) *endpoint {
+	var candidates []*endpoint
+	for _, e := range p.endpoints {
+		if p.available(e) {
+			candidates = append(candidates, e)
+		}
+	}
+
+	// If no endpoint is available, try them all rather than failing every
+	// request.
+	if len(candidates) == 0 {
+		candidates = p.endpoints
+	}
+
+	if httpstream.IsUpgradeRequest(req) {
+		_, remoteAddr := proxycontext.RemoteAddr(req)
+		if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+			remoteAddr = host
+		}
+
+		h := fnv.New32a()
+		h.Write([]byte(remoteAddr))
+		return candidates[int(h.Sum32()%uint32(len(candidates)))]
+	}
+
+	next := int(atomic.AddUint64(&p.next, 1) % uint64(len(candidates)))
+
+	if p.balancer == LeastConnections {
+		best := candidates[next]
+		for i := 1; i < len(candidates); i++ {
+			e := candidates[(next+i)%len(candidates)]
+			if atomic.LoadInt64(&e.inFlight) < atomic.LoadInt64(&best.inFlight) {
+				best = e
+			}
+		}
+		return best
+	}
+
+	return candidates[next]
+}
+
+// RoundTripper returns a round tripper sending each request to an endpoint of
+// the pool, using the given round tripper.
+func (p *Pool) RoundTripper(rt http.RoundTripper) http.RoundTripper {
+	return &roundTripper{pool: p, rt: rt}
+}
+
+type roundTripper struct {
+	pool *Pool
+	rt   http.RoundTripper
+}
+
+func (r *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	e := r.pool.pick(req)
+
+	// The request must not be modified, so is cloned before being sent to
+	// the endpoint.
+	req = req.Clone(req.Context())
+	req.URL.Scheme = e.url.Scheme
+	req.URL.Host = e.url.Host
+	req.Host = ""
+
+	atomic.AddInt64(&e.inFlight, 1)
+	endpointRequestsInFlight.WithLabelValues(e.url.Host).Inc()
+	done := func() {
+		atomic.AddInt64(&e.inFlight, -1)
+		endpointRequestsInFlight.WithLabelValues(e.url.Host).Dec()
+	}
+
+	resp, err := r.rt.RoundTrip(req)
+	if err != nil {
+		done()
+
+		if isConnectionError(err) {
+			r.pool.eject(e, err)
+		}
+
+		return nil, err
+	}
+
+	// The request remains in flight until the body has been closed, which
+	// for upgrade responses is the upgraded connection.
+	if rwc, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = &readWriteCloser{ReadWriteCloser: rwc, done: done}
+	} else {
+		resp.Body = &readCloser{ReadCloser: resp.Body, done: done}
+	}
+
+	return resp, nil
+}
+
+// isConnectionError returns whether the error is a failure to connect to, or
+// a connection reset by, the endpoint.
+func isConnectionError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+type readCloser struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (r *readCloser) Close() error {
+	r.once.Do(r.done)
+	return r.ReadCloser.Close()
+}
+
+type readWriteCloser struct {
+	io.ReadWriteCloser
+	once sync.Once
+	done func()
+}
+
+func (r *readWriteCloser) Close() error {
+	r.once.Do(r.done)
+	return r.ReadWriteCloser.Close()
+}
@@ -0,0 +1,260 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package upstream
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+// newTestServer returns a server which responds with its name, and with the
+// given status to health checks.
+func newTestServer(name string, readyz *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == healthCheckPath {
+			rw.WriteHeader(*readyz)
+			return
+		}
+
+		rw.Write([]byte(name))
+	}))
+}
+
+func newTestPool(t *testing.T, balancer string, endpoints ...string) (*Pool, *clock.FakeClock) {
+	p, err := New(Options{
+		Endpoints:           endpoints,
+		Balancer:            balancer,
+		HealthCheckInterval: time.Second,
+		HealthCheckTimeout:  time.Second,
+		EjectionDuration:    time.Second * 30,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fakeClock := clock.NewFakeClock(time.Now())
+	p.clock = fakeClock
+
+	return p, fakeClock
+}
+
+func doRequest(t *testing.T, rt http.RoundTripper, req *http.Request) string {
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(body)
+}
+
+func newTestRequest(t *testing.T) *http.Request {
+	req, err := http.NewRequest(http.MethodGet, "https://kubernetes.default/api/v1/pods", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestNew(t *testing.T) {
+	tests := map[string]struct {
+		opts   Options
+		expErr bool
+	}{
+		"valid endpoints should not error": {
+			opts: Options{
+				Endpoints: []string{"https://10.0.0.1:6443", "https://10.0.0.2:6443"},
+				Balancer:  RoundRobin,
+			},
+		},
+		"no endpoints should error": {
+			opts:   Options{Balancer: RoundRobin},
+			expErr: true,
+		},
+		"an endpoint without a scheme should error": {
+			opts: Options{
+				Endpoints: []string{"10.0.0.1:6443"},
+				Balancer:  LeastConnections,
+			},
+			expErr: true,
+		},
+		"an unknown balancer should error": {
+			opts: Options{
+				Endpoints: []string{"https://10.0.0.1:6443"},
+				Balancer:  "random",
+			},
+			expErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := New(test.opts)
+			if (err != nil) != test.expErr {
+				t.Errorf("unexpected error, exp=%t got=%v", test.expErr, err)
+			}
+		})
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	ok := http.StatusOK
+	a, b := newTestServer("a", &ok), newTestServer("b", &ok)
+	defer a.Close()
+	defer b.Close()
+
+	p, _ := newTestPool(t, RoundRobin, a.URL, b.URL)
+	rt := p.RoundTripper(http.DefaultTransport)
+
+	got := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		got[doRequest(t, rt, newTestRequest(t))]++
+	}
+
+	if got["a"] != 2 || got["b"] != 2 {
+		t.Errorf("unexpected balancing of requests, exp=map[a:2 b:2] got=%v", got)
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	ok := http.StatusOK
+	a, b := newTestServer("a", &ok), newTestServer("b", &ok)
+	defer a.Close()
+	defer b.Close()
+
+	p, _ := newTestPool(t, LeastConnections, a.URL, b.URL)
+	rt := p.RoundTripper(http.DefaultTransport)
+
+	// Keep the first request in flight until its body is closed.
+	resp, err := rt.RoundTrip(newTestRequest(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	busy := string(body)
+
+	for i := 0; i < 3; i++ {
+		if got := doRequest(t, rt, newTestRequest(t)); got == busy {
+			t.Errorf("unexpected request to endpoint with request in flight %q", busy)
+		}
+	}
+
+	resp.Body.Close()
+	for _, e := range p.endpoints {
+		if e.inFlight != 0 {
+			t.Errorf("unexpected requests in flight to %s, exp=0 got=%d", e.url.Host, e.inFlight)
+		}
+	}
+}
+
+func TestEjection(t *testing.T) {
+	ok := http.StatusOK
+	a, b := newTestServer("a", &ok), newTestServer("b", &ok)
+	defer a.Close()
+
+	// Connections to a closed server are refused.
+	b.Close()
+
+	p, fakeClock := newTestPool(t, RoundRobin, a.URL, b.URL)
+	rt := p.RoundTripper(http.DefaultTransport)
+
+	var refused int
+	for i := 0; i < 2; i++ {
+		if _, err := rt.RoundTrip(newTestRequest(t)); err != nil {
+			refused++
+		}
+	}
+
+	if refused != 1 {
+		t.Fatalf("unexpected number of refused requests, exp=1 got=%d", refused)
+	}
+
+	for i := 0; i < 4; i++ {
+		if got := doRequest(t, rt, newTestRequest(t)); got != "a" {
+			t.Errorf("unexpected request to ejected endpoint, exp=a got=%s", got)
+		}
+	}
+
+	fakeClock.Step(time.Second * 31)
+	if !p.available(p.endpoints[1]) {
+		t.Errorf("expected ejected endpoint to be available after ejection duration")
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	readyzA, readyzB := http.StatusOK, http.StatusServiceUnavailable
+	a, b := newTestServer("a", &readyzA), newTestServer("b", &readyzB)
+	defer a.Close()
+	defer b.Close()
+
+	p, _ := newTestPool(t, RoundRobin, a.URL, b.URL)
+	rt := p.RoundTripper(http.DefaultTransport)
+	client := &http.Client{Transport: http.DefaultTransport}
+
+	for _, e := range p.endpoints {
+		p.healthCheck(client, e)
+	}
+
+	for i := 0; i < 4; i++ {
+		if got := doRequest(t, rt, newTestRequest(t)); got != "a" {
+			t.Errorf("unexpected request to unhealthy endpoint, exp=a got=%s", got)
+		}
+	}
+
+	// With no healthy endpoint, all endpoints are tried.
+	readyzA = http.StatusServiceUnavailable
+	p.healthCheck(client, p.endpoints[0])
+
+	got := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		got[doRequest(t, rt, newTestRequest(t))]++
+	}
+
+	if got["a"] != 2 || got["b"] != 2 {
+		t.Errorf("unexpected balancing of requests with no healthy endpoint, exp=map[a:2 b:2] got=%v", got)
+	}
+
+	readyzB = http.StatusOK
+	p.healthCheck(client, p.endpoints[1])
+	if !p.available(p.endpoints[1]) {
+		t.Errorf("expected endpoint to be available after passing health check")
+	}
+}
+
+func TestStickyUpgrades(t *testing.T) {
+	p, _ := newTestPool(t, RoundRobin,
+		"https://10.0.0.1:6443", "https://10.0.0.2:6443", "https://10.0.0.3:6443")
+
+	for _, remoteAddr := range []string{"192.168.0.1", "192.168.0.2", "192.168.0.3"} {
+		var exp *endpoint
+		for port := 40000; port < 40010; port++ {
+			req := newTestRequest(t)
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "SPDY/3.1")
+			req.RemoteAddr = remoteAddr + ":" + strconv.Itoa(port)
+
+			got := p.pick(req)
+			if exp == nil {
+				exp = got
+			}
+
+			if got != exp {
+				t.Errorf("unexpected endpoint for upgrade request from %s, exp=%s got=%s",
+					remoteAddr, exp.url.Host, got.url.Host)
+			}
+		}
+	}
+}
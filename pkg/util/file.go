@@ -0,0 +1,78 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package util
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+)
+
+// FileWatcher polls a file for changes to its contents, calling a function
+// with the new contents on each change. Polling, rather than watching file
+// system events, means atomic replacements of mounted ConfigMaps and Secrets
+// are observed.
+type FileWatcher struct {
+	path     string
+	interval time.Duration
+	onChange func(data []byte) error
+
+	lock sync.Mutex
+	data []byte
+}
+
+// NewFileWatcher creates a new FileWatcher, synchronously calling onChange
+// with the current contents of the file. An error is returned if the file
+// could not be read, or onChange returned an error.
+func NewFileWatcher(path string, interval time.Duration, onChange func(data []byte) error) (*FileWatcher, error) {
+	f := &FileWatcher{
+		path:     path,
+		interval: interval,
+		onChange: onChange,
+	}
+
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Run will poll the file for changes until the stop channel is closed.
+func (f *FileWatcher) Run(stopCh <-chan struct{}) {
+	go wait.Until(func() {
+		if err := f.Sync(); err != nil {
+			klog.Errorf("failed to sync file %q: %s", f.path, err)
+		}
+	}, f.interval, stopCh)
+}
+
+// Sync will read the file, calling onChange if the contents have changed
+// since the last successful sync.
+func (f *FileWatcher) Sync() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %s", err)
+	}
+
+	if f.data != nil && bytes.Equal(f.data, data) {
+		return nil
+	}
+
+	if err := f.onChange(data); err != nil {
+		return err
+	}
+
+	klog.V(2).Infof("loaded file %q", f.path)
+
+	f.data = data
+
+	return nil
+}
@@ -0,0 +1,47 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package util
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"k8s.io/klog"
+)
+
+const (
+	serverShutdownTimeout = time.Second * 5
+)
+
+// ListenAndServeUntil will listen on the address of the given server, and
+// serve it in the background, shutting it down once the stop channel has been
+// closed. Returns an error if the address could not be listened on.
+func ListenAndServeUntil(name string, server *http.Server, stopCh <-chan struct{}) error {
+	l, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for %s on %s: %s", name, server.Addr, err)
+	}
+
+	go func() {
+		klog.Infof("serving %s on %s", name, server.Addr)
+
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			klog.Errorf("failed to serve %s on %s: %s", name, server.Addr, err)
+		}
+	}()
+
+	go func() {
+		<-stopCh
+
+		ctx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+		defer cancel()
+
+		if err := server.Shutdown(ctx); err != nil {
+			klog.Errorf("failed to shutdown %s server: %s", name, err)
+		}
+	}()
+
+	return nil
+}
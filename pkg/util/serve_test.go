@@ -0,0 +1,24 @@
+// Copyright Jetstack Ltd. See LICENSE for details.
+package util
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestListenAndServeUntilBindFailure(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	err = ListenAndServeUntil("test", &http.Server{Addr: l.Addr().String()}, stopCh)
+	if err == nil {
+		t.Error("expected error listening on an address already in use, got=nil")
+	}
+}
@@ -2,6 +2,7 @@
 package util
 
 import (
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
@@ -36,6 +37,22 @@ func ParseTokenFromRequest(req *http.Request) (string, bool) {
 	return token, true
 }
 
+// UnverifiedTokenClaims returns the claims of the JWT without verifying its
+// signature. The token must have already been verified.
+func UnverifiedTokenClaims(token string) (map[string]interface{}, error) {
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse token: %s", err)
+	}
+
+	var claims map[string]interface{}
+	if err := parsed.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return nil, fmt.Errorf("failed to parse token claims: %s", err)
+	}
+
+	return claims, nil
+}
+
 // fakeJWT generates a valid JWT using the passed input parameters which is
 // signed by a generated key. This is useful for checking the status of a
 // signer.